@@ -0,0 +1,262 @@
+/*
+ * This file is part of Crocodile Game Bot.
+ * Copyright (C) 2019  Viktor
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package achievements
+
+import (
+	"fmt"
+	"html"
+	"strings"
+	"time"
+
+	"github.com/nuetoban/crocodile-game-bot/model"
+)
+
+// Storage provides data needed to evaluate rules and saves awards
+type Storage interface {
+	// GetUserTotals returns user stats summed over all chats
+	GetUserTotals(userID int) (model.UserInChat, error)
+	CountUserChats(userID int) (int, error)
+	GetLastHostedRounds(userID int, limit int) ([]model.Round, error)
+
+	// AwardAchievement returns false if user already has the achievement
+	AwardAchievement(model.Achievement) (bool, error)
+	GetAchievements(userID int) ([]model.Achievement, error)
+}
+
+// Logger is used to report errors during evaluation
+type Logger interface {
+	Errorf(format string, args ...interface{})
+}
+
+// Role shows whom in the round the rule is evaluated for
+type Role int
+
+const (
+	Winner Role = iota
+	Host
+	Anyone
+)
+
+// Rule describes one achievement and the condition to earn it
+type Rule struct {
+	Code        string
+	Title       string
+	Description string
+	Role        Role
+
+	// Check returns true if user has earned the achievement in the round
+	Check func(s Storage, r model.Round, userID int) (bool, error)
+}
+
+// DefaultRules are rules the bot awards achievements for
+var DefaultRules = []Rule{
+	{
+		Code:        "first_guess",
+		Title:       "Первый шаг",
+		Description: "Отгадать первое слово",
+		Role:        Winner,
+		Check: func(s Storage, r model.Round, userID int) (bool, error) {
+			u, err := s.GetUserTotals(userID)
+			return u.Guessed >= 1, err
+		},
+	},
+	{
+		Code:        "guessed_100",
+		Title:       "Эрудит",
+		Description: "Отгадать 100 слов",
+		Role:        Winner,
+		Check: func(s Storage, r model.Round, userID int) (bool, error) {
+			u, err := s.GetUserTotals(userID)
+			return u.Guessed >= 100, err
+		},
+	},
+	{
+		Code:        "fast_guess",
+		Title:       "Телепат",
+		Description: "Отгадать слово за 5 секунд",
+		Role:        Winner,
+		Check: func(s Storage, r model.Round, userID int) (bool, error) {
+			return r.Duration() <= 5*time.Second, nil
+		},
+	},
+	{
+		Code:        "host_streak_10",
+		Title:       "Оратор",
+		Description: "Успешно объяснить 10 слов подряд",
+		Role:        Host,
+		Check: func(s Storage, r model.Round, userID int) (bool, error) {
+			rounds, err := s.GetLastHostedRounds(userID, 10)
+			if err != nil || len(rounds) < 10 {
+				return false, err
+			}
+			for _, v := range rounds {
+				if !v.Success() {
+					return false, nil
+				}
+			}
+			return true, nil
+		},
+	},
+	{
+		Code:        "chats_5",
+		Title:       "Путешественник",
+		Description: "Сыграть в 5 чатах",
+		Role:        Anyone,
+		Check: func(s Storage, r model.Round, userID int) (bool, error) {
+			count, err := s.CountUserChats(userID)
+			return count >= 5, err
+		},
+	},
+}
+
+// Engine evaluates rules when a round is finished and awards achievements
+type Engine struct {
+	storage Storage
+	rules   []Rule
+	log     Logger
+}
+
+// NewEngine returns new instance of Engine with DefaultRules
+func NewEngine(s Storage, log Logger) *Engine {
+	return &Engine{
+		storage: s,
+		rules:   DefaultRules,
+		log:     log,
+	}
+}
+
+// Rules returns all rules known to the engine
+func (e *Engine) Rules() []Rule { return e.rules }
+
+// Evaluate checks every rule for the round participants and returns new awards,
+// a rule which cannot be checked does not stop the others, their errors are returned together
+func (e *Engine) Evaluate(r model.Round) ([]model.Achievement, error) {
+	var (
+		awarded []model.Achievement
+		errs    []string
+	)
+
+	if !r.Success() || r.Flagged() {
+		return awarded, nil
+	}
+
+	for _, rule := range e.rules {
+		for _, userID := range participants(rule.Role, r) {
+			ok, err := rule.Check(e.storage, r, userID)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("rule %s for user %d: %v", rule.Code, userID, err))
+				continue
+			}
+			if !ok {
+				continue
+			}
+
+			a := model.Achievement{
+				UserID:    userID,
+				Code:      rule.Code,
+				ChatID:    r.ChatID,
+				AwardedAt: r.FinishedAt,
+			}
+			isNew, err := e.storage.AwardAchievement(a)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("award %s to user %d: %v", rule.Code, userID, err))
+				continue
+			}
+			if isNew {
+				awarded = append(awarded, a)
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return awarded, fmt.Errorf("%d checks failed: %s", len(errs), strings.Join(errs, "; "))
+	}
+	return awarded, nil
+}
+
+// RoundFinished implements crocodile.RoundObserver and returns announcements of new awards
+func (e *Engine) RoundFinished(r model.Round) []string {
+	awarded, err := e.Evaluate(r)
+	if err != nil {
+		e.log.Errorf("Achievements: cannot evaluate round in chat %d: %v", r.ChatID, err)
+	}
+
+	var out []string
+	for _, a := range awarded {
+		rule, ok := e.rule(a.Code)
+		if !ok {
+			continue
+		}
+
+		name := r.WinnerName
+		if a.UserID == r.HostID {
+			name = r.HostName
+		}
+
+		out = append(out, fmt.Sprintf(
+			"🏆 %s получает достижение <b>%s</b> — %s",
+			html.EscapeString(name), rule.Title, rule.Description,
+		))
+	}
+
+	return out
+}
+
+// Describe returns list of user's achievements ready to be sent to the chat
+func (e *Engine) Describe(userID int, userName string) (string, error) {
+	list, err := e.storage.GetAchievements(userID)
+	if err != nil {
+		return "", err
+	}
+
+	earned := make(map[string]bool)
+	for _, a := range list {
+		earned[a.Code] = true
+	}
+
+	out := fmt.Sprintf("Достижения <b>%s</b> — %d из %d 🐊\n\n", html.EscapeString(userName), len(earned), len(e.rules))
+	for _, rule := range e.rules {
+		mark := "▫️"
+		if earned[rule.Code] {
+			mark = "🏆"
+		}
+		out += fmt.Sprintf("%s <b>%s</b> — %s\n", mark, rule.Title, rule.Description)
+	}
+
+	return out, nil
+}
+
+func (e *Engine) rule(code string) (Rule, bool) {
+	for _, r := range e.rules {
+		if r.Code == code {
+			return r, true
+		}
+	}
+	return Rule{}, false
+}
+
+func participants(role Role, r model.Round) []int {
+	switch role {
+	case Winner:
+		return []int{r.WinnerID}
+	case Host:
+		return []int{r.HostID}
+	}
+	return []int{r.WinnerID, r.HostID}
+}
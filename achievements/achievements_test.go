@@ -0,0 +1,198 @@
+/*
+ * This file is part of Crocodile Game Bot.
+ * Copyright (C) 2019  Viktor
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package achievements
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nuetoban/crocodile-game-bot/model"
+)
+
+type fakeStorage struct {
+	totals  map[int]model.UserInChat
+	chats   map[int]int
+	hosted  map[int][]model.Round
+	awarded map[int]map[string]model.Achievement
+
+	// Returned by GetLastHostedRounds only
+	hostedErr error
+}
+
+func newFakeStorage() *fakeStorage {
+	return &fakeStorage{
+		totals:  make(map[int]model.UserInChat),
+		chats:   make(map[int]int),
+		hosted:  make(map[int][]model.Round),
+		awarded: make(map[int]map[string]model.Achievement),
+	}
+}
+
+func (f *fakeStorage) GetUserTotals(userID int) (model.UserInChat, error) {
+	return f.totals[userID], nil
+}
+
+func (f *fakeStorage) CountUserChats(userID int) (int, error) { return f.chats[userID], nil }
+
+func (f *fakeStorage) GetLastHostedRounds(userID int, limit int) ([]model.Round, error) {
+	if f.hostedErr != nil {
+		return nil, f.hostedErr
+	}
+	rounds := f.hosted[userID]
+	if len(rounds) > limit {
+		rounds = rounds[:limit]
+	}
+	return rounds, nil
+}
+
+func (f *fakeStorage) AwardAchievement(a model.Achievement) (bool, error) {
+	if f.awarded[a.UserID] == nil {
+		f.awarded[a.UserID] = make(map[string]model.Achievement)
+	}
+	if _, ok := f.awarded[a.UserID][a.Code]; ok {
+		return false, nil
+	}
+	f.awarded[a.UserID][a.Code] = a
+	return true, nil
+}
+
+func (f *fakeStorage) GetAchievements(userID int) ([]model.Achievement, error) {
+	var out []model.Achievement
+	for _, a := range f.awarded[userID] {
+		out = append(out, a)
+	}
+	return out, nil
+}
+
+func codes(list []model.Achievement) map[string]int {
+	out := make(map[string]int)
+	for _, a := range list {
+		out[a.Code] = a.UserID
+	}
+	return out
+}
+
+func TestEngineEvaluate(t *testing.T) {
+	const host, winner = 1, 2
+	now := time.Now()
+
+	s := newFakeStorage()
+	e := NewEngine(s, nil)
+
+	round := model.Round{
+		ChatID:     100,
+		HostID:     host,
+		WinnerID:   winner,
+		StartedAt:  now.Add(-3 * time.Second),
+		FinishedAt: now,
+	}
+
+	s.totals[winner] = model.UserInChat{Guessed: 1}
+	s.chats[host] = 5
+	for i := 0; i < 10; i++ {
+		s.hosted[host] = append(s.hosted[host], round)
+	}
+
+	awarded, err := e.Evaluate(round)
+	if err != nil {
+		t.Fatalf("Evaluate: %v", err)
+	}
+
+	got := codes(awarded)
+	expected := map[string]int{
+		"first_guess":    winner,
+		"fast_guess":     winner,
+		"host_streak_10": host,
+		"chats_5":        host,
+	}
+	if len(got) != len(expected) {
+		t.Errorf("Wrong awards: got %v, expected %v", got, expected)
+	}
+	for code, user := range expected {
+		if got[code] != user {
+			t.Errorf("Wrong award %q: got user %d, expected %d", code, got[code], user)
+		}
+	}
+
+	// Achievements are awarded only once
+	awarded, err = e.Evaluate(round)
+	if err != nil {
+		t.Fatalf("Evaluate: %v", err)
+	}
+	if len(awarded) != 0 {
+		t.Errorf("Expected no awards second time, got %v", codes(awarded))
+	}
+}
+
+func TestEngineHostStreakBroken(t *testing.T) {
+	const host, winner = 1, 2
+	now := time.Now()
+
+	s := newFakeStorage()
+	e := NewEngine(s, nil)
+
+	round := model.Round{HostID: host, WinnerID: winner, StartedAt: now.Add(-time.Minute), FinishedAt: now}
+	for i := 0; i < 9; i++ {
+		s.hosted[host] = append(s.hosted[host], round)
+	}
+	s.hosted[host] = append(s.hosted[host], model.Round{HostID: host})
+
+	awarded, err := e.Evaluate(round)
+	if err != nil {
+		t.Fatalf("Evaluate: %v", err)
+	}
+	if _, ok := codes(awarded)["host_streak_10"]; ok {
+		t.Errorf("host_streak_10 should not be awarded when streak is broken")
+	}
+}
+
+func TestEngineRuleErrorDoesNotStopOthers(t *testing.T) {
+	const host, winner = 1, 2
+	now := time.Now()
+
+	s := newFakeStorage()
+	e := NewEngine(s, nil)
+
+	round := model.Round{HostID: host, WinnerID: winner, StartedAt: now.Add(-3 * time.Second), FinishedAt: now}
+	s.totals[winner] = model.UserInChat{Guessed: 1}
+	s.chats[host] = 5
+	s.hostedErr = errors.New("connection refused")
+
+	awarded, err := e.Evaluate(round)
+	if err == nil || !strings.Contains(err.Error(), "host_streak_10") {
+		t.Errorf("Evaluate: got %v, expected error of host_streak_10", err)
+	}
+
+	got := codes(awarded)
+	expected := map[string]int{
+		"first_guess": winner,
+		"fast_guess":  winner,
+		"chats_5":     host,
+	}
+	if len(got) != len(expected) {
+		t.Errorf("Wrong awards: got %v, expected %v", got, expected)
+	}
+	for code, user := range expected {
+		if got[code] != user {
+			t.Errorf("Wrong award %q: got user %d, expected %d", code, got[code], user)
+		}
+	}
+}
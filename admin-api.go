@@ -0,0 +1,602 @@
+/*
+ * This file is part of Crocodile Game Bot.
+ * Copyright (C) 2019  Viktor
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/nuetoban/crocodile-game-bot/crocodile"
+	"github.com/nuetoban/crocodile-game-bot/model"
+	"github.com/nuetoban/crocodile-game-bot/storage"
+)
+
+// Specification of the admin API, it is served without authentication
+//
+//go:embed admin-api.yaml
+var adminAPISpec []byte
+
+// Default and maximum count of items in one page
+const (
+	adminPageSize    = 50
+	adminMaxPageSize = 500
+)
+
+// AdminStorage is everything the admin API reads and changes
+type AdminStorage interface {
+	ListChats(query string, limit, offset int) ([]model.ChatSummary, error)
+	GetChat(chatID int64) (model.ChatSummary, error)
+	LookupForMachine(chatID int64) (*crocodile.MachineState, error)
+	GetUserStats(userID int) ([]model.UserInChat, error)
+	SetUserStats(model.UserInChat) error
+	ResetUserStats(userID int, chatID int64) (int64, error)
+	GetBans() ([]model.Ban, error)
+	SaveBan(model.Ban) error
+	DeleteBan(kind string, id int64) (bool, error)
+	GetDictionaryWords() ([]model.DictionaryWord, error)
+	SaveDictionaryWord(model.DictionaryWord) error
+	GetRounds(storage.RoundFilter) ([]model.Round, error)
+}
+
+// adminAPI serves /api/ on the server of metrics, requests are authenticated with the bearer token
+type adminAPI struct {
+	token   string
+	storage AdminStorage
+	bans    *banList
+	words   *crocodile.WordsProviderReader
+	routes  []adminRoute
+
+	// resetMachine finishes the game in the chat, it is replaced in tests
+	resetMachine func(ctx context.Context, chatID int64) error
+	now          func() time.Time
+}
+
+// adminHandler returns the response body, nil body is sent as 204 No Content
+type adminHandler func(ctx context.Context, r *http.Request, args []string) (interface{}, error)
+
+type adminRoute struct {
+	method string
+
+	// Path segments, "*" matches any segment which is passed to the handler
+	path   []string
+	handle adminHandler
+}
+
+// adminError is sent to the client with its status
+type adminError struct {
+	status  int
+	message string
+}
+
+func (e *adminError) Error() string { return e.message }
+
+func badRequest(format string, args ...interface{}) error {
+	return &adminError{http.StatusBadRequest, fmt.Sprintf(format, args...)}
+}
+
+func notFound(format string, args ...interface{}) error {
+	return &adminError{http.StatusNotFound, fmt.Sprintf(format, args...)}
+}
+
+func newAdminAPI(token string, s AdminStorage, bans *banList, words *crocodile.WordsProviderReader) *adminAPI {
+	a := &adminAPI{
+		token:        token,
+		storage:      s,
+		bans:         bans,
+		words:        words,
+		resetMachine: resetMachine,
+		now:          time.Now,
+	}
+
+	route := func(method, path string, h adminHandler) {
+		a.routes = append(a.routes, adminRoute{method, strings.Split(path, "/"), h})
+	}
+	route(http.MethodGet, "chats", a.listChats)
+	route(http.MethodGet, "chats/*", a.getChat)
+	route(http.MethodGet, "chats/*/machine", a.getMachine)
+	route(http.MethodDelete, "chats/*/machine", a.deleteMachine)
+	route(http.MethodGet, "users/*/stats", a.getUserStats)
+	route(http.MethodPut, "users/*/stats/*", a.setUserStats)
+	route(http.MethodDelete, "users/*/stats", a.resetUserStats)
+	route(http.MethodDelete, "users/*/stats/*", a.resetUserStats)
+	route(http.MethodGet, "bans", a.listBans)
+	route(http.MethodPut, "bans/*/*", a.putBan)
+	route(http.MethodDelete, "bans/*/*", a.deleteBan)
+	route(http.MethodGet, "dictionary", a.getDictionary)
+	route(http.MethodPut, "dictionary/*", a.putWord)
+	route(http.MethodDelete, "dictionary/*", a.deleteWord)
+	route(http.MethodGet, "rounds", a.listRounds)
+	return a
+}
+
+// Refresh loads bans and changes of the dictionary, the previous ones are kept on error
+func (a *adminAPI) Refresh() {
+	bans, err := a.storage.GetBans()
+	if err != nil {
+		log.Warnf("Cannot refresh bans: %v", err)
+	} else {
+		a.bans.Set(bans)
+	}
+
+	if err := a.refreshDictionary(); err != nil {
+		log.Warnf("Cannot refresh dictionary: %v", err)
+	}
+}
+
+func (a *adminAPI) refreshDictionary() error {
+	words, err := a.storage.GetDictionaryWords()
+	if err != nil {
+		return err
+	}
+
+	var added, removed []string
+	for _, w := range words {
+		if w.Removed {
+			removed = append(removed, w.Word)
+		} else {
+			added = append(added, w.Word)
+		}
+	}
+	a.words.SetChanges(added, removed)
+	return nil
+}
+
+// Run refreshes bans and the dictionary every interval until ctx is done,
+// so changes made through other replicas are applied
+func (a *adminAPI) Run(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		a.Refresh()
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func (a *adminAPI) authorized(r *http.Request) bool {
+	header := r.Header.Get("Authorization")
+	if a.token == "" || !strings.HasPrefix(header, "Bearer ") {
+		return false
+	}
+	token := strings.TrimPrefix(header, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) == 1
+}
+
+func (a *adminAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/"), "/")
+	if path == "openapi.yaml" && r.Method == http.MethodGet {
+		w.Header().Set("Content-Type", "application/yaml")
+		w.Write(adminAPISpec)
+		return
+	}
+
+	if !a.authorized(r) {
+		writeJSON(w, http.StatusUnauthorized, apiError{"invalid token"})
+		return
+	}
+
+	ctx := withLog(r.Context(), log.WithFields(logrus.Fields{"admin_request": r.Method + " " + r.URL.Path}))
+	h, args, status := a.match(r.Method, strings.Split(path, "/"))
+	if h == nil {
+		writeJSON(w, status, apiError{http.StatusText(status)})
+		return
+	}
+
+	body, err := h(ctx, r, args)
+	var e *adminError
+	switch {
+	case errors.As(err, &e):
+		writeJSON(w, e.status, apiError{e.message})
+	case errors.Is(err, storage.ErrNotFound):
+		writeJSON(w, http.StatusNotFound, apiError{err.Error()})
+	case err != nil:
+		logFrom(ctx).Errorf("Admin API: %v", err)
+		writeJSON(w, http.StatusInternalServerError, apiError{"internal error"})
+	case body == nil:
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeJSON(w, http.StatusOK, body)
+	}
+}
+
+// match returns the handler with values of "*" segments,
+// 405 status is returned if only the method does not match
+func (a *adminAPI) match(method string, path []string) (adminHandler, []string, int) {
+	status := http.StatusNotFound
+	for _, route := range a.routes {
+		if len(route.path) != len(path) {
+			continue
+		}
+
+		var args []string
+		ok := true
+		for i, segment := range route.path {
+			if segment == "*" {
+				args = append(args, path[i])
+			} else if segment != path[i] {
+				ok = false
+				break
+			}
+		}
+		if !ok {
+			continue
+		}
+		if route.method != method {
+			status = http.StatusMethodNotAllowed
+			continue
+		}
+		return route.handle, args, 0
+	}
+	return nil, nil, status
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// readJSON decodes the request body, empty body leaves v as is
+func readJSON(r *http.Request, v interface{}) error {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil && err != io.EOF {
+		return badRequest("invalid body: %v", err)
+	}
+	return nil
+}
+
+func parseID(name, s string) (int64, error) {
+	id, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || id == 0 {
+		return 0, badRequest("invalid %s: %q", name, s)
+	}
+	return id, nil
+}
+
+// queryInt returns the query parameter, def if it is not set
+func queryInt(r *http.Request, name string, def, max int) (int, error) {
+	s := r.URL.Query().Get(name)
+	if s == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 || n > max {
+		return 0, badRequest("%s must be a number from 0 to %d", name, max)
+	}
+	return n, nil
+}
+
+func (a *adminAPI) listChats(ctx context.Context, r *http.Request, _ []string) (interface{}, error) {
+	limit, err := queryInt(r, "limit", adminPageSize, adminMaxPageSize)
+	if err != nil {
+		return nil, err
+	}
+	offset, err := queryInt(r, "offset", 0, 1<<31-1)
+	if err != nil {
+		return nil, err
+	}
+
+	chats, err := a.storage.ListChats(r.URL.Query().Get("query"), limit, offset)
+	if chats == nil {
+		chats = []model.ChatSummary{}
+	}
+	return chats, err
+}
+
+type adminChat struct {
+	model.ChatSummary
+	Banned bool `json:"banned"`
+}
+
+func (a *adminAPI) getChat(ctx context.Context, r *http.Request, args []string) (interface{}, error) {
+	chatID, err := parseID("chat ID", args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	chat, err := a.storage.GetChat(chatID)
+	if err != nil {
+		return nil, err
+	}
+	return adminChat{chat, a.bans.Banned(model.BanChat, chatID)}, nil
+}
+
+func (a *adminAPI) getMachine(ctx context.Context, r *http.Request, args []string) (interface{}, error) {
+	chatID, err := parseID("chat ID", args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	state, err := a.storage.LookupForMachine(chatID)
+	if err != nil {
+		return nil, err
+	}
+	if state == nil {
+		return nil, notFound("there is no game in chat %d", chatID)
+	}
+	return state, nil
+}
+
+func (a *adminAPI) deleteMachine(ctx context.Context, r *http.Request, args []string) (interface{}, error) {
+	chatID, err := parseID("chat ID", args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	if err := a.resetMachine(ctx, chatID); err != nil {
+		return nil, err
+	}
+	logFrom(ctx).Infof("Admin API: game in chat %d has been reset", chatID)
+	return nil, nil
+}
+
+// resetMachine finishes the game in the chat without saving the round, the next /start begins a new one
+func resetMachine(ctx context.Context, chatID int64) error {
+	lock, err := chatLocker.Lock(chatID)
+	if err != nil {
+		return fmt.Errorf("cannot lock chat %d: %v", chatID, err)
+	}
+	defer lock.Unlock()
+
+	s := machineStorage.WithLogger(queryMetricsLogger{storage.WrapLogrus(logFrom(ctx))})
+	prev, err := s.LookupForMachine(chatID)
+	if err != nil {
+		return err
+	}
+
+	// The reset state must be newer than copies of the game kept by replicas
+	reset := crocodile.MachineState{ChatID: chatID, State: "init"}
+	if prev != nil {
+		reset.Revision = prev.Revision + 1
+	}
+	err = s.SaveMachineState(reset)
+
+	// Other replicas are told to forget the machine by the storage
+	if fabric.Cache != nil {
+		fabric.Cache.Forget(chatID)
+	}
+	return err
+}
+
+type adminUser struct {
+	ID     int                `json:"id"`
+	Banned bool               `json:"banned"`
+	Stats  []model.UserInChat `json:"stats"`
+}
+
+func (a *adminAPI) getUserStats(ctx context.Context, r *http.Request, args []string) (interface{}, error) {
+	userID, err := parseID("user ID", args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	stats, err := a.storage.GetUserStats(int(userID))
+	if stats == nil {
+		stats = []model.UserInChat{}
+	}
+	return adminUser{int(userID), a.bans.Banned(model.BanUser, userID), stats}, err
+}
+
+func (a *adminAPI) setUserStats(ctx context.Context, r *http.Request, args []string) (interface{}, error) {
+	userID, err := parseID("user ID", args[0])
+	if err != nil {
+		return nil, err
+	}
+	chatID, err := parseID("chat ID", args[1])
+	if err != nil {
+		return nil, err
+	}
+
+	var body struct {
+		WasHost int `json:"was_host"`
+		Success int `json:"success"`
+		Guessed int `json:"guessed"`
+	}
+	if err := readJSON(r, &body); err != nil {
+		return nil, err
+	}
+	if body.WasHost < 0 || body.Success < 0 || body.Guessed < 0 {
+		return nil, badRequest("counters must not be negative")
+	}
+	if body.Success > body.WasHost {
+		return nil, badRequest("success cannot be greater than was_host")
+	}
+
+	u := model.UserInChat{ID: int(userID), ChatID: chatID, WasHost: body.WasHost, Success: body.Success, Guessed: body.Guessed}
+	if err := a.storage.SetUserStats(u); err != nil {
+		return nil, err
+	}
+	logFrom(ctx).Infof("Admin API: stats of user %d in chat %d have been set to %+v", userID, chatID, body)
+	return u, nil
+}
+
+func (a *adminAPI) resetUserStats(ctx context.Context, r *http.Request, args []string) (interface{}, error) {
+	userID, err := parseID("user ID", args[0])
+	if err != nil {
+		return nil, err
+	}
+	var chatID int64
+	if len(args) > 1 {
+		if chatID, err = parseID("chat ID", args[1]); err != nil {
+			return nil, err
+		}
+	}
+
+	n, err := a.storage.ResetUserStats(int(userID), chatID)
+	if err != nil {
+		return nil, err
+	}
+	logFrom(ctx).Infof("Admin API: stats of user %d have been zeroed in %d chats", userID, n)
+	return struct {
+		Chats int64 `json:"chats"`
+	}{n}, nil
+}
+
+func (a *adminAPI) listBans(ctx context.Context, r *http.Request, _ []string) (interface{}, error) {
+	bans, err := a.storage.GetBans()
+	if bans == nil {
+		bans = []model.Ban{}
+	}
+	return bans, err
+}
+
+func parseBan(args []string) (string, int64, error) {
+	kind := args[0]
+	if kind != model.BanUser && kind != model.BanChat {
+		return "", 0, notFound("unknown kind of ban %q, expected user or chat", kind)
+	}
+	id, err := parseID(kind+" ID", args[1])
+	return kind, id, err
+}
+
+func (a *adminAPI) putBan(ctx context.Context, r *http.Request, args []string) (interface{}, error) {
+	kind, id, err := parseBan(args)
+	if err != nil {
+		return nil, err
+	}
+
+	var body struct {
+		Reason string `json:"reason"`
+	}
+	if err := readJSON(r, &body); err != nil {
+		return nil, err
+	}
+
+	ban := model.Ban{Kind: kind, ID: id, Reason: body.Reason, CreatedAt: a.now().UTC()}
+	if err := a.storage.SaveBan(ban); err != nil {
+		return nil, err
+	}
+	a.bans.Add(kind, id)
+
+	logFrom(ctx).Infof("Admin API: %s %d has been banned: %s", kind, id, body.Reason)
+	return ban, nil
+}
+
+func (a *adminAPI) deleteBan(ctx context.Context, r *http.Request, args []string) (interface{}, error) {
+	kind, id, err := parseBan(args)
+	if err != nil {
+		return nil, err
+	}
+
+	ok, err := a.storage.DeleteBan(kind, id)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, notFound("%s %d is not banned", kind, id)
+	}
+	a.bans.Remove(kind, id)
+
+	logFrom(ctx).Infof("Admin API: %s %d has been unbanned", kind, id)
+	return nil, nil
+}
+
+type adminDictionary struct {
+	// Words is count of words given to hosts
+	Words   int                    `json:"words"`
+	Changes []model.DictionaryWord `json:"changes"`
+}
+
+func (a *adminAPI) getDictionary(ctx context.Context, r *http.Request, _ []string) (interface{}, error) {
+	changes, err := a.storage.GetDictionaryWords()
+	if changes == nil {
+		changes = []model.DictionaryWord{}
+	}
+	return adminDictionary{a.words.Len(), changes}, err
+}
+
+func (a *adminAPI) putWord(ctx context.Context, r *http.Request, args []string) (interface{}, error) {
+	return a.changeWord(ctx, args[0], false)
+}
+
+func (a *adminAPI) deleteWord(ctx context.Context, r *http.Request, args []string) (interface{}, error) {
+	return a.changeWord(ctx, args[0], true)
+}
+
+func (a *adminAPI) changeWord(ctx context.Context, word string, removed bool) (interface{}, error) {
+	word = crocodile.NormalizeWord(word)
+	if word == "" || strings.IndexFunc(word, func(c rune) bool { return !unicode.IsLetter(c) && c != '-' }) >= 0 {
+		return nil, badRequest("word must consist of letters and hyphens, got %q", word)
+	}
+
+	w := model.DictionaryWord{Word: word, Removed: removed, UpdatedAt: a.now().UTC()}
+	if err := a.storage.SaveDictionaryWord(w); err != nil {
+		return nil, err
+	}
+	if err := a.refreshDictionary(); err != nil {
+		return nil, err
+	}
+
+	logFrom(ctx).Infof("Admin API: word %q has been changed, removed: %t", word, removed)
+	return w, nil
+}
+
+func (a *adminAPI) listRounds(ctx context.Context, r *http.Request, _ []string) (interface{}, error) {
+	q := r.URL.Query()
+	f := storage.RoundFilter{}
+
+	var err error
+	if f.Limit, err = queryInt(r, "limit", adminPageSize, adminMaxPageSize); err != nil {
+		return nil, err
+	}
+	if s := q.Get("chat_id"); s != "" {
+		if f.ChatID, err = parseID("chat_id", s); err != nil {
+			return nil, err
+		}
+	}
+	if s := q.Get("user_id"); s != "" {
+		id, err := parseID("user_id", s)
+		if err != nil {
+			return nil, err
+		}
+		f.UserID = int(id)
+	}
+	if s := q.Get("before"); s != "" {
+		if f.Before, err = time.Parse(time.RFC3339, s); err != nil {
+			return nil, badRequest("before must be RFC 3339 time, got %q", s)
+		}
+	}
+
+	rounds, err := a.storage.GetRounds(f)
+	if rounds == nil {
+		rounds = []model.Round{}
+	}
+	return rounds, err
+}
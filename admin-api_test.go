@@ -0,0 +1,223 @@
+/*
+ * This file is part of Crocodile Game Bot.
+ * Copyright (C) 2019  Viktor
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	tb "gopkg.in/tucnak/telebot.v2"
+
+	"github.com/nuetoban/crocodile-game-bot/crocodile"
+	"github.com/nuetoban/crocodile-game-bot/model"
+	"github.com/nuetoban/crocodile-game-bot/storage"
+)
+
+func newTestAdminAPI(t *testing.T) (*adminAPI, *storage.SQLite) {
+	log.Out = ioutil.Discard
+
+	s, err := storage.NewSQLite(filepath.Join(t.TempDir(), "crocodile.db"), storage.WrapLogrus(log))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	if err := autoMigrate(s); err != nil {
+		t.Fatal(err)
+	}
+
+	words, _ := crocodile.NewWordsProviderReader(strings.NewReader("слон\nкот"))
+	a := newAdminAPI("secret", s, newBanList(), words)
+	a.now = newFakeClock().now
+	return a, s
+}
+
+// adminRequest sends the request with the token and decodes the response into out
+func adminRequest(t *testing.T, a *adminAPI, method, path, body string, out interface{}) int {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	a.ServeHTTP(rec, req)
+
+	if out != nil && rec.Code == http.StatusOK {
+		if err := json.Unmarshal(rec.Body.Bytes(), out); err != nil {
+			t.Fatalf("%s %s: cannot decode %q: %v", method, path, rec.Body.String(), err)
+		}
+	}
+	return rec.Code
+}
+
+func TestAdminAPIAuth(t *testing.T) {
+	a, _ := newTestAdminAPI(t)
+
+	for _, header := range []string{"", "Bearer wrong", "secret"} {
+		req := httptest.NewRequest(http.MethodGet, "/api/chats", nil)
+		req.Header.Set("Authorization", header)
+		rec := httptest.NewRecorder()
+		a.ServeHTTP(rec, req)
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("Authorization %q: got %d, want 401", header, rec.Code)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	a.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/openapi.yaml", nil))
+	if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Body.String(), "openapi:") {
+		t.Errorf("Specification: got %d", rec.Code)
+	}
+
+	if code := adminRequest(t, a, http.MethodPost, "/api/chats", "", nil); code != http.StatusMethodNotAllowed {
+		t.Errorf("POST /api/chats: got %d, want 405", code)
+	}
+	if code := adminRequest(t, a, http.MethodGet, "/api/games", "", nil); code != http.StatusNotFound {
+		t.Errorf("Unknown path: got %d, want 404", code)
+	}
+}
+
+func TestAdminAPIStats(t *testing.T) {
+	a, s := newTestAdminAPI(t)
+	s.IncrementUserStats(model.Chat{ID: -1, Title: "Чат"}, model.UserInChat{ID: 10, ChatID: -1, Name: "user", WasHost: 2, Guessed: 5})
+
+	var chats []model.ChatSummary
+	if code := adminRequest(t, a, http.MethodGet, "/api/chats?query=Ча", "", &chats); code != http.StatusOK || len(chats) != 1 {
+		t.Errorf("Chats: got %d %+v", code, chats)
+	}
+
+	code := adminRequest(t, a, http.MethodPut, "/api/users/10/stats/-1", `{"was_host": 1, "success": 2}`, nil)
+	if code != http.StatusBadRequest {
+		t.Errorf("Success greater than was_host: got %d, want 400", code)
+	}
+	if code := adminRequest(t, a, http.MethodPut, "/api/users/10/stats/-2", `{}`, nil); code != http.StatusNotFound {
+		t.Errorf("Stats in unknown chat: got %d, want 404", code)
+	}
+	if code := adminRequest(t, a, http.MethodPut, "/api/users/10/stats/-1", `{"guessed": 3}`, nil); code != http.StatusOK {
+		t.Errorf("Set stats: got %d", code)
+	}
+
+	var user adminUser
+	adminRequest(t, a, http.MethodGet, "/api/users/10/stats", "", &user)
+	if len(user.Stats) != 1 || user.Stats[0].Guessed != 3 || user.Stats[0].WasHost != 0 {
+		t.Errorf("Stats after the change: %+v", user)
+	}
+
+	if code := adminRequest(t, a, http.MethodDelete, "/api/users/10/stats", "", nil); code != http.StatusOK {
+		t.Errorf("Reset stats: got %d", code)
+	}
+	if u, _ := s.GetUserInChat(-1, 10); u.Guessed != 0 {
+		t.Errorf("Stats are not zeroed: %+v", u)
+	}
+}
+
+func TestAdminAPIBans(t *testing.T) {
+	a, _ := newTestAdminAPI(t)
+	allowed := banMiddlewarePoller(a.bans)
+	upd := &tb.Update{Message: &tb.Message{Chat: &tb.Chat{ID: -1}, Sender: &tb.User{ID: 10}}}
+
+	if code := adminRequest(t, a, http.MethodPut, "/api/bans/user/10", `{"reason": "flood"}`, nil); code != http.StatusOK {
+		t.Fatalf("Ban: got %d", code)
+	}
+	if allowed(upd) {
+		t.Errorf("Update of the banned user is allowed")
+	}
+
+	// Another replica loads the ban from the database
+	other := newAdminAPI("secret", a.storage, newBanList(), a.words)
+	other.Refresh()
+	if !other.bans.Banned(model.BanUser, 10) {
+		t.Errorf("Ban is not loaded by another replica")
+	}
+
+	if code := adminRequest(t, a, http.MethodDelete, "/api/bans/user/10", "", nil); code != http.StatusNoContent {
+		t.Errorf("Unban: got %d", code)
+	}
+	if !allowed(upd) {
+		t.Errorf("Update of the unbanned user is dropped")
+	}
+	if code := adminRequest(t, a, http.MethodDelete, "/api/bans/user/10", "", nil); code != http.StatusNotFound {
+		t.Errorf("Unban twice: got %d, want 404", code)
+	}
+	if code := adminRequest(t, a, http.MethodPut, "/api/bans/bot/10", "", nil); code != http.StatusNotFound {
+		t.Errorf("Unknown kind of ban: got %d, want 404", code)
+	}
+}
+
+func TestAdminAPIDictionary(t *testing.T) {
+	a, _ := newTestAdminAPI(t)
+
+	if code := adminRequest(t, a, http.MethodPut, "/api/dictionary/Ёжик", "", nil); code != http.StatusOK {
+		t.Fatalf("Add word: got %d", code)
+	}
+	if code := adminRequest(t, a, http.MethodDelete, "/api/dictionary/слон", "", nil); code != http.StatusOK {
+		t.Fatalf("Remove word: got %d", code)
+	}
+	if code := adminRequest(t, a, http.MethodPut, "/api/dictionary/два%20слова", "", nil); code != http.StatusBadRequest {
+		t.Errorf("Two words: got %d, want 400", code)
+	}
+
+	var d adminDictionary
+	adminRequest(t, a, http.MethodGet, "/api/dictionary", "", &d)
+	if d.Words != 2 || len(d.Changes) != 2 || !a.words.Contains("ежик") || a.words.Contains("слон") {
+		t.Errorf("Dictionary after changes: %+v", d)
+	}
+}
+
+func TestAdminAPIMachine(t *testing.T) {
+	a, s := newTestAdminAPI(t)
+	s.SaveMachineState(crocodile.MachineState{ChatID: -1, State: "game_started", Word: "слон"})
+
+	var state crocodile.MachineState
+	if code := adminRequest(t, a, http.MethodGet, "/api/chats/-1/machine", "", &state); code != http.StatusOK || state.Word != "слон" {
+		t.Errorf("Machine: got %d %+v", code, state)
+	}
+	if code := adminRequest(t, a, http.MethodGet, "/api/chats/-2/machine", "", nil); code != http.StatusNotFound {
+		t.Errorf("Machine of unknown chat: got %d, want 404", code)
+	}
+
+	var reset int64
+	a.resetMachine = func(_ context.Context, chatID int64) error {
+		reset = chatID
+		return nil
+	}
+	if code := adminRequest(t, a, http.MethodDelete, "/api/chats/-1/machine", "", nil); code != http.StatusNoContent || reset != -1 {
+		t.Errorf("Reset: got %d, chat %d", code, reset)
+	}
+}
+
+func TestAdminAPIRounds(t *testing.T) {
+	a, s := newTestAdminAPI(t)
+	clock := newFakeClock()
+	for _, r := range []model.Round{{ChatID: -1, HostID: 10}, {ChatID: -2, HostID: 20, WinnerID: 10}, {ChatID: -2, HostID: 20}} {
+		r.StartedAt, r.FinishedAt = clock.now(), clock.now()
+		clock.add(1)
+		s.SaveRound(r)
+	}
+
+	var rounds []model.Round
+	if code := adminRequest(t, a, http.MethodGet, "/api/rounds?user_id=10&limit=1", "", &rounds); code != http.StatusOK || len(rounds) != 1 || rounds[0].ChatID != -2 {
+		t.Errorf("Rounds of the user: got %d %+v", code, rounds)
+	}
+	if code := adminRequest(t, a, http.MethodGet, "/api/rounds?before=yesterday", "", nil); code != http.StatusBadRequest {
+		t.Errorf("Invalid time: got %d, want 400", code)
+	}
+}
@@ -0,0 +1,93 @@
+/*
+ * This file is part of Crocodile Game Bot.
+ * Copyright (C) 2019  Viktor
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"strconv"
+	"strings"
+	"time"
+
+	tb "gopkg.in/tucnak/telebot.v2"
+
+	"github.com/nuetoban/crocodile-game-bot/model"
+)
+
+// AbuseReporter provides data for the admin report about rating farming
+type AbuseReporter interface {
+	GetOffenders(since time.Time, limit int) ([]model.Offender, error)
+}
+
+var (
+	admins        map[int]bool
+	abuseReporter AbuseReporter
+)
+
+// adminOnly decorator ignores commands from users which are not admins
+func adminOnly(f func(context.Context, *tb.Message)) func(context.Context, *tb.Message) {
+	return func(ctx context.Context, m *tb.Message) {
+		if m.Sender == nil {
+			return
+		}
+		if !admins[m.Sender.ID] {
+			logFrom(ctx).Infof("adminOnly: user %d is not an admin", m.Sender.ID)
+			return
+		}
+		f(ctx, m)
+	}
+}
+
+// chatMembersCounter implements antiabuse.MembersCounter
+type chatMembersCounter struct{}
+
+func (chatMembersCounter) ChatMembersCount(chatID int64) (int, error) {
+	return bot.Len(&tb.Chat{ID: chatID})
+}
+
+func abuseReportHandler(ctx context.Context, m *tb.Message) {
+	days := 30
+	if v, err := strconv.Atoi(strings.TrimSpace(m.Payload)); err == nil && v > 0 {
+		days = v
+	}
+
+	offenders, err := abuseReporter.GetOffenders(time.Now().AddDate(0, 0, -days), 25)
+	if err != nil {
+		logFrom(ctx).Errorf("abuseReportHandler: cannot get offenders: %v", err)
+		sendMessage(ctx, m.Chat, fallbackMessage)
+		return
+	}
+
+	out := fmt.Sprintf("Подозрительные игроки за %d дн.\n\n", days)
+	if len(offenders) == 0 {
+		out += "Никого не нашлось!"
+	}
+	for k, v := range offenders {
+		out += fmt.Sprintf(
+			"<b>%d</b>. <a href=\"tg://user?id=%d\">%s</a> (%d) — %d подозрительных раундов в %d чатах\n",
+			k+1, v.UserID, html.EscapeString(v.Name), v.UserID, v.Rounds, v.Chats,
+		)
+	}
+
+	err = send(ctx, m.Chat, out, tb.ModeHTML, tb.NoPreview)
+	if err != nil {
+		logFrom(ctx).Errorf("abuseReportHandler: cannot send report: %v", err)
+	}
+}
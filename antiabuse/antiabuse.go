@@ -0,0 +1,163 @@
+/*
+ * This file is part of Crocodile Game Bot.
+ * Copyright (C) 2019  Viktor
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package antiabuse
+
+import (
+	"sync"
+	"time"
+
+	"github.com/nuetoban/crocodile-game-bot/model"
+)
+
+// Reasons to flag a round
+const (
+	FlagTinyChat     = "tiny_chat"
+	FlagInstantGuess = "instant_guess"
+	FlagWordNotSeen  = "word_not_seen"
+	FlagSamePair     = "same_pair"
+)
+
+// Storage provides recent rounds of the chat
+type Storage interface {
+	// GetLastSuccessfulRounds returns successful rounds of the chat, the most recent first
+	GetLastSuccessfulRounds(chatID int64, limit int) ([]model.Round, error)
+}
+
+// MembersCounter returns how many members are in the chat
+type MembersCounter interface {
+	ChatMembersCount(chatID int64) (int, error)
+}
+
+// Logger is used to report errors during inspection
+type Logger interface {
+	Errorf(format string, args ...interface{})
+}
+
+// Detector flags rounds which look like rating farming
+type Detector struct {
+	// Chats with less members are considered private games between friends
+	MinChatMembers int
+
+	// Guess faster than this after the host has seen the word cannot be honest
+	MinGuessAfterSeen time.Duration
+
+	// If the same pair of users has played PairRepeats of PairWindow last rounds, the round is flagged
+	PairWindow  int
+	PairRepeats int
+
+	// How long chat members count is cached
+	MembersTTL time.Duration
+
+	storage Storage
+	members MembersCounter
+	log     Logger
+
+	mu    sync.Mutex
+	cache map[int64]membersCount
+}
+
+type membersCount struct {
+	count   int
+	expires time.Time
+}
+
+// NewDetector returns new instance of Detector with default thresholds
+func NewDetector(s Storage, members MembersCounter, log Logger) *Detector {
+	return &Detector{
+		MinChatMembers:    4,
+		MinGuessAfterSeen: 3 * time.Second,
+		PairWindow:        10,
+		PairRepeats:       6,
+		MembersTTL:        time.Hour,
+
+		storage: s,
+		members: members,
+		log:     log,
+		cache:   make(map[int64]membersCount),
+	}
+}
+
+// Inspect implements crocodile.RoundInspector
+func (d *Detector) Inspect(r model.Round) []string {
+	var flags []string
+
+	if d.isTinyChat(r.ChatID) {
+		flags = append(flags, FlagTinyChat)
+	}
+
+	if r.SeenAt.IsZero() {
+		flags = append(flags, FlagWordNotSeen)
+	} else if r.FinishedAt.Sub(r.SeenAt) < d.MinGuessAfterSeen {
+		flags = append(flags, FlagInstantGuess)
+	}
+
+	if d.isSamePair(r) {
+		flags = append(flags, FlagSamePair)
+	}
+
+	return flags
+}
+
+func (d *Detector) isTinyChat(chatID int64) bool {
+	if d.members == nil {
+		return false
+	}
+
+	d.mu.Lock()
+	cached, ok := d.cache[chatID]
+	d.mu.Unlock()
+
+	if !ok || time.Now().After(cached.expires) {
+		count, err := d.members.ChatMembersCount(chatID)
+		if err != nil {
+			d.log.Errorf("Detector: cannot get members count of chat %d: %v", chatID, err)
+			return false
+		}
+
+		cached = membersCount{count: count, expires: time.Now().Add(d.MembersTTL)}
+		d.mu.Lock()
+		d.cache[chatID] = cached
+		d.mu.Unlock()
+	}
+
+	return cached.count < d.MinChatMembers
+}
+
+// isSamePair checks if the host and the winner keep playing with each other in any roles
+func (d *Detector) isSamePair(r model.Round) bool {
+	rounds, err := d.storage.GetLastSuccessfulRounds(r.ChatID, d.PairWindow-1)
+	if err != nil {
+		d.log.Errorf("Detector: cannot get last rounds of chat %d: %v", r.ChatID, err)
+		return false
+	}
+
+	repeats := 1
+	for _, v := range rounds {
+		if samePair(r, v) {
+			repeats++
+		}
+	}
+
+	return repeats >= d.PairRepeats
+}
+
+func samePair(a, b model.Round) bool {
+	return (a.HostID == b.HostID && a.WinnerID == b.WinnerID) ||
+		(a.HostID == b.WinnerID && a.WinnerID == b.HostID)
+}
@@ -0,0 +1,112 @@
+/*
+ * This file is part of Crocodile Game Bot.
+ * Copyright (C) 2019  Viktor
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package antiabuse
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/nuetoban/crocodile-game-bot/model"
+)
+
+type fakeStorage []model.Round
+
+func (f fakeStorage) GetLastSuccessfulRounds(chatID int64, limit int) ([]model.Round, error) {
+	if len(f) > limit {
+		return f[:limit], nil
+	}
+	return f, nil
+}
+
+type fakeMembers map[int64]int
+
+func (f fakeMembers) ChatMembersCount(chatID int64) (int, error) { return f[chatID], nil }
+
+func TestDetectorInspect(t *testing.T) {
+	now := time.Now()
+	fair := model.Round{
+		ChatID:     1,
+		HostID:     10,
+		WinnerID:   20,
+		StartedAt:  now.Add(-time.Minute),
+		SeenAt:     now.Add(-time.Minute),
+		FinishedAt: now,
+	}
+
+	pair := make(fakeStorage, 5)
+	for i := range pair {
+		pair[i] = model.Round{HostID: 20, WinnerID: 10}
+	}
+
+	tests := []struct {
+		name    string
+		round   func() model.Round
+		storage fakeStorage
+		members fakeMembers
+		flags   []string
+	}{
+		{
+			name:    "fair round",
+			round:   func() model.Round { return fair },
+			members: fakeMembers{1: 30},
+		},
+		{
+			name:    "tiny chat",
+			round:   func() model.Round { return fair },
+			members: fakeMembers{1: 2},
+			flags:   []string{FlagTinyChat},
+		},
+		{
+			name: "instant guess",
+			round: func() model.Round {
+				r := fair
+				r.SeenAt = now.Add(-time.Second)
+				return r
+			},
+			members: fakeMembers{1: 30},
+			flags:   []string{FlagInstantGuess},
+		},
+		{
+			name: "word not seen",
+			round: func() model.Round {
+				r := fair
+				r.SeenAt = time.Time{}
+				return r
+			},
+			members: fakeMembers{1: 30},
+			flags:   []string{FlagWordNotSeen},
+		},
+		{
+			name:    "same pair",
+			round:   func() model.Round { return fair },
+			storage: pair,
+			members: fakeMembers{1: 30},
+			flags:   []string{FlagSamePair},
+		},
+	}
+
+	for _, tt := range tests {
+		d := NewDetector(tt.storage, tt.members, nil)
+		flags := d.Inspect(tt.round())
+		if !reflect.DeepEqual(flags, tt.flags) {
+			t.Errorf("%s: got flags %v, expected %v", tt.name, flags, tt.flags)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+/*
+ * This file is part of Crocodile Game Bot.
+ * Copyright (C) 2019  Viktor
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"sync"
+
+	tb "gopkg.in/tucnak/telebot.v2"
+
+	"github.com/nuetoban/crocodile-game-bot/model"
+)
+
+type banKey struct {
+	kind string
+	id   int64
+}
+
+// banList keeps bans in memory, so updates are checked without queries
+type banList struct {
+	mu   sync.RWMutex
+	bans map[banKey]bool
+}
+
+func newBanList() *banList {
+	return &banList{bans: make(map[banKey]bool)}
+}
+
+// Set replaces all bans, e.g. with ones loaded from the database
+func (l *banList) Set(bans []model.Ban) {
+	m := make(map[banKey]bool, len(bans))
+	for _, b := range bans {
+		m[banKey{b.Kind, b.ID}] = true
+	}
+
+	l.mu.Lock()
+	l.bans = m
+	l.mu.Unlock()
+}
+
+func (l *banList) Add(kind string, id int64) {
+	l.mu.Lock()
+	l.bans[banKey{kind, id}] = true
+	l.mu.Unlock()
+}
+
+func (l *banList) Remove(kind string, id int64) {
+	l.mu.Lock()
+	delete(l.bans, banKey{kind, id})
+	l.mu.Unlock()
+}
+
+// Banned returns true if the user or the chat is banned
+func (l *banList) Banned(kind string, id int64) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.bans[banKey{kind, id}]
+}
+
+// banMiddlewarePoller drops updates from banned users and chats
+func banMiddlewarePoller(l *banList) func(*tb.Update) bool {
+	return func(upd *tb.Update) bool {
+		if chatID := updateChatID(upd); chatID != 0 && l.Banned(model.BanChat, chatID) {
+			log.Debugf("Chat %d is banned, skipping update %d", chatID, upd.ID)
+			return false
+		}
+		if userID := updateUserID(upd); userID != 0 && l.Banned(model.BanUser, int64(userID)) {
+			log.Debugf("User %d is banned, skipping update %d", userID, upd.ID)
+			return false
+		}
+		return true
+	}
+}
@@ -19,186 +19,132 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"html"
-	"io/ioutil"
 	"net/http"
 	"os"
 	"os/signal"
 	"strconv"
 	"strings"
-	"sync"
 	"syscall"
 	"time"
 
-	"github.com/go-redsync/redsync"
-	"github.com/gomodule/redigo/redis"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/attribute"
 	tb "gopkg.in/tucnak/telebot.v2"
 
+	"github.com/nuetoban/crocodile-game-bot/achievements"
+	"github.com/nuetoban/crocodile-game-bot/antiabuse"
 	"github.com/nuetoban/crocodile-game-bot/crocodile"
+	"github.com/nuetoban/crocodile-game-bot/dispatcher"
+	"github.com/nuetoban/crocodile-game-bot/locker"
 	"github.com/nuetoban/crocodile-game-bot/model"
+	"github.com/nuetoban/crocodile-game-bot/redisconn"
+	"github.com/nuetoban/crocodile-game-bot/sender"
+	"github.com/nuetoban/crocodile-game-bot/skill"
 	"github.com/nuetoban/crocodile-game-bot/storage"
 	"github.com/nuetoban/crocodile-game-bot/utils"
 )
 
+// Sent to the chat when the request cannot be processed, e.g. the database is down
+const fallbackMessage = "Что-то пошло не так 😔 Попробуйте ещё раз через пару минут"
+
 var (
-	mutexFabric  *redsync.Redsync
-	locks        map[int64]*sync.Mutex
-	lockForLocks *sync.Mutex // ну а хули нам
-	machines     map[int64]*crocodile.Machine
-	fabric       *crocodile.MachineFabric
-	bot          *tb.Bot
-	redisPool    *redis.Pool
-
-	textUpdatesRecieved float64
-	startTotal          float64
-	ratingTotal         float64
-	globalRatingTotal   float64
-	cstatTotal          float64
-	chatsRatingTotal    float64
-
-	updatesProcessed int
-
-	wordsInlineKeys   [][]tb.InlineButton
-	newGameInlineKeys [][]tb.InlineButton
-	ratingGetter      RatingGetter
-	statisticsGetter  StatisticsGetter
-
-	rateLimiter *RateLimiter
+	chatLocker     locker.ChatLocker
+	fabric         *crocodile.MachineFabric
+	machineStorage loggingStorage
+	machineWords   wordsProvider
+	bot            *tb.Bot
+	redisPool      *redisconn.Client
+
+	wordsInlineKeys    [][]tb.InlineButton
+	newGameInlineKeys  [][]tb.InlineButton
+	ratingGetter       RatingGetter
+	statisticsGetter   StatisticsGetter
+	botStatistics      *statisticsCache
+	achievementsEngine *achievements.Engine
+
+	rateLimiter   messageLimiter
+	messageSender *sender.Sender
+	botHealth     = newHealth()
+	botBans       = newBanList()
 
 	DEBUG = false
 )
 
-func init() {
-	lockForLocks = &sync.Mutex{}
-	locks = make(map[int64]*sync.Mutex)
-
-	redisHost := os.Getenv("REDIS_HOST")
-	if redisHost == "" {
-		redisHost = ":6379"
-	}
-	redisPool = newPool(redisHost)
-	mutexFabric = redsync.New([]redsync.Pool{redisPool})
-	cleanupHook()
-}
-
-// https://github.com/pete911/examples-redigo
-func newPool(server string) *redis.Pool {
-	return &redis.Pool{
-		MaxIdle:     200,
-		MaxActive:   10000,
-		IdleTimeout: 240 * time.Second,
-		Dial: func() (redis.Conn, error) {
-			c, err := redis.Dial("tcp", server)
-			if err != nil {
-				panic(err)
-			}
-			return c, err
-		},
-
-		TestOnBorrow: func(c redis.Conn, t time.Time) error {
-			_, err := c.Do("PING")
-			if err != nil {
-				panic(err)
-			}
-			return err
-		},
-	}
-}
-
-// https://github.com/pete911/examples-redigo
-func cleanupHook() {
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
-	signal.Notify(c, syscall.SIGTERM)
-	signal.Notify(c, syscall.SIGKILL)
-	go func() {
-		<-c
-		redisPool.Close()
-		os.Exit(0)
-	}()
-}
-
 type RatingGetter interface {
 	GetRating(chatID int64) ([]model.UserInChat, error)
 	GetGlobalRating() ([]model.UserInChat, error)
 	GetChatsRating() ([]model.ChatStatistics, error)
+	GetDailyRating(day time.Time) ([]model.DailyResult, error)
+	GetSkillRating(chatID int64, role string) ([]model.SkillRating, error)
 }
 
 type StatisticsGetter interface {
 	GetStatistics() (model.Statistics, error)
 }
 
-type dbCredentials struct {
-	Host,
-	User,
-	Pass,
-	Name string
-
-	Port int
-	KW   storage.KW
-}
-
 func loggerMiddlewarePoller(upd *tb.Update) bool {
 	if upd.Message != nil && upd.Message.Chat != nil && upd.Message.Sender != nil {
-		log.Debugf(
-			"Received update, chat: %d, chatTitle: \"%s\", user: %d",
-			upd.Message.Chat.ID,
-			upd.Message.Chat.Title,
-			upd.Message.Sender.ID,
-		)
+		updateLog(upd).Debugf("Received update, chatTitle: \"%s\"", upd.Message.Chat.Title)
 	}
-	updatesProcessed++
+	botHealth.UpdateReceived()
 	return true
 }
 
-func getDbCredentialsFromEnv() (dbCredentials, error) {
-	prefix := "CROCODILE_GAME_DB_"
-	ret := dbCredentials{}
-	ret.KW = storage.KW{}
-	envList := os.Environ()
-	env := make(map[string]string)
-	for _, v := range envList {
-		kv := strings.Split(v, "=")
-		env[kv[0]] = kv[1]
+func main() {
+	logInit()
+
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		if err := configCommand(os.Args[2:]); err != nil {
+			log.Fatalf("config: %v", err)
+		}
+		return
 	}
-	var err error
 
-	ret.Port, err = strconv.Atoi(env[prefix+"PORT"])
+	cfg, err := loadConfig("")
 	if err != nil {
-		return ret, err
-	}
-	delete(env, prefix+"PORT")
-
-	ret.Host = env[prefix+"HOST"]
-	ret.User = env[prefix+"USER"]
-	ret.Pass = env[prefix+"PASS"]
-	ret.Name = env[prefix+"NAME"]
-	delete(env, prefix+"HOST")
-	delete(env, prefix+"USER")
-	delete(env, prefix+"PASS")
-	delete(env, prefix+"NAME")
-
-	for k, v := range env {
-		if strings.HasPrefix(k, prefix) {
-			ret.KW[strings.ToLower(strings.TrimPrefix(k, prefix))] = v
+		log.Fatalf("Cannot load config: %v", err)
+	}
+
+	DEBUG = cfg.Bot.Dev
+	if err := setLogLevel(cfg.LogLevel()); err != nil {
+		log.Fatalf("Cannot set log level: %v", err)
+	}
+	if err := setLogFormat(cfg.Log.Format); err != nil {
+		log.Fatalf("Cannot set log format: %v", err)
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := cfg.ValidateDatabase(); err != nil {
+			log.Fatalf("Invalid config: %v", err)
+		}
+		if err := migrateCommand(cfg, os.Args[2:]); err != nil {
+			log.Fatalf("migrate: %v", err)
 		}
+		return
 	}
 
-	return ret, nil
-}
+	if err := cfg.Validate(); err != nil {
+		log.Fatalf("Invalid config: %v", err)
+	}
 
-func main() {
-	logInit()
-	if os.Getenv("CROCODILE_GAME_DEV") != "" {
-		DEBUG = true
-		setLogLevel("TRACE")
+	redisPool, err = redisconn.New(redisConfig(cfg.Redis))
+	if err != nil {
+		log.Fatalf("Cannot configure Redis: %v", err)
 	}
+	redisPool.Observe = observeRedisCommand
+
+	// The root context is done on SIGINT or SIGTERM, SIGKILL cannot be caught
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	if os.Getenv("CROCODILE_GAME_LOGLEVEL") != "" {
-		setLogLevel(os.Getenv("CROCODILE_GAME_LOGLEVEL"))
+	flushTraces, err := initTracing(ctx, cfg.Tracing.Exporter)
+	if err != nil {
+		log.Fatalf("Cannot configure tracing: %v", err)
 	}
 
 	log.Info("Loading words")
@@ -206,52 +152,116 @@ func main() {
 	if err != nil {
 		log.Fatalf("Cannot open dictionary: %v", err)
 	}
-	wordsProvider, _ := crocodile.NewWordsProviderReader(f)
+	words, _ := crocodile.NewWordsProviderReader(f)
+	machineWords = words
 
-	log.Info("Readind DB env variables")
-	creds, err := getDbCredentialsFromEnv()
+	pg, err := openStorage(cfg)
 	if err != nil {
-		log.Fatalf("Cannot get database credentials from ENV: %v", err)
+		log.Fatalf("Cannot open storage: %v", err)
 	}
 
-	log.Info("Connecting to the database")
-	pg, err := storage.NewStorage(storage.NewConnString(
-		creds.Host, creds.User,
-		creds.Pass, creds.Name,
-		creds.Port, creds.KW,
-	), redisPool, storage.WrapLogrus(log))
-	if err != nil {
-		log.Fatalf("Cannot connect to database (%s, %s) on host %s: %v", creds.User, creds.Name, creds.Host, err)
+	if cfg.Database.AutoMigrate || cfg.SQLite() {
+		log.Info("Applying migrations")
+		if err := autoMigrate(pg); err != nil {
+			log.Fatalf("Cannot apply migrations: %v", err)
+		}
 	}
 
 	ratingGetter = pg
 	statisticsGetter = pg
+	botStatistics = newStatisticsCache(pg)
+	personalStatsGetter = pg
+	abuseReporter = pg
+	chatMigrator = pg
+	machineStorage = pg
+
+	admins = make(map[int]bool)
+	for _, id := range cfg.Bot.Admins {
+		admins[id] = true
+	}
+
+	adminAPI := newAdminAPI(cfg.Admin.Token, pg, botBans, words)
+	go adminAPI.Run(ctx, cfg.Admin.SyncInterval)
 
 	log.Info("Creating games fabric")
-	fabric = crocodile.NewMachineFabric(pg, wordsProvider, log)
-	machines = make(map[int64]*crocodile.Machine)
+	fabric = crocodile.NewMachineFabric(pg, words, log)
+
+	achievementsEngine = achievements.NewEngine(pg, log)
+	fabric.AddObserver(achievementsEngine)
+	fabric.AddObserver(skill.NewUpdater(pg, log))
+	fabric.AddObserver(roundMetrics{})
+	fabric.Inspector = antiabuse.NewDetector(pg, chatMembersCounter{}, log)
+
+	if cfg.Bot.MachineCache > 0 {
+		fabric.Cache = crocodile.NewMachineCache(cfg.Bot.MachineCache, 10*time.Minute)
+
+		// Other replicas may change machines only when they are kept in Redis
+		if w, ok := pg.(machinesWatcher); ok {
+			go w.WatchMachines(ctx, fabric.Cache, storage.WrapLogrus(log))
+		}
+	}
+
+	// Local locks and limits are enough only when the bot is run in one replica
+	if cfg.SQLite() {
+		rateLimiter = NewLocalRateLimiter()
+	} else {
+		rateLimiter = NewRateLimiter(redisPool)
+	}
 
-	rateLimiter = NewRateLimiter(redisPool)
+	if cfg.Bot.Locker == "local" || cfg.SQLite() {
+		chatLocker = locker.NewLocal()
+	} else {
+		l := locker.NewRedis(redisPool)
+		l.Available = redisPool.Available
+		chatLocker = l
+	}
+
+	messageSender = sender.New()
+	messageSender.Throttle = rateLimiter.Reserve
+	messageSender.OnError = func(chatID int64, err error) {
+		if sender.IsKicked(err) {
+			log.Infof("Bot cannot write to chat %d anymore: %v", chatID, err)
+			return
+		}
+		log.Errorf("Cannot send message to chat %d: %v", chatID, err)
+	}
 
 	log.Info("Connecting to Telegram API")
+	d := cfg.Dispatcher
+	updatesDispatcher = dispatcher.New(d.Workers, d.WorkerQueue, d.ChatQueue)
+
+	var dedup updateDeduplicator
+	if cfg.SQLite() {
+		dedup = NewLocalDeduplicator()
+	} else {
+		dedup = NewRedisDeduplicator(redisPool)
+	}
+
+	middlewares := chainMiddlewares(
+		loggerMiddlewarePoller,
+		dedupMiddlewarePoller(dedup),
+		banMiddlewarePoller(botBans),
+		dispatchMiddlewarePoller,
+	)
+
 	var poller tb.Poller
-	if os.Getenv("CROCODILE_GAME_WEBHOOK") != "" {
-		poller = &tb.Webhook{
+	if cfg.Bot.Webhook.PublicURL != "" {
+		mp := tb.NewMiddlewarePoller(&tb.Webhook{
 			Endpoint: &tb.WebhookEndpoint{
-				PublicURL: os.Getenv("CROCODILE_GAME_WEBHOOK"),
+				PublicURL: cfg.Bot.Webhook.PublicURL,
 			},
-			Listen: "0.0.0.0:9999",
-		}
+			Listen: cfg.Bot.Webhook.Listen,
+		}, middlewares)
+		mp.Capacity = 10000
+		poller = mp
 	} else {
-		poller = &tb.LongPoller{Timeout: 5 * time.Second}
+		// Updates are passed to middlewares right away, so the ones taken before stop are not lost
+		poller = &drainingPoller{Timeout: cfg.Bot.PollTimeout, Filter: middlewares}
 	}
 
-	mp := tb.NewMiddlewarePoller(poller, loggerMiddlewarePoller)
-	mp.Capacity = 10000
-
 	settings := tb.Settings{
-		Token:   os.Getenv("CROCODILE_GAME_BOT_TOKEN"),
-		Poller:  mp,
+		Token:   cfg.Bot.Token,
+		Poller:  poller,
 		Updates: 10000,
 	}
 	bot, err = tb.NewBot(settings)
@@ -259,121 +269,190 @@ func main() {
 		log.Fatalf("Cannot connect to Telegram API: %v", err)
 	}
 	// pg.SetBotID(bot.Me.ID)
+	updatesRouter.username = bot.Me.Username
 
 	log.Info("Binding handlers")
-	bot.Handle(tb.OnText, logDuration(mustLock(textHandler)))
-	bot.Handle("/start", logDuration(mustLock(startNewGameHandler)))
-	bot.Handle("/rating", logDuration(ratingHandler))
-	bot.Handle("/globalrating", logDuration(globalRatingHandler))
-	bot.Handle("/cancel", func(m *tb.Message) {})
-	bot.Handle("/cstat", logDuration(statsHandler))
-	bot.Handle("/rules", logDuration(rulesHandler))
-	bot.Handle("/chatrating", logDuration(chatsRatingHandler))
-	bindButtonsHandlers(bot)
-
-	collector := newMetricsCollector(pg)
-	prometheus.MustRegister(collector)
+	updatesRouter.Handle(tb.OnText, skipIdleChats(logDuration(mustLock(textHandler))))
+	updatesRouter.Handle("/start", logDuration(rateLimited(mustLock(startNewGameHandler))))
+	updatesRouter.Handle("/daily", logDuration(rateLimited(mustLock(startDailyGameHandler))))
+	updatesRouter.Handle("/dailyrating", logDuration(rateLimited(dailyRatingHandler)))
+	updatesRouter.Handle("/rating", logDuration(rateLimited(ratingHandler)))
+	updatesRouter.Handle("/globalrating", logDuration(rateLimited(globalRatingHandler)))
+	updatesRouter.Handle("/cancel", func(context.Context, *tb.Message) {})
+	updatesRouter.Handle("/cstat", logDuration(rateLimited(statsHandler)))
+	updatesRouter.Handle("/rules", logDuration(rateLimited(rulesHandler)))
+	updatesRouter.Handle("/chatrating", logDuration(rateLimited(chatsRatingHandler)))
+	updatesRouter.Handle("/achievements", logDuration(rateLimited(achievementsHandler)))
+	updatesRouter.Handle("/me", logDuration(rateLimited(meHandler)))
+	updatesRouter.Handle("/stats", logDuration(rateLimited(userStatsHandler)))
+	updatesRouter.Handle("/abusereport", logDuration(adminOnly(abuseReportHandler)))
+	updatesRouter.Handle("/mergechats", logDuration(adminOnly(mergeChatsHandler)))
+	updatesRouter.Handle(tb.OnMigration, logDuration(chatMigrationHandler))
+	bindButtonsHandlers(updatesRouter)
+
+	go botStatistics.Run(ctx, cfg.Bot.StatsInterval)
+	registerMetrics(prometheus.DefaultRegisterer, newMetricsCollector(botStatistics))
+
+	botHealth.maxIdle = cfg.Bot.HealthMaxIdle
+	botHealth.checks = append(botHealth.checks, healthCheck{name: "postgres", critical: true, check: pg.Ping})
+	if !cfg.SQLite() {
+		// The bot keeps working without Redis, it is only reported
+		botHealth.checks = append(botHealth.checks, healthCheck{name: "redis", check: pingRedis(redisPool)})
+	}
 
 	http.Handle("/metrics", promhttp.Handler())
+	http.HandleFunc("/healthz", botHealth.healthz)
+	http.HandleFunc("/readyz", botHealth.readyz)
+	if cfg.Admin.Token != "" {
+		http.Handle("/api/", adminAPI)
+	}
 
 	log.Info("Starting metrics exporter server")
-	go http.ListenAndServe(":8080", nil)
-
+	metricsServer := &http.Server{Addr: cfg.Server.Listen}
 	go func() {
-		var err error
-		for {
-			time.Sleep(time.Second * 15)
-
-			if updatesProcessed == 0 {
-				err = ioutil.WriteFile("/tmp/crocostatus", []byte("BAD"), 0644)
-			} else {
-				err = ioutil.WriteFile("/tmp/crocostatus", []byte("GOOD"), 0644)
-			}
-
-			updatesProcessed = 0
-			if err != nil {
-				panic(err)
-			}
+		if err := metricsServer.ListenAndServe(); err != http.ErrServerClosed {
+			log.Errorf("Metrics exporter server has failed: %v", err)
 		}
 	}()
 
 	log.Info("Starting the bot")
-	bot.Start()
+	updatesDispatcher.Start()
+
+	botDone := make(chan struct{})
+	botHealth.SetPolling(true)
+	go func() {
+		bot.Start()
+		botHealth.SetPolling(false)
+		close(botDone)
+	}()
+
+	<-ctx.Done()
+	log.Info("Shutting down")
+	shutdown(cfg.Bot.ShutdownTimeout, botDone, metricsServer, pg, flushTraces)
+	log.Info("Bye")
+}
+
+// newMachine returns machine of the chat logging with fields of the update, its queries included,
+// and tracing calls to the storage and words generation
+func newMachine(ctx context.Context, chatID int64, mesID int) (*crocodile.Machine, error) {
+	l := logFrom(ctx)
+	return fabric.NewMachineWith(chatID, mesID, crocodile.Scope{
+		Storage:       tracedStorage{machineStorage.WithLogger(queryMetricsLogger{storage.WrapLogrus(l)}), ctx},
+		WordsProvider: tracedWords{machineWords, ctx},
+		Log:           l,
+	})
 }
 
 // Decorator for logging duration of function execution
-func logDuration(f func(*tb.Message)) func(*tb.Message) {
-	return func(m *tb.Message) {
+func logDuration(f func(context.Context, *tb.Message)) func(context.Context, *tb.Message) {
+	return func(ctx context.Context, m *tb.Message) {
 		start := time.Now()
-		f(m)
+		f(ctx, m)
 		diff := time.Now().Sub(start)
 		if diff.Seconds() > 1 {
-			log.Warnf("Took %s time to complete update processing", time.Time{}.Add(diff).Format("04:05.000"))
+			logFrom(ctx).Warnf("Took %s time to complete update processing", time.Time{}.Add(diff).Format("04:05.000"))
 		} else {
-			log.Tracef("Took %s time to complete update processing", time.Time{}.Add(diff).Format("04:05.000"))
+			logFrom(ctx).Tracef("Took %s time to complete update processing", time.Time{}.Add(diff).Format("04:05.000"))
 		}
 	}
 }
 
 // Decorator for logging duration of function execution (callback handlers)
-func logDurationCallback(f func(*tb.Callback)) func(*tb.Callback) {
-	return func(c *tb.Callback) {
+func logDurationCallback(f func(context.Context, *tb.Callback)) func(context.Context, *tb.Callback) {
+	return func(ctx context.Context, c *tb.Callback) {
 		start := time.Now()
-		f(c)
+		f(ctx, c)
 		diff := time.Now().Sub(start)
 		if diff.Seconds() > 1 {
-			log.Warnf("Took %s time to complete update processing (cb)", time.Time{}.Add(diff).Format("04:05.000"))
+			logFrom(ctx).Warnf("Took %s time to complete update processing (cb)", time.Time{}.Add(diff).Format("04:05.000"))
 		} else {
-			log.Tracef("Took %s time to complete update processing (cb)", time.Time{}.Add(diff).Format("04:05.000"))
+			logFrom(ctx).Tracef("Took %s time to complete update processing (cb)", time.Time{}.Add(diff).Format("04:05.000"))
+		}
+	}
+}
+
+// Decorator ignoring commands which exceed budgets of the chat or the user who sent them
+func rateLimited(f func(context.Context, *tb.Message)) func(context.Context, *tb.Message) {
+	return func(ctx context.Context, m *tb.Message) {
+		rateLimiter.Limit(m.Chat.ID, m.Sender.ID,
+			func() error { f(ctx, m); return nil },
+			func() error {
+				return sendMessage(ctx, m.Chat, "Достигнут лимит по количеству сообщений в минуту!")
+			},
+			func() error { return nil })
+	}
+}
+
+// Decorator skipping messages in chats without a game, so they do not wait for the lock
+func skipIdleChats(f func(context.Context, *tb.Message)) func(context.Context, *tb.Message) {
+	return func(ctx context.Context, m *tb.Message) {
+		if fabric.IsIdle(m.Chat.ID) {
+			return
 		}
+		f(ctx, m)
 	}
 }
 
 // Decorator for distributed lock for chat (messages handlers)
-func mustLock(f func(*tb.Message)) func(*tb.Message) {
-	return func(m *tb.Message) {
-		go func() {
-			m := m
-			log.Tracef("Locking chat %d", m.Chat.ID)
-			lockChat(m.Chat.ID)
+func mustLock(f func(context.Context, *tb.Message)) func(context.Context, *tb.Message) {
+	return func(ctx context.Context, m *tb.Message) {
+		logFrom(ctx).Tracef("Locking chat %d", m.Chat.ID)
+		_, span := startSpan(ctx, "lock")
+		lock, err := chatLocker.Lock(m.Chat.ID)
+		endSpan(span, err)
+		if err != nil {
+			logFrom(ctx).Errorf("mustLock: cannot lock chat %d: %v", m.Chat.ID, err)
+			return
+		}
 
-			f(m)
+		f(ctx, m)
 
-			log.Tracef("Unlocking chat %d", m.Chat.ID)
-			unlockChat(m.Chat.ID)
-		}()
+		logFrom(ctx).Tracef("Unlocking chat %d", m.Chat.ID)
+		if err := lock.Unlock(); err != nil {
+			logFrom(ctx).Errorf("mustLock: cannot unlock chat %d: %v", m.Chat.ID, err)
+		}
 	}
 }
 
 // Decorator for distributed lock for chat (callback handlers)
-func mustLockCallback(f func(*tb.Callback)) func(*tb.Callback) {
-	return func(c *tb.Callback) {
-		go func() {
-			c := c
-			log.Tracef("Locking chat %d", c.Message.Chat.ID)
-			lockChat(c.Message.Chat.ID)
+func mustLockCallback(f func(context.Context, *tb.Callback)) func(context.Context, *tb.Callback) {
+	return func(ctx context.Context, c *tb.Callback) {
+		logFrom(ctx).Tracef("Locking chat %d", c.Message.Chat.ID)
+		_, span := startSpan(ctx, "lock")
+		lock, err := chatLocker.Lock(c.Message.Chat.ID)
+		endSpan(span, err)
+		if err != nil {
+			logFrom(ctx).Errorf("mustLockCallback: cannot lock chat %d: %v", c.Message.Chat.ID, err)
+			return
+		}
 
-			f(c)
+		f(ctx, c)
 
-			log.Tracef("Unlocking chat %d", c.Message.Chat.ID)
-			unlockChat(c.Message.Chat.ID)
-		}()
+		logFrom(ctx).Tracef("Unlocking chat %d", c.Message.Chat.ID)
+		if err := lock.Unlock(); err != nil {
+			logFrom(ctx).Errorf("mustLockCallback: cannot unlock chat %d: %v", c.Message.Chat.ID, err)
+		}
 	}
 }
 
-func globalRatingHandler(m *tb.Message) {
-	globalRatingTotal++
+func globalRatingHandler(ctx context.Context, m *tb.Message) {
+	if strings.TrimSpace(m.Payload) == "skill" {
+		sendSkillRating(ctx, m, 0, "во всех чатах")
+		return
+	}
+
 	rating, err := ratingGetter.GetGlobalRating()
 	if err != nil {
-		log.Errorf("globalRatingHandler: cannot get rating %v:", err)
+		logFrom(ctx).Errorf("globalRatingHandler: cannot get rating %v:", err)
+		sendMessage(ctx, m.Chat, fallbackMessage)
 		return
 	}
 
 	ratingString := buildRating("Топ-25 <b>игроков в крокодила</b> во всех чатах 🐊", rating)
 
-	err = sendMessage(m.Chat, m.Chat.ID, ratingString)
+	err = sendMessage(ctx, m.Chat, ratingString)
 	if err != nil {
-		log.Errorf("globalRatingHandler: cannot send rating: %v", err)
+		logFrom(ctx).Errorf("globalRatingHandler: cannot send rating: %v", err)
 	}
 }
 
@@ -415,39 +494,62 @@ func buildRatingChatStatistics(header string, data []model.ChatStatistics) strin
 	return out
 }
 
-func ratingHandler(m *tb.Message) {
-	ratingTotal++
+func ratingHandler(ctx context.Context, m *tb.Message) {
+	if strings.TrimSpace(m.Payload) == "skill" {
+		sendSkillRating(ctx, m, m.Chat.ID, "в этом чате")
+		return
+	}
+
 	rating, err := ratingGetter.GetRating(m.Chat.ID)
 	if err != nil {
-		log.Errorf("ratingHandler: cannot get rating %v:", err)
+		logFrom(ctx).Errorf("ratingHandler: cannot get rating %v:", err)
+		sendMessage(ctx, m.Chat, fallbackMessage)
 		return
 	}
 
 	ratingString := buildRating("Топ-25 <b>игроков в крокодила</b> 🐊", rating)
 
-	err = sendMessage(m.Chat, m.Chat.ID, ratingString)
+	err = sendMessage(ctx, m.Chat, ratingString)
 	if err != nil {
-		log.Errorf("ratingHandler: cannot send rating: %v", err)
+		logFrom(ctx).Errorf("ratingHandler: cannot send rating: %v", err)
 	}
 }
 
-func sendMessage(s tb.Recipient, chatID int64, text string) error {
-	err := rateLimiter.Limit(chatID,
-		func() error { _, err := bot.Send(s, text, tb.ModeHTML, tb.NoPreview); return err },
-		func() error {
-			_, err := bot.Send(s, "Достигнут лимит по количеству сообщений в минуту!")
-			return err
-		},
-		func() error { return nil })
-	return err
+func sendMessage(ctx context.Context, s tb.Recipient, text string) error {
+	return send(ctx, s, text, tb.ModeHTML, tb.NoPreview)
 }
 
-func statsHandler(m *tb.Message) {
-	cstatTotal++
-	stats, err := statisticsGetter.GetStatistics()
+// send queues the message, it is delivered in order with other messages to the recipient
+func send(ctx context.Context, to tb.Recipient, what interface{}, options ...interface{}) error {
+	chatID, _ := strconv.ParseInt(to.Recipient(), 10, 64)
+	return messageSender.Enqueue(chatID, func() error {
+		_, span := startSpan(ctx, "telegram.sendMessage", attribute.Int64("chat.id", chatID))
+		_, err := bot.Send(to, what, options...)
+		endSpan(span, err)
+		return err
+	})
+}
+
+// respond answers the callback at once, Telegram does not accept late answers
+func respond(ctx context.Context, c *tb.Callback, resp *tb.CallbackResponse) {
+	_, span := startSpan(ctx, "telegram.answerCallbackQuery")
+	err := bot.Respond(c, resp)
+	endSpan(span, err)
 	if err != nil {
-		log.Errorf("statsHandler: cannot get stats %v:", err)
-		return
+		logFrom(ctx).Errorf("Cannot respond to callback of user %d: %v", c.Sender.ID, err)
+	}
+}
+
+func statsHandler(ctx context.Context, m *tb.Message) {
+	stats, ok := botStatistics.Get()
+	if !ok {
+		var err error
+		stats, err = statisticsGetter.GetStatistics()
+		if err != nil {
+			logFrom(ctx).Errorf("statsHandler: cannot get stats %v:", err)
+			sendMessage(ctx, m.Chat, fallbackMessage)
+			return
+		}
 	}
 
 	outString := "<b>Статистика крокодила</b> 🐊\n\n"
@@ -455,122 +557,168 @@ func statsHandler(m *tb.Message) {
 	outString += fmt.Sprintf("Количество игроков: %d\n", stats.Users)
 	outString += fmt.Sprintf("Всего игр: %d\n", stats.GamesPlayed)
 
-	err = sendMessage(m.Chat, m.Chat.ID, outString)
+	err := sendMessage(ctx, m.Chat, outString)
 	if err != nil {
-		log.Errorf("statsHandler: cannot send stats: %v", err)
+		logFrom(ctx).Errorf("statsHandler: cannot send stats: %v", err)
 	}
 }
 
-func lockChat(chatID int64) error {
-	if _, ok := locks[chatID]; ok {
-		if locks[chatID] != nil {
-			locks[chatID].Lock()
-		} else {
-			lockForLocks.Lock()
-			locks[chatID] = &sync.Mutex{}
-			lockForLocks.Unlock()
-			locks[chatID].Lock()
+func startNewGameHandler(ctx context.Context, m *tb.Message) {
+	if m.Private() {
+		sendMessage(ctx, m.Sender, "Добавить бота в чат: https://t.me/Crocodile_Game_Bot?startgroup=a ")
+		return
+	}
+
+	rememberUser(ctx, m.Sender)
+
+	machine, err := newMachine(ctx, m.Chat.ID, m.ID)
+	if err != nil {
+		logFrom(ctx).Errorf("startNewGameHandler: cannot restore game: %v", err)
+		sendMessage(ctx, m.Chat, fallbackMessage)
+		return
+	}
+
+	username := strings.TrimSpace(m.Sender.FirstName + " " + m.Sender.LastName)
+
+	_, err = machine.StartNewGameAndReturnWord(m.Sender.ID, username, m.Chat.Title)
+
+	if errors.Is(err, crocodile.ErrGameAlreadyStarted) {
+		_, ms, _ := utils.CalculateTimeDiff(time.Now(), machine.GetStartedTime())
+
+		if ms < 2 {
+			sendMessage(ctx, m.Chat, "Игра уже начата! Ожидайте 2 минуты")
+			return
+		}
+
+		err = machine.StopGame()
+		if err == nil {
+			_, err = machine.StartNewGameAndReturnWord(m.Sender.ID, username, m.Chat.Title)
 		}
-	} else {
-		lockForLocks.Lock()
-		locks[chatID] = &sync.Mutex{}
-		lockForLocks.Unlock()
-		locks[chatID].Lock()
 	}
-	return nil
-}
 
-func unlockChat(chatID int64) {
-	// mutexFabric.NewMutex("mutex/" + strconv.Itoa(int(chatID))).Unlock()
-	locks[chatID].Unlock()
+	if err != nil {
+		logFrom(ctx).Errorf("startNewGameHandler: cannot start game: %v", err)
+		if !errors.Is(err, crocodile.ErrWaitingForWinnerRespond) {
+			sendMessage(ctx, m.Chat, fallbackMessage)
+		}
+		return
+	}
+
+	send(ctx,
+		m.Chat,
+		fmt.Sprintf(
+			`<a href="tg://user?id=%d">%s</a> объясняет слово`,
+			m.Sender.ID, html.EscapeString(m.Sender.FirstName)),
+		tb.ModeHTML,
+		&tb.ReplyMarkup{InlineKeyboard: wordsInlineKeys},
+	)
 }
 
-func startNewGameHandler(m *tb.Message) {
+func startDailyGameHandler(ctx context.Context, m *tb.Message) {
 	if m.Private() {
-		sendMessage(m.Sender, m.Chat.ID, "Добавить бота в чат: https://t.me/Crocodile_Game_Bot?startgroup=a ")
+		sendMessage(ctx, m.Sender, "Добавить бота в чат: https://t.me/Crocodile_Game_Bot?startgroup=a ")
 		return
 	}
 
-	startTotal++
+	rememberUser(ctx, m.Sender)
 
-	machine := fabric.NewMachine(m.Chat.ID, m.ID)
+	machine, err := newMachine(ctx, m.Chat.ID, m.ID)
+	if err != nil {
+		logFrom(ctx).Errorf("startDailyGameHandler: cannot restore game: %v", err)
+		sendMessage(ctx, m.Chat, fallbackMessage)
+		return
+	}
 
 	username := strings.TrimSpace(m.Sender.FirstName + " " + m.Sender.LastName)
 
-	_, err := machine.StartNewGameAndReturnWord(m.Sender.ID, username, m.Chat.Title)
+	_, err = machine.StartNewDailyGameAndReturnWord(m.Sender.ID, username, m.Chat.Title)
 
-	if err != nil {
-		if err.Error() == crocodile.ErrGameAlreadyStarted {
-			_, ms, _ := utils.CalculateTimeDiff(time.Now(), machine.GetStartedTime())
+	if errors.Is(err, crocodile.ErrGameAlreadyStarted) {
+		_, ms, _ := utils.CalculateTimeDiff(time.Now(), machine.GetStartedTime())
 
-			if ms < 2 {
-				sendMessage(m.Chat, m.Chat.ID, "Игра уже начата! Ожидайте 2 минуты")
-				return
-			} else {
-				machine.StopGame()
-				_, err = machine.StartNewGameAndReturnWord(m.Sender.ID, username, m.Chat.Title)
-				if err != nil {
-					log.Println(err)
-				}
-			}
-		} else {
-			log.Println(err)
+		if ms < 2 {
+			sendMessage(ctx, m.Chat, "Игра уже начата! Ожидайте 2 минуты")
 			return
 		}
+
+		err = machine.StopGame()
+		if err == nil {
+			_, err = machine.StartNewDailyGameAndReturnWord(m.Sender.ID, username, m.Chat.Title)
+		}
 	}
 
-	bot.Send(
+	if err != nil {
+		switch {
+		case errors.Is(err, crocodile.ErrWaitingForWinnerRespond):
+			sendMessage(ctx, m.Chat, "У победителя есть 5 секунд на решение!")
+		case errors.Is(err, crocodile.ErrDailyAlreadyGuessed):
+			sendMessage(ctx, m.Chat, "Слово дня в этом чате уже отгадано! Приходите завтра, а пока посмотрите /dailyrating")
+		default:
+			logFrom(ctx).Errorf("startDailyGameHandler: cannot start daily game: %v", err)
+			sendMessage(ctx, m.Chat, fallbackMessage)
+		}
+		return
+	}
+
+	send(ctx,
 		m.Chat,
 		fmt.Sprintf(
-			`<a href="tg://user?id=%d">%s</a> объясняет слово`,
+			`<a href="tg://user?id=%d">%s</a> объясняет <b>слово дня</b>`,
 			m.Sender.ID, html.EscapeString(m.Sender.FirstName)),
 		tb.ModeHTML,
 		&tb.ReplyMarkup{InlineKeyboard: wordsInlineKeys},
 	)
 }
 
-func startNewGameHandlerCallback(c *tb.Callback) {
+func startNewGameHandlerCallback(ctx context.Context, c *tb.Callback) {
 	m := c.Message
+	rememberUser(ctx, c.Sender)
 
 	// If machine for this chat has been created already
-	ma := fabric.NewMachine(m.Chat.ID, m.ID)
+	ma, err := newMachine(ctx, m.Chat.ID, m.ID)
+	if err != nil {
+		logFrom(ctx).Errorf("startNewGameHandlerCallback: cannot restore game: %v", err)
+		respond(ctx, c, &tb.CallbackResponse{Text: fallbackMessage, ShowAlert: true})
+		return
+	}
 
 	username := strings.TrimSpace(c.Sender.FirstName + " " + c.Sender.LastName)
-	_, err := ma.StartNewGameAndReturnWord(c.Sender.ID, username, m.Chat.Title)
+	_, err = ma.StartNewGameAndReturnWord(c.Sender.ID, username, m.Chat.Title)
 
-	if err != nil {
-		if err.Error() == crocodile.ErrGameAlreadyStarted {
-			_, ms, _ := utils.CalculateTimeDiff(time.Now(), ma.GetStartedTime())
+	if errors.Is(err, crocodile.ErrGameAlreadyStarted) {
+		_, ms, _ := utils.CalculateTimeDiff(time.Now(), ma.GetStartedTime())
 
-			if ms < 2 {
-				bot.Respond(c, &tb.CallbackResponse{Text: "Игра уже начата! Ожидайте 2 минуты"})
-				return
-			} else {
-				ma.StopGame()
-				_, err = ma.StartNewGameAndReturnWord(c.Sender.ID, username, m.Chat.Title)
-				if err != nil {
-					log.Println(err)
-				}
-				bot.Respond(c, &tb.CallbackResponse{
-					Text:      fmt.Sprintf("Ты — ведущий, твое слово — %s", ma.GetWord()),
-					ShowAlert: true,
-				})
-			}
-		} else if err.Error() == crocodile.ErrWaitingForWinnerRespond {
-			bot.Respond(c, &tb.CallbackResponse{Text: "У победителя есть 5 секунд на решение!"})
-			return
-		} else {
-			log.Println(err)
-			bot.Respond(c, &tb.CallbackResponse{Text: "."})
+		if ms < 2 {
+			respond(ctx, c, &tb.CallbackResponse{Text: "Игра уже начата! Ожидайте 2 минуты"})
 			return
 		}
+
+		err = ma.StopGame()
+		if err == nil {
+			_, err = ma.StartNewGameAndReturnWord(c.Sender.ID, username, m.Chat.Title)
+		}
+	}
+
+	if errors.Is(err, crocodile.ErrWaitingForWinnerRespond) {
+		respond(ctx, c, &tb.CallbackResponse{Text: "У победителя есть 5 секунд на решение!"})
+		return
+	} else if err != nil {
+		logFrom(ctx).Errorf("startNewGameHandlerCallback: cannot start game: %v", err)
+		respond(ctx, c, &tb.CallbackResponse{Text: fallbackMessage, ShowAlert: true})
+		return
 	}
 
-	bot.Respond(c, &tb.CallbackResponse{
-		Text:      fmt.Sprintf("Ты — ведущий, твое слово — %s", ma.GetWord()),
+	// The word is shown to the host right away, so it is seen as with the "see word" button
+	word, err := ma.SeeWord()
+	if err != nil {
+		logFrom(ctx).Errorf("startNewGameHandlerCallback: cannot save state: %v", err)
+	}
+
+	respond(ctx, c, &tb.CallbackResponse{
+		Text:      fmt.Sprintf("Ты — ведущий, твое слово — %s", word),
 		ShowAlert: true,
 	})
-	bot.Send(
+	send(ctx,
 		m.Chat,
 		fmt.Sprintf(
 			`<a href="tg://user?id=%d">%s</a> объясняет слово`,
@@ -580,60 +728,109 @@ func startNewGameHandlerCallback(c *tb.Callback) {
 	)
 }
 
-func textHandler(m *tb.Message) {
-	textUpdatesRecieved++
-
-	ma := fabric.NewMachine(m.Chat.ID, m.ID)
+func textHandler(ctx context.Context, m *tb.Message) {
+	ma, err := newMachine(ctx, m.Chat.ID, m.ID)
+	if err != nil {
+		logFrom(ctx).Errorf("textHandler: cannot restore game in chat %d: %v", m.Chat.ID, err)
+		sendMessage(ctx, m.Chat, fallbackMessage)
+		return
+	}
 
 	if ma.GetHost() != m.Sender.ID || DEBUG {
 		username := strings.TrimSpace(m.Sender.FirstName + " " + m.Sender.LastName)
-		if word, ok := ma.CheckWordAndSetWinner(m.Text, m.Sender.ID, username); ok {
-			bot.Send(
-				m.Chat,
-				fmt.Sprintf(
-					"%s отгадал(а) слово <b>%s</b>",
-					username, word,
-				),
-				tb.ModeHTML,
-				&tb.ReplyMarkup{InlineKeyboard: newGameInlineKeys},
-			)
+		word, ok, err := ma.CheckWordAndSetWinner(m.Text, m.Sender.ID, username)
+		if err != nil {
+			logFrom(ctx).Errorf("textHandler: cannot check word in chat %d: %v", m.Chat.ID, err)
+		}
+
+		// The guess has not been accepted, the game goes on
+		if err != nil && !ok {
+			sendMessage(ctx, m.Chat, fallbackMessage)
+			return
+		}
+
+		if ok {
+			rememberUser(ctx, m.Sender)
+
+			if ma.IsDaily() {
+				send(ctx,
+					m.Chat,
+					fmt.Sprintf(
+						"%s отгадал(а) слово дня <b>%s</b> за %s",
+						username, word, formatDuration(ma.GetGuessedTime().Sub(ma.GetStartedTime())),
+					),
+					tb.ModeHTML,
+					&tb.ReplyMarkup{InlineKeyboard: newGameInlineKeys},
+				)
+			} else {
+				send(ctx,
+					m.Chat,
+					fmt.Sprintf(
+						"%s отгадал(а) слово <b>%s</b>",
+						username, word,
+					),
+					tb.ModeHTML,
+					&tb.ReplyMarkup{InlineKeyboard: newGameInlineKeys},
+				)
+			}
+
+			for _, a := range ma.GetAnnouncements() {
+				sendMessage(ctx, m.Chat, a)
+			}
+
+			if err != nil {
+				sendMessage(ctx, m.Chat, "Не получилось сохранить результат раунда, он не попадёт в рейтинг 😔")
+			}
 		}
 	}
 }
 
-func seeWordCallbackHandler(c *tb.Callback) {
-	m := fabric.NewMachine(c.Message.Chat.ID, c.Message.ID)
+func seeWordCallbackHandler(ctx context.Context, c *tb.Callback) {
+	m, err := newMachine(ctx, c.Message.Chat.ID, c.Message.ID)
+	if err != nil {
+		logFrom(ctx).Errorf("seeWordCallbackHandler: cannot restore game: %v", err)
+		respond(ctx, c, &tb.CallbackResponse{Text: fallbackMessage, ShowAlert: true})
+		return
+	}
 	var message string
 
 	if c.Sender.ID != m.GetHost() {
 		message = "Это слово предназначено не для тебя!"
 	} else {
-		message = m.GetWord()
+		message, err = m.SeeWord()
+		if err != nil {
+			logFrom(ctx).Errorf("seeWordCallbackHandler: cannot save state: %v", err)
+		}
 	}
 
-	bot.Respond(c, &tb.CallbackResponse{Text: message, ShowAlert: true})
+	respond(ctx, c, &tb.CallbackResponse{Text: message, ShowAlert: true})
 }
 
-func nextWordCallbackHandler(c *tb.Callback) {
-	m := fabric.NewMachine(c.Message.Chat.ID, c.Message.ID)
+func nextWordCallbackHandler(ctx context.Context, c *tb.Callback) {
+	m, err := newMachine(ctx, c.Message.Chat.ID, c.Message.ID)
+	if err != nil {
+		logFrom(ctx).Errorf("nextWordCallbackHandler: cannot restore game: %v", err)
+		respond(ctx, c, &tb.CallbackResponse{Text: fallbackMessage, ShowAlert: true})
+		return
+	}
 	var message string
-	var err error
 
 	if c.Sender.ID != m.GetHost() {
 		message = "Это слово предназначено не для тебя!"
 	} else {
 		message, err = m.SetNewRandomWord()
-		if err != nil {
-			log.Errorf("nextWordCallbackHandler: cannot get word: %v", err)
-			bot.Respond(c, &tb.CallbackResponse{Text: message, ShowAlert: true})
-			return
+		if errors.Is(err, crocodile.ErrDailyWordIsFixed) {
+			message = "Слово дня нельзя поменять!"
+		} else if err != nil {
+			logFrom(ctx).Errorf("nextWordCallbackHandler: cannot get word: %v", err)
+			message = fallbackMessage
 		}
 	}
 
-	bot.Respond(c, &tb.CallbackResponse{Text: message, ShowAlert: true})
+	respond(ctx, c, &tb.CallbackResponse{Text: message, ShowAlert: true})
 }
 
-func bindButtonsHandlers(bot *tb.Bot) {
+func bindButtonsHandlers(r *updateRouter) {
 	seeWord := tb.InlineButton{Unique: "see_word", Text: "Посмотреть слово"}
 	nextWord := tb.InlineButton{Unique: "next_word", Text: "Следующее слово"}
 	newGame := tb.InlineButton{Unique: "new_game", Text: "Хочу быть ведущим!"}
@@ -641,13 +838,13 @@ func bindButtonsHandlers(bot *tb.Bot) {
 	wordsInlineKeys = [][]tb.InlineButton{[]tb.InlineButton{seeWord}, []tb.InlineButton{nextWord}}
 	newGameInlineKeys = [][]tb.InlineButton{[]tb.InlineButton{newGame}}
 
-	bot.Handle(&newGame, logDurationCallback(mustLockCallback(startNewGameHandlerCallback)))
-	bot.Handle(&seeWord, logDurationCallback(mustLockCallback(seeWordCallbackHandler)))
-	bot.Handle(&nextWord, logDurationCallback(mustLockCallback(nextWordCallbackHandler)))
+	r.HandleButton(&newGame, logDurationCallback(mustLockCallback(startNewGameHandlerCallback)))
+	r.HandleButton(&seeWord, logDurationCallback(mustLockCallback(seeWordCallbackHandler)))
+	r.HandleButton(&nextWord, logDurationCallback(mustLockCallback(nextWordCallbackHandler)))
 }
 
-func rulesHandler(m *tb.Message) {
-	sendMessage(m.Chat, m.Chat.ID, `
+func rulesHandler(ctx context.Context, m *tb.Message) {
+	sendMessage(ctx, m.Chat, `
 <b>ПРАВИЛА ИГРЫ В КРОКОДИЛА</b>
 
 Есть ведущий и есть игроки, которые отгадывают слова.
@@ -655,21 +852,131 @@ func rulesHandler(m *tb.Message) {
 После нажатия /start@Crocodile_Game_Bot задача ведущего — нажать кнопку "Посмотреть слово" и объяснить его, не используя однокоренные слова.
 Если слово не нравится, то можно нажать "Следующее слово".
 Задача игроков — отгадать загаданное слово, для этого нужно просто писать их в чат, по одному слову в сообщении.
+
+Команда /daily начинает игру со <b>словом дня</b> — оно одинаковое во всех чатах. Чаты соревнуются, кто отгадает его быстрее: /dailyrating
 `)
 }
 
-func chatsRatingHandler(m *tb.Message) {
-	chatsRatingTotal++
+func chatsRatingHandler(ctx context.Context, m *tb.Message) {
 	rating, err := ratingGetter.GetChatsRating()
 	if err != nil {
-		log.Errorf("chatsRatingHandler: cannot get rating %v:", err)
+		logFrom(ctx).Errorf("chatsRatingHandler: cannot get rating %v:", err)
+		sendMessage(ctx, m.Chat, fallbackMessage)
 		return
 	}
 
 	ratingString := buildRatingChatStatistics("Топ-25 <b>чатов по количеству игр в крокодила</b>🐊", rating)
 
-	err = sendMessage(m.Chat, m.Chat.ID, ratingString)
+	err = sendMessage(ctx, m.Chat, ratingString)
+	if err != nil {
+		logFrom(ctx).Errorf("chatsRatingHandler: cannot send rating: %v", err)
+	}
+}
+
+// formatDuration formats d as mm:ss.000, hours are added in front for long rounds
+func formatDuration(d time.Duration) string {
+	ms := d.Milliseconds()
+	h, m, s, ms := ms/3600000, ms/60000%60, ms/1000%60, ms%1000
+	if h > 0 {
+		return fmt.Sprintf("%d:%02d:%02d.%03d", h, m, s, ms)
+	}
+	return fmt.Sprintf("%02d:%02d.%03d", m, s, ms)
+}
+
+func dailyRatingHandler(ctx context.Context, m *tb.Message) {
+	rating, err := ratingGetter.GetDailyRating(time.Now())
+	if err != nil {
+		logFrom(ctx).Errorf("dailyRatingHandler: cannot get rating %v:", err)
+		sendMessage(ctx, m.Chat, fallbackMessage)
+		return
+	}
+
+	ratingString := buildRatingDaily("Самые быстрые отгадавшие <b>слово дня</b> 🐊", rating)
+
+	err = sendMessage(ctx, m.Chat, ratingString)
 	if err != nil {
-		log.Errorf("chatsRatingHandler: cannot send rating: %v", err)
+		logFrom(ctx).Errorf("dailyRatingHandler: cannot send rating: %v", err)
+	}
+}
+
+func buildRatingDaily(header string, data []model.DailyResult) string {
+	if len(data) < 1 {
+		return "Сегодня слово дня еще никто не отгадал! Начните игру: /daily"
+	}
+
+	out := header + "\n\n"
+	for k, v := range data {
+		out += fmt.Sprintf(
+			"<b>%d</b>. %s (%s) — %s\n",
+			k+1,
+			html.EscapeString(v.UserName),
+			html.EscapeString(v.ChatTitle),
+			formatDuration(time.Duration(v.DurationMs)*time.Millisecond),
+		)
+	}
+
+	return out
+}
+
+func achievementsHandler(ctx context.Context, m *tb.Message) {
+	user := m.Sender
+	if m.ReplyTo != nil && m.ReplyTo.Sender != nil {
+		user = m.ReplyTo.Sender
 	}
+
+	out, err := achievementsEngine.Describe(user.ID, strings.TrimSpace(user.FirstName+" "+user.LastName))
+	if err != nil {
+		logFrom(ctx).Errorf("achievementsHandler: cannot get achievements %v:", err)
+		sendMessage(ctx, m.Chat, fallbackMessage)
+		return
+	}
+
+	err = sendMessage(ctx, m.Chat, out)
+	if err != nil {
+		logFrom(ctx).Errorf("achievementsHandler: cannot send achievements: %v", err)
+	}
+}
+
+// sendSkillRating sends Elo ratings of guessers and hosts, chatID == 0 means global rating
+func sendSkillRating(ctx context.Context, m *tb.Message, chatID int64, where string) {
+	guessers, err := ratingGetter.GetSkillRating(chatID, model.RoleGuesser)
+	if err != nil {
+		logFrom(ctx).Errorf("sendSkillRating: cannot get guessers rating %v:", err)
+		sendMessage(ctx, m.Chat, fallbackMessage)
+		return
+	}
+	hosts, err := ratingGetter.GetSkillRating(chatID, model.RoleHost)
+	if err != nil {
+		logFrom(ctx).Errorf("sendSkillRating: cannot get hosts rating %v:", err)
+		sendMessage(ctx, m.Chat, fallbackMessage)
+		return
+	}
+
+	out := buildSkillRating("Топ-25 <b>отгадывающих по мастерству</b> "+where+" 🐊", guessers)
+	out += "\n" + buildSkillRating("Топ-25 <b>ведущих по мастерству</b> "+where+" 🐊", hosts)
+
+	err = sendMessage(ctx, m.Chat, out)
+	if err != nil {
+		logFrom(ctx).Errorf("sendSkillRating: cannot send rating: %v", err)
+	}
+}
+
+func buildSkillRating(header string, data []model.SkillRating) string {
+	if len(data) < 1 {
+		return header + "\n\nДанных пока недостаточно!\n"
+	}
+
+	out := header + "\n\n"
+	for k, v := range data {
+		out += fmt.Sprintf(
+			"<b>%d</b>. %s — %.0f (%d %s)\n",
+			k+1,
+			html.EscapeString(v.Name),
+			v.Rating,
+			v.Games,
+			utils.DetectCaseForGames(v.Games),
+		)
+	}
+
+	return out
 }
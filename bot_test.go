@@ -0,0 +1,22 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFormatDuration(t *testing.T) {
+	for _, tc := range []struct {
+		d        time.Duration
+		expected string
+	}{
+		{1500 * time.Millisecond, "00:01.500"},
+		{59*time.Minute + 59*time.Second, "59:59.000"},
+		{time.Hour + 2*time.Minute + 3*time.Second + 4*time.Millisecond, "1:02:03.004"},
+		{26 * time.Hour, "26:00:00.000"},
+	} {
+		if got := formatDuration(tc.d); got != tc.expected {
+			t.Errorf("formatDuration(%v): got %q, expected %q", tc.d, got, tc.expected)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+/*
+ * This file is part of Crocodile Game Bot.
+ * Copyright (C) 2019  Viktor
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+// ChatMigrator moves everything of the chat to another chat ID
+type ChatMigrator interface {
+	MigrateChat(from, to int64) error
+}
+
+var chatMigrator ChatMigrator
+
+// migrateChat moves rating, the game and limits of the chat, e.g. when a group
+// has been upgraded to a supergroup. Both chats are locked, so no game is saved meanwhile.
+func migrateChat(ctx context.Context, from, to int64) error {
+	if from == to {
+		return fmt.Errorf("chat %d cannot be merged into itself", from)
+	}
+
+	// The same order of locks in all replicas avoids deadlocks
+	first, second := from, to
+	if first > second {
+		first, second = second, first
+	}
+	for _, chatID := range []int64{first, second} {
+		lock, err := chatLocker.Lock(chatID)
+		if err != nil {
+			return fmt.Errorf("cannot lock chat %d: %v", chatID, err)
+		}
+		defer lock.Unlock()
+	}
+
+	if err := chatMigrator.MigrateChat(from, to); err != nil {
+		return err
+	}
+	rateLimiter.MigrateChat(from, to)
+
+	if fabric.Cache != nil {
+		fabric.Cache.Forget(from)
+		fabric.Cache.Forget(to)
+	}
+
+	logFrom(ctx).Infof("migrateChat: chat %d has been moved to %d", from, to)
+	return nil
+}
+
+// Telegram sends migrate_to_chat_id to the old group and migrate_from_chat_id to the new supergroup,
+// the second migration finds nothing to move
+func chatMigrationHandler(ctx context.Context, m *tb.Message) {
+	from, to := m.Chat.ID, m.MigrateTo
+	if m.MigrateFrom != 0 {
+		from, to = m.MigrateFrom, m.Chat.ID
+	}
+
+	if err := migrateChat(ctx, from, to); err != nil {
+		logFrom(ctx).Errorf("chatMigrationHandler: cannot move chat %d to %d: %v", from, to, err)
+	}
+}
+
+// mergeChatsHandler merges chats manually: /mergechats <from> <to>
+func mergeChatsHandler(ctx context.Context, m *tb.Message) {
+	args := strings.Fields(m.Payload)
+	if len(args) != 2 {
+		sendMessage(ctx, m.Chat, "Использование: /mergechats <откуда> <куда>")
+		return
+	}
+
+	from, errFrom := strconv.ParseInt(args[0], 10, 64)
+	to, errTo := strconv.ParseInt(args[1], 10, 64)
+	if errFrom != nil || errTo != nil {
+		sendMessage(ctx, m.Chat, "ID чатов должны быть числами")
+		return
+	}
+
+	if err := migrateChat(ctx, from, to); err != nil {
+		logFrom(ctx).Errorf("mergeChatsHandler: cannot move chat %d to %d: %v", from, to, err)
+		sendMessage(ctx, m.Chat, fallbackMessage)
+		return
+	}
+	sendMessage(ctx, m.Chat, fmt.Sprintf("Чат %d перенесён в %d", from, to))
+}
@@ -0,0 +1,68 @@
+/*
+ * This file is part of Crocodile Game Bot.
+ * Copyright (C) 2019  Viktor
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/nuetoban/crocodile-game-bot/config"
+)
+
+const configUsage = "usage: crocodile-server config check [FILE]"
+
+// loadConfig loads the file from CROCODILE_GAME_CONFIG if it is set, environment variables override it
+func loadConfig(path string) (config.Config, error) {
+	if path == "" {
+		path = os.Getenv("CROCODILE_GAME_CONFIG")
+	}
+	return config.Load(path, os.Environ())
+}
+
+// configCommand runs `crocodile-server config check` subcommand, it prints
+// the effective config with secrets masked and fails if the config is invalid
+func configCommand(args []string) error {
+	if len(args) == 0 || args[0] != "check" || len(args) > 2 {
+		return fmt.Errorf(configUsage)
+	}
+
+	path := ""
+	if len(args) == 2 {
+		path = args[1]
+	}
+	c, err := loadConfig(path)
+	if err != nil {
+		return err
+	}
+
+	out, err := yaml.Marshal(c.Masked())
+	if err != nil {
+		return err
+	}
+	fmt.Print(string(out))
+
+	if errs, ok := c.Validate().(config.Errors); ok {
+		for _, err := range errs {
+			fmt.Fprintln(os.Stderr, "error:", err)
+		}
+		return fmt.Errorf("config is invalid")
+	}
+	return nil
+}
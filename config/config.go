@@ -0,0 +1,499 @@
+/*
+ * This file is part of Crocodile Game Bot.
+ * Copyright (C) 2019  Viktor
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+// Package config loads settings of the bot from a YAML or TOML file and environment variables.
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is everything the bot may be configured with
+type Config struct {
+	Bot        Bot        `yaml:"bot" toml:"bot"`
+	Database   Database   `yaml:"database" toml:"database"`
+	Redis      Redis      `yaml:"redis" toml:"redis"`
+	Server     Server     `yaml:"server" toml:"server"`
+	Dispatcher Dispatcher `yaml:"dispatcher" toml:"dispatcher"`
+	Log        Log        `yaml:"log" toml:"log"`
+	Tracing    Tracing    `yaml:"tracing" toml:"tracing"`
+	Admin      Admin      `yaml:"admin" toml:"admin"`
+}
+
+// Bot configures the game itself
+type Bot struct {
+	Token string `yaml:"token" toml:"token"`
+
+	// Admins are user IDs allowed to run admin commands
+	Admins []int `yaml:"admins" toml:"admins"`
+
+	// Webhook is used instead of long polling when its public URL is set
+	Webhook     Webhook       `yaml:"webhook" toml:"webhook"`
+	PollTimeout time.Duration `yaml:"poll_timeout" toml:"poll_timeout"`
+
+	// Dev lets the host guess own words and enables trace logs
+	Dev bool `yaml:"dev" toml:"dev"`
+
+	// MachineCache is how many games are kept in memory, 0 disables the cache
+	MachineCache int `yaml:"machine_cache" toml:"machine_cache"`
+
+	// Locker is "redis" or "local", local locks are enough for one replica only
+	Locker string `yaml:"locker" toml:"locker"`
+
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" toml:"shutdown_timeout"`
+
+	// HealthMaxIdle is how long the bot may get no updates before /healthz fails, 0 disables the check.
+	// Kubernetes restarts the bot when /healthz fails, so it is disabled by default.
+	HealthMaxIdle time.Duration `yaml:"health_max_idle" toml:"health_max_idle"`
+
+	// StatsInterval is how often totals of the bot are queried for metrics
+	StatsInterval time.Duration `yaml:"stats_interval" toml:"stats_interval"`
+}
+
+// Webhook configures the server Telegram sends updates to
+type Webhook struct {
+	PublicURL string `yaml:"public_url" toml:"public_url"`
+	Listen    string `yaml:"listen" toml:"listen"`
+}
+
+// Database configures Postgres or SQLite
+type Database struct {
+	// Driver is "postgres" or "sqlite", SQLite keeps everything in one file without Redis
+	Driver string `yaml:"driver" toml:"driver"`
+
+	Host     string `yaml:"host" toml:"host"`
+	Port     int    `yaml:"port" toml:"port"`
+	User     string `yaml:"user" toml:"user"`
+	Password string `yaml:"password" toml:"password"`
+	Name     string `yaml:"name" toml:"name"`
+
+	// Params are added to the connection string, e.g. sslmode
+	Params map[string]string `yaml:"params" toml:"params"`
+
+	SQLitePath string `yaml:"sqlite_path" toml:"sqlite_path"`
+
+	// AutoMigrate applies migrations on start, they are always applied to SQLite
+	AutoMigrate bool `yaml:"auto_migrate" toml:"auto_migrate"`
+}
+
+// Redis configures a single Redis, Sentinel or Cluster, only one of them is used
+type Redis struct {
+	Addr           string   `yaml:"addr" toml:"addr"`
+	Sentinels      []string `yaml:"sentinels" toml:"sentinels"`
+	SentinelMaster string   `yaml:"sentinel_master" toml:"sentinel_master"`
+	Cluster        []string `yaml:"cluster" toml:"cluster"`
+	Password       string   `yaml:"password" toml:"password"`
+
+	// Timeouts of connecting, reading and writing, 0 means no timeout
+	ConnectTimeout time.Duration `yaml:"connect_timeout" toml:"connect_timeout"`
+	ReadTimeout    time.Duration `yaml:"read_timeout" toml:"read_timeout"`
+	WriteTimeout   time.Duration `yaml:"write_timeout" toml:"write_timeout"`
+}
+
+// Server configures the server of metrics and health checks
+type Server struct {
+	Listen string `yaml:"listen" toml:"listen"`
+}
+
+// Dispatcher configures workers handling updates
+type Dispatcher struct {
+	Workers     int `yaml:"workers" toml:"workers"`
+	WorkerQueue int `yaml:"worker_queue" toml:"worker_queue"`
+	ChatQueue   int `yaml:"chat_queue" toml:"chat_queue"`
+}
+
+// Log configures log lines
+type Log struct {
+	// Level is TRACE, DEBUG, INFO, WARN, ERROR, FATAL or PANIC, INFO by default and TRACE in dev mode
+	Level string `yaml:"level" toml:"level"`
+
+	// Format is "text" or "json"
+	Format string `yaml:"format" toml:"format"`
+}
+
+// Tracing configures OpenTelemetry
+type Tracing struct {
+	// Exporter is "off" or "otlp", the collector is taken from OTEL_EXPORTER_OTLP_* variables
+	Exporter string `yaml:"exporter" toml:"exporter"`
+}
+
+// Admin configures the admin API on the server of metrics
+type Admin struct {
+	// Token authenticates requests, the API is disabled when it is empty
+	Token string `yaml:"token" toml:"token"`
+
+	// SyncInterval is how often bans and the dictionary changed by other replicas are loaded
+	SyncInterval time.Duration `yaml:"sync_interval" toml:"sync_interval"`
+}
+
+// Default returns the config used when nothing is set
+func Default() Config {
+	return Config{
+		Bot: Bot{
+			Webhook:         Webhook{Listen: "0.0.0.0:9999"},
+			PollTimeout:     5 * time.Second,
+			MachineCache:    10000,
+			Locker:          "redis",
+			ShutdownTimeout: 30 * time.Second,
+			StatsInterval:   time.Minute,
+		},
+		Database: Database{
+			Driver:     "postgres",
+			Port:       5432,
+			SQLitePath: "crocodile.db",
+		},
+		Redis: Redis{
+			Addr:           ":6379",
+			SentinelMaster: "mymaster",
+			ConnectTimeout: 2 * time.Second,
+			ReadTimeout:    2 * time.Second,
+			WriteTimeout:   2 * time.Second,
+		},
+		Server:     Server{Listen: ":8080"},
+		Dispatcher: Dispatcher{Workers: 64, WorkerQueue: 1000, ChatQueue: 100},
+		Log:        Log{Format: "text"},
+		Tracing:    Tracing{Exporter: "off"},
+		Admin:      Admin{SyncInterval: time.Minute},
+	}
+}
+
+// Load reads the file if path is not empty, then applies environment variables
+// in the "NAME=value" form of os.Environ. The result is not validated.
+func Load(path string, environ []string) (Config, error) {
+	c := Default()
+	if path != "" {
+		if err := c.loadFile(path); err != nil {
+			return c, err
+		}
+	}
+	return c, c.applyEnv(environ)
+}
+
+// loadFile decodes YAML or TOML file depending on its extension
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		err = dec.Decode(c)
+	case ".toml":
+		var md toml.MetaData
+		md, err = toml.Decode(string(data), c)
+		if err == nil && len(md.Undecoded()) > 0 {
+			err = fmt.Errorf("unknown keys %v", md.Undecoded())
+		}
+	default:
+		return fmt.Errorf("config %s: unknown format %q, expected .yaml, .yml or .toml", path, ext)
+	}
+	if err != nil {
+		return fmt.Errorf("config %s: %v", path, err)
+	}
+	return nil
+}
+
+// dbPrefix is the prefix of database variables, unknown ones are added to the connection string
+const dbPrefix = "CROCODILE_GAME_DB_"
+
+// env binds environment variables to fields of the config
+func (c *Config) env() map[string]func(string) error {
+	return map[string]func(string) error{
+		"CROCODILE_GAME_BOT_TOKEN":        setString(&c.Bot.Token),
+		"CROCODILE_GAME_ADMINS":           setInts(&c.Bot.Admins),
+		"CROCODILE_GAME_WEBHOOK":          setString(&c.Bot.Webhook.PublicURL),
+		"CROCODILE_GAME_WEBHOOK_LISTEN":   setString(&c.Bot.Webhook.Listen),
+		"CROCODILE_GAME_DEV":              setBool(&c.Bot.Dev),
+		"CROCODILE_GAME_MACHINE_CACHE":    setInt(&c.Bot.MachineCache),
+		"CROCODILE_GAME_LOCKER":           setString(&c.Bot.Locker),
+		"CROCODILE_GAME_SHUTDOWN_TIMEOUT": setDuration(&c.Bot.ShutdownTimeout),
+		"CROCODILE_GAME_HEALTH_MAX_IDLE":  setDuration(&c.Bot.HealthMaxIdle),
+		"CROCODILE_GAME_STATS_INTERVAL":   setDuration(&c.Bot.StatsInterval),
+
+		"CROCODILE_GAME_STORAGE":      setString(&c.Database.Driver),
+		dbPrefix + "HOST":             setString(&c.Database.Host),
+		dbPrefix + "PORT":             setInt(&c.Database.Port),
+		dbPrefix + "USER":             setString(&c.Database.User),
+		dbPrefix + "PASS":             setString(&c.Database.Password),
+		dbPrefix + "NAME":             setString(&c.Database.Name),
+		"CROCODILE_GAME_SQLITE_PATH":  setString(&c.Database.SQLitePath),
+		"CROCODILE_GAME_AUTO_MIGRATE": setBool(&c.Database.AutoMigrate),
+
+		"REDIS_HOST":            setString(&c.Redis.Addr),
+		"REDIS_SENTINELS":       setList(&c.Redis.Sentinels),
+		"REDIS_SENTINEL_MASTER": setString(&c.Redis.SentinelMaster),
+		"REDIS_CLUSTER":         setList(&c.Redis.Cluster),
+		"REDIS_PASSWORD":        setString(&c.Redis.Password),
+		"REDIS_CONNECT_TIMEOUT": setDuration(&c.Redis.ConnectTimeout),
+		"REDIS_READ_TIMEOUT":    setDuration(&c.Redis.ReadTimeout),
+		"REDIS_WRITE_TIMEOUT":   setDuration(&c.Redis.WriteTimeout),
+
+		"CROCODILE_GAME_LISTEN":       setString(&c.Server.Listen),
+		"CROCODILE_GAME_WORKERS":      setInt(&c.Dispatcher.Workers),
+		"CROCODILE_GAME_WORKER_QUEUE": setInt(&c.Dispatcher.WorkerQueue),
+		"CROCODILE_GAME_CHAT_QUEUE":   setInt(&c.Dispatcher.ChatQueue),
+		"CROCODILE_GAME_LOGLEVEL":     setString(&c.Log.Level),
+		"CROCODILE_GAME_LOG_FORMAT":   setString(&c.Log.Format),
+		"CROCODILE_GAME_TRACING":      setString(&c.Tracing.Exporter),
+
+		"CROCODILE_GAME_ADMIN_TOKEN":         setString(&c.Admin.Token),
+		"CROCODILE_GAME_ADMIN_SYNC_INTERVAL": setDuration(&c.Admin.SyncInterval),
+	}
+}
+
+// applyEnv overrides the config with variables which are set and not empty
+func (c *Config) applyEnv(environ []string) error {
+	vars := c.env()
+	var errs Errors
+	for _, kv := range environ {
+		// Values may contain "=" themselves
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			continue
+		}
+		name, v := parts[0], parts[1]
+
+		if set, ok := vars[name]; ok {
+			if err := set(v); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %v", name, err))
+			}
+			continue
+		}
+		if strings.HasPrefix(name, dbPrefix) {
+			if c.Database.Params == nil {
+				c.Database.Params = make(map[string]string)
+			}
+			c.Database.Params[strings.ToLower(strings.TrimPrefix(name, dbPrefix))] = v
+		}
+	}
+	return errs.err()
+}
+
+func setString(p *string) func(string) error {
+	return func(v string) error {
+		*p = v
+		return nil
+	}
+}
+
+func setInt(p *int) func(string) error {
+	return func(v string) (err error) {
+		*p, err = strconv.Atoi(v)
+		return err
+	}
+}
+
+func setBool(p *bool) func(string) error {
+	return func(v string) (err error) {
+		*p, err = strconv.ParseBool(v)
+		return err
+	}
+}
+
+func setDuration(p *time.Duration) func(string) error {
+	return func(v string) (err error) {
+		*p, err = time.ParseDuration(v)
+		return err
+	}
+}
+
+func setList(p *[]string) func(string) error {
+	return func(v string) error {
+		*p = nil
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				*p = append(*p, s)
+			}
+		}
+		return nil
+	}
+}
+
+func setInts(p *[]int) func(string) error {
+	return func(v string) error {
+		var list []string
+		setList(&list)(v)
+
+		*p = nil
+		for _, s := range list {
+			n, err := strconv.Atoi(s)
+			if err != nil {
+				return fmt.Errorf("wrong number %q", s)
+			}
+			*p = append(*p, n)
+		}
+		return nil
+	}
+}
+
+// Errors are all problems of the config
+type Errors []error
+
+func (e Errors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (e Errors) err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+var logLevels = map[string]bool{"": true, "TRACE": true, "DEBUG": true, "INFO": true, "WARN": true, "ERROR": true, "FATAL": true, "PANIC": true}
+
+type checker struct{ errs Errors }
+
+func (c *checker) check(ok bool, format string, args ...interface{}) {
+	if !ok {
+		c.errs = append(c.errs, fmt.Errorf(format, args...))
+	}
+}
+
+// Validate returns Errors describing every wrong value
+func (c Config) Validate() error {
+	ch := &checker{}
+	check := ch.check
+
+	check(c.Bot.Token != "", "bot.token is required")
+	for _, id := range c.Bot.Admins {
+		check(id > 0, "bot.admins: wrong user ID %d", id)
+	}
+	if c.Bot.Webhook.PublicURL != "" {
+		u, err := url.Parse(c.Bot.Webhook.PublicURL)
+		check(err == nil && u.Scheme == "https" && u.Host != "", "bot.webhook.public_url must be https URL, got %q", c.Bot.Webhook.PublicURL)
+		check(validAddr(c.Bot.Webhook.Listen), "bot.webhook.listen must be host:port, got %q", c.Bot.Webhook.Listen)
+	}
+	check(c.Bot.PollTimeout > 0, "bot.poll_timeout must be positive")
+	check(c.Bot.MachineCache >= 0, "bot.machine_cache must not be negative")
+	check(c.Bot.Locker == "redis" || c.Bot.Locker == "local", "bot.locker must be redis or local, got %q", c.Bot.Locker)
+	check(c.Bot.ShutdownTimeout > 0, "bot.shutdown_timeout must be positive")
+	check(c.Bot.HealthMaxIdle >= 0, "bot.health_max_idle must not be negative")
+	check(c.Bot.StatsInterval > 0, "bot.stats_interval must be positive")
+
+	c.checkDatabase(ch)
+	if !c.SQLite() {
+		check(len(c.Redis.Sentinels) == 0 || len(c.Redis.Cluster) == 0, "redis.sentinels and redis.cluster cannot be used together")
+		if len(c.Redis.Sentinels) == 0 && len(c.Redis.Cluster) == 0 {
+			check(validAddr(c.Redis.Addr), "redis.addr must be host:port, got %q", c.Redis.Addr)
+		}
+		check(c.Redis.ConnectTimeout >= 0, "redis.connect_timeout must not be negative")
+		check(c.Redis.ReadTimeout >= 0, "redis.read_timeout must not be negative")
+		check(c.Redis.WriteTimeout >= 0, "redis.write_timeout must not be negative")
+	}
+
+	check(validAddr(c.Server.Listen), "server.listen must be host:port, got %q", c.Server.Listen)
+	check(c.Dispatcher.Workers > 0, "dispatcher.workers must be positive")
+	check(c.Dispatcher.WorkerQueue > 0, "dispatcher.worker_queue must be positive")
+	check(c.Dispatcher.ChatQueue > 0, "dispatcher.chat_queue must be positive")
+	check(logLevels[c.Log.Level], "log.level is unknown: %q", c.Log.Level)
+	check(c.Log.Format == "text" || c.Log.Format == "json", "log.format must be text or json, got %q", c.Log.Format)
+	check(c.Tracing.Exporter == "off" || c.Tracing.Exporter == "otlp", "tracing.exporter must be off or otlp, got %q", c.Tracing.Exporter)
+	check(c.Admin.SyncInterval > 0, "admin.sync_interval must be positive")
+
+	return ch.errs.err()
+}
+
+// ValidateDatabase checks only the database, it is enough for migrations
+func (c Config) ValidateDatabase() error {
+	ch := &checker{}
+	c.checkDatabase(ch)
+	return ch.errs.err()
+}
+
+func (c Config) checkDatabase(ch *checker) {
+	check := ch.check
+	switch c.Database.Driver {
+	case "postgres":
+		check(c.Database.Host != "", "database.host is required")
+		check(c.Database.Port > 0 && c.Database.Port < 65536, "database.port must be in 1-65535, got %d", c.Database.Port)
+		check(c.Database.User != "", "database.user is required")
+		check(c.Database.Name != "", "database.name is required")
+	case "sqlite":
+		check(c.Database.SQLitePath != "", "database.sqlite_path is required")
+	default:
+		check(false, "database.driver must be postgres or sqlite, got %q", c.Database.Driver)
+	}
+}
+
+func validAddr(addr string) bool {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	n, err := strconv.Atoi(port)
+	return err == nil && n > 0 && n < 65536
+}
+
+// LogLevel returns the level of logs, TRACE in dev mode unless it is set
+func (c Config) LogLevel() string {
+	switch {
+	case c.Log.Level != "":
+		return c.Log.Level
+	case c.Bot.Dev:
+		return "TRACE"
+	}
+	return "INFO"
+}
+
+// SQLite is true when the bot runs without Postgres and Redis
+func (c Config) SQLite() bool { return c.Database.Driver == "sqlite" }
+
+const mask = "********"
+
+// Masked returns the config with secrets replaced, so it may be printed
+func (c Config) Masked() Config {
+	if c.Bot.Token != "" {
+		// The token is often a part of the webhook path
+		c.Bot.Webhook.PublicURL = strings.ReplaceAll(c.Bot.Webhook.PublicURL, c.Bot.Token, mask)
+	}
+	for _, s := range []*string{&c.Bot.Token, &c.Database.Password, &c.Redis.Password, &c.Admin.Token} {
+		if *s != "" {
+			*s = mask
+		}
+	}
+
+	params := make(map[string]string, len(c.Database.Params))
+	for k, v := range c.Database.Params {
+		if strings.Contains(k, "pass") || strings.Contains(k, "key") {
+			v = mask
+		}
+		params[k] = v
+	}
+	if c.Database.Params != nil {
+		c.Database.Params = params
+	}
+	return c
+}
@@ -0,0 +1,186 @@
+/*
+ * This file is part of Crocodile Game Bot.
+ * Copyright (C) 2019  Viktor
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, name, data string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadYAML(t *testing.T) {
+	path := writeFile(t, "config.yaml", `
+bot:
+  token: "123:abc"
+  admins: [1, 2]
+  poll_timeout: 10s
+database:
+  host: db
+  user: crocodile
+  name: crocodile
+  params:
+    sslmode: disable
+redis:
+  sentinels: [a:26379, b:26379]
+`)
+	c, err := Load(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Bot.Token != "123:abc" || !reflect.DeepEqual(c.Bot.Admins, []int{1, 2}) {
+		t.Errorf("Got token %q and admins %v", c.Bot.Token, c.Bot.Admins)
+	}
+	if c.Bot.PollTimeout != 10*time.Second {
+		t.Errorf("Got poll timeout %v, want 10s", c.Bot.PollTimeout)
+	}
+	if c.Database.Params["sslmode"] != "disable" || len(c.Redis.Sentinels) != 2 {
+		t.Errorf("Got params %v and sentinels %v", c.Database.Params, c.Redis.Sentinels)
+	}
+	// Values missing in the file are defaults
+	if c.Database.Port != 5432 || c.Server.Listen != ":8080" {
+		t.Errorf("Got port %d and listen %q, want defaults", c.Database.Port, c.Server.Listen)
+	}
+	if err := c.Validate(); err != nil {
+		t.Errorf("Valid config: %v", err)
+	}
+}
+
+func TestLoadTOML(t *testing.T) {
+	path := writeFile(t, "config.toml", `
+[bot]
+token = "123:abc"
+shutdown_timeout = "1m"
+
+[database]
+driver = "sqlite"
+sqlite_path = "/data/crocodile.db"
+`)
+	c, err := Load(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Bot.ShutdownTimeout != time.Minute || !c.SQLite() || c.Database.SQLitePath != "/data/crocodile.db" {
+		t.Errorf("Got %+v", c)
+	}
+	if err := c.Validate(); err != nil {
+		t.Errorf("Valid config: %v", err)
+	}
+}
+
+func TestLoadUnknownKey(t *testing.T) {
+	for name, data := range map[string]string{
+		"config.yaml": "bot:\n  tokn: x\n",
+		"config.toml": "[bot]\ntokn = \"x\"\n",
+	} {
+		if _, err := Load(writeFile(t, name, data), nil); err == nil {
+			t.Errorf("%s: misspelled key is accepted", name)
+		}
+	}
+}
+
+func TestEnvOverridesFile(t *testing.T) {
+	path := writeFile(t, "config.yaml", "database:\n  host: db\n  password: file\n")
+	c, err := Load(path, []string{
+		"CROCODILE_GAME_DB_HOST=",
+		"CROCODILE_GAME_DB_PASS=a=b",
+		"CROCODILE_GAME_DB_SSLMODE=require",
+		"CROCODILE_GAME_ADMINS=1, 2",
+		"CROCODILE_GAME_HEALTH_MAX_IDLE=5m",
+		"PATH=/bin",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Empty variables are ignored
+	if c.Database.Host != "db" {
+		t.Errorf("Got host %q, want db", c.Database.Host)
+	}
+	if c.Database.Password != "a=b" {
+		t.Errorf("Got password %q, want a=b", c.Database.Password)
+	}
+	if c.Database.Params["sslmode"] != "require" {
+		t.Errorf("Got params %v, want sslmode", c.Database.Params)
+	}
+	if !reflect.DeepEqual(c.Bot.Admins, []int{1, 2}) || c.Bot.HealthMaxIdle != 5*time.Minute {
+		t.Errorf("Got admins %v and max idle %v", c.Bot.Admins, c.Bot.HealthMaxIdle)
+	}
+}
+
+func TestEnvErrors(t *testing.T) {
+	_, err := Load("", []string{"CROCODILE_GAME_WORKERS=many", "CROCODILE_GAME_STATS_INTERVAL=1"})
+	errs, ok := err.(Errors)
+	if !ok || len(errs) != 2 {
+		t.Errorf("Got %v, want both variables reported", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	c := Default()
+	c.Bot.Webhook.PublicURL = "http://example.com"
+	c.Bot.Locker = "etcd"
+	c.Dispatcher.Workers = 0
+
+	errs, ok := c.Validate().(Errors)
+	if !ok {
+		t.Fatalf("Invalid config is valid")
+	}
+	msg := errs.Error()
+	for _, field := range []string{"bot.token", "bot.webhook.public_url", "bot.locker", "database.host", "dispatcher.workers"} {
+		if !strings.Contains(msg, field) {
+			t.Errorf("%s is not reported: %s", field, msg)
+		}
+	}
+
+	if err := c.ValidateDatabase(); err == nil || strings.Contains(err.Error(), "bot.") {
+		t.Errorf("ValidateDatabase: %v", err)
+	}
+}
+
+func TestMasked(t *testing.T) {
+	c := Default()
+	c.Bot.Token = "123:abc"
+	c.Bot.Webhook.PublicURL = "https://example.com/123:abc"
+	c.Database.Password = "secret"
+	c.Admin.Token = "admin"
+	c.Database.Params = map[string]string{"sslmode": "require", "sslpassword": "secret"}
+
+	m := c.Masked()
+	if m.Bot.Token != mask || m.Database.Password != mask || m.Database.Params["sslpassword"] != mask || m.Admin.Token != mask {
+		t.Errorf("Secrets are not masked: %+v", m)
+	}
+	if m.Bot.Webhook.PublicURL != "https://example.com/"+mask {
+		t.Errorf("Got webhook %q, want the token masked", m.Bot.Webhook.PublicURL)
+	}
+	if m.Database.Params["sslmode"] != "require" || c.Database.Params["sslpassword"] != "secret" {
+		t.Errorf("Masked changed other values or the original config")
+	}
+}
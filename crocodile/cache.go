@@ -0,0 +1,125 @@
+/*
+ * This file is part of Crocodile Game Bot.
+ * Copyright (C) 2019  Viktor
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package crocodile
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// MachineCache is bounded LRU cache of machines, so messages in chats
+// do not have to restore the machine from the storage every time
+type MachineCache struct {
+	size int
+	ttl  time.Duration
+
+	mu      sync.Mutex
+	order   *list.List
+	entries map[int64]*list.Element
+
+	// Allows to fake time in tests
+	now func() time.Time
+}
+
+type cacheEntry struct {
+	machine *Machine
+	added   time.Time
+}
+
+// NewMachineCache returns cache keeping up to size machines, every machine
+// is restored from the storage again after ttl in case invalidation has been missed
+func NewMachineCache(size int, ttl time.Duration) *MachineCache {
+	return &MachineCache{
+		size:    size,
+		ttl:     ttl,
+		order:   list.New(),
+		entries: make(map[int64]*list.Element),
+		now:     time.Now,
+	}
+}
+
+// Get returns cached machine of the chat
+func (c *MachineCache) Get(chatID int64) (*Machine, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[chatID]
+	if !ok {
+		return nil, false
+	}
+
+	entry := el.Value.(*cacheEntry)
+	if c.ttl > 0 && c.now().Sub(entry.added) > c.ttl {
+		c.remove(el)
+		return nil, false
+	}
+
+	c.order.MoveToFront(el)
+	return entry.machine, true
+}
+
+// Add puts the machine to the cache evicting the least recently used one if the cache is full
+func (c *MachineCache) Add(m *Machine) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[m.ChatID]; ok {
+		el.Value = &cacheEntry{machine: m, added: c.now()}
+		c.order.MoveToFront(el)
+		return
+	}
+
+	c.entries[m.ChatID] = c.order.PushFront(&cacheEntry{machine: m, added: c.now()})
+	for c.size > 0 && c.order.Len() > c.size {
+		c.remove(c.order.Back())
+	}
+}
+
+// Forget removes machine of the chat, e.g. when it has been changed by another replica
+func (c *MachineCache) Forget(chatID int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[chatID]; ok {
+		c.remove(el)
+	}
+}
+
+// ForgetAll removes all machines
+func (c *MachineCache) ForgetAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.order.Init()
+	c.entries = make(map[int64]*list.Element)
+}
+
+// Len returns count of cached machines
+func (c *MachineCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.order.Len()
+}
+
+func (c *MachineCache) remove(el *list.Element) {
+	c.order.Remove(el)
+	delete(c.entries, el.Value.(*cacheEntry).machine.ChatID)
+}
@@ -0,0 +1,256 @@
+/*
+ * This file is part of Crocodile Game Bot.
+ * Copyright (C) 2019  Viktor
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package crocodile
+
+import (
+	"errors"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/nuetoban/crocodile-game-bot/model"
+)
+
+func discardLogger() *logrus.Logger {
+	l := logrus.New()
+	l.Out = ioutil.Discard
+	return l
+}
+
+type fakeStorage struct {
+	lookups int
+	saved   map[int64]MachineState
+
+	// Returned by all writes
+	err error
+
+	// Returned by SaveRound only
+	roundErr error
+	rounds   []model.Round
+
+	// Returned by SaveMachineState only
+	stateErr error
+
+	// Returned by LookupForMachine only
+	lookupErr error
+
+	// Count of games counted for hosts
+	hosted int
+}
+
+// mustMachine returns the machine of the chat failing the test when it cannot be looked up
+func mustMachine(t *testing.T, f *MachineFabric, chatID int64) *Machine {
+	t.Helper()
+	m, err := f.NewMachine(chatID, 0)
+	if err != nil {
+		t.Fatalf("NewMachine: %v", err)
+	}
+	return m
+}
+
+func (s *fakeStorage) IncrementUserStats(_ model.Chat, users ...model.UserInChat) error {
+	if s.err != nil {
+		return s.err
+	}
+	for _, u := range users {
+		s.hosted += u.WasHost
+	}
+	return nil
+}
+func (s *fakeStorage) SaveDailyResult(model.DailyResult) error       { return nil }
+func (s *fakeStorage) HasDailyResult(int64, time.Time) (bool, error) { return false, nil }
+
+func (s *fakeStorage) SaveRound(r model.Round) error {
+	if s.err != nil {
+		return s.err
+	}
+	if s.roundErr != nil {
+		return s.roundErr
+	}
+	s.rounds = append(s.rounds, r)
+	return nil
+}
+
+func (s *fakeStorage) SaveMachineState(m MachineState) error {
+	if s.err != nil {
+		return s.err
+	}
+	if s.stateErr != nil {
+		return s.stateErr
+	}
+	s.saved[m.ChatID] = m
+	return nil
+}
+
+func (s *fakeStorage) LookupForMachine(chatID int64) (*MachineState, error) {
+	s.lookups++
+	if s.lookupErr != nil {
+		return nil, s.lookupErr
+	}
+	if saved, ok := s.saved[chatID]; ok {
+		return &saved, nil
+	}
+	return nil, nil
+}
+
+func (s *fakeStorage) MachineRevision(chatID int64) (int64, error) {
+	if s.lookupErr != nil {
+		return 0, s.lookupErr
+	}
+	return s.saved[chatID].Revision, nil
+}
+
+type fakeWords struct{}
+
+func (fakeWords) GetWord() (string, error) { return "крокодил", nil }
+
+func TestMachineCacheEviction(t *testing.T) {
+	c := NewMachineCache(2, 0)
+	c.Add(&Machine{ChatID: 1})
+	c.Add(&Machine{ChatID: 2})
+
+	// 1 becomes the most recently used
+	c.Get(1)
+	c.Add(&Machine{ChatID: 3})
+
+	if _, ok := c.Get(2); ok {
+		t.Errorf("Least recently used machine has not been evicted")
+	}
+	for _, id := range []int64{1, 3} {
+		if _, ok := c.Get(id); !ok {
+			t.Errorf("Machine %d has been evicted", id)
+		}
+	}
+	if c.Len() != 2 {
+		t.Errorf("Len: got %d, expected 2", c.Len())
+	}
+
+	c.Forget(1)
+	if _, ok := c.Get(1); ok {
+		t.Errorf("Forgotten machine is still cached")
+	}
+}
+
+func TestMachineCacheTTL(t *testing.T) {
+	now := time.Now()
+	c := NewMachineCache(10, time.Minute)
+	c.now = func() time.Time { return now }
+
+	c.Add(&Machine{ChatID: 1})
+	now = now.Add(2 * time.Minute)
+
+	if _, ok := c.Get(1); ok {
+		t.Errorf("Expired machine is still cached")
+	}
+}
+
+func TestFabricCache(t *testing.T) {
+	s := &fakeStorage{saved: make(map[int64]MachineState)}
+	f := NewMachineFabric(s, fakeWords{}, discardLogger())
+	f.Cache = NewMachineCache(10, 0)
+
+	if f.IsIdle(1) {
+		t.Errorf("Unknown chat must not be idle")
+	}
+
+	m := mustMachine(t, f, 1)
+	if !f.IsIdle(1) {
+		t.Errorf("Chat without a game must be idle")
+	}
+
+	if _, err := m.StartNewGameAndReturnWord(10, "host", "chat"); err != nil {
+		t.Fatalf("Cannot start game: %v", err)
+	}
+	if f.IsIdle(1) {
+		t.Errorf("Chat with a game must not be idle")
+	}
+
+	// Write-through
+	if s.saved[1].State != "game_started" {
+		t.Errorf("State has not been saved: %q", s.saved[1].State)
+	}
+
+	if mustMachine(t, f, 1) != m {
+		t.Errorf("Machine has not been taken from the cache")
+	}
+	if s.lookups != 1 {
+		t.Errorf("Lookups: got %d, expected 1", s.lookups)
+	}
+
+	// Machine which cannot be looked up is neither returned nor cached
+	f.Cache.Forget(1)
+	s.lookupErr = errors.New("connection refused")
+	if _, err := f.NewMachine(1, 0); !errors.Is(err, ErrStorage) {
+		t.Errorf("NewMachine: got %v, expected ErrStorage", err)
+	}
+	if _, ok := f.Cache.Get(1); ok {
+		t.Errorf("Machine which cannot be looked up is cached")
+	}
+	s.lookupErr = nil
+
+	m = mustMachine(t, f, 1)
+	if m.GetWord() != "крокодил" {
+		t.Errorf("Machine has not been restored from the storage")
+	}
+	if s.lookups != 3 {
+		t.Errorf("Lookups: got %d, expected 3", s.lookups)
+	}
+
+	// The cached machine is given the message of the current update
+	if cached, err := f.NewMachine(1, 42); err != nil || cached != m || m.MesID != 42 {
+		t.Errorf("NewMachine: got message %d, %v, expected cached machine with message 42", m.MesID, err)
+	}
+
+	// Changed by another replica, the cache has not been told about it yet
+	changed := s.saved[1]
+	changed.Word = "бегемот"
+	changed.Revision++
+	s.saved[1] = changed
+	if mustMachine(t, f, 1).GetWord() != "бегемот" {
+		t.Errorf("Stale machine has been taken from the cache")
+	}
+	if s.lookups != 4 {
+		t.Errorf("Lookups: got %d, expected 4", s.lookups)
+	}
+
+	// Game started by another replica, messages must reach the machine
+	if err := mustMachine(t, f, 1).StopGame(); err != nil {
+		t.Fatalf("Cannot stop game: %v", err)
+	}
+	if !f.IsIdle(1) {
+		t.Errorf("Chat without a game must be idle")
+	}
+	stopped := s.saved[1]
+	started := stopped
+	started.State = "game_started"
+	started.Revision++
+	s.saved[1] = started
+	if f.IsIdle(1) {
+		t.Errorf("Chat with a game started by another replica must not be idle")
+	}
+
+	// Revision which cannot be checked does not skip messages either
+	s.saved[1] = stopped
+	s.lookupErr = errors.New("connection refused")
+	if f.IsIdle(1) {
+		t.Errorf("Chat must not be idle when its revision cannot be checked")
+	}
+}
@@ -20,7 +20,9 @@ package crocodile
 
 import (
 	"errors"
+	"fmt"
 	"strings"
+	"sync/atomic"
 	"time"
 	"unicode"
 
@@ -30,12 +32,24 @@ import (
 	"github.com/nuetoban/crocodile-game-bot/utils"
 )
 
-const (
+var (
 	// ErrGameAlreadyStarted is error when user tries to start a game in chat, but there is the one already
-	ErrGameAlreadyStarted = "Game already started"
+	ErrGameAlreadyStarted = errors.New("game already started")
 
 	// ErrWaitingForWinnerRespond is error when the game have been played, but winner did't start a new one
-	ErrWaitingForWinnerRespond = "Waiting for winner respond"
+	ErrWaitingForWinnerRespond = errors.New("waiting for winner respond")
+
+	// ErrDailyAlreadyGuessed is error when chat tries to play the daily word second time in a day
+	ErrDailyAlreadyGuessed = errors.New("daily word already guessed")
+
+	// ErrDailyWordIsFixed is error when host tries to change the daily word
+	ErrDailyWordIsFixed = errors.New("daily word cannot be changed")
+
+	// ErrDailyNotSupported is error when WordsProvider cannot produce the daily word
+	ErrDailyNotSupported = errors.New("daily word is not supported")
+
+	// ErrStorage wraps errors of Storage, the game or stats may be not saved
+	ErrStorage = errors.New("storage error")
 )
 
 // WordsProvider should return random word
@@ -43,15 +57,39 @@ type WordsProvider interface {
 	GetWord() (string, error)
 }
 
+// DailyWordsProvider should return the same word for every chat during one day
+type DailyWordsProvider interface {
+	GetDailyWord(day time.Time) (string, error)
+}
+
 // Storage aims to save FSM state somewhere (e.g. in Redis)
 type Storage interface {
 	IncrementUserStats(model.Chat, ...model.UserInChat) error
-	SaveMachineState(Machine) error
-	LookupForMachine(*Machine) error
+	SaveMachineState(MachineState) error
+	// LookupForMachine returns nil if there is no saved state of the chat
+	LookupForMachine(chatID int64) (*MachineState, error)
+	// MachineRevision returns revision of the saved state of the chat, 0 if there is none,
+	// cached machines of other revisions are looked up again
+	MachineRevision(chatID int64) (int64, error)
+	SaveDailyResult(model.DailyResult) error
+	HasDailyResult(chatID int64, day time.Time) (bool, error)
+	SaveRound(model.Round) error
+}
+
+// RoundInspector looks for abuse in the successful round, flagged rounds are not counted in ratings
+type RoundInspector interface {
+	// Inspect returns reasons to flag the round, nil if the round is fair
+	Inspect(model.Round) []string
+}
+
+// RoundObserver is notified when a round is finished, returned messages are announced in the chat
+type RoundObserver interface {
+	RoundFinished(model.Round) []string
 }
 
 // Machine stores state of game in one chat
 type Machine struct {
+	// MesID is the message being handled
 	MesID int
 
 	// ChatID where the game is started
@@ -73,11 +111,36 @@ type Machine struct {
 	StartedTime time.Time
 	GuessedTime time.Time
 
+	// Daily is true when the game is played with the word of the day
+	Daily bool
+
+	// Players are users who tried to guess the word in the current round
+	Players []model.Player
+
+	// SeenTime is when the host looked at the word last time
+	SeenTime time.Time
+
+	// Skips is how many times the host has changed the word in the current round
+	Skips int
+
+	// Revision of the saved state
+	Revision int64
+
 	// Technical data
-	Storage       Storage       `json:"-"`
-	WordsProvider WordsProvider `json:"-"`
-	FSM           *fsm.FSM      `json:"-"`
-	Log           Logger        `json:"-"`
+	Storage       Storage         `json:"-"`
+	WordsProvider WordsProvider   `json:"-"`
+	FSM           *fsm.FSM        `json:"-"`
+	Log           Logger          `json:"-"`
+	Observers     []RoundObserver `json:"-"`
+	Inspector     RoundInspector  `json:"-"`
+
+	// Messages from observers which should be sent to the chat
+	Announcements []string `json:"-"`
+
+	cache *MachineCache
+
+	// Error of the last saveState call
+	saveErr error
 
 	// We have to set this explicitly for saving state in external storage
 	State string
@@ -88,11 +151,88 @@ type MachineFabric struct {
 	Storage       Storage
 	WordsProvider WordsProvider
 	Log           Logger
+	Observers     []RoundObserver
+	Inspector     RoundInspector
+
+	// Cache of machines, every machine is restored from the storage if it is nil
+	Cache *MachineCache
+}
+
+// Scope is what the machine uses while the current update is handled,
+// e.g. the logger adding IDs of the update to log lines or the storage tracing its calls
+type Scope struct {
+	Storage       Storage
+	WordsProvider WordsProvider
+	Log           Logger
 }
 
 // NewMachine returns Machine with freezed Storage and WordsProvider
-func (m *MachineFabric) NewMachine(chatID int64, mesID int) *Machine {
-	return NewMachine(m.Storage, m.WordsProvider, m.Log, chatID, mesID)
+func (m *MachineFabric) NewMachine(chatID int64, mesID int) (*Machine, error) {
+	return m.NewMachineWith(chatID, mesID, Scope{Storage: m.Storage, WordsProvider: m.WordsProvider, Log: m.Log})
+}
+
+// NewMachineWith returns Machine using the scope of the current update,
+// cached machine is switched to the scope too,
+// ErrStorage is returned when the state of the machine cannot be looked up
+func (m *MachineFabric) NewMachineWith(chatID int64, mesID int, s Scope) (*Machine, error) {
+	if m.Cache != nil {
+		if machine, ok := m.Cache.Get(chatID); ok {
+			// Another replica could change the machine before the cache has been told about it
+			revision, err := s.Storage.MachineRevision(chatID)
+			if err != nil {
+				s.Log.Errorf("NewMachineWith: cannot check revision of machine %d: %v", chatID, err)
+				return nil, storageError(err)
+			}
+			if revision == machine.Revision {
+				machine.Announcements = nil
+				machine.MesID = mesID
+				machine.Storage = s.Storage
+				machine.WordsProvider = s.WordsProvider
+				machine.Log = s.Log
+				return machine, nil
+			}
+			m.Cache.Forget(chatID)
+		}
+	}
+
+	machine, err := NewMachine(s.Storage, s.WordsProvider, s.Log, chatID, mesID)
+	if err != nil {
+		return nil, err
+	}
+	machine.Observers = m.Observers
+	machine.Inspector = m.Inspector
+
+	if m.Cache != nil {
+		machine.cache = m.Cache
+		m.Cache.Add(machine)
+	}
+	return machine, nil
+}
+
+// IsIdle returns true when the cache knows there is no game in the chat,
+// so messages of the chat may be skipped without restoring the machine.
+// It is called without the lock of the chat, so the revision is loaded atomically
+func (m *MachineFabric) IsIdle(chatID int64) bool {
+	if m.Cache == nil {
+		return false
+	}
+	machine, ok := m.Cache.Get(chatID)
+	if !ok || machine.FSM.Current() == "game_started" {
+		return false
+	}
+
+	// Another replica could start a game before the cache has been told about it
+	revision, err := m.Storage.MachineRevision(chatID)
+	if err != nil {
+		m.Log.Warnf("IsIdle: cannot check revision of machine %d: %v", chatID, err)
+		return false
+	}
+	return revision == atomic.LoadInt64(&machine.Revision)
+}
+
+// AddObserver registers observer for rounds of every machine produced by the fabric
+func (m *MachineFabric) AddObserver(o RoundObserver) {
+	m.Observers = append(m.Observers, o)
 }
 
 // NewMachineFabric returns MachineFabric
@@ -104,8 +244,8 @@ func NewMachineFabric(storage Storage, wp WordsProvider, log Logger) *MachineFab
 	}
 }
 
-// NewMachine returns new Machine instance
-func NewMachine(storage Storage, wp WordsProvider, log Logger, chatID int64, mesID int) *Machine {
+// NewMachine returns new Machine instance restored from the storage
+func NewMachine(storage Storage, wp WordsProvider, log Logger, chatID int64, mesID int) (*Machine, error) {
 	m := &Machine{
 		ChatID:        chatID,
 		Storage:       storage,
@@ -128,64 +268,119 @@ func NewMachine(storage Storage, wp WordsProvider, log Logger, chatID int64, mes
 		},
 	)
 
-	m.lookupForMachine()
+	if err := m.lookupForMachine(); err != nil {
+		return nil, err
+	}
+	m.MesID = mesID
 
-	return m
+	return m, nil
 }
 
 // StartNewGameAndReturnWord sets m.Word to new words and returns it
 func (m *Machine) StartNewGameAndReturnWord(host int, hostName string, chatTitle string) (string, error) {
-	m.Log.Debugf("Starting new game, host: %d, hostName: %s", host, hostName)
+	return m.startNewGame(host, hostName, chatTitle, false)
+}
+
+// StartNewDailyGameAndReturnWord sets m.Word to the word of the day and returns it
+func (m *Machine) StartNewDailyGameAndReturnWord(host int, hostName string, chatTitle string) (string, error) {
+	return m.startNewGame(host, hostName, chatTitle, true)
+}
+
+func (m *Machine) startNewGame(host int, hostName string, chatTitle string, daily bool) (string, error) {
+	m.Log.Debugf("Starting new game, host: %d, hostName: %s, daily: %t", host, hostName, daily)
 
 	if m.FSM.Cannot("new_game") {
 		m.Log.Debugf("StartNewGameAndReturnWord: already started, machine: %+v", m)
-		return "", errors.New(ErrGameAlreadyStarted)
+		return "", ErrGameAlreadyStarted
 	}
 
 	_, _, ss := utils.CalculateTimeDiff(time.Now(), m.GetGuessedTime())
 	if host != m.GetWinner() && m.GetWinner() != 0 && ss < 5 {
-		m.Log.Debug("StartNewGameAndReturnWord: waiting for winner respond")
-		return "", errors.New(ErrWaitingForWinnerRespond)
+		m.Log.Debugf("StartNewGameAndReturnWord: waiting for winner respond")
+		return "", ErrWaitingForWinnerRespond
 	}
 
-	var err error
-	m.Word, err = m.WordsProvider.GetWord()
+	word, err := m.newWord(daily)
 	if err != nil {
-		m.Log.Warningf("StartNewGameAndReturnWord: error during getting word: %v", err)
+		m.Log.Warnf("StartNewGameAndReturnWord: error during getting word: %v", err)
 		return "", err
 	}
 
+	prev := m.Snapshot()
+	m.Word = word
+	m.Daily = daily
 	m.Host = host
 	m.StartedTime = time.Now()
 	m.HostName = hostName
 	m.ChatTitle = chatTitle
-	m.FSM.Event("new_game")
+	m.Players = nil
+	m.SeenTime = time.Time{}
+	m.Skips = 0
+	if err := m.event("new_game"); err != nil {
+		m.rollback(prev)
+		return "", err
+	}
 
-	m.Storage.IncrementUserStats(model.Chat{
-		ID: m.ChatID,
-		Title: m.ChatTitle,
+	// The game is started already, so it goes on even if the host is not counted
+	err = m.Storage.IncrementUserStats(model.Chat{
+		ID:    m.ChatID,
+		Title: chatTitle,
 	}, model.UserInChat{
-		ID:      m.Host,
+		ID:      host,
 		ChatID:  m.ChatID,
 		WasHost: 1,
 		Name:    hostName,
 	})
+	if err != nil {
+		m.Log.Warnf("StartNewGameAndReturnWord: cannot count the game of host %d: %v", host, err)
+	}
 
 	m.Log.Debugf("StartNewGameAndReturnWord: returning word: \"%s\"", m.Word)
 	return m.Word, nil
 }
 
+func (m *Machine) newWord(daily bool) (string, error) {
+	if !daily {
+		return m.WordsProvider.GetWord()
+	}
+
+	wp, ok := m.WordsProvider.(DailyWordsProvider)
+	if !ok {
+		return "", ErrDailyNotSupported
+	}
+
+	now := time.Now()
+	guessed, err := m.Storage.HasDailyResult(m.ChatID, now)
+	if err != nil {
+		return "", storageError(err)
+	}
+	if guessed {
+		return "", ErrDailyAlreadyGuessed
+	}
+
+	return wp.GetDailyWord(now)
+}
+
 // SetNewRandomWord generates new word
 func (m *Machine) SetNewRandomWord() (string, error) {
-	var err error
+	if m.Daily {
+		return m.Word, ErrDailyWordIsFixed
+	}
 
-	m.Word, err = m.WordsProvider.GetWord()
+	word, err := m.WordsProvider.GetWord()
 	if err != nil {
-		m.Log.Warningf("SetNewRandomWord: error during getting word: %v", err)
+		m.Log.Warnf("SetNewRandomWord: error during getting word: %v", err)
 		return "", err
 	}
 
-	m.FSM.Event("update")
+	prev := m.Snapshot()
+	m.Word = word
+	m.SeenTime = time.Now()
+	m.Skips++
+	if err := m.event("update"); err != nil {
+		m.rollback(prev)
+		return "", err
+	}
 
 	m.Log.Tracef("SetNewRandomWord: setting word for chat (%d): %s", m.ChatID, m.Word)
 
@@ -195,6 +390,13 @@ func (m *Machine) SetNewRandomWord() (string, error) {
 // GetWord is getter for m.Word
 func (m *Machine) GetWord() string { return m.Word }
 
+// SeeWord returns m.Word and remembers when the host has seen it,
+// the word is returned even if the time has not been saved
+func (m *Machine) SeeWord() (string, error) {
+	m.SeenTime = time.Now()
+	return m.Word, m.event("update")
+}
+
 // GetHost is getter for m.Host
 func (m *Machine) GetHost() int { return m.Host }
 
@@ -207,6 +409,12 @@ func (m *Machine) GetGuessedTime() time.Time { return m.GuessedTime }
 // GetWinner is getter for m.Winner
 func (m *Machine) GetWinner() int { return m.Winner }
 
+// IsDaily is getter for m.Daily
+func (m *Machine) IsDaily() bool { return m.Daily }
+
+// GetAnnouncements is getter for m.Announcements
+func (m *Machine) GetAnnouncements() []string { return m.Announcements }
+
 // CheckWord checks if m.Word == provided word
 func (m *Machine) CheckWord(word string) bool {
 	// Preprocess word
@@ -221,8 +429,9 @@ func (m *Machine) CheckWord(word string) bool {
 	return false
 }
 
-// CheckWordAndSetWinner sets m.Winner and returns true if m.CheckWord() returns true, otherwise ret. false
-func (m *Machine) CheckWordAndSetWinner(word string, potentialWinner int, winnerName string) (string, bool) {
+// CheckWordAndSetWinner sets m.Winner and returns true if m.CheckWord() returns true, otherwise ret. false.
+// Error with true means the round is finished, but its results have not been saved.
+func (m *Machine) CheckWordAndSetWinner(word string, potentialWinner int, winnerName string) (string, bool, error) {
 	m.Log.Debugf(
 		"CheckWordAndSetWinner: checking word: %s, potentialWinner: %d, winnerName: %s, chatID: %d",
 		word, potentialWinner, winnerName, m.ChatID,
@@ -230,47 +439,150 @@ func (m *Machine) CheckWordAndSetWinner(word string, potentialWinner int, winner
 
 	if m.FSM.Current() != "game_started" {
 		m.Log.Debugf("CheckWordAndSetWinner: game is not in state \"game_started\", chatID: %d", m.ChatID)
-		return "", false
+		return "", false, nil
 	}
 
-	if m.CheckWord(word) {
+	guessed := m.CheckWord(word)
+	isNewPlayer := m.addPlayer(potentialWinner, winnerName)
+
+	if guessed {
 		m.Log.Debugf("CheckWordAndSetWinner: stopping game, chatID: %d", m.ChatID)
 		m.Winner = potentialWinner
 		m.GuessedTime = time.Now()
 
-		m.FSM.Event("stop_game")
-
-		winner := model.UserInChat{
-			ID:      m.Winner,
-			ChatID:  m.ChatID,
-			Guessed: 1,
-			Name:    winnerName,
+		if err := m.event("stop_game"); err != nil {
+			return "", false, err
 		}
-		host := model.UserInChat{
-			ID:      m.Host,
-			ChatID:  m.ChatID,
-			Success: 1,
-			Name:    m.HostName,
+
+		var err error
+		round := m.newRound(m.Winner, winnerName)
+		if round.Flagged() {
+			m.Log.Infof("CheckWordAndSetWinner: round is excluded from ratings (%s), chatID: %d", round.Flags, m.ChatID)
+		} else {
+			err = m.countRound(round)
 		}
 
-		err := m.Storage.IncrementUserStats(model.Chat{
-			ID: m.ChatID,
-			Title: m.ChatTitle,
-		}, host, winner)
-		if err != nil {
-			m.Log.Errorf("CheckWordAndSetWinner: cannot increment host or winner stats: %v", err)
+		if ferr := m.finishRound(round); err == nil {
+			err = ferr
 		}
 
-		return m.Word, true
+		return m.Word, true, err
 	}
 
-	return "", false
+	// Save the new player to the state, players are used only for
+	// statistics, so the guess is not failed if they are not saved
+	if isNewPlayer {
+		if err := m.event("update"); err != nil {
+			m.Log.Warnf("CheckWordAndSetWinner: cannot save player: %v", err)
+		}
+	}
+
+	return "", false, nil
+}
+
+// addPlayer returns false if user has already tried to guess in the current round
+func (m *Machine) addPlayer(userID int, name string) bool {
+	for _, p := range m.Players {
+		if p.ID == userID {
+			return false
+		}
+	}
+	m.Players = append(m.Players, model.Player{ID: userID, Name: name})
+	return true
 }
 
 // StopGame sends stop_game event to FSM
 func (m *Machine) StopGame() error {
 	m.Log.Debugf("Stopping game, machine: %+v", m)
-	m.FSM.Event("stop_game")
+	if m.FSM.Current() != "game_started" {
+		return nil
+	}
+
+	if err := m.event("stop_game"); err != nil {
+		return err
+	}
+	return m.finishRound(m.newRound(0, ""))
+}
+
+// newRound returns the current round and checks it with the inspector
+func (m *Machine) newRound(winner int, winnerName string) model.Round {
+	round := model.Round{
+		ChatID:     m.ChatID,
+		HostID:     m.Host,
+		HostName:   m.HostName,
+		WinnerID:   winner,
+		WinnerName: winnerName,
+		Word:       m.Word,
+		Daily:      m.Daily,
+		Players:    m.Players,
+		Skips:      m.Skips,
+		StartedAt:  m.StartedTime,
+		SeenAt:     m.SeenTime,
+		FinishedAt: time.Now(),
+	}
+	if round.Success() {
+		round.FinishedAt = m.GuessedTime
+	}
+	round.DurationMs = round.Duration().Milliseconds()
+
+	if m.Inspector != nil && round.Success() {
+		round.Flags = strings.Join(m.Inspector.Inspect(round), ",")
+	}
+
+	return round
+}
+
+// countRound adds the successful round to stats and daily results
+func (m *Machine) countRound(round model.Round) error {
+	winner := model.UserInChat{
+		ID:      round.WinnerID,
+		ChatID:  m.ChatID,
+		Guessed: 1,
+		Name:    round.WinnerName,
+	}
+	host := model.UserInChat{
+		ID:      m.Host,
+		ChatID:  m.ChatID,
+		Success: 1,
+		Name:    m.HostName,
+	}
+
+	err := m.Storage.IncrementUserStats(model.Chat{
+		ID:    m.ChatID,
+		Title: m.ChatTitle,
+	}, host, winner)
+	if err != nil {
+		return storageError(err)
+	}
+
+	if m.Daily {
+		err = m.Storage.SaveDailyResult(model.DailyResult{
+			Day:        m.StartedTime,
+			ChatID:     m.ChatID,
+			ChatTitle:  m.ChatTitle,
+			UserID:     round.WinnerID,
+			UserName:   round.WinnerName,
+			HostID:     m.Host,
+			DurationMs: round.DurationMs,
+		})
+		if err != nil {
+			return storageError(err)
+		}
+	}
+
+	return nil
+}
+
+// finishRound saves the round to the history and notifies observers,
+// they are not notified if the round has not been saved, so they see it in the history
+func (m *Machine) finishRound(round model.Round) error {
+	if err := m.Storage.SaveRound(round); err != nil {
+		return storageError(err)
+	}
+
+	for _, o := range m.Observers {
+		m.Announcements = append(m.Announcements, o.RoundFinished(round)...)
+	}
 	return nil
 }
 
@@ -281,21 +593,63 @@ func (m *Machine) saveState(e *fsm.Event) {
 	m.State = e.Dst
 
 	// Save state to Redis
-	err := m.Storage.SaveMachineState(*m)
+	state := m.Snapshot()
+	state.Revision++
+	err := m.Storage.SaveMachineState(state)
 	if err != nil {
-		m.Log.Errorf("saveState: error:", err)
+		m.saveErr = storageError(err)
+
+		// Cached machine must not differ from the saved one
+		if m.cache != nil {
+			m.cache.Forget(m.ChatID)
+		}
+		return
+	}
+	atomic.StoreInt64(&m.Revision, state.Revision)
+}
+
+// event sends the event to FSM and returns error if the new state has not been saved
+func (m *Machine) event(name string) error {
+	m.saveErr = nil
+
+	err := m.FSM.Event(name)
+	// Self-transitions (e.g. "update") are saved, but FSM reports them as no transition
+	if _, ok := err.(fsm.NoTransitionError); ok {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return m.saveErr
+}
+
+// rollback restores the machine when its new state has not been saved
+func (m *Machine) rollback(prev MachineState) {
+	m.Restore(prev)
+	if prev.State == "" {
+		prev.State = "init"
 	}
+	m.FSM.SetState(prev.State)
+}
+
+func storageError(err error) error {
+	return fmt.Errorf("%w: %v", ErrStorage, err)
 }
 
-func (m *Machine) lookupForMachine() {
+func (m *Machine) lookupForMachine() error {
 	m.Log.Tracef("Restoring machine state for chat (%d)", m.ChatID)
 
-	err := m.Storage.LookupForMachine(m)
+	state, err := m.Storage.LookupForMachine(m.ChatID)
 	if err != nil {
 		m.Log.Errorf("lookupForMachine: error: %v", err)
-		return
+		return storageError(err)
+	}
+	if state != nil {
+		m.Restore(*state)
 	}
 	if m.State != "" {
 		m.FSM.SetState(m.State)
 	}
+	return nil
 }
@@ -0,0 +1,174 @@
+/*
+ * This file is part of Crocodile Game Bot.
+ * Copyright (C) 2019  Viktor
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package crocodile
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/nuetoban/crocodile-game-bot/model"
+)
+
+func TestStorageErrorsPropagate(t *testing.T) {
+	s := &fakeStorage{saved: make(map[int64]MachineState)}
+	f := NewMachineFabric(s, fakeWords{}, discardLogger())
+	f.Cache = NewMachineCache(10, 0)
+
+	s.err = errors.New("connection refused")
+	if _, err := mustMachine(t, f, 1).StartNewGameAndReturnWord(10, "host", "chat"); !errors.Is(err, ErrStorage) {
+		t.Fatalf("StartNewGameAndReturnWord: got %v, expected ErrStorage", err)
+	}
+	if _, ok := s.saved[1]; ok {
+		t.Errorf("Game has been saved")
+	}
+
+	s.err = nil
+	m := mustMachine(t, f, 1)
+	if _, err := m.StartNewGameAndReturnWord(10, "host", "chat"); err != nil {
+		t.Fatalf("StartNewGameAndReturnWord: %v", err)
+	}
+	if _, err := m.StartNewGameAndReturnWord(10, "host", "chat"); err != ErrGameAlreadyStarted {
+		t.Errorf("StartNewGameAndReturnWord: got %v, expected ErrGameAlreadyStarted", err)
+	}
+
+	// The guess is not accepted when the finished game cannot be saved
+	s.err = errors.New("connection refused")
+	if _, ok, err := m.CheckWordAndSetWinner("крокодил", 20, "winner"); ok || !errors.Is(err, ErrStorage) {
+		t.Errorf("CheckWordAndSetWinner: got %t, %v, expected false, ErrStorage", ok, err)
+	}
+	if _, ok := f.Cache.Get(1); ok {
+		t.Errorf("Unsaved machine is still cached")
+	}
+
+	s.err = nil
+	if _, ok, err := mustMachine(t, f, 1).CheckWordAndSetWinner("крокодил", 20, "winner"); !ok || err != nil {
+		t.Errorf("CheckWordAndSetWinner: got %t, %v, expected true, nil", ok, err)
+	}
+}
+
+type roundRecorder struct{ rounds []model.Round }
+
+func (r *roundRecorder) RoundFinished(round model.Round) []string {
+	r.rounds = append(r.rounds, round)
+	return nil
+}
+
+func TestRoundSkips(t *testing.T) {
+	s := &fakeStorage{saved: make(map[int64]MachineState)}
+	f := NewMachineFabric(s, fakeWords{}, discardLogger())
+	rec := &roundRecorder{}
+	f.AddObserver(rec)
+
+	if _, err := mustMachine(t, f, 1).StartNewGameAndReturnWord(10, "host", "chat"); err != nil {
+		t.Fatalf("StartNewGameAndReturnWord: %v", err)
+	}
+
+	// Skips are kept in the saved state between updates
+	for i := 0; i < 2; i++ {
+		if _, err := mustMachine(t, f, 1).SetNewRandomWord(); err != nil {
+			t.Fatalf("SetNewRandomWord: %v", err)
+		}
+	}
+	if _, ok, err := mustMachine(t, f, 1).CheckWordAndSetWinner("крокодил", 20, "winner"); !ok || err != nil {
+		t.Fatalf("CheckWordAndSetWinner: got %t, %v, expected true, nil", ok, err)
+	}
+
+	if len(rec.rounds) != 1 || rec.rounds[0].Skips != 2 {
+		t.Fatalf("Got rounds %+v, expected one round with 2 skips", rec.rounds)
+	}
+
+	if _, err := mustMachine(t, f, 1).StartNewGameAndReturnWord(20, "winner", "chat"); err != nil {
+		t.Fatalf("StartNewGameAndReturnWord: %v", err)
+	}
+	if got := s.saved[1].Skips; got != 0 {
+		t.Errorf("Skips of the new round: got %d, expected 0", got)
+	}
+}
+
+// historyObserver remembers how many rounds were in the history when it was notified
+type historyObserver struct {
+	s     *fakeStorage
+	saved []int
+}
+
+func (o *historyObserver) RoundFinished(model.Round) []string {
+	o.saved = append(o.saved, len(o.s.rounds))
+	return []string{"announcement"}
+}
+
+func TestObserversSeeSavedRound(t *testing.T) {
+	s := &fakeStorage{saved: make(map[int64]MachineState)}
+	f := NewMachineFabric(s, fakeWords{}, discardLogger())
+	o := &historyObserver{s: s}
+	f.AddObserver(o)
+
+	m := mustMachine(t, f, 1)
+	if _, err := m.StartNewGameAndReturnWord(10, "host", "chat"); err != nil {
+		t.Fatalf("StartNewGameAndReturnWord: %v", err)
+	}
+
+	// The round is not saved, so nobody is notified and nothing is announced
+	s.roundErr = errors.New("connection refused")
+	if _, _, err := m.CheckWordAndSetWinner("крокодил", 20, "winner"); !errors.Is(err, ErrStorage) {
+		t.Fatalf("CheckWordAndSetWinner: got %v, expected ErrStorage", err)
+	}
+	if len(o.saved) != 0 || len(m.GetAnnouncements()) != 0 {
+		t.Errorf("Observer has been notified about unsaved round")
+	}
+
+	s.roundErr = nil
+	if _, err := m.StartNewGameAndReturnWord(20, "winner", "chat"); err != nil {
+		t.Fatalf("StartNewGameAndReturnWord: %v", err)
+	}
+	if _, _, err := m.CheckWordAndSetWinner("крокодил", 10, "host"); err != nil {
+		t.Fatalf("CheckWordAndSetWinner: %v", err)
+	}
+	if len(o.saved) != 1 || o.saved[0] != 1 {
+		t.Errorf("Observer has not seen the round in the history: %v", o.saved)
+	}
+}
+
+func TestUnsavedChangesAreRolledBack(t *testing.T) {
+	s := &fakeStorage{saved: make(map[int64]MachineState)}
+	m := mustMachine(t, NewMachineFabric(s, fakeWords{}, discardLogger()), 1)
+
+	s.stateErr = errors.New("connection refused")
+	if _, err := m.StartNewGameAndReturnWord(10, "host", "chat"); !errors.Is(err, ErrStorage) {
+		t.Fatalf("StartNewGameAndReturnWord: got %v, expected ErrStorage", err)
+	}
+	if s.hosted != 0 || m.GetHost() != 0 || m.GetWord() != "" || m.FSM.Current() != "init" {
+		t.Errorf("Unsaved game has changed the machine or stats: hosted %d, machine %+v", s.hosted, m.Snapshot())
+	}
+
+	s.stateErr = nil
+	if _, err := m.StartNewGameAndReturnWord(10, "host", "chat"); err != nil {
+		t.Fatalf("StartNewGameAndReturnWord: %v", err)
+	}
+	if s.hosted != 1 {
+		t.Errorf("Hosted games: got %d, expected 1", s.hosted)
+	}
+
+	s.stateErr = errors.New("connection refused")
+	if _, err := m.SetNewRandomWord(); !errors.Is(err, ErrStorage) {
+		t.Fatalf("SetNewRandomWord: got %v, expected ErrStorage", err)
+	}
+	if m.Skips != 0 || !m.SeenTime.IsZero() || m.FSM.Current() != "game_started" {
+		t.Errorf("Unsaved word has changed the machine: %+v", m.Snapshot())
+	}
+}
@@ -0,0 +1,108 @@
+/*
+ * This file is part of Crocodile Game Bot.
+ * Copyright (C) 2019  Viktor
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package crocodile
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/nuetoban/crocodile-game-bot/model"
+)
+
+// MachineStateVersion is the current version of MachineState format.
+// Increment it and add an upgrade to the storage when the format changes.
+const MachineStateVersion = 1
+
+// MachineState is the persisted state of Machine, it is kept separate from
+// Machine so runtime fields can be changed without breaking games in flight
+type MachineState struct {
+	Version   int           `json:"version"`
+	ChatID    int64         `json:"chat_id"`
+	ChatTitle string        `json:"chat_title"`
+	MesID     int           `json:"message_id"`
+	State     string        `json:"state"`
+	Word      string        `json:"word"`
+	Daily     bool          `json:"daily"`
+	HostID    int           `json:"host_id"`
+	HostName  string        `json:"host_name"`
+	WinnerID  int           `json:"winner_id"`
+	Players   []StatePlayer `json:"players"`
+	Skips     int           `json:"skips,omitempty"`
+	StartedAt time.Time     `json:"started_at"`
+	SeenAt    time.Time     `json:"seen_at"`
+	GuessedAt time.Time     `json:"guessed_at"`
+
+	// Revision is incremented every time the state is saved,
+	// so of two copies of the state the newer one is known
+	Revision int64 `json:"revision,omitempty"`
+}
+
+// StatePlayer is a player in MachineState
+type StatePlayer struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+// Snapshot returns persisted state of the machine
+func (m *Machine) Snapshot() MachineState {
+	s := MachineState{
+		Version:   MachineStateVersion,
+		ChatID:    m.ChatID,
+		ChatTitle: m.ChatTitle,
+		MesID:     m.MesID,
+		State:     m.State,
+		Word:      m.Word,
+		Daily:     m.Daily,
+		HostID:    m.Host,
+		HostName:  m.HostName,
+		WinnerID:  m.Winner,
+		Skips:     m.Skips,
+		StartedAt: m.StartedTime,
+		SeenAt:    m.SeenTime,
+		GuessedAt: m.GuessedTime,
+		Revision:  m.Revision,
+	}
+	for _, p := range m.Players {
+		s.Players = append(s.Players, StatePlayer{ID: p.ID, Name: p.Name})
+	}
+	return s
+}
+
+// Restore sets the machine fields from the persisted state
+func (m *Machine) Restore(s MachineState) {
+	m.ChatTitle = s.ChatTitle
+	m.MesID = s.MesID
+	m.State = s.State
+	m.Word = s.Word
+	m.Daily = s.Daily
+	m.Host = s.HostID
+	m.HostName = s.HostName
+	m.Winner = s.WinnerID
+	m.Skips = s.Skips
+	m.StartedTime = s.StartedAt
+	m.SeenTime = s.SeenAt
+	m.GuessedTime = s.GuessedAt
+	// Read by MachineFabric.IsIdle without the lock of the chat
+	atomic.StoreInt64(&m.Revision, s.Revision)
+
+	m.Players = nil
+	for _, p := range s.Players {
+		m.Players = append(m.Players, model.Player{ID: p.ID, Name: p.Name})
+	}
+}
@@ -19,16 +19,32 @@
 package crocodile
 
 import (
+	"errors"
+	"hash/fnv"
 	"io"
 	"io/ioutil"
 	"math/rand"
 	"strings"
+	"sync"
 	"time"
 )
 
+// ErrNoWords is returned when every word has been removed from the dictionary
+var ErrNoWords = errors.New("dictionary is empty")
+
 // WordsProviderReader takes content from reader, converts to string, splits by "\n" and returns random word
 type WordsProviderReader struct {
 	wordsList []string
+
+	// Words added and removed by admins, the list itself is never changed
+	mu      sync.RWMutex
+	words   []string
+	removed map[string]bool
+}
+
+// NormalizeWord returns the word in the form of the dictionary
+func NormalizeWord(word string) string {
+	return strings.ReplaceAll(strings.ToLower(strings.TrimSpace(word)), "ё", "е")
 }
 
 // NewWordsProviderReader returns new instance of WordsProviderReader
@@ -41,14 +57,87 @@ func NewWordsProviderReader(r io.Reader) (*WordsProviderReader, error) {
 	contentString := strings.TrimSpace(string(content))
 	contentString = strings.ReplaceAll(contentString, "ё", "е")
 
-	return &WordsProviderReader{
-		wordsList: strings.Split(contentString, "\n"),
-	}, nil
+	w := &WordsProviderReader{}
+	for _, word := range strings.Split(contentString, "\n") {
+		w.wordsList = append(w.wordsList, strings.TrimSpace(word))
+	}
+	w.SetChanges(nil, nil)
+	return w, nil
+}
+
+// SetChanges replaces words added to the list and removed from it
+func (w *WordsProviderReader) SetChanges(added, removed []string) {
+	rm := make(map[string]bool, len(removed))
+	for _, word := range removed {
+		rm[NormalizeWord(word)] = true
+	}
+
+	words := make([]string, 0, len(w.wordsList)+len(added))
+	seen := make(map[string]bool, cap(words))
+	for _, list := range [][]string{w.wordsList, added} {
+		for _, word := range list {
+			word = NormalizeWord(word)
+			if word == "" || rm[word] || seen[word] {
+				continue
+			}
+			seen[word] = true
+			words = append(words, word)
+		}
+	}
+
+	w.mu.Lock()
+	w.words, w.removed = words, rm
+	w.mu.Unlock()
+}
+
+// Contains returns true if the word may be given to hosts
+func (w *WordsProviderReader) Contains(word string) bool {
+	word = NormalizeWord(word)
+
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	for _, v := range w.words {
+		if v == word {
+			return true
+		}
+	}
+	return false
+}
+
+// Len returns count of words which may be given to hosts
+func (w *WordsProviderReader) Len() int {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return len(w.words)
 }
 
 // GetWord returns random word
 func (w *WordsProviderReader) GetWord() (string, error) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if len(w.words) == 0 {
+		return "", ErrNoWords
+	}
+
 	rand.Seed(time.Now().UnixNano())
-	index := rand.Intn(len(w.wordsList))
-	return strings.TrimSpace(w.wordsList[index]), nil
+	index := rand.Intn(len(w.words))
+	return w.words[index], nil
+}
+
+// GetDailyWord returns the word of the day, it is the same for every caller during one UTC day.
+// It is picked from the list only, so added words do not change it, a removed word is replaced with the next one.
+func (w *WordsProviderReader) GetDailyWord(day time.Time) (string, error) {
+	h := fnv.New64a()
+	h.Write([]byte(day.UTC().Format("2006-01-02")))
+	index := h.Sum64() % uint64(len(w.wordsList))
+
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	for i := range w.wordsList {
+		word := NormalizeWord(w.wordsList[(int(index)+i)%len(w.wordsList)])
+		if word != "" && !w.removed[word] {
+			return word, nil
+		}
+	}
+	return "", ErrNoWords
 }
@@ -0,0 +1,55 @@
+/*
+ * This file is part of Crocodile Game Bot.
+ * Copyright (C) 2019  Viktor
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package crocodile
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWordsProviderChanges(t *testing.T) {
+	w, err := NewWordsProviderReader(strings.NewReader("слон\nёж\nкот\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	day := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	daily, _ := w.GetDailyWord(day)
+
+	w.SetChanges([]string{" Жираф "}, []string{daily})
+	if w.Len() != 3 || !w.Contains("жираф") || w.Contains(daily) {
+		t.Errorf("Got %d words, the added word is missing or the removed one is kept", w.Len())
+	}
+	for i := 0; i < 20; i++ {
+		if word, _ := w.GetWord(); word == daily {
+			t.Fatalf("Removed word %q is given", word)
+		}
+	}
+
+	// The removed word of the day is replaced, added words are never the word of the day
+	if got, _ := w.GetDailyWord(day); got == daily || got == "жираф" {
+		t.Errorf("Got daily word %q", got)
+	}
+
+	w.SetChanges(nil, []string{"слон", "еж", "кот"})
+	if _, err := w.GetWord(); err != ErrNoWords {
+		t.Errorf("Empty dictionary: got %v, want ErrNoWords", err)
+	}
+}
@@ -0,0 +1,122 @@
+/*
+ * This file is part of Crocodile Game Bot.
+ * Copyright (C) 2019  Viktor
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	tb "gopkg.in/tucnak/telebot.v2"
+
+	"github.com/nuetoban/crocodile-game-bot/storage"
+)
+
+// How long update IDs are remembered, Telegram retries webhooks within minutes
+const updateDedupTTL = time.Hour
+
+// updateDeduplicator tells whether the update has been taken already by this or another replica
+type updateDeduplicator interface {
+	// Seen marks the update as taken and returns true if it was marked before
+	Seen(updateID int) (bool, error)
+}
+
+// RedisDeduplicator marks updates with SET NX, so only one replica takes the update
+type RedisDeduplicator struct {
+	pool storage.RedisPool
+	ttl  time.Duration
+
+	// Remembers updates while Redis is unavailable
+	local *LocalDeduplicator
+}
+
+// NewRedisDeduplicator returns new instance of RedisDeduplicator
+func NewRedisDeduplicator(pool storage.RedisPool) *RedisDeduplicator {
+	return &RedisDeduplicator{pool: pool, ttl: updateDedupTTL, local: NewLocalDeduplicator()}
+}
+
+// Seen implements updateDeduplicator
+func (d *RedisDeduplicator) Seen(updateID int) (bool, error) {
+	conn := d.pool.Get()
+	defer conn.Close()
+
+	reply, err := conn.Do("SET", "update/"+strconv.Itoa(updateID), 1, "EX", int(d.ttl.Seconds()), "NX")
+	if err != nil {
+		log.Warnf("RedisDeduplicator: Seen: Redis is unavailable, remembering update locally: %v", err)
+		return d.local.Seen(updateID)
+	}
+	// The key has not been set because it exists
+	return reply == nil, nil
+}
+
+// LocalDeduplicator remembers updates in memory, for the bot run in one replica
+type LocalDeduplicator struct {
+	ttl time.Duration
+
+	mu        sync.Mutex
+	seen      map[int]time.Time
+	lastSweep time.Time
+
+	now func() time.Time
+}
+
+// NewLocalDeduplicator returns new instance of LocalDeduplicator
+func NewLocalDeduplicator() *LocalDeduplicator {
+	return &LocalDeduplicator{ttl: updateDedupTTL, seen: make(map[int]time.Time), now: time.Now}
+}
+
+// Seen implements updateDeduplicator
+func (d *LocalDeduplicator) Seen(updateID int) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.now()
+	if now.Sub(d.lastSweep) > d.ttl {
+		d.lastSweep = now
+		for id, at := range d.seen {
+			if now.Sub(at) > d.ttl {
+				delete(d.seen, id)
+			}
+		}
+	}
+
+	if at, ok := d.seen[updateID]; ok && now.Sub(at) <= d.ttl {
+		return true, nil
+	}
+	d.seen[updateID] = now
+	return false, nil
+}
+
+// dedupMiddlewarePoller skips updates which have been taken already,
+// so a retried webhook or a second poller does not count the same guess twice
+func dedupMiddlewarePoller(d updateDeduplicator) func(*tb.Update) bool {
+	return func(upd *tb.Update) bool {
+		seen, err := d.Seen(upd.ID)
+		if err != nil {
+			// Handling the update twice is better than losing it
+			log.Errorf("dedupMiddlewarePoller: cannot check update %d: %v", upd.ID, err)
+			return true
+		}
+		if seen {
+			log.Debugf("Update %d has been taken already, skipping", upd.ID)
+			return false
+		}
+		return true
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gomodule/redigo/redis"
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+func TestDedupMiddlewarePoller(t *testing.T) {
+	log.Out = ioutil.Discard
+
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mr.Close()
+	pool := &redis.Pool{Dial: func() (redis.Conn, error) { return redis.Dial("tcp", mr.Addr()) }}
+
+	// Two replicas receive the same updates, e.g. a webhook retried by Telegram
+	var handled []int
+	handle := func(upd *tb.Update) bool { handled = append(handled, upd.ID); return false }
+	replicas := []func(*tb.Update) bool{
+		chainMiddlewares(dedupMiddlewarePoller(NewRedisDeduplicator(pool)), handle),
+		chainMiddlewares(dedupMiddlewarePoller(NewRedisDeduplicator(pool)), handle),
+	}
+
+	for _, id := range []int{1, 2, 1, 3, 2, 2} {
+		for _, r := range replicas {
+			r(&tb.Update{ID: id, Message: &tb.Message{Text: "крокодил"}})
+		}
+	}
+
+	expected := []int{1, 2, 3}
+	if len(handled) != len(expected) {
+		t.Fatalf("Handled %v, expected %v", handled, expected)
+	}
+	for i := range expected {
+		if handled[i] != expected[i] {
+			t.Fatalf("Handled %v, expected %v", handled, expected)
+		}
+	}
+
+	if ttl := mr.TTL("update/1"); ttl != updateDedupTTL {
+		t.Errorf("TTL of update key is %s", ttl)
+	}
+}
+
+func TestRedisDeduplicatorFallback(t *testing.T) {
+	log.Out = ioutil.Discard
+
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := mr.Addr()
+	mr.Close()
+
+	d := NewRedisDeduplicator(&redis.Pool{Dial: func() (redis.Conn, error) { return redis.Dial("tcp", addr) }})
+	if seen, err := d.Seen(1); seen || err != nil {
+		t.Fatalf("First delivery: got %v, %v", seen, err)
+	}
+	if seen, err := d.Seen(1); !seen || err != nil {
+		t.Fatalf("Second delivery: got %v, %v", seen, err)
+	}
+}
+
+func TestLocalDeduplicatorTTL(t *testing.T) {
+	clock := newFakeClock()
+	d := NewLocalDeduplicator()
+	d.now = clock.now
+
+	if seen, _ := d.Seen(1); seen {
+		t.Fatal("First delivery is seen")
+	}
+	clock.add(updateDedupTTL / 2)
+	if seen, _ := d.Seen(1); !seen {
+		t.Fatal("Second delivery is not seen")
+	}
+
+	clock.add(updateDedupTTL + time.Second)
+	if seen, _ := d.Seen(1); seen {
+		t.Fatal("Update is remembered after TTL")
+	}
+	if seen, _ := d.Seen(1); !seen {
+		t.Fatal("Update delivered after TTL is not remembered again")
+	}
+}
@@ -0,0 +1,172 @@
+/*
+ * This file is part of Crocodile Game Bot.
+ * Copyright (C) 2019  Viktor
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package dispatcher
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Dispatcher runs tasks of one key (e.g. chat) in order, tasks of different keys run concurrently.
+// Every key with queued tasks has its own goroutine, so a task waiting for long (e.g. for a lock of the chat)
+// does not hold up other keys. Keys are sharded to bound queued tasks, workers bound running ones.
+type Dispatcher struct {
+	// MaxPerKey is how many tasks of one key may wait in the queue, further droppable tasks are dropped
+	MaxPerKey int
+
+	shards  []*shard
+	workers chan struct{}
+	dropped uint64
+	started int32
+	wg      sync.WaitGroup
+}
+
+type shard struct {
+	mu    sync.Mutex
+	space *sync.Cond
+
+	// size is how many tasks may be queued to keys of the shard
+	size   int
+	queued int
+
+	// Queues of keys, the running task is the first one
+	queues  map[int64][]func()
+	running map[int64]bool
+}
+
+// New returns new instance of Dispatcher with given count of workers and queue size of each shard
+func New(workers, queueSize, maxPerKey int) *Dispatcher {
+	d := &Dispatcher{MaxPerKey: maxPerKey, workers: make(chan struct{}, workers)}
+	for i := 0; i < workers; i++ {
+		s := &shard{size: queueSize, queues: make(map[int64][]func()), running: make(map[int64]bool)}
+		s.space = sync.NewCond(&s.mu)
+		d.shards = append(d.shards, s)
+	}
+	return d
+}
+
+// Start runs tasks queued so far and the ones dispatched later
+func (d *Dispatcher) Start() {
+	atomic.StoreInt32(&d.started, 1)
+
+	for _, s := range d.shards {
+		s.mu.Lock()
+		for key := range s.queues {
+			d.runKey(s, key)
+		}
+		s.mu.Unlock()
+	}
+}
+
+// Stop waits until all queued tasks are done, Dispatch must not be called after Stop
+func (d *Dispatcher) Stop() {
+	d.wg.Wait()
+}
+
+// Dispatch queues the task and returns false if it has been dropped.
+// Droppable tasks are dropped when the key or the shard queue is overflowed,
+// other tasks block until there is space in the shard queue.
+func (d *Dispatcher) Dispatch(key int64, fn func(), droppable bool) bool {
+	s := d.shard(key)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if droppable && d.MaxPerKey > 0 && len(s.queues[key]) >= d.MaxPerKey {
+		atomic.AddUint64(&d.dropped, 1)
+		return false
+	}
+	for s.queued >= s.size {
+		if droppable {
+			atomic.AddUint64(&d.dropped, 1)
+			return false
+		}
+		s.space.Wait()
+	}
+
+	s.queues[key] = append(s.queues[key], fn)
+	s.queued++
+	if atomic.LoadInt32(&d.started) == 1 {
+		d.runKey(s, key)
+	}
+	return true
+}
+
+// Depths returns count of queued tasks of every shard
+func (d *Dispatcher) Depths() []int {
+	out := make([]int, len(d.shards))
+	for i, s := range d.shards {
+		s.mu.Lock()
+		out[i] = s.queued
+		s.mu.Unlock()
+	}
+	return out
+}
+
+// Dropped returns how many tasks have been dropped
+func (d *Dispatcher) Dropped() uint64 {
+	return atomic.LoadUint64(&d.dropped)
+}
+
+func (d *Dispatcher) shard(key int64) *shard {
+	k := uint64(key)
+	// Spread sequential IDs between shards
+	k ^= k >> 33
+	k *= 0xff51afd7ed558ccd
+	k ^= k >> 33
+	return d.shards[k%uint64(len(d.shards))]
+}
+
+// runKey starts the goroutine of the key unless it runs already, s.mu must be held
+func (d *Dispatcher) runKey(s *shard, key int64) {
+	if s.running[key] {
+		return
+	}
+	s.running[key] = true
+	d.wg.Add(1)
+	go d.run(s, key)
+}
+
+// run does tasks of the key until its queue is empty
+func (d *Dispatcher) run(s *shard, key int64) {
+	defer d.wg.Done()
+
+	for {
+		s.mu.Lock()
+		queue := s.queues[key]
+		if len(queue) == 0 {
+			delete(s.queues, key)
+			delete(s.running, key)
+			s.mu.Unlock()
+			return
+		}
+		fn := queue[0]
+		s.mu.Unlock()
+
+		d.workers <- struct{}{}
+		fn()
+		<-d.workers
+
+		s.mu.Lock()
+		s.queues[key] = s.queues[key][1:]
+		s.queued--
+		s.space.Signal()
+		s.mu.Unlock()
+	}
+}
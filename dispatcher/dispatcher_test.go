@@ -0,0 +1,116 @@
+/*
+ * This file is part of Crocodile Game Bot.
+ * Copyright (C) 2019  Viktor
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package dispatcher
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDispatcherOrder(t *testing.T) {
+	d := New(4, 100, 0)
+	d.Start()
+
+	const keys, tasks = 10, 100
+
+	var mu sync.Mutex
+	got := make(map[int64][]int)
+
+	for i := 0; i < tasks; i++ {
+		for k := int64(0); k < keys; k++ {
+			i, k := i, k
+			d.Dispatch(k, func() {
+				mu.Lock()
+				got[k] = append(got[k], i)
+				mu.Unlock()
+			}, false)
+		}
+	}
+	d.Stop()
+
+	for k := int64(0); k < keys; k++ {
+		if len(got[k]) != tasks {
+			t.Fatalf("Key %d: got %d tasks, expected %d", k, len(got[k]), tasks)
+		}
+		for i, v := range got[k] {
+			if v != i {
+				t.Fatalf("Key %d: tasks are out of order: %v", k, got[k])
+			}
+		}
+	}
+}
+
+func TestDispatcherDropsOverflow(t *testing.T) {
+	d := New(1, 100, 3)
+
+	// Workers are not started, so the tasks stay in the queue
+	for i := 0; i < 5; i++ {
+		d.Dispatch(1, func() {}, true)
+	}
+	if dropped := d.Dropped(); dropped != 2 {
+		t.Errorf("Dropped: got %d, expected 2", dropped)
+	}
+
+	// Not droppable tasks are queued anyway
+	if !d.Dispatch(1, func() {}, false) {
+		t.Errorf("Not droppable task has been dropped")
+	}
+
+	// Other keys are not affected
+	if !d.Dispatch(2, func() {}, true) {
+		t.Errorf("Task of another key has been dropped")
+	}
+
+	if depth := d.Depths()[0]; depth != 5 {
+		t.Errorf("Depth: got %d, expected 5", depth)
+	}
+
+	d.Start()
+	d.Stop()
+
+	if depth := d.Depths()[0]; depth != 0 {
+		t.Errorf("Depth after stop: got %d, expected 0", depth)
+	}
+}
+
+func TestDispatcherBlockedKeyDoesNotStallShard(t *testing.T) {
+	d := New(2, 100, 0)
+	d.Start()
+
+	// Another key of the same shard
+	other := int64(2)
+	for d.shard(other) != d.shard(1) {
+		other++
+	}
+
+	release := make(chan struct{})
+	d.Dispatch(1, func() { <-release }, false)
+
+	done := make(chan struct{})
+	d.Dispatch(other, func() { close(done) }, false)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("Task of another key waits for the blocked key")
+	}
+	close(release)
+	d.Stop()
+}
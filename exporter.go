@@ -1,36 +1,26 @@
 package main
 
 import (
-	"os"
+	"strconv"
 
 	"github.com/prometheus/client_golang/prometheus"
 )
 
 type metricsCollector struct {
-	sg StatisticsGetter
+	stats *statisticsCache
 
-	textUpdatesRecieved *prometheus.Desc
-	chatsTotal          *prometheus.Desc
-	usersTotal          *prometheus.Desc
-	gamesTotal          *prometheus.Desc
-	startTotal          *prometheus.Desc
-	ratingTotal         *prometheus.Desc
-	globalRatingTotal   *prometheus.Desc
-	cstatTotal          *prometheus.Desc
-	chatsRatingTotal    *prometheus.Desc
+	chatsTotal     *prometheus.Desc
+	usersTotal     *prometheus.Desc
+	gamesTotal     *prometheus.Desc
+	queueDepth     *prometheus.Desc
+	droppedTotal   *prometheus.Desc
+	senderQueued   *prometheus.Desc
+	senderMessages *prometheus.Desc
 }
 
-var (
-	hostname, _ = os.Hostname()
-)
-
-func newMetricsCollector(sg StatisticsGetter) *metricsCollector {
+func newMetricsCollector(stats *statisticsCache) *metricsCollector {
 	return &metricsCollector{
-		sg: sg,
-		textUpdatesRecieved: prometheus.NewDesc("text_updates_total",
-			"Shows how many text updates has been recieved",
-			[]string{"hostname"}, nil,
-		),
+		stats: stats,
 		chatsTotal: prometheus.NewDesc("chats_total",
 			"Shows how many chats are in the bot",
 			nil, nil,
@@ -43,54 +33,57 @@ func newMetricsCollector(sg StatisticsGetter) *metricsCollector {
 			"Shows how many games has been played",
 			nil, nil,
 		),
-		startTotal: prometheus.NewDesc("start_total",
-			"Shows how many times /start command has been called",
-			[]string{"hostname"}, nil,
-		),
-		ratingTotal: prometheus.NewDesc("rating_total",
-			"Shows how many times /rating command has been called",
-			[]string{"hostname"}, nil,
+		queueDepth: prometheus.NewDesc("dispatcher_queue_depth",
+			"Shows how many updates are waiting in the queue of the worker",
+			[]string{"hostname", "worker"}, nil,
 		),
-		globalRatingTotal: prometheus.NewDesc("globalrating_total",
-			"Shows how many times /globalrating command has been called",
+		droppedTotal: prometheus.NewDesc("dispatcher_dropped_total",
+			"Shows how many updates have been dropped because of chat flood",
 			[]string{"hostname"}, nil,
 		),
-		cstatTotal: prometheus.NewDesc("cstat_total",
-			"Shows how many times /cstat command has been called",
+		senderQueued: prometheus.NewDesc("sender_queue_depth",
+			"Shows how many outgoing messages are waiting to be sent",
 			[]string{"hostname"}, nil,
 		),
-		chatsRatingTotal: prometheus.NewDesc("chatrating_total",
-			"Shows how many times /chatrating command has been called",
-			[]string{"hostname"}, nil,
+		senderMessages: prometheus.NewDesc("sender_messages_total",
+			"Shows how many outgoing messages have been sent, retried, failed or dropped",
+			[]string{"hostname", "result"}, nil,
 		),
 	}
 }
 
 // Writes all descriptors to the prometheus desc channel
 func (c *metricsCollector) Describe(ch chan<- *prometheus.Desc) {
-	ch <- c.textUpdatesRecieved
 	ch <- c.chatsTotal
 	ch <- c.usersTotal
 	ch <- c.gamesTotal
-	ch <- c.startTotal
-	ch <- c.ratingTotal
-	ch <- c.globalRatingTotal
-	ch <- c.cstatTotal
-	ch <- c.chatsRatingTotal
+	ch <- c.queueDepth
+	ch <- c.droppedTotal
+	ch <- c.senderQueued
+	ch <- c.senderMessages
 }
 
 // Collect implements required collect function for all promehteus collectors
 func (c *metricsCollector) Collect(ch chan<- prometheus.Metric) {
-	stats, _ := c.sg.GetStatistics()
+	// Totals are refreshed in background, the database is not queried on scrape
+	if stats, ok := c.stats.Get(); ok {
+		ch <- prometheus.MustNewConstMetric(c.chatsTotal, prometheus.CounterValue, float64(stats.Chats))
+		ch <- prometheus.MustNewConstMetric(c.usersTotal, prometheus.CounterValue, float64(stats.Users))
+		ch <- prometheus.MustNewConstMetric(c.gamesTotal, prometheus.CounterValue, float64(stats.GamesPlayed))
+	}
 
-	// TODO Get rid of textUpdatesRecieved global variable
-	ch <- prometheus.MustNewConstMetric(c.textUpdatesRecieved, prometheus.CounterValue, textUpdatesRecieved, hostname)
-	ch <- prometheus.MustNewConstMetric(c.chatsTotal, prometheus.CounterValue, float64(stats.Chats))
-	ch <- prometheus.MustNewConstMetric(c.usersTotal, prometheus.CounterValue, float64(stats.Users))
-	ch <- prometheus.MustNewConstMetric(c.gamesTotal, prometheus.CounterValue, float64(stats.GamesPlayed))
-	ch <- prometheus.MustNewConstMetric(c.startTotal, prometheus.CounterValue, startTotal, hostname)
-	ch <- prometheus.MustNewConstMetric(c.ratingTotal, prometheus.CounterValue, ratingTotal, hostname)
-	ch <- prometheus.MustNewConstMetric(c.globalRatingTotal, prometheus.CounterValue, globalRatingTotal, hostname)
-	ch <- prometheus.MustNewConstMetric(c.cstatTotal, prometheus.CounterValue, cstatTotal, hostname)
-	ch <- prometheus.MustNewConstMetric(c.chatsRatingTotal, prometheus.CounterValue, chatsRatingTotal, hostname)
+	if updatesDispatcher != nil {
+		for i, depth := range updatesDispatcher.Depths() {
+			ch <- prometheus.MustNewConstMetric(c.queueDepth, prometheus.GaugeValue, float64(depth), hostname, strconv.Itoa(i))
+		}
+		ch <- prometheus.MustNewConstMetric(c.droppedTotal, prometheus.CounterValue, float64(updatesDispatcher.Dropped()), hostname)
+	}
+
+	if messageSender != nil {
+		st := messageSender.Stats()
+		ch <- prometheus.MustNewConstMetric(c.senderQueued, prometheus.GaugeValue, float64(st.Queued), hostname)
+		for result, v := range map[string]uint64{"sent": st.Sent, "retried": st.Retried, "failed": st.Failed, "dropped": st.Dropped} {
+			ch <- prometheus.MustNewConstMetric(c.senderMessages, prometheus.CounterValue, float64(v), hostname, result)
+		}
+	}
 }
@@ -1,17 +1,26 @@
 module github.com/nuetoban/crocodile-game-bot
 
-go 1.13
+go 1.16
 
 require (
+	github.com/BurntSushi/toml v1.2.1
+	github.com/alicebob/miniredis/v2 v2.30.0
 	github.com/go-redsync/redsync v1.3.1
 	github.com/gomodule/redigo v2.0.0+incompatible
 	github.com/jinzhu/gorm v1.9.11
-	github.com/kr/pretty v0.2.0 // indirect
+	github.com/lib/pq v1.1.1
 	github.com/looplab/fsm v0.1.0
 	github.com/mattn/go-colorable v0.1.4 // indirect
+	github.com/mattn/go-sqlite3 v1.11.0
 	github.com/mgutz/ansi v0.0.0-20170206155736-9520e82c474b // indirect
+	github.com/mna/redisc v1.3.2
 	github.com/prometheus/client_golang v1.3.0
 	github.com/sirupsen/logrus v1.4.2
 	github.com/x-cray/logrus-prefixed-formatter v0.5.2
+	go.opentelemetry.io/otel v1.7.0
+	go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp v1.7.0
+	go.opentelemetry.io/otel/sdk v1.7.0
+	go.opentelemetry.io/otel/trace v1.7.0
 	gopkg.in/tucnak/telebot.v2 v2.0.0-20191225234705-baa616bc00d5
+	gopkg.in/yaml.v3 v3.0.1
 )
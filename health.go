@@ -0,0 +1,162 @@
+/*
+ * This file is part of Crocodile Game Bot.
+ * Copyright (C) 2019  Viktor
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// healthCheck checks a dependency, the bot is not ready when a critical check fails
+type healthCheck struct {
+	name     string
+	critical bool
+	check    func(ctx context.Context) error
+}
+
+// health serves /healthz and /readyz
+type health struct {
+	checks []healthCheck
+
+	// The bot is considered stuck when no updates have come for maxIdle, 0 disables the check.
+	// Quiet bots get no updates for hours, so it is disabled by default.
+	maxIdle time.Duration
+
+	// Unix time in nanoseconds, accessed atomically
+	lastUpdate int64
+	polling    int32
+
+	now func() time.Time
+}
+
+type checkStatus struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type healthStatus struct {
+	Status            string                 `json:"status"`
+	Poller            string                 `json:"poller"`
+	LastUpdateSeconds float64                `json:"last_update_seconds"`
+	Checks            map[string]checkStatus `json:"checks,omitempty"`
+}
+
+func newHealth(checks ...healthCheck) *health {
+	h := &health{checks: checks, now: time.Now}
+	h.UpdateReceived()
+	return h
+}
+
+// UpdateReceived is called for every update from Telegram
+func (h *health) UpdateReceived() {
+	atomic.StoreInt64(&h.lastUpdate, h.now().UnixNano())
+}
+
+// SetPolling reports whether the poller is running
+func (h *health) SetPolling(running bool) {
+	var v int32
+	if running {
+		v = 1
+	}
+	atomic.StoreInt32(&h.polling, v)
+}
+
+// alive checks the poller and how long ago the last update has come
+func (h *health) alive() healthStatus {
+	idle := h.now().Sub(time.Unix(0, atomic.LoadInt64(&h.lastUpdate)))
+	s := healthStatus{Status: "ok", Poller: "running", LastUpdateSeconds: idle.Seconds()}
+
+	if atomic.LoadInt32(&h.polling) == 0 {
+		s.Status, s.Poller = "fail", "stopped"
+	}
+	if h.maxIdle > 0 && idle > h.maxIdle {
+		s.Status = "fail"
+	}
+	return s
+}
+
+// healthz tells Kubernetes whether the bot should be restarted, dependencies are not checked
+func (h *health) healthz(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, h.alive())
+}
+
+// readyz checks dependencies as well, failed non-critical checks are only reported
+func (h *health) readyz(w http.ResponseWriter, r *http.Request) {
+	s := h.alive()
+	s.Checks = make(map[string]checkStatus, len(h.checks))
+
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+
+	for _, c := range h.checks {
+		if err := c.check(ctx); err != nil {
+			s.Checks[c.name] = checkStatus{Status: "fail", Error: err.Error()}
+			if c.critical {
+				s.Status = "fail"
+			}
+			continue
+		}
+		s.Checks[c.name] = checkStatus{Status: "ok"}
+	}
+
+	writeHealth(w, s)
+}
+
+func writeHealth(w http.ResponseWriter, s healthStatus) {
+	w.Header().Set("Content-Type", "application/json")
+	if s.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(s); err != nil {
+		log.Errorf("Cannot write health status: %v", err)
+	}
+}
+
+// redisGetter is a pool of Redis connections
+type redisGetter interface {
+	Get() redis.Conn
+}
+
+// pingRedis returns check of Redis, PING is given up when ctx is done
+// so probes do not pile up while Redis hangs
+func pingRedis(pool redisGetter) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		timeout := time.Second
+		if deadline, ok := ctx.Deadline(); ok {
+			timeout = time.Until(deadline)
+		}
+		if timeout <= 0 {
+			return context.DeadlineExceeded
+		}
+
+		conn := pool.Get()
+		defer conn.Close()
+		_, err := redis.DoWithTimeout(conn, timeout, "PING")
+		return err
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+func getHealth(t *testing.T, handler http.HandlerFunc) (int, healthStatus) {
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("GET", "/", nil))
+
+	var s healthStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &s); err != nil {
+		t.Fatalf("Cannot decode %q: %v", rec.Body.String(), err)
+	}
+	return rec.Code, s
+}
+
+func TestHealth(t *testing.T) {
+	log.Out = ioutil.Discard
+	clock := newFakeClock()
+
+	var redisErr error
+	h := newHealth(
+		healthCheck{name: "postgres", critical: true, check: func(context.Context) error { return nil }},
+		healthCheck{name: "redis", check: func(context.Context) error { return redisErr }},
+	)
+	h.now = clock.now
+	h.UpdateReceived()
+
+	if code, s := getHealth(t, h.healthz); code != http.StatusServiceUnavailable || s.Poller != "stopped" {
+		t.Errorf("Poller is not started: got %d %+v", code, s)
+	}
+
+	h.SetPolling(true)
+	clock.add(time.Minute)
+	if code, s := getHealth(t, h.healthz); code != http.StatusOK || s.LastUpdateSeconds != 60 {
+		t.Errorf("Healthy bot: got %d %+v", code, s)
+	}
+
+	// Redis is not critical, the bot keeps working without it
+	redisErr = errors.New("connection refused")
+	code, s := getHealth(t, h.readyz)
+	if code != http.StatusOK || s.Checks["redis"].Status != "fail" || s.Checks["postgres"].Status != "ok" {
+		t.Errorf("Ready bot without Redis: got %d %+v", code, s)
+	}
+
+	h.checks[0].check = func(context.Context) error { return errors.New("connection refused") }
+	if code, s := getHealth(t, h.readyz); code != http.StatusServiceUnavailable || s.Checks["postgres"].Error == "" {
+		t.Errorf("Bot without Postgres: got %d %+v", code, s)
+	}
+	// Liveness does not depend on Postgres
+	if code, _ := getHealth(t, h.healthz); code != http.StatusOK {
+		t.Errorf("Liveness without Postgres: got %d", code)
+	}
+
+	// Quiet bot is not restarted unless the idle check is enabled
+	clock.add(24 * time.Hour)
+	if code, _ := getHealth(t, h.healthz); code != http.StatusOK {
+		t.Errorf("Quiet bot: got %d", code)
+	}
+	h.maxIdle = time.Hour
+	if code, _ := getHealth(t, h.healthz); code != http.StatusServiceUnavailable {
+		t.Errorf("Stuck bot: got %d", code)
+	}
+}
+
+func TestPingRedisRespectsContext(t *testing.T) {
+	// Nothing answers, so the connection hangs
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	pool := &redis.Pool{Dial: func() (redis.Conn, error) { return redis.Dial("tcp", l.Addr().String()) }}
+	defer pool.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := pingRedis(pool)(ctx); err == nil {
+		t.Errorf("Ping of hung Redis has succeeded")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Ping has taken %s", d)
+	}
+	if n := pool.ActiveCount(); n != 0 {
+		t.Errorf("Connections left active: %d", n)
+	}
+
+	// Nothing is sent when the time is already over
+	<-ctx.Done()
+	if err := pingRedis(pool)(ctx); err != ctx.Err() {
+		t.Errorf("Got %v, want %v", err, ctx.Err())
+	}
+}
@@ -0,0 +1,108 @@
+/*
+ * This file is part of Crocodile Game Bot.
+ * Copyright (C) 2019  Viktor
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package locker
+
+import (
+	"errors"
+	"sync"
+)
+
+var (
+	// ErrNotLocked is returned when lock is released twice
+	ErrNotLocked = errors.New("lock is not held")
+
+	// ErrLeaseLost is returned on unlock when the distributed lock has expired while being held
+	ErrLeaseLost = errors.New("lock lease has been lost")
+)
+
+// ChatLocker serializes processing of updates of one chat
+type ChatLocker interface {
+	Lock(chatID int64) (Lock, error)
+}
+
+// Lock is a held chat lock
+type Lock interface {
+	Unlock() error
+}
+
+// Local is in-process ChatLocker, it works only when the bot is run in one replica
+type Local struct {
+	mu    sync.Mutex
+	locks map[int64]*localEntry
+}
+
+type localEntry struct {
+	mu sync.Mutex
+
+	// How many goroutines hold or wait for the lock, guarded by Local.mu
+	refs int
+}
+
+type localLock struct {
+	locker *Local
+	chatID int64
+	entry  *localEntry
+	once   sync.Once
+}
+
+// NewLocal returns new instance of Local
+func NewLocal() *Local {
+	return &Local{locks: make(map[int64]*localEntry)}
+}
+
+// Lock blocks until the chat lock is acquired
+func (l *Local) Lock(chatID int64) (Lock, error) {
+	l.mu.Lock()
+	e, ok := l.locks[chatID]
+	if !ok {
+		e = &localEntry{}
+		l.locks[chatID] = e
+	}
+	e.refs++
+	l.mu.Unlock()
+
+	e.mu.Lock()
+
+	return &localLock{locker: l, chatID: chatID, entry: e}, nil
+}
+
+// Len returns how many chats are locked or awaited at the moment
+func (l *Local) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.locks)
+}
+
+func (l *localLock) Unlock() error {
+	err := ErrNotLocked
+	l.once.Do(func() {
+		l.entry.mu.Unlock()
+
+		l.locker.mu.Lock()
+		l.entry.refs--
+		// Nobody waits for the lock, forget about the chat
+		if l.entry.refs == 0 {
+			delete(l.locker.locks, l.chatID)
+		}
+		l.locker.mu.Unlock()
+
+		err = nil
+	})
+	return err
+}
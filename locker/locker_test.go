@@ -0,0 +1,198 @@
+/*
+ * This file is part of Crocodile Game Bot.
+ * Copyright (C) 2019  Viktor
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package locker
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redsync/redsync"
+	"github.com/gomodule/redigo/redis"
+)
+
+func newRedisPool(t *testing.T) (*miniredis.Miniredis, *redis.Pool) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("Cannot start miniredis: %v", err)
+	}
+
+	addr := s.Addr()
+	pool := &redis.Pool{
+		MaxIdle: 10,
+		Dial:    func() (redis.Conn, error) { return redis.Dial("tcp", addr) },
+	}
+	return s, pool
+}
+
+// hammer locks chats from many goroutines and checks that nobody holds the same chat at once
+func hammer(t *testing.T, lockers []ChatLocker, chats, goroutines, iterations int) {
+	holders := make([]int32, chats)
+	counters := make([]int, chats)
+
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			l := lockers[g%len(lockers)]
+
+			for i := 0; i < iterations; i++ {
+				chat := (g + i) % chats
+
+				lock, err := l.Lock(int64(chat))
+				if err != nil {
+					t.Errorf("Cannot lock chat %d: %v", chat, err)
+					return
+				}
+
+				if n := atomic.AddInt32(&holders[chat], 1); n != 1 {
+					t.Errorf("Chat %d is held by %d goroutines", chat, n)
+				}
+				// Unprotected read-modify-write, the race detector complains if the lock does not work
+				counters[chat]++
+				atomic.AddInt32(&holders[chat], -1)
+
+				if err := lock.Unlock(); err != nil {
+					t.Errorf("Cannot unlock chat %d: %v", chat, err)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	total := 0
+	for _, c := range counters {
+		total += c
+	}
+	if total != goroutines*iterations {
+		t.Errorf("Lost updates: got %d, expected %d", total, goroutines*iterations)
+	}
+}
+
+func TestLocal(t *testing.T) {
+	l := NewLocal()
+	hammer(t, []ChatLocker{l}, 3, 50, 100)
+
+	if n := l.Len(); n != 0 {
+		t.Errorf("Released locks should be forgotten, %d left", n)
+	}
+}
+
+func TestLocalDoubleUnlock(t *testing.T) {
+	lock, _ := NewLocal().Lock(1)
+	if err := lock.Unlock(); err != nil {
+		t.Fatalf("Unlock: %v", err)
+	}
+	if err := lock.Unlock(); err != ErrNotLocked {
+		t.Errorf("Second unlock: got %v, expected %v", err, ErrNotLocked)
+	}
+}
+
+func TestRedis(t *testing.T) {
+	s, pool := newRedisPool(t)
+	defer s.Close()
+
+	// Two lockers act as two replicas sharing one Redis
+	var lockers []ChatLocker
+	for i := 0; i < 2; i++ {
+		r := NewRedis(pool)
+		r.RetryDelay = time.Millisecond
+		r.Tries = 10000
+		lockers = append(lockers, r)
+	}
+
+	hammer(t, lockers, 3, 10, 20)
+}
+
+func TestRedisLeaseExtension(t *testing.T) {
+	s, pool := newRedisPool(t)
+	defer s.Close()
+
+	r := NewRedis(pool)
+	r.Expiry = 300 * time.Millisecond
+
+	lock, err := r.Lock(1)
+	if err != nil {
+		t.Fatalf("Lock: %v", err)
+	}
+
+	// Hold the lock longer than the lease, the key must not expire
+	for i := 0; i < 10; i++ {
+		time.Sleep(100 * time.Millisecond)
+		s.FastForward(100 * time.Millisecond)
+	}
+	if !s.Exists("mutex/1") {
+		t.Fatalf("Lease has not been extended")
+	}
+
+	// Another replica cannot take the held lock
+	other := NewRedis(pool)
+	other.Tries = 3
+	other.RetryDelay = time.Millisecond
+	if _, err := other.Lock(1); err != redsync.ErrFailed {
+		t.Errorf("Held lock has been acquired by another replica: %v", err)
+	}
+
+	if err := lock.Unlock(); err != nil {
+		t.Errorf("Unlock: %v", err)
+	}
+	if s.Exists("mutex/1") {
+		t.Errorf("Lock key should be deleted after unlock")
+	}
+}
+
+func TestRedisLeaseLost(t *testing.T) {
+	s, pool := newRedisPool(t)
+	defer s.Close()
+
+	r := NewRedis(pool)
+	r.Expiry = 300 * time.Millisecond
+
+	lock, err := r.Lock(1)
+	if err != nil {
+		t.Fatalf("Lock: %v", err)
+	}
+
+	// Somebody has removed the key, e.g. Redis has been restarted
+	s.Del("mutex/1")
+	time.Sleep(150 * time.Millisecond)
+
+	if err := lock.Unlock(); err != ErrLeaseLost {
+		t.Errorf("Unlock: got %v, expected %v", err, ErrLeaseLost)
+	}
+}
+
+func TestRedisUnavailable(t *testing.T) {
+	s, pool := newRedisPool(t)
+	s.Close()
+
+	r := NewRedis(pool)
+	r.Tries = 3
+	r.RetryDelay = time.Millisecond
+	if _, err := r.Lock(1); err == nil {
+		t.Fatalf("Lock has been acquired without Redis")
+	}
+
+	// Chats are locked within the replica while Redis is down
+	r.Available = func() bool { return false }
+	hammer(t, []ChatLocker{r}, 3, 10, 20)
+}
@@ -0,0 +1,150 @@
+/*
+ * This file is part of Crocodile Game Bot.
+ * Copyright (C) 2019  Viktor
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package locker
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redsync/redsync"
+)
+
+// Redis is ChatLocker shared between replicas, the lease is extended while the lock is held
+type Redis struct {
+	// Expiry is the lease time, the lock is released by Redis if the holder dies
+	Expiry time.Duration
+
+	// How many times and how often to try acquiring the lock
+	Tries      int
+	RetryDelay time.Duration
+
+	// Available is optional, while it returns false chats are locked only
+	// within this replica instead of waiting for Redis
+	Available func() bool
+
+	rs *redsync.Redsync
+
+	// Goroutines of this replica wait for each other locally instead of polling Redis
+	local *Local
+}
+
+type redisLock struct {
+	mutex *redsync.Mutex
+	local Lock
+
+	stop chan struct{}
+	done chan struct{}
+	once sync.Once
+
+	// Set by the extending goroutine if the lease could not be extended
+	mu   sync.Mutex
+	lost bool
+}
+
+// NewRedis returns new instance of Redis locker
+func NewRedis(pools ...redsync.Pool) *Redis {
+	return &Redis{
+		Expiry:     8 * time.Second,
+		Tries:      200,
+		RetryDelay: 50 * time.Millisecond,
+
+		rs:    redsync.New(pools),
+		local: NewLocal(),
+	}
+}
+
+// Lock blocks until the chat lock is acquired or tries are exhausted
+func (r *Redis) Lock(chatID int64) (Lock, error) {
+	local, err := r.local.Lock(chatID)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.Available != nil && !r.Available() {
+		return local, nil
+	}
+
+	mutex := r.rs.NewMutex(
+		"mutex/"+strconv.FormatInt(chatID, 10),
+		redsync.SetExpiry(r.Expiry),
+		redsync.SetTries(r.Tries),
+		redsync.SetRetryDelay(r.RetryDelay),
+	)
+	if err := mutex.Lock(); err != nil {
+		// Redis has gone while we were trying
+		if r.Available != nil && !r.Available() {
+			return local, nil
+		}
+		local.Unlock()
+		return nil, err
+	}
+
+	l := &redisLock{
+		mutex: mutex,
+		local: local,
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	go l.extend(r.Expiry / 3)
+
+	return l, nil
+}
+
+// extend keeps the lease alive until the lock is released
+func (l *redisLock) extend(interval time.Duration) {
+	defer close(l.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			if !l.mutex.Extend() {
+				l.mu.Lock()
+				l.lost = true
+				l.mu.Unlock()
+			}
+		}
+	}
+}
+
+func (l *redisLock) Unlock() error {
+	err := ErrNotLocked
+	l.once.Do(func() {
+		close(l.stop)
+		<-l.done
+
+		l.mu.Lock()
+		lost := l.lost
+		l.mu.Unlock()
+
+		released := l.mutex.Unlock()
+		l.local.Unlock()
+
+		err = nil
+		if lost || !released {
+			err = ErrLeaseLost
+		}
+	})
+	return err
+}
@@ -19,11 +19,14 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"os"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/x-cray/logrus-prefixed-formatter"
+	tb "gopkg.in/tucnak/telebot.v2"
 )
 
 var log = logrus.New()
@@ -40,6 +43,19 @@ func logInit() {
 	log.SetOutput(os.Stdout)
 }
 
+// setLogFormat switches between colored text for terminals and JSON for log collectors
+func setLogFormat(format string) error {
+	switch format {
+	case "text":
+		logInit()
+	case "json":
+		log.Formatter = &logrus.JSONFormatter{TimestampFormat: time.RFC3339Nano}
+	default:
+		return errors.New("unknown log format")
+	}
+	return nil
+}
+
 func setLogLevel(level string) error {
 	switch level {
 	case "PANIC":
@@ -61,3 +77,30 @@ func setLogLevel(level string) error {
 	}
 	return nil
 }
+
+type logKey struct{}
+
+// withLog returns context carrying the logger of the update
+func withLog(ctx context.Context, l *logrus.Entry) context.Context {
+	return context.WithValue(ctx, logKey{}, l)
+}
+
+// logFrom returns the logger of the update, the global one if there is no update
+func logFrom(ctx context.Context) *logrus.Entry {
+	if l, ok := ctx.Value(logKey{}).(*logrus.Entry); ok {
+		return l
+	}
+	return logrus.NewEntry(log)
+}
+
+// updateLog returns logger adding IDs of the update, its chat and user to every line
+func updateLog(upd *tb.Update) *logrus.Entry {
+	fields := logrus.Fields{"update_id": upd.ID}
+	if chatID := updateChatID(upd); chatID != 0 {
+		fields["chat_id"] = chatID
+	}
+	if userID := updateUserID(upd); userID != 0 {
+		fields["user_id"] = userID
+	}
+	return log.WithFields(fields)
+}
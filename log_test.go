@@ -0,0 +1,67 @@
+/*
+ * This file is part of Crocodile Game Bot.
+ * Copyright (C) 2019  Viktor
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+func TestUpdateLog(t *testing.T) {
+	var out bytes.Buffer
+	log.Out = &out
+	if err := setLogFormat("json"); err != nil {
+		t.Fatal(err)
+	}
+	defer logInit()
+
+	upd := &tb.Update{ID: 7, Callback: &tb.Callback{
+		Sender:  &tb.User{ID: 10},
+		Message: &tb.Message{Chat: &tb.Chat{ID: -100}},
+	}}
+	ctx := withLog(context.Background(), updateLog(upd))
+	logFrom(ctx).Info("handled")
+
+	var line map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &line); err != nil {
+		t.Fatalf("Log line is not JSON: %v: %s", err, out.String())
+	}
+	for field, expected := range map[string]float64{"update_id": 7, "chat_id": -100, "user_id": 10} {
+		if line[field] != expected {
+			t.Errorf("%s: got %v, expected %v", field, line[field], expected)
+		}
+	}
+	if line["msg"] != "handled" {
+		t.Errorf("msg: got %v", line["msg"])
+	}
+
+	// Logs outside of updates go to the global logger
+	out.Reset()
+	logFrom(context.Background()).Info("started")
+	if bytes.Contains(out.Bytes(), []byte("update_id")) {
+		t.Errorf("Global log line has fields of the update: %s", out.String())
+	}
+
+	if err := setLogFormat("xml"); err == nil {
+		t.Errorf("Unknown format has been accepted")
+	}
+}
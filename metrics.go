@@ -0,0 +1,257 @@
+/*
+ * This file is part of Crocodile Game Bot.
+ * Copyright (C) 2019  Viktor
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/nuetoban/crocodile-game-bot/model"
+	"github.com/nuetoban/crocodile-game-bot/storage"
+)
+
+var (
+	hostname, _ = os.Hostname()
+	hostLabels  = prometheus.Labels{"hostname": hostname}
+
+	textUpdatesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name:        "text_updates_total",
+		Help:        "Shows how many text updates has been recieved",
+		ConstLabels: hostLabels,
+	})
+	commandsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name:        "commands_total",
+		Help:        "Shows how many times every command has been called",
+		ConstLabels: hostLabels,
+	}, []string{"command"})
+	// Counters of commands exported before commands_total, they are kept for existing dashboards and alerts
+	legacyCommandsTotal = map[string]prometheus.Counter{
+		"/start":        newLegacyCommandCounter("start_total", "/start"),
+		"/daily":        newLegacyCommandCounter("daily_total", "/daily"),
+		"/rating":       newLegacyCommandCounter("rating_total", "/rating"),
+		"/globalrating": newLegacyCommandCounter("globalrating_total", "/globalrating"),
+		"/cstat":        newLegacyCommandCounter("cstat_total", "/cstat"),
+		"/chatrating":   newLegacyCommandCounter("chatrating_total", "/chatrating"),
+		"/dailyrating":  newLegacyCommandCounter("dailyrating_total", "/dailyrating"),
+		"/achievements": newLegacyCommandCounter("achievements_total", "/achievements"),
+		"/me":           newLegacyCommandCounter("me_total", "/me"),
+		"/stats":        newLegacyCommandCounter("stats_total", "/stats"),
+	}
+	callbacksTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name:        "callbacks_total",
+		Help:        "Shows how many times every inline button has been pressed",
+		ConstLabels: hostLabels,
+	}, []string{"button"})
+	handlerDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:        "handler_duration_seconds",
+		Help:        "Shows how long updates are handled",
+		ConstLabels: hostLabels,
+	}, []string{"handler"})
+
+	roundDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:        "round_duration_seconds",
+		Help:        "Shows how long rounds last",
+		ConstLabels: hostLabels,
+		Buckets:     []float64{10, 30, 60, 120, 300, 600, 1800, 3600},
+	}, []string{"result"})
+	roundTimeToGuess = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:        "round_time_to_guess_seconds",
+		Help:        "Shows how long the word is guessed after the host has seen it",
+		ConstLabels: hostLabels,
+		Buckets:     []float64{5, 10, 30, 60, 120, 300, 600},
+	})
+	roundSkips = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:        "round_skips",
+		Help:        "Shows how many times the host changes the word in a round",
+		ConstLabels: hostLabels,
+		Buckets:     []float64{0, 1, 2, 3, 5, 10},
+	})
+
+	redisDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:        "redis_command_duration_seconds",
+		Help:        "Shows how long Redis commands take",
+		ConstLabels: hostLabels,
+		Buckets:     []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, 1},
+	}, []string{"command"})
+	databaseDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:        "database_query_duration_seconds",
+		Help:        "Shows how long database queries take",
+		ConstLabels: hostLabels,
+		Buckets:     []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 5},
+	}, []string{"operation"})
+
+	rateLimitHits = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name:        "rate_limit_hits_total",
+		Help:        "Shows how many commands have been ignored and outgoing messages have waited because of rate limits",
+		ConstLabels: hostLabels,
+	}, []string{"budget"})
+)
+
+func newLegacyCommandCounter(name, command string) prometheus.Counter {
+	return prometheus.NewCounter(prometheus.CounterOpts{
+		Name:        name,
+		Help:        "Shows how many times " + command + " command has been called, use commands_total instead",
+		ConstLabels: hostLabels,
+	})
+}
+
+// registerMetrics registers metrics of the bot and the collector of gauges
+func registerMetrics(r prometheus.Registerer, c prometheus.Collector) {
+	r.MustRegister(
+		textUpdatesTotal, commandsTotal, callbacksTotal, handlerDuration,
+		roundDuration, roundTimeToGuess, roundSkips,
+		redisDuration, databaseDuration, rateLimitHits,
+		c,
+	)
+	for _, counter := range legacyCommandsTotal {
+		r.MustRegister(counter)
+	}
+}
+
+// countLegacyCommand increments the counter of the command exported before commands_total
+func countLegacyCommand(command string) {
+	if counter, ok := legacyCommandsTotal[command]; ok {
+		counter.Inc()
+	}
+}
+
+// observeHandler counts the update if counter is set, observes its handling time and traces it
+func observeHandler(ctx context.Context, counter prometheus.Counter, handler string, f func(context.Context)) {
+	ctx, span := startSpan(ctx, "handler "+handler)
+	defer span.End()
+
+	start := time.Now()
+	f(ctx)
+	if counter != nil {
+		counter.Inc()
+	}
+	handlerDuration.WithLabelValues(handler).Observe(time.Since(start).Seconds())
+}
+
+// Labels of rate limit hits
+var rateDenialBudgets = map[rateDenial]string{
+	rateDeniedGlobal: "global",
+	rateDeniedChat:   "chat",
+	rateDeniedUser:   "user",
+}
+
+// roundMetrics observes finished rounds
+type roundMetrics struct{}
+
+func (roundMetrics) RoundFinished(r model.Round) []string {
+	result := "timeout"
+	if r.Success() {
+		result = "guessed"
+		if !r.SeenAt.IsZero() {
+			roundTimeToGuess.Observe(r.FinishedAt.Sub(r.SeenAt).Seconds())
+		}
+	}
+	roundDuration.WithLabelValues(result).Observe(r.Duration().Seconds())
+	roundSkips.Observe(float64(r.Skips))
+	return nil
+}
+
+// observeRedisCommand is redisconn.Client.Observe
+func observeRedisCommand(cmd string, d time.Duration, err error) {
+	redisDuration.WithLabelValues(strings.ToUpper(cmd)).Observe(d.Seconds())
+}
+
+// Known kinds of SQL statements, others are reported as "OTHER"
+var sqlOperations = map[string]bool{
+	"SELECT": true, "INSERT": true, "UPDATE": true, "DELETE": true,
+	"BEGIN": true, "COMMIT": true, "ROLLBACK": true,
+}
+
+// queryMetricsLogger observes durations of queries gorm logs and passes the log further
+type queryMetricsLogger struct {
+	storage.Logger
+}
+
+func (l queryMetricsLogger) Print(v ...interface{}) {
+	if len(v) > 3 && v[0] == "sql" {
+		d, _ := v[2].(time.Duration)
+		query, _ := v[3].(string)
+		databaseDuration.WithLabelValues(sqlOperation(query)).Observe(d.Seconds())
+	}
+	l.Logger.Print(v...)
+}
+
+func sqlOperation(query string) string {
+	fields := strings.Fields(query)
+	if len(fields) == 0 {
+		return "OTHER"
+	}
+	op := strings.ToUpper(fields[0])
+	if !sqlOperations[op] {
+		return "OTHER"
+	}
+	return op
+}
+
+// statisticsCache keeps totals of the bot, so scrapes do not query the database
+type statisticsCache struct {
+	sg StatisticsGetter
+
+	mu    sync.RWMutex
+	stats model.Statistics
+	ok    bool
+}
+
+func newStatisticsCache(sg StatisticsGetter) *statisticsCache {
+	return &statisticsCache{sg: sg}
+}
+
+// Get returns the last totals, false if they have not been queried yet
+func (c *statisticsCache) Get() (model.Statistics, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.stats, c.ok
+}
+
+// Refresh queries the totals, the previous ones are kept on error
+func (c *statisticsCache) Refresh() {
+	stats, err := c.sg.GetStatistics()
+	if err != nil {
+		log.Warnf("Cannot refresh statistics: %v", err)
+		return
+	}
+
+	c.mu.Lock()
+	c.stats, c.ok = stats, true
+	c.mu.Unlock()
+}
+
+// Run refreshes the totals every interval until ctx is done
+func (c *statisticsCache) Run(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		c.Refresh()
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
@@ -0,0 +1,139 @@
+/*
+ * This file is part of Crocodile Game Bot.
+ * Copyright (C) 2019  Viktor
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	tb "gopkg.in/tucnak/telebot.v2"
+
+	"github.com/nuetoban/crocodile-game-bot/model"
+)
+
+func TestRouterMetrics(t *testing.T) {
+	r := newUpdateRouter()
+	r.Handle("/rating", func(context.Context, *tb.Message) {})
+	r.Handle(tb.OnText, func(context.Context, *tb.Message) {})
+	r.HandleButton(&tb.InlineButton{Unique: "see_word"}, func(context.Context, *tb.Callback) {})
+
+	rating := testutil.ToFloat64(commandsTotal.WithLabelValues("/rating"))
+	legacyRating := testutil.ToFloat64(legacyCommandsTotal["/rating"])
+	text := testutil.ToFloat64(textUpdatesTotal)
+	button := testutil.ToFloat64(callbacksTotal.WithLabelValues("see_word"))
+
+	for _, upd := range []*tb.Update{
+		{Message: &tb.Message{Text: "/rating"}},
+		{Message: &tb.Message{Text: "/rating skill"}},
+		{Message: &tb.Message{Text: "/unknown"}},
+		{Message: &tb.Message{Text: "крокодил"}},
+		{Callback: &tb.Callback{Data: "\fsee_word"}},
+	} {
+		r.Route(context.Background(), upd)
+	}
+
+	if got := testutil.ToFloat64(commandsTotal.WithLabelValues("/rating")) - rating; got != 2 {
+		t.Errorf("/rating has been counted %v times, expected 2", got)
+	}
+	if got := testutil.ToFloat64(legacyCommandsTotal["/rating"]) - legacyRating; got != 2 {
+		t.Errorf("/rating has been counted in rating_total %v times, expected 2", got)
+	}
+	// Unknown commands are handled as text
+	if got := testutil.ToFloat64(textUpdatesTotal) - text; got != 2 {
+		t.Errorf("Text updates have been counted %v times, expected 2", got)
+	}
+	if got := testutil.ToFloat64(callbacksTotal.WithLabelValues("see_word")) - button; got != 1 {
+		t.Errorf("see_word has been counted %v times, expected 1", got)
+	}
+}
+
+func TestRateLimitHits(t *testing.T) {
+	log.Out = ioutil.Discard
+	clock := newFakeClock()
+	l := NewLocalRateLimiter()
+	l.now = clock.now
+
+	hits := testutil.ToFloat64(rateLimitHits.WithLabelValues("user"))
+	noop := func() error { return nil }
+	for i := 0; i < 3; i++ {
+		l.Limit(1, 10, noop, noop, noop)
+	}
+	if got := testutil.ToFloat64(rateLimitHits.WithLabelValues("user")) - hits; got != 2 {
+		t.Errorf("User budget has been hit %v times, expected 2", got)
+	}
+}
+
+func TestSQLOperation(t *testing.T) {
+	for query, expected := range map[string]string{
+		`SELECT * FROM "rounds"`:       "SELECT",
+		"\n\t\tinsert into chats (id)": "INSERT",
+		"VACUUM":                       "OTHER",
+		"":                             "OTHER",
+	} {
+		if got := sqlOperation(query); got != expected {
+			t.Errorf("sqlOperation(%q): got %s, expected %s", query, got, expected)
+		}
+	}
+}
+
+type fakeStatisticsGetter struct {
+	stats model.Statistics
+	err   error
+	calls int
+}
+
+func (g *fakeStatisticsGetter) GetStatistics() (model.Statistics, error) {
+	g.calls++
+	return g.stats, g.err
+}
+
+func TestStatisticsCache(t *testing.T) {
+	log.Out = ioutil.Discard
+	g := &fakeStatisticsGetter{err: errors.New("connection refused")}
+	c := newStatisticsCache(g)
+
+	c.Refresh()
+	if _, ok := c.Get(); ok {
+		t.Fatalf("Statistics are cached after an error")
+	}
+
+	g.stats, g.err = model.Statistics{Chats: 10}, nil
+	c.Refresh()
+	g.stats, g.err = model.Statistics{Chats: 20}, errors.New("connection refused")
+	c.Refresh()
+
+	// The last totals are kept while the database is down
+	if stats, ok := c.Get(); !ok || stats.Chats != 10 {
+		t.Errorf("Got %+v, %t, expected 10 chats", stats, ok)
+	}
+
+	// Scrapes do not query the database
+	calls := g.calls
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(newMetricsCollector(c))
+	if _, err := reg.Gather(); err != nil {
+		t.Fatalf("Gather: %v", err)
+	}
+	if g.calls != calls {
+		t.Errorf("Statistics have been queried on scrape")
+	}
+}
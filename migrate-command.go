@@ -0,0 +1,117 @@
+/*
+ * This file is part of Crocodile Game Bot.
+ * Copyright (C) 2019  Viktor
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/nuetoban/crocodile-game-bot/config"
+	"github.com/nuetoban/crocodile-game-bot/migrations"
+)
+
+const migrateUsage = "usage: crocodile-server migrate up | down [N] | status | force VERSION"
+
+// migrateCommand runs `crocodile-server migrate ...` subcommand
+func migrateCommand(cfg config.Config, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf(migrateUsage)
+	}
+
+	pg, err := openStorage(cfg)
+	if err != nil {
+		return err
+	}
+
+	migrator, err := pg.Migrator()
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "up":
+		applied, err := migrator.Up()
+		printMigrations("Applied", applied)
+		return err
+
+	case "down":
+		n := 1
+		if len(args) > 1 {
+			if n, err = strconv.Atoi(args[1]); err != nil || n <= 0 {
+				return fmt.Errorf("invalid count of migrations: %q", args[1])
+			}
+		}
+		reverted, err := migrator.Down(n)
+		printMigrations("Reverted", reverted)
+		return err
+
+	case "status":
+		status, err := migrator.Status()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Version: %s\n", formatVersion(status.Version, status.Dirty))
+		printMigrations("Pending", status.Pending)
+		return nil
+
+	case "force":
+		if len(args) < 2 {
+			return fmt.Errorf(migrateUsage)
+		}
+		v, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid version: %q", args[1])
+		}
+		return migrator.Force(v)
+	}
+
+	return fmt.Errorf(migrateUsage)
+}
+
+// autoMigrate applies pending migrations on start
+func autoMigrate(pg botStorage) error {
+	migrator, err := pg.Migrator()
+	if err != nil {
+		return err
+	}
+
+	applied, err := migrator.Up()
+	for _, m := range applied {
+		log.Infof("Applied migration %d_%s", m.Version, m.Name)
+	}
+	return err
+}
+
+func printMigrations(title string, ms []migrations.Migration) {
+	fmt.Printf("%s: %d\n", title, len(ms))
+	for _, m := range ms {
+		fmt.Printf("  %d_%s\n", m.Version, m.Name)
+	}
+}
+
+func formatVersion(v int64, dirty bool) string {
+	out := "none"
+	if v != migrations.NilVersion {
+		out = strconv.FormatInt(v, 10)
+	}
+	if dirty {
+		out += " (dirty)"
+	}
+	return out
+}
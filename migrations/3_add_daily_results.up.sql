@@ -0,0 +1,16 @@
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS daily_results(
+    day DATE NOT NULL,
+    chat_id BIGINT NOT NULL,
+    chat_title TEXT,
+    user_id INTEGER NOT NULL,
+    user_name TEXT,
+    host_id INTEGER NOT NULL,
+    duration_ms BIGINT NOT NULL,
+    PRIMARY KEY(day, chat_id)
+);
+
+CREATE INDEX IF NOT EXISTS daily_results_day_duration_idx ON daily_results(day, duration_ms);
+
+COMMIT;
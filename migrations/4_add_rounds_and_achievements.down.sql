@@ -0,0 +1,6 @@
+BEGIN;
+
+DROP TABLE IF EXISTS achievements;
+DROP TABLE IF EXISTS rounds;
+
+COMMIT;
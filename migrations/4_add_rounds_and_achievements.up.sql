@@ -0,0 +1,28 @@
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS rounds(
+    id BIGSERIAL PRIMARY KEY,
+    chat_id BIGINT NOT NULL,
+    host_id INTEGER NOT NULL,
+    host_name TEXT,
+    winner_id INTEGER NOT NULL DEFAULT 0,
+    winner_name TEXT,
+    word TEXT,
+    daily BOOLEAN NOT NULL DEFAULT FALSE,
+    started_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    finished_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS rounds_chat_id_finished_at_idx ON rounds(chat_id, finished_at);
+CREATE INDEX IF NOT EXISTS rounds_host_id_finished_at_idx ON rounds(host_id, finished_at);
+CREATE INDEX IF NOT EXISTS rounds_winner_id_idx ON rounds(winner_id);
+
+CREATE TABLE IF NOT EXISTS achievements(
+    user_id INTEGER NOT NULL,
+    code TEXT NOT NULL,
+    chat_id BIGINT NOT NULL,
+    awarded_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    PRIMARY KEY(user_id, code)
+);
+
+COMMIT;
@@ -0,0 +1,10 @@
+BEGIN;
+
+DROP TABLE IF EXISTS usernames;
+
+DROP INDEX IF EXISTS rounds_chat_id_winner_id_idx;
+
+ALTER TABLE rounds
+DROP COLUMN IF EXISTS duration_ms;
+
+COMMIT;
@@ -0,0 +1,18 @@
+BEGIN;
+
+ALTER TABLE rounds
+ADD COLUMN IF NOT EXISTS duration_ms BIGINT NOT NULL DEFAULT 0;
+
+UPDATE rounds
+SET duration_ms = (EXTRACT(EPOCH FROM finished_at - started_at) * 1000)::BIGINT;
+
+CREATE INDEX IF NOT EXISTS rounds_chat_id_winner_id_idx ON rounds(chat_id, winner_id);
+
+CREATE TABLE IF NOT EXISTS usernames(
+    id INTEGER PRIMARY KEY,
+    username TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS usernames_username_idx ON usernames(username);
+
+COMMIT;
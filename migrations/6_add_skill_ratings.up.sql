@@ -0,0 +1,15 @@
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS skill_ratings(
+    user_id INTEGER NOT NULL,
+    chat_id BIGINT NOT NULL,
+    role TEXT NOT NULL,
+    name TEXT,
+    rating DOUBLE PRECISION NOT NULL,
+    games INTEGER NOT NULL DEFAULT 0,
+    PRIMARY KEY(user_id, chat_id, role)
+);
+
+CREATE INDEX IF NOT EXISTS skill_ratings_chat_id_role_rating_idx ON skill_ratings(chat_id, role, rating);
+
+COMMIT;
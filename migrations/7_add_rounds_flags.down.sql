@@ -0,0 +1,11 @@
+BEGIN;
+
+DROP INDEX IF EXISTS rounds_flagged_finished_at_idx;
+
+ALTER TABLE rounds
+DROP COLUMN IF EXISTS flags;
+
+ALTER TABLE rounds
+DROP COLUMN IF EXISTS seen_at;
+
+COMMIT;
@@ -0,0 +1,11 @@
+BEGIN;
+
+ALTER TABLE rounds
+ADD COLUMN IF NOT EXISTS seen_at TIMESTAMP WITH TIME ZONE;
+
+ALTER TABLE rounds
+ADD COLUMN IF NOT EXISTS flags TEXT NOT NULL DEFAULT '';
+
+CREATE INDEX IF NOT EXISTS rounds_flagged_finished_at_idx ON rounds(finished_at) WHERE flags != '';
+
+COMMIT;
@@ -0,0 +1,9 @@
+BEGIN;
+
+DELETE FROM usernames
+WHERE EXISTS (SELECT 1 FROM usernames AS newer WHERE newer.username = usernames.username AND newer.id > usernames.id);
+
+DROP INDEX IF EXISTS usernames_username_idx;
+CREATE UNIQUE INDEX IF NOT EXISTS usernames_username_key ON usernames(username);
+
+COMMIT;
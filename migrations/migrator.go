@@ -0,0 +1,220 @@
+/*
+ * This file is part of Crocodile Game Bot.
+ * Copyright (C) 2019  Viktor
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+)
+
+// NilVersion is version of the database without migrations
+const NilVersion int64 = -1
+
+// Key of Postgres advisory lock taken while migrating
+const advisoryLockKey = 7420420
+
+// ErrDirty is returned when the last migration has failed, the schema should be
+// fixed manually and the version should be set with Force
+var ErrDirty = errors.New("database is dirty")
+
+// Status describes the version of the database schema
+type Status struct {
+	Version int64
+	Dirty   bool
+	Pending []Migration
+}
+
+// Migrator applies migrations to the database
+type Migrator struct {
+	db         *sql.DB
+	dialect    string
+	migrations []Migration
+}
+
+// NewMigrator loads migrations from fsys, dialect is name of gorm dialect ("postgres" or "sqlite3")
+func NewMigrator(db *sql.DB, dialect string, fsys fs.FS) (*Migrator, error) {
+	migrations, err := Load(fsys)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{db: db, dialect: dialect, migrations: migrations}, nil
+}
+
+// Migrations returns all known migrations
+func (m *Migrator) Migrations() []Migration {
+	return m.migrations
+}
+
+// Status returns current version of the schema and migrations which are not applied yet
+func (m *Migrator) Status() (Status, error) {
+	var status Status
+	err := m.withConn(func(conn *sql.Conn) error {
+		var err error
+		status.Version, status.Dirty, err = version(conn)
+		if err != nil {
+			return err
+		}
+		for _, mig := range m.migrations {
+			if mig.Version > status.Version {
+				status.Pending = append(status.Pending, mig)
+			}
+		}
+		return nil
+	})
+	return status, err
+}
+
+// Up applies all pending migrations and returns them
+func (m *Migrator) Up() ([]Migration, error) {
+	var applied []Migration
+	err := m.withConn(func(conn *sql.Conn) error {
+		current, dirty, err := version(conn)
+		if err != nil {
+			return err
+		}
+		if dirty {
+			return fmt.Errorf("%w: version %d", ErrDirty, current)
+		}
+
+		for _, mig := range m.migrations {
+			if mig.Version <= current {
+				continue
+			}
+			if err := run(conn, mig.Version, mig.Up); err != nil {
+				return fmt.Errorf("cannot apply %d_%s: %v", mig.Version, mig.Name, err)
+			}
+			applied = append(applied, mig)
+		}
+		return nil
+	})
+	return applied, err
+}
+
+// Down rolls back n last applied migrations and returns them
+func (m *Migrator) Down(n int) ([]Migration, error) {
+	var reverted []Migration
+	err := m.withConn(func(conn *sql.Conn) error {
+		current, dirty, err := version(conn)
+		if err != nil {
+			return err
+		}
+		if dirty {
+			return fmt.Errorf("%w: version %d", ErrDirty, current)
+		}
+
+		for i := len(m.migrations) - 1; i >= 0 && len(reverted) < n; i-- {
+			mig := m.migrations[i]
+			if mig.Version > current {
+				continue
+			}
+
+			previous := NilVersion
+			if i > 0 {
+				previous = m.migrations[i-1].Version
+			}
+			if err := run(conn, previous, mig.Down); err != nil {
+				return fmt.Errorf("cannot revert %d_%s: %v", mig.Version, mig.Name, err)
+			}
+			reverted = append(reverted, mig)
+		}
+		return nil
+	})
+	return reverted, err
+}
+
+// Force sets the version and clears dirty flag without running migrations
+func (m *Migrator) Force(v int64) error {
+	return m.withConn(func(conn *sql.Conn) error {
+		return setVersion(conn, v, false)
+	})
+}
+
+// withConn runs f on one connection holding the lock, so replicas do not migrate simultaneously
+func (m *Migrator) withConn(f func(*sql.Conn) error) error {
+	ctx := context.Background()
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if m.dialect == "postgres" {
+		if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", advisoryLockKey); err != nil {
+			return err
+		}
+		defer conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", advisoryLockKey)
+	}
+
+	_, err = conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (version BIGINT NOT NULL PRIMARY KEY, dirty BOOLEAN NOT NULL)`)
+	if err != nil {
+		return err
+	}
+
+	return f(conn)
+}
+
+// run marks the target version dirty, runs the script and clears the flag
+func run(conn *sql.Conn, target int64, script string) error {
+	if err := setVersion(conn, target, true); err != nil {
+		return err
+	}
+	if _, err := conn.ExecContext(context.Background(), script); err != nil {
+		return err
+	}
+	return setVersion(conn, target, false)
+}
+
+func version(conn *sql.Conn) (int64, bool, error) {
+	var (
+		v     int64
+		dirty bool
+	)
+	err := conn.QueryRowContext(context.Background(), `SELECT version, dirty FROM schema_migrations LIMIT 1`).Scan(&v, &dirty)
+	if err == sql.ErrNoRows {
+		return NilVersion, false, nil
+	}
+	return v, dirty, err
+}
+
+func setVersion(conn *sql.Conn, v int64, dirty bool) error {
+	ctx := context.Background()
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM schema_migrations`); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	// golang-migrate keeps no row for the empty clean database
+	if v != NilVersion || dirty {
+		// Both lib/pq and go-sqlite3 understand $N placeholders
+		if _, err := tx.ExecContext(ctx, `INSERT INTO schema_migrations (version, dirty) VALUES ($1, $2)`, v, dirty); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
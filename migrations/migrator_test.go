@@ -0,0 +1,216 @@
+/*
+ * This file is part of Crocodile Game Bot.
+ * Copyright (C) 2019  Viktor
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package migrations
+
+import (
+	"database/sql"
+	"errors"
+	"os"
+	"testing"
+	"testing/fstest"
+
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+var testMigrations = fstest.MapFS{
+	"1_create_users.up.sql":         {Data: []byte(`CREATE TABLE users (id INTEGER PRIMARY KEY, name TEXT);`)},
+	"1_create_users.down.sql":       {Data: []byte(`DROP TABLE users;`)},
+	"2_add_users_name_idx.up.sql":   {Data: []byte(`CREATE UNIQUE INDEX users_name_idx ON users(name);`)},
+	"2_add_users_name_idx.down.sql": {Data: []byte(`DROP INDEX users_name_idx;`)},
+	"3_create_chats.up.sql":         {Data: []byte(`BEGIN; CREATE TABLE chats (id INTEGER PRIMARY KEY); COMMIT;`)},
+	"3_create_chats.down.sql":       {Data: []byte(`DROP TABLE chats;`)},
+	"README.md":                     {Data: []byte(`Not a migration`)},
+}
+
+func openSQLite(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every connection to :memory: is a new database
+	db.SetMaxOpenConns(1)
+	return db
+}
+
+func checkStatus(t *testing.T, m *Migrator, version int64, dirty bool, pending int) {
+	t.Helper()
+	s, err := m.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Version != version || s.Dirty != dirty || len(s.Pending) != pending {
+		t.Errorf("Status: got version %d, dirty %t, %d pending, expected %d, %t, %d",
+			s.Version, s.Dirty, len(s.Pending), version, dirty, pending)
+	}
+}
+
+func TestMigratorUpDown(t *testing.T) {
+	db := openSQLite(t)
+	defer db.Close()
+
+	m, err := NewMigrator(db, "sqlite3", testMigrations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStatus(t, m, NilVersion, false, 3)
+
+	applied, err := m.Up()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != 3 {
+		t.Errorf("Applied %d migrations, expected 3", len(applied))
+	}
+	checkStatus(t, m, 3, false, 0)
+
+	if _, err := db.Exec(`INSERT INTO chats (id) VALUES (1)`); err != nil {
+		t.Errorf("Schema is not migrated: %v", err)
+	}
+
+	// Nothing to do
+	if applied, err := m.Up(); err != nil || len(applied) != 0 {
+		t.Errorf("Second Up: applied %d, error %v", len(applied), err)
+	}
+
+	if _, err := m.Down(2); err != nil {
+		t.Fatal(err)
+	}
+	checkStatus(t, m, 1, false, 2)
+
+	if _, err := m.Down(10); err != nil {
+		t.Fatal(err)
+	}
+	checkStatus(t, m, NilVersion, false, 3)
+
+	// golang-migrate keeps no version of the empty database
+	var rows int
+	db.QueryRow(`SELECT count(*) FROM schema_migrations`).Scan(&rows)
+	if rows != 0 {
+		t.Errorf("schema_migrations has %d rows, expected 0", rows)
+	}
+}
+
+func TestMigratorDirty(t *testing.T) {
+	db := openSQLite(t)
+	defer db.Close()
+
+	broken := fstest.MapFS{}
+	for k, v := range testMigrations {
+		broken[k] = v
+	}
+	broken["2_add_users_name_idx.up.sql"] = &fstest.MapFile{Data: []byte(`CREATE INDEX users_name_idx ON nonexistent(name);`)}
+
+	m, err := NewMigrator(db, "sqlite3", broken)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := m.Up(); err == nil {
+		t.Fatal("Broken migration has been applied")
+	}
+	checkStatus(t, m, 2, true, 1)
+
+	if _, err := m.Up(); !errors.Is(err, ErrDirty) {
+		t.Errorf("Up on dirty database: got %v, expected ErrDirty", err)
+	}
+
+	if err := m.Force(1); err != nil {
+		t.Fatal(err)
+	}
+	checkStatus(t, m, 1, false, 2)
+}
+
+func TestLoadValidates(t *testing.T) {
+	_, err := Load(fstest.MapFS{"1_init.up.sql": {Data: []byte(`SELECT 1;`)}})
+	if err == nil {
+		t.Errorf("Migration without down script has been loaded")
+	}
+}
+
+func TestPostgresMigrationsAreConsistent(t *testing.T) {
+	migrations, err := Load(Postgres)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrations) == 0 {
+		t.Fatal("No migrations are embedded")
+	}
+	for i, m := range migrations {
+		if m.Version != int64(i+1) {
+			t.Errorf("Migration %s has version %d, expected %d", m.Name, m.Version, i+1)
+		}
+	}
+}
+
+func TestSQLiteMigrations(t *testing.T) {
+	db := openSQLite(t)
+	defer db.Close()
+
+	m, err := NewMigrator(db, "sqlite3", SQLite)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	all := len(m.Migrations())
+	if all == 0 {
+		t.Fatal("No migrations are embedded")
+	}
+	for _, step := range []func() ([]Migration, error){
+		m.Up,
+		func() ([]Migration, error) { return m.Down(all) },
+		m.Up,
+	} {
+		if _, err := step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkStatus(t, m, int64(all), false, 0)
+}
+
+// Runs real migrations when CROCODILE_GAME_TEST_POSTGRES has DSN of a disposable database
+func TestPostgresMigrations(t *testing.T) {
+	dsn := os.Getenv("CROCODILE_GAME_TEST_POSTGRES")
+	if dsn == "" {
+		t.Skip("CROCODILE_GAME_TEST_POSTGRES is not set")
+	}
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	m, err := NewMigrator(db, "postgres", Postgres)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	all := len(m.Migrations())
+	for _, step := range []func() ([]Migration, error){
+		m.Up,
+		func() ([]Migration, error) { return m.Down(all) },
+		m.Up,
+	} {
+		if _, err := step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkStatus(t, m, int64(all), false, 0)
+}
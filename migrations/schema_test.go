@@ -0,0 +1,189 @@
+/*
+ * This file is part of Crocodile Game Bot.
+ * Copyright (C) 2019  Viktor
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package migrations
+
+import (
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// schema is columns of every table
+type schema map[string][]string
+
+// Tables kept in SQLite only, Postgres setups keep machines in Redis
+var sqliteOnlyTables = map[string]bool{"machine_states": true}
+
+var (
+	commentRx     = regexp.MustCompile(`--[^\n]*`)
+	spaceRx       = regexp.MustCompile(`\s+`)
+	createRx      = regexp.MustCompile(`(?i)^CREATE TABLE (?:IF NOT EXISTS )?(\w+) ?\((.*)\)$`)
+	createAsRx    = regexp.MustCompile(`(?i)^CREATE TABLE (?:IF NOT EXISTS )?(\w+) AS SELECT (?:DISTINCT )?(.*?) FROM `)
+	addColumnRx   = regexp.MustCompile(`(?i)^ALTER TABLE (\w+) ADD COLUMN (?:IF NOT EXISTS )?(\w+)`)
+	dropColumnRx  = regexp.MustCompile(`(?i)^ALTER TABLE (\w+) DROP COLUMN (?:IF EXISTS )?(\w+)`)
+	constraintRx  = regexp.MustCompile(`(?i)^ALTER TABLE \w+ (?:ADD|DROP) (?:CONSTRAINT|PRIMARY KEY)`)
+	dropTableRx   = regexp.MustCompile(`(?i)^DROP TABLE (?:IF EXISTS )?(\w+)$`)
+	alterTableRx  = regexp.MustCompile(`(?i)^(?:ALTER|CREATE|DROP) TABLE`)
+	nonColumnsRx  = regexp.MustCompile(`(?i)^(?:PRIMARY KEY|CONSTRAINT|UNIQUE|FOREIGN KEY|CHECK)\b`)
+	selectAliasRx = regexp.MustCompile(`(?i)(\w+)$`)
+)
+
+// apply changes the schema as the script does, only statements changing tables are understood
+func (s schema) apply(t *testing.T, name, script string) {
+	t.Helper()
+	script = commentRx.ReplaceAllString(script, "")
+
+	for _, stmt := range strings.Split(script, ";") {
+		stmt = strings.TrimSpace(spaceRx.ReplaceAllString(stmt, " "))
+
+		if m := createRx.FindStringSubmatch(stmt); m != nil {
+			var columns []string
+			for _, def := range splitTopLevel(m[2]) {
+				if !nonColumnsRx.MatchString(def) {
+					columns = append(columns, strings.Fields(def)[0])
+				}
+			}
+			s[m[1]] = columns
+		} else if m := createAsRx.FindStringSubmatch(stmt); m != nil {
+			var columns []string
+			for _, expr := range splitTopLevel(m[2]) {
+				columns = append(columns, selectAliasRx.FindString(expr))
+			}
+			s[m[1]] = columns
+		} else if m := addColumnRx.FindStringSubmatch(stmt); m != nil {
+			s[m[1]] = append(s[m[1]], m[2])
+		} else if m := dropColumnRx.FindStringSubmatch(stmt); m != nil {
+			var columns []string
+			for _, c := range s[m[1]] {
+				if c != m[2] {
+					columns = append(columns, c)
+				}
+			}
+			s[m[1]] = columns
+		} else if m := dropTableRx.FindStringSubmatch(stmt); m != nil {
+			delete(s, m[1])
+		} else if alterTableRx.MatchString(stmt) && !constraintRx.MatchString(stmt) {
+			t.Errorf("%s: cannot understand %q, teach the schema test", name, stmt)
+		}
+	}
+}
+
+// sorted returns the schema with sorted columns to compare it regardless of their order
+func (s schema) sorted() schema {
+	out := make(schema, len(s))
+	for table, columns := range s {
+		columns = append([]string(nil), columns...)
+		sort.Strings(columns)
+		out[table] = columns
+	}
+	return out
+}
+
+// splitTopLevel splits s by commas which are not in parentheses
+func splitTopLevel(s string) []string {
+	var (
+		parts []string
+		depth int
+		start int
+	)
+	for i, r := range s {
+		switch r {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				parts = append(parts, strings.TrimSpace(s[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, strings.TrimSpace(s[start:]))
+}
+
+func TestPostgresMigrationsMatchSQLite(t *testing.T) {
+	migrations, err := Load(Postgres)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	postgres := schema{}
+	for _, m := range migrations {
+		postgres.apply(t, m.Name+".up.sql", m.Up)
+	}
+
+	db := openSQLite(t)
+	defer db.Close()
+	m, err := NewMigrator(db, "sqlite3", SQLite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := db.Query(`SELECT name FROM sqlite_master
+                           WHERE type = 'table' AND name != 'schema_migrations' AND name NOT LIKE 'sqlite_%'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tables []string
+	for rows.Next() {
+		var table string
+		if err := rows.Scan(&table); err != nil {
+			t.Fatal(err)
+		}
+		tables = append(tables, table)
+	}
+	rows.Close()
+
+	sqlite := schema{}
+	for _, table := range tables {
+		if sqliteOnlyTables[table] {
+			continue
+		}
+		rows, err := db.Query(`SELECT name FROM pragma_table_info(?)`, table)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for rows.Next() {
+			var column string
+			if err := rows.Scan(&column); err != nil {
+				t.Fatal(err)
+			}
+			sqlite[table] = append(sqlite[table], column)
+		}
+		rows.Close()
+	}
+
+	if got, expected := sqlite.sorted(), postgres.sorted(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("SQLite schema differs from Postgres one:\nSQLite:   %v\nPostgres: %v", got, expected)
+	}
+
+	// Down scripts revert everything
+	for i := len(migrations) - 1; i >= 0; i-- {
+		postgres.apply(t, migrations[i].Name+".down.sql", migrations[i].Down)
+	}
+	if len(postgres) != 0 {
+		t.Errorf("Tables are left after all down scripts: %v", postgres)
+	}
+}
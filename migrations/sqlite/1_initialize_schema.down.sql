@@ -0,0 +1,12 @@
+BEGIN;
+
+DROP TABLE IF EXISTS machine_states;
+DROP TABLE IF EXISTS skill_ratings;
+DROP TABLE IF EXISTS usernames;
+DROP TABLE IF EXISTS achievements;
+DROP TABLE IF EXISTS rounds;
+DROP TABLE IF EXISTS daily_results;
+DROP TABLE IF EXISTS user_in_chats;
+DROP TABLE IF EXISTS chats;
+
+COMMIT;
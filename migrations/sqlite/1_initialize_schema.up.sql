@@ -0,0 +1,88 @@
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS chats(
+    id BIGINT NOT NULL PRIMARY KEY,
+    title TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE IF NOT EXISTS user_in_chats(
+    id INTEGER NOT NULL,
+    chat_id BIGINT NOT NULL REFERENCES chats(id),
+    was_host INTEGER NOT NULL DEFAULT 0,
+    success INTEGER NOT NULL DEFAULT 0,
+    guessed INTEGER NOT NULL DEFAULT 0,
+    name TEXT,
+    PRIMARY KEY(id, chat_id)
+);
+
+CREATE INDEX IF NOT EXISTS user_in_chats_id_idx ON user_in_chats(id);
+CREATE INDEX IF NOT EXISTS user_in_chats_chat_id_idx ON user_in_chats(chat_id);
+
+CREATE TABLE IF NOT EXISTS daily_results(
+    day DATETIME NOT NULL,
+    chat_id BIGINT NOT NULL,
+    chat_title TEXT,
+    user_id INTEGER NOT NULL,
+    user_name TEXT,
+    host_id INTEGER NOT NULL,
+    duration_ms BIGINT NOT NULL,
+    PRIMARY KEY(day, chat_id)
+);
+
+CREATE INDEX IF NOT EXISTS daily_results_day_duration_idx ON daily_results(day, duration_ms);
+
+CREATE TABLE IF NOT EXISTS rounds(
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    chat_id BIGINT NOT NULL,
+    host_id INTEGER NOT NULL,
+    host_name TEXT,
+    winner_id INTEGER NOT NULL DEFAULT 0,
+    winner_name TEXT,
+    word TEXT,
+    daily BOOLEAN NOT NULL DEFAULT FALSE,
+    started_at DATETIME NOT NULL,
+    seen_at DATETIME,
+    finished_at DATETIME NOT NULL,
+    duration_ms BIGINT NOT NULL DEFAULT 0,
+    flags TEXT NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS rounds_chat_id_finished_at_idx ON rounds(chat_id, finished_at);
+CREATE INDEX IF NOT EXISTS rounds_host_id_finished_at_idx ON rounds(host_id, finished_at);
+CREATE INDEX IF NOT EXISTS rounds_winner_id_idx ON rounds(winner_id);
+CREATE INDEX IF NOT EXISTS rounds_chat_id_winner_id_idx ON rounds(chat_id, winner_id);
+
+CREATE TABLE IF NOT EXISTS achievements(
+    user_id INTEGER NOT NULL,
+    code TEXT NOT NULL,
+    chat_id BIGINT NOT NULL,
+    awarded_at DATETIME NOT NULL,
+    PRIMARY KEY(user_id, code)
+);
+
+CREATE TABLE IF NOT EXISTS usernames(
+    id INTEGER PRIMARY KEY,
+    username TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS usernames_username_idx ON usernames(username);
+
+CREATE TABLE IF NOT EXISTS skill_ratings(
+    user_id INTEGER NOT NULL,
+    chat_id BIGINT NOT NULL,
+    role TEXT NOT NULL,
+    name TEXT,
+    rating DOUBLE PRECISION NOT NULL,
+    games INTEGER NOT NULL DEFAULT 0,
+    PRIMARY KEY(user_id, chat_id, role)
+);
+
+CREATE INDEX IF NOT EXISTS skill_ratings_chat_id_role_rating_idx ON skill_ratings(chat_id, role, rating);
+
+CREATE TABLE IF NOT EXISTS machine_states(
+    chat_id BIGINT NOT NULL PRIMARY KEY,
+    state TEXT NOT NULL,
+    updated_at DATETIME NOT NULL
+);
+
+COMMIT;
@@ -0,0 +1,7 @@
+BEGIN;
+
+DROP INDEX IF EXISTS rounds_winner_id_finished_at_idx;
+DROP TABLE IF EXISTS dictionary_words;
+DROP TABLE IF EXISTS bans;
+
+COMMIT;
@@ -0,0 +1,19 @@
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS bans(
+    kind TEXT NOT NULL,
+    id BIGINT NOT NULL,
+    reason TEXT NOT NULL DEFAULT '',
+    created_at DATETIME NOT NULL,
+    PRIMARY KEY(kind, id)
+);
+
+CREATE TABLE IF NOT EXISTS dictionary_words(
+    word TEXT NOT NULL PRIMARY KEY,
+    removed BOOLEAN NOT NULL DEFAULT FALSE,
+    updated_at DATETIME NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS rounds_winner_id_finished_at_idx ON rounds(winner_id, finished_at);
+
+COMMIT;
@@ -0,0 +1,6 @@
+BEGIN;
+
+DROP INDEX IF EXISTS usernames_username_key;
+CREATE INDEX IF NOT EXISTS usernames_username_idx ON usernames(username);
+
+COMMIT;
@@ -18,18 +18,20 @@
 
 package model
 
+import "time"
+
 type UserInChat struct {
-	ID     int
-	ChatID int64
+	ID     int   `json:"id"`
+	ChatID int64 `json:"chat_id"`
 
-	Name string
+	Name string `json:"name"`
 
 	// When user was a Host
-	WasHost int
-	Success int
+	WasHost int `json:"was_host"`
+	Success int `json:"success"`
 
 	// When user was a guesser
-	Guessed int
+	Guessed int `json:"guessed"`
 }
 
 type Statistics struct {
@@ -49,3 +51,131 @@ type ChatStatistics struct {
 	// How many games have been done
 	Guessed int
 }
+
+// DailyResult is the fastest solve of the word of the day in one chat
+type DailyResult struct {
+	Day    time.Time
+	ChatID int64
+
+	ChatTitle string
+	UserID    int
+	UserName  string
+	HostID    int
+
+	// How long it took to guess the word
+	DurationMs int64
+}
+
+// Player is a user who tried to guess the word
+type Player struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+// Round is one finished game in a chat
+type Round struct {
+	ID     int64 `json:"id"`
+	ChatID int64 `json:"chat_id"`
+
+	HostID   int    `json:"host_id"`
+	HostName string `json:"host_name"`
+
+	// WinnerID is 0 when nobody guessed the word
+	WinnerID   int    `json:"winner_id"`
+	WinnerName string `json:"winner_name"`
+
+	Word  string `json:"word"`
+	Daily bool   `json:"daily"`
+
+	// Players are users who tried to guess the word, it is not stored in the database
+	Players []Player `gorm:"-" json:"players,omitempty"`
+
+	// Skips is how many times the host has changed the word, it is not stored in the database
+	Skips int `gorm:"-" json:"skips,omitempty"`
+
+	StartedAt  time.Time `json:"started_at"`
+	SeenAt     time.Time `json:"seen_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	DurationMs int64     `json:"duration_ms"`
+
+	// Flags are comma separated reasons to exclude the round from ratings
+	Flags string `json:"flags"`
+}
+
+// Success returns true if the word has been guessed
+func (r Round) Success() bool { return r.WinnerID != 0 }
+
+// Flagged returns true if the round is suspected in rating farming
+func (r Round) Flagged() bool { return r.Flags != "" }
+
+// Duration returns how long the round lasted
+func (r Round) Duration() time.Duration { return r.FinishedAt.Sub(r.StartedAt) }
+
+// Achievement is a milestone earned by user
+type Achievement struct {
+	UserID int
+	Code   string
+
+	// Chat where the achievement has been earned
+	ChatID    int64
+	AwardedAt time.Time
+}
+
+// Roles for SkillRating
+const (
+	RoleGuesser = "guesser"
+	RoleHost    = "host"
+)
+
+// SkillRating is Elo rating of user as a guesser or as a host,
+// ChatID == 0 means global rating
+type SkillRating struct {
+	UserID int
+	ChatID int64
+	Role   string
+
+	Name   string
+	Rating float64
+	Games  int
+}
+
+// Offender is a user who took part in flagged rounds
+type Offender struct {
+	UserID int
+	Name   string
+
+	Rounds int
+	Chats  int
+}
+
+// ChatSummary is a chat with totals of its players
+type ChatSummary struct {
+	ID    int64  `json:"id"`
+	Title string `json:"title"`
+
+	Players int `json:"players"`
+
+	// Games is how many words have been explained in the chat
+	Games int `json:"games"`
+}
+
+// Kinds of Ban
+const (
+	BanUser = "user"
+	BanChat = "chat"
+)
+
+// Ban makes the bot ignore updates of the user or the chat
+type Ban struct {
+	Kind      string    `json:"kind"`
+	ID        int64     `json:"id"`
+	Reason    string    `json:"reason"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// DictionaryWord is a word added to the dictionary by admins or removed from it
+type DictionaryWord struct {
+	Word      string    `json:"word"`
+	Removed   bool      `json:"removed"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
@@ -0,0 +1,193 @@
+/*
+ * This file is part of Crocodile Game Bot.
+ * Copyright (C) 2019  Viktor
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	tb "gopkg.in/tucnak/telebot.v2"
+
+	"github.com/nuetoban/crocodile-game-bot/model"
+	"github.com/nuetoban/crocodile-game-bot/utils"
+)
+
+// PersonalStatsGetter provides numbers for /me and /stats commands
+type PersonalStatsGetter interface {
+	GetUserInChat(chatID int64, userID int) (model.UserInChat, error)
+	GetUserTotals(userID int) (model.UserInChat, error)
+	GetUserRank(chatID int64, userID int) (int, error)
+	GetGlobalUserRank(userID int) (int, error)
+	GetAverageGuessTime(chatID int64, userID int) (time.Duration, error)
+	GetGuessStreaks(chatID int64, userID int) (current, best int, err error)
+	GetHostStreaks(userID int) (current, best int, err error)
+	SaveUsername(userID int, username string) error
+	GetUserIDByUsername(username string) (int, error)
+}
+
+var personalStatsGetter PersonalStatsGetter
+
+// rememberUser saves username to be able to find the user by @mention in /stats
+func rememberUser(ctx context.Context, u *tb.User) {
+	if u == nil || u.Username == "" {
+		return
+	}
+	err := personalStatsGetter.SaveUsername(u.ID, u.Username)
+	if err != nil {
+		logFrom(ctx).Errorf("rememberUser: cannot save username: %v", err)
+	}
+}
+
+func meHandler(ctx context.Context, m *tb.Message) {
+	name := strings.TrimSpace(m.Sender.FirstName + " " + m.Sender.LastName)
+	sendPersonalStats(ctx, m, m.Sender.ID, name)
+}
+
+func userStatsHandler(ctx context.Context, m *tb.Message) {
+	if m.ReplyTo != nil && m.ReplyTo.Sender != nil {
+		u := m.ReplyTo.Sender
+		sendPersonalStats(ctx, m, u.ID, strings.TrimSpace(u.FirstName+" "+u.LastName))
+		return
+	}
+
+	for _, e := range m.Entities {
+		switch e.Type {
+		case tb.EntityTMention:
+			if e.User != nil {
+				sendPersonalStats(ctx, m, e.User.ID, strings.TrimSpace(e.User.FirstName+" "+e.User.LastName))
+				return
+			}
+		case tb.EntityMention:
+			username := entityText(m.Text, e)
+			userID, err := personalStatsGetter.GetUserIDByUsername(username)
+			if err != nil {
+				logFrom(ctx).Errorf("userStatsHandler: cannot find user %s: %v", username, err)
+				sendMessage(ctx, m.Chat, fallbackMessage)
+				return
+			}
+			if userID == 0 {
+				sendMessage(ctx, m.Chat, "Этот игрок еще не играл в крокодила!")
+				return
+			}
+			sendPersonalStats(ctx, m, userID, username)
+			return
+		}
+	}
+
+	sendMessage(ctx, m.Chat, "Ответьте командой /stats на сообщение игрока или упомяните его: /stats @username")
+}
+
+// entityText cuts entity from text, offsets are in UTF-16 code units
+func entityText(text string, e tb.MessageEntity) string {
+	units := utf16.Encode([]rune(text))
+	if e.Offset < 0 || e.Offset+e.Length > len(units) {
+		return ""
+	}
+	return string(utf16.Decode(units[e.Offset : e.Offset+e.Length]))
+}
+
+func sendPersonalStats(ctx context.Context, m *tb.Message, userID int, name string) {
+	out, err := buildPersonalStats(m.Chat.ID, !m.Private(), userID, name)
+	if err != nil {
+		logFrom(ctx).Errorf("sendPersonalStats: cannot get stats: %v", err)
+		sendMessage(ctx, m.Chat, fallbackMessage)
+		return
+	}
+
+	err = sendMessage(ctx, m.Chat, out)
+	if err != nil {
+		logFrom(ctx).Errorf("sendPersonalStats: cannot send stats: %v", err)
+	}
+}
+
+func buildPersonalStats(chatID int64, withChat bool, userID int, name string) (string, error) {
+	out := fmt.Sprintf("Статистика игрока <b>%s</b> 🐊\n", html.EscapeString(name))
+
+	if withChat {
+		user, err := personalStatsGetter.GetUserInChat(chatID, userID)
+		if err != nil {
+			return "", err
+		}
+		rank, err := personalStatsGetter.GetUserRank(chatID, userID)
+		if err != nil {
+			return "", err
+		}
+		avg, err := personalStatsGetter.GetAverageGuessTime(chatID, userID)
+		if err != nil {
+			return "", err
+		}
+		current, best, err := personalStatsGetter.GetGuessStreaks(chatID, userID)
+		if err != nil {
+			return "", err
+		}
+
+		out += "\n<b>В этом чате</b>\n"
+		out += buildCounters(user, rank, avg)
+		out += fmt.Sprintf("Отгадано подряд: %d (лучшая серия: %d)\n", current, best)
+	}
+
+	user, err := personalStatsGetter.GetUserTotals(userID)
+	if err != nil {
+		return "", err
+	}
+	rank, err := personalStatsGetter.GetGlobalUserRank(userID)
+	if err != nil {
+		return "", err
+	}
+	avg, err := personalStatsGetter.GetAverageGuessTime(0, userID)
+	if err != nil {
+		return "", err
+	}
+	current, best, err := personalStatsGetter.GetHostStreaks(userID)
+	if err != nil {
+		return "", err
+	}
+
+	out += "\n<b>Во всех чатах</b>\n"
+	out += buildCounters(user, rank, avg)
+	out += fmt.Sprintf("Объяснено подряд: %d (лучшая серия: %d)\n", current, best)
+
+	return out, nil
+}
+
+func buildCounters(u model.UserInChat, rank int, avg time.Duration) string {
+	out := ""
+	if rank > 0 {
+		out += fmt.Sprintf("Место в рейтинге: %d\n", rank)
+	} else {
+		out += "Место в рейтинге: —\n"
+	}
+
+	out += fmt.Sprintf("Отгадано: %d %s\n", u.Guessed, utils.DetectCaseAnswers(u.Guessed))
+	out += fmt.Sprintf("Был(а) ведущим: %d, слово отгадали: %d", u.WasHost, u.Success)
+	if u.WasHost > 0 {
+		out += fmt.Sprintf(" (%d%%)", u.Success*100/u.WasHost)
+	}
+	out += "\n"
+
+	if avg > 0 {
+		out += fmt.Sprintf("Среднее время отгадывания: %s\n", formatDuration(avg))
+	}
+
+	return out
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nuetoban/crocodile-game-bot/antiabuse"
+	"github.com/nuetoban/crocodile-game-bot/model"
+)
+
+func TestPersonalStatsSkipFlaggedRounds(t *testing.T) {
+	_, s := newTestAdminAPI(t)
+	prev := personalStatsGetter
+	defer func() { personalStatsGetter = prev }()
+	personalStatsGetter = s
+
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	save := func(i int, flags string) {
+		err := s.SaveRound(model.Round{
+			ChatID:     1,
+			HostID:     9,
+			WinnerID:   2,
+			StartedAt:  now,
+			FinishedAt: now.Add(time.Duration(i) * time.Minute),
+			DurationMs: int64(i * 1000),
+			Flags:      flags,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	save(2, "")
+	save(4, "")
+
+	before, err := buildPersonalStats(1, true, 2, "Игрок")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(before, "00:03.000") || !strings.Contains(before, "Отгадано подряд: 2") {
+		t.Fatalf("Unexpected stats:\n%s", before)
+	}
+	hostBefore, err := buildPersonalStats(1, true, 9, "Ведущий")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Farmed rounds are kept for reports, but do not change stats
+	save(10, antiabuse.FlagSamePair)
+	save(20, antiabuse.FlagInstantGuess)
+
+	if after, _ := buildPersonalStats(1, true, 2, "Игрок"); after != before {
+		t.Errorf("Flagged rounds changed stats of the winner:\n%s\nwant:\n%s", after, before)
+	}
+	if after, _ := buildPersonalStats(1, true, 9, "Ведущий"); after != hostBefore {
+		t.Errorf("Flagged rounds changed stats of the host:\n%s\nwant:\n%s", after, hostBefore)
+	}
+}
@@ -0,0 +1,134 @@
+/*
+ * This file is part of Crocodile Game Bot.
+ * Copyright (C) 2019  Viktor
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+// drainingPoller is the long poller which stops fetching updates when it is stopped.
+// tb.LongPoller goes on calling getUpdates after the bot is stopped, so updates are
+// acknowledged to Telegram and never handled. This one passes updates of the last request
+// to Filter and acknowledges only them, the rest is left to the next start of the bot.
+type drainingPoller struct {
+	Timeout time.Duration
+
+	// Filter is called with every update before the next request, updates are sent to the bot if it returns true
+	Filter func(*tb.Update) bool
+
+	// Offset is the ID of the first update which has not been passed to Filter yet
+	Offset int
+
+	// getUpdates calls getUpdates method of Telegram, telegramUpdates of the bot is used if it is nil
+	getUpdates func(offset int, timeout time.Duration) ([]tb.Update, error)
+
+	// Pause after failed requests
+	retryDelay time.Duration
+}
+
+// Poll implements tb.Poller
+func (p *drainingPoller) Poll(b *tb.Bot, dest chan tb.Update, stop chan struct{}) {
+	getUpdates := p.getUpdates
+	if getUpdates == nil {
+		getUpdates = telegramUpdates(b)
+	}
+	retryDelay := p.retryDelay
+	if retryDelay == 0 {
+		retryDelay = time.Second
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		<-stop
+		close(stopped)
+	}()
+	// The bot waits for it after asking to stop
+	defer close(stop)
+
+	// Updates up to the offset of the last request have been acknowledged
+	acknowledged := p.Offset
+	for {
+		select {
+		case <-stopped:
+			p.acknowledge(getUpdates, acknowledged)
+			return
+		default:
+		}
+
+		acknowledged = p.Offset
+		updates, err := getUpdates(p.Offset, p.Timeout)
+		if err != nil {
+			log.Warnf("drainingPoller: cannot get updates: %v", err)
+			select {
+			case <-stopped:
+			case <-time.After(retryDelay):
+			}
+			continue
+		}
+
+		for i := range updates {
+			p.Offset = updates[i].ID + 1
+			if p.Filter == nil || p.Filter(&updates[i]) {
+				dest <- updates[i]
+			}
+		}
+	}
+}
+
+// acknowledge confirms updates passed to Filter since the last request,
+// updates returned by this request are left for the next start
+func (p *drainingPoller) acknowledge(getUpdates func(int, time.Duration) ([]tb.Update, error), acknowledged int) {
+	if p.Offset == acknowledged {
+		return
+	}
+	if _, err := getUpdates(p.Offset, 0); err != nil {
+		log.Errorf("drainingPoller: cannot acknowledge updates before %d, they will be taken again: %v", p.Offset, err)
+	}
+}
+
+// telegramUpdates returns function calling getUpdates method of Telegram
+func telegramUpdates(b *tb.Bot) func(offset int, timeout time.Duration) ([]tb.Update, error) {
+	return func(offset int, timeout time.Duration) ([]tb.Update, error) {
+		data, err := b.Raw("getUpdates", map[string]string{
+			"offset":  strconv.Itoa(offset),
+			"timeout": strconv.Itoa(int(timeout / time.Second)),
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		var resp struct {
+			Ok          bool
+			Result      []tb.Update
+			Description string
+		}
+		if err := json.Unmarshal(data, &resp); err != nil {
+			return nil, fmt.Errorf("bad response json: %w", err)
+		}
+		if !resp.Ok {
+			return nil, fmt.Errorf("api error: %s", resp.Description)
+		}
+		return resp.Result, nil
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+// fakeTelegram keeps updates until they are acknowledged by offset of getUpdates
+type fakeTelegram struct {
+	mu      sync.Mutex
+	pending []tb.Update
+
+	// Long polling requests wait for hold if it is set
+	hold     chan struct{}
+	inFlight chan struct{}
+}
+
+func (f *fakeTelegram) add(ids ...int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, id := range ids {
+		f.pending = append(f.pending, tb.Update{ID: id})
+	}
+}
+
+func (f *fakeTelegram) ids() []int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var ids []int
+	for _, u := range f.pending {
+		ids = append(ids, u.ID)
+	}
+	return ids
+}
+
+func (f *fakeTelegram) getUpdates(offset int, timeout time.Duration) ([]tb.Update, error) {
+	f.mu.Lock()
+	// Updates before the offset are acknowledged
+	for len(f.pending) > 0 && f.pending[0].ID < offset {
+		f.pending = f.pending[1:]
+	}
+
+	if hold := f.hold; hold != nil && timeout > 0 {
+		f.mu.Unlock()
+		f.inFlight <- struct{}{}
+		<-hold
+		f.mu.Lock()
+	} else if timeout > 0 {
+		for deadline := time.Now().Add(timeout); len(f.pending) == 0 && time.Now().Before(deadline); {
+			f.mu.Unlock()
+			time.Sleep(time.Millisecond)
+			f.mu.Lock()
+		}
+	}
+	defer f.mu.Unlock()
+	return append([]tb.Update(nil), f.pending...), nil
+}
+
+// handledUpdates counts how many times every update has been passed to the filter
+type handledUpdates struct {
+	mu    sync.Mutex
+	count map[int]int
+}
+
+func (h *handledUpdates) filter(upd *tb.Update) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.count[upd.ID]++
+	return false
+}
+
+func (h *handledUpdates) waitFor(t *testing.T, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		h.mu.Lock()
+		got := len(h.count)
+		h.mu.Unlock()
+		if got >= n {
+			return
+		}
+	}
+	t.Fatalf("%d updates have not been handled", n)
+}
+
+// startPoller runs the poller and returns the function stopping it the way tb.Bot does
+func startPoller(p *drainingPoller) func() {
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		p.Poll(nil, make(chan tb.Update), stop)
+		close(done)
+	}()
+	return func() {
+		stop <- struct{}{}
+		<-stop
+		<-done
+	}
+}
+
+func TestDrainingPollerStops(t *testing.T) {
+	log.Out = ioutil.Discard
+
+	f := &fakeTelegram{inFlight: make(chan struct{}, 1)}
+	h := &handledUpdates{count: make(map[int]int)}
+
+	f.add(1, 2, 3)
+	stop := startPoller(&drainingPoller{Timeout: 50 * time.Millisecond, Filter: h.filter, getUpdates: f.getUpdates})
+	h.waitFor(t, 3)
+
+	// Updates come while the bot is stopped during a long polling request
+	f.mu.Lock()
+	f.hold = make(chan struct{})
+	f.mu.Unlock()
+	<-f.inFlight
+
+	stopped := make(chan struct{})
+	go func() {
+		stop()
+		close(stopped)
+	}()
+	f.add(4, 5)
+
+	f.mu.Lock()
+	close(f.hold)
+	f.hold = nil
+	f.mu.Unlock()
+	<-stopped
+
+	// Updates coming after the stop are left for the next start
+	f.add(6)
+	if ids := f.ids(); len(ids) != 1 || ids[0] != 6 {
+		t.Errorf("Updates left in Telegram: %v, want [6]", ids)
+	}
+
+	// The next start takes the rest
+	stop = startPoller(&drainingPoller{Timeout: 50 * time.Millisecond, Filter: h.filter, getUpdates: f.getUpdates})
+	h.waitFor(t, 6)
+	stop()
+
+	for id := 1; id <= 6; id++ {
+		if n := h.count[id]; n != 1 {
+			t.Errorf("Update %d has been handled %d times", id, n)
+		}
+	}
+}
@@ -1,51 +1,449 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gomodule/redigo/redis"
+
+	"github.com/nuetoban/crocodile-game-bot/storage"
 )
 
-// RateLimiter -
+// messageLimiter limits count of commands handled by the bot and messages sent by it
+type messageLimiter interface {
+	// Limit calls onsuccess if the command fits budgets of the chat and of the user who sent it.
+	// Slots of the chat budget are taken by replies, commands are ignored while it is exhausted.
+	// onFirstFailure is called the first time the chat budget is exceeded within its window, onFailure otherwise.
+	Limit(chatID int64, userID int, onsuccess, onFirstFailure, onFailure func() error) error
+
+	// Reserve takes a slot of the chat budget and of the global one for a message sent to the chat,
+	// if either has none it returns how long to wait before trying again
+	Reserve(chatID int64) time.Duration
+
+	// MigrateChat adds messages sent to the old chat to the new one
+	MigrateChat(from, to int64)
+}
+
+// rateBudget is how many messages may be sent within the sliding window
+type rateBudget struct {
+	Limit  int
+	Window time.Duration
+}
+
+// rateLimits match limits of Telegram: 30 messages per second in total,
+// 20 messages per minute to a group and about one message per second to a user.
+// Messages wait for the global and chat budgets, commands exceeding budgets of chats and users are ignored.
+type rateLimits struct {
+	Global rateBudget
+	Chat   rateBudget
+	User   rateBudget
+}
+
+var defaultRateLimits = rateLimits{
+	Global: rateBudget{Limit: 30, Window: time.Second},
+	Chat:   rateBudget{Limit: 20, Window: time.Minute},
+	User:   rateBudget{Limit: 1, Window: time.Second},
+}
+
+// Budget which has not let the message through
+type rateDenial int
+
+const (
+	rateAllowed rateDenial = iota
+	rateDeniedGlobal
+	rateDeniedChat
+	rateDeniedUser
+)
+
+// rateBudgetKey is a budget of one chat, user or all of them
+type rateBudgetKey struct {
+	denial rateDenial
+	id     string
+	budget rateBudget
+
+	// checkOnly budgets are not taken, e.g. the chat budget is taken by replies, not by commands
+	checkOnly bool
+}
+
+// keys are budgets of commands
+func (l rateLimits) keys(chatID int64, userID int) []rateBudgetKey {
+	keys := []rateBudgetKey{
+		{rateDeniedChat, chatBudgetID(chatID), l.Chat, true},
+	}
+	if userID != 0 {
+		keys = append(keys, rateBudgetKey{rateDeniedUser, "user/" + strconv.Itoa(userID), l.User, false})
+	}
+	return keys
+}
+
+// reserveKeys are budgets of outgoing messages
+func (l rateLimits) reserveKeys(chatID int64) []rateBudgetKey {
+	return []rateBudgetKey{
+		{rateDeniedGlobal, "global", l.Global, false},
+		{rateDeniedChat, chatBudgetID(chatID), l.Chat, false},
+	}
+}
+
+func chatBudgetID(chatID int64) string {
+	return "chat/" + strconv.FormatInt(chatID, 10)
+}
+
+func applyRateLimit(chatID int64, userID int, denial rateDenial, first bool, onsuccess, onFirstFailure, onFailure func() error) error {
+	if denial != rateAllowed {
+		rateLimitHits.WithLabelValues(rateDenialBudgets[denial]).Inc()
+	}
+
+	switch denial {
+	case rateAllowed:
+		return onsuccess()
+	case rateDeniedChat:
+		if first {
+			log.Infof("RateLimiter: Limit: first time chat limit exceeded for chat (%d)", chatID)
+			return onFirstFailure()
+		}
+		log.Infof("RateLimiter: Limit: chat limit exceeded for chat (%d)", chatID)
+	case rateDeniedUser:
+		log.Infof("RateLimiter: Limit: user limit exceeded for user (%d) in chat (%d)", userID, chatID)
+	}
+	onFailure()
+	return nil
+}
+
+func applyReserveRateLimit(chatID int64, denial rateDenial, wait time.Duration) time.Duration {
+	if wait > 0 {
+		rateLimitHits.WithLabelValues(rateDenialBudgets[denial]).Inc()
+		log.Debugf("RateLimiter: Reserve: %s limit exceeded for chat (%d), message waits %s",
+			rateDenialBudgets[denial], chatID, wait)
+	}
+	return wait
+}
+
+// rateLimitScript checks all budgets and takes a slot of every budget not checked only if all of them have one.
+// KEYS are sorted sets of send times, ARGV are the current time in ms, unique member,
+// then limit, start of the window, window in ms and 1 for checked only budgets.
+// Returns 0 or the number of exhausted budget.
+var rateLimitScript = redis.NewScript(-1, `
+for i = 1, #KEYS do
+	local arg = i * 4 - 1
+	redis.call("ZREMRANGEBYSCORE", KEYS[i], "-inf", ARGV[arg + 1])
+	if redis.call("ZCARD", KEYS[i]) >= tonumber(ARGV[arg]) then
+		return i
+	end
+end
+for i = 1, #KEYS do
+	local arg = i * 4 - 1
+	if ARGV[arg + 3] ~= "1" then
+		redis.call("ZADD", KEYS[i], ARGV[1], ARGV[2])
+		redis.call("PEXPIRE", KEYS[i], ARGV[arg + 2])
+	end
+end
+return 0
+`)
+
+// rateReserveScript takes a slot of every budget if all of them have one.
+// KEYS are sorted sets of send times, ARGV are the current time in ms, unique member,
+// then limit and window in ms of every budget.
+// Returns {0, 0} or how many ms are left until a slot of every budget is free and the number of the budget waited for.
+var rateReserveScript = redis.NewScript(-1, `
+local now = tonumber(ARGV[1])
+local wait, budget = 0, 0
+for i = 1, #KEYS do
+	local limit, window = tonumber(ARGV[i * 2 + 1]), tonumber(ARGV[i * 2 + 2])
+	redis.call("ZREMRANGEBYSCORE", KEYS[i], "-inf", now - window)
+	local count = redis.call("ZCARD", KEYS[i])
+	if count >= limit then
+		local oldest = redis.call("ZRANGE", KEYS[i], count - limit, count - limit, "WITHSCORES")
+		local left = math.max(tonumber(oldest[2]) + window - now, 1)
+		if left > wait then
+			wait, budget = left, i
+		end
+	end
+end
+if wait > 0 then
+	return {wait, budget}
+end
+for i = 1, #KEYS do
+	redis.call("ZADD", KEYS[i], now, ARGV[2])
+	redis.call("PEXPIRE", KEYS[i], ARGV[i * 2 + 2])
+end
+return {0, 0}
+`)
+
+// All keys share the hash tag, so the script may use them together in Redis Cluster
+const rateKeyPrefix = "{rate}/"
+
+// RateLimiter keeps sliding windows in Redis, so the budgets are shared by replicas
 type RateLimiter struct {
-	pool *redis.Pool
+	pool   storage.RedisPool
+	limits rateLimits
+
+	// Makes members of sorted sets unique among replicas
+	instance string
+	seq      uint64
+
+	// Counts messages while Redis is unavailable
+	local *LocalRateLimiter
+
+	now func() time.Time
 }
 
 // NewRateLimiter returns new instance of RateLimiter
-func NewRateLimiter(pool *redis.Pool) *RateLimiter {
-	return &RateLimiter{pool: pool}
+func NewRateLimiter(pool storage.RedisPool) *RateLimiter {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return &RateLimiter{
+		pool:     pool,
+		limits:   defaultRateLimits,
+		instance: hex.EncodeToString(id),
+		local:    NewLocalRateLimiter(),
+		now:      time.Now,
+	}
+}
+
+// Limit takes a slot of every budget atomically
+func (r *RateLimiter) Limit(chatID int64, userID int, onsuccess, onFirstFailure, onFailure func() error) error {
+	denial, first, err := r.take(chatID, userID)
+	if err != nil {
+		log.Warnf("RateLimiter: Limit: Redis is unavailable, counting locally: %v", err)
+		return r.local.Limit(chatID, userID, onsuccess, onFirstFailure, onFailure)
+	}
+	return applyRateLimit(chatID, userID, denial, first, onsuccess, onFirstFailure, onFailure)
+}
+
+// Reserve takes slots of the chat and global budgets shared by replicas atomically
+func (r *RateLimiter) Reserve(chatID int64) time.Duration {
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	keys := r.limits.reserveKeys(chatID)
+	ms := r.now().UnixNano() / int64(time.Millisecond)
+	args := make([]interface{}, 0, len(keys)*3+3)
+	args = append(args, len(keys))
+	for _, k := range keys {
+		args = append(args, rateKeyPrefix+k.id)
+	}
+	args = append(args, ms, r.member())
+	for _, k := range keys {
+		args = append(args, k.budget.Limit, k.budget.Window.Milliseconds())
+	}
+
+	reply, err := redis.Int64s(rateReserveScript.Do(conn, args...))
+	if err == nil && len(reply) != 2 {
+		err = fmt.Errorf("unexpected reply %v", reply)
+	}
+	if err != nil {
+		log.Warnf("RateLimiter: Reserve: Redis is unavailable, counting locally: %v", err)
+		return r.local.Reserve(chatID)
+	}
+	if reply[0] == 0 {
+		return 0
+	}
+	return applyReserveRateLimit(chatID, keys[reply[1]-1].denial, time.Duration(reply[0])*time.Millisecond)
 }
 
-// Limit -
-func (r *RateLimiter) Limit(token int64, onsuccess, onFirstFailure, onFailure func() error) error {
+func (r *RateLimiter) member() string {
+	return r.instance + ":" + strconv.FormatUint(atomic.AddUint64(&r.seq, 1), 10)
+}
+
+func (r *RateLimiter) take(chatID int64, userID int) (rateDenial, bool, error) {
 	conn := r.pool.Get()
 	defer conn.Close()
 
-	minute := time.Now().Minute()
-	key := fmt.Sprintf("rate/%d/%d", token, minute)
-	resp, err := conn.Do("INCR", key)
+	now := r.now()
+	keys := r.limits.keys(chatID, userID)
+	member := r.member()
+
+	ms := now.UnixNano() / int64(time.Millisecond)
+	args := make([]interface{}, 0, len(keys)*5+3)
+	args = append(args, len(keys))
+	for _, k := range keys {
+		args = append(args, rateKeyPrefix+k.id)
+	}
+	args = append(args, ms, member)
+	for _, k := range keys {
+		window := k.budget.Window.Milliseconds()
+		checkOnly := 0
+		if k.checkOnly {
+			checkOnly = 1
+		}
+		args = append(args, k.budget.Limit, ms-window, window, checkOnly)
+	}
+
+	n, err := redis.Int(rateLimitScript.Do(conn, args...))
 	if err != nil {
-		panic(err)
+		return rateAllowed, false, err
+	}
+	if n == 0 {
+		return rateAllowed, false, nil
+	}
+
+	denied := keys[n-1]
+	if denied.denial != rateDeniedChat {
+		return denied.denial, false, nil
+	}
+
+	// The chat is warned once per window
+	reply, err := conn.Do("SET", rateKeyPrefix+"warned/"+strconv.FormatInt(chatID, 10), 1,
+		"PX", denied.budget.Window.Milliseconds(), "NX")
+	return denied.denial, err == nil && reply != nil, nil
+}
+
+// MigrateChat moves sent messages of the chat
+func (r *RateLimiter) MigrateChat(from, to int64) {
+	r.local.MigrateChat(from, to)
+
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	oldKey := rateKeyPrefix + chatBudgetID(from)
+	newKey := rateKeyPrefix + chatBudgetID(to)
+	if _, err := conn.Do("ZUNIONSTORE", newKey, 2, newKey, oldKey, "AGGREGATE", "MAX"); err != nil {
+		log.Warnf("RateLimiter: MigrateChat: cannot move chat (%d): %v", from, err)
+		return
+	}
+	conn.Do("PEXPIRE", newKey, r.limits.Chat.Window.Milliseconds())
+	conn.Do("DEL", oldKey)
+}
+
+// LocalRateLimiter is RateLimiter keeping sliding windows in memory, for the bot run in one replica
+type LocalRateLimiter struct {
+	limits rateLimits
+
+	mu     sync.Mutex
+	sent   map[string][]time.Time
+	warned map[int64]time.Time
+
+	// Windows of chats which stopped sending messages are removed from time to time
+	lastSweep time.Time
+
+	now func() time.Time
+}
+
+// NewLocalRateLimiter returns new instance of LocalRateLimiter
+func NewLocalRateLimiter() *LocalRateLimiter {
+	return &LocalRateLimiter{
+		limits: defaultRateLimits,
+		sent:   make(map[string][]time.Time),
+		warned: make(map[int64]time.Time),
+		now:    time.Now,
+	}
+}
+
+// Limit works the same way as RateLimiter.Limit
+func (r *LocalRateLimiter) Limit(chatID int64, userID int, onsuccess, onFirstFailure, onFailure func() error) error {
+	denial, first := r.take(chatID, userID)
+	return applyRateLimit(chatID, userID, denial, first, onsuccess, onFirstFailure, onFailure)
+}
+
+func (r *LocalRateLimiter) take(chatID int64, userID int) (rateDenial, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.now()
+	r.sweep(now)
+
+	keys := r.limits.keys(chatID, userID)
+	for _, k := range keys {
+		sent := r.window(k.id, now.Add(-k.budget.Window))
+		if len(sent) < k.budget.Limit {
+			continue
+		}
+
+		if k.denial != rateDeniedChat {
+			return k.denial, false
+		}
+		if now.Before(r.warned[chatID]) {
+			return k.denial, false
+		}
+		r.warned[chatID] = now.Add(k.budget.Window)
+		return k.denial, true
 	}
 
-	if count, ok := resp.(int64); ok {
-		if count == 1 {
-			conn.Do("EXPIRE", key, "60")
+	for _, k := range keys {
+		if !k.checkOnly {
+			r.sent[k.id] = append(r.sent[k.id], now)
 		}
-		if count < 11 {
-			err := onsuccess()
-			return err
+	}
+	return rateAllowed, false
+}
+
+// Reserve works the same way as RateLimiter.Reserve
+func (r *LocalRateLimiter) Reserve(chatID int64) time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.now()
+	r.sweep(now)
+
+	var (
+		wait   time.Duration
+		denial rateDenial
+	)
+	keys := r.limits.reserveKeys(chatID)
+	for _, k := range keys {
+		sent := r.window(k.id, now.Add(-k.budget.Window))
+		if len(sent) < k.budget.Limit {
+			continue
 		}
-		if count == 11 {
-			log.Infof("RateLimiter: Limit: first time limit exceeded for token (%d), tries: %d, minute: %d", token, count, minute)
-			err := onFirstFailure()
-			return err
+		// The message waits until enough messages leave the window
+		if left := sent[len(sent)-k.budget.Limit].Add(k.budget.Window).Sub(now); left > wait {
+			wait, denial = left, k.denial
 		}
-		log.Infof("RateLimiter: Limit: limit exceeded for token (%d), tries: %d, minute: %d", token, count, minute)
-		onFailure()
-		return err
 	}
+	if wait > 0 {
+		return applyReserveRateLimit(chatID, denial, wait)
+	}
+
+	for _, k := range keys {
+		r.sent[k.id] = append(r.sent[k.id], now)
+	}
+	return 0
+}
+
+// window forgets messages sent before since and returns the rest
+func (r *LocalRateLimiter) window(id string, since time.Time) []time.Time {
+	sent := r.sent[id]
+	i := 0
+	for i < len(sent) && !sent[i].After(since) {
+		i++
+	}
+	sent = sent[i:]
+	r.sent[id] = sent
+	return sent
+}
+
+func (r *LocalRateLimiter) sweep(now time.Time) {
+	if now.Sub(r.lastSweep) < r.limits.Chat.Window {
+		return
+	}
+	r.lastSweep = now
+
+	for id, sent := range r.sent {
+		if len(sent) == 0 || now.Sub(sent[len(sent)-1]) > r.limits.Chat.Window {
+			delete(r.sent, id)
+		}
+	}
+	for chatID, until := range r.warned {
+		if now.After(until) {
+			delete(r.warned, chatID)
+		}
+	}
+}
+
+// MigrateChat works the same way as RateLimiter.MigrateChat
+func (r *LocalRateLimiter) MigrateChat(from, to int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 
-	return fmt.Errorf("RateLimiter: Limit: Redis returned wrong type: %T", resp)
+	oldID, newID := chatBudgetID(from), chatBudgetID(to)
+	merged := append(r.sent[newID], r.sent[oldID]...)
+	sort.Slice(merged, func(i, j int) bool { return merged[i].Before(merged[j]) })
+	r.sent[newID] = merged
+	delete(r.sent, oldID)
 }
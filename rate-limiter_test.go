@@ -0,0 +1,223 @@
+package main
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gomodule/redigo/redis"
+)
+
+// fakeClock is moved by tests only
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) now() time.Time      { return c.t }
+func (c *fakeClock) add(d time.Duration) { c.t = c.t.Add(d) }
+func newFakeClock() *fakeClock           { return &fakeClock{t: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)} }
+
+type limitResult int
+
+const (
+	sent limitResult = iota
+	warned
+	dropped
+)
+
+func limit(l messageLimiter, chatID int64, userID int) limitResult {
+	res := dropped
+	l.Limit(chatID, userID,
+		func() error { res = sent; return nil },
+		func() error { res = warned; return nil },
+		func() error { return nil },
+	)
+	return res
+}
+
+func newRedisRateLimiter(t *testing.T, clock *fakeClock) (*RateLimiter, *miniredis.Miniredis) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(mr.Close)
+
+	addr := mr.Addr()
+	r := NewRateLimiter(&redis.Pool{Dial: func() (redis.Conn, error) { return redis.Dial("tcp", addr) }})
+	r.now = clock.now
+	r.local.now = clock.now
+	return r, mr
+}
+
+func rateLimiters(t *testing.T, clock *fakeClock) map[string]messageLimiter {
+	redisLimiter, _ := newRedisRateLimiter(t, clock)
+	local := NewLocalRateLimiter()
+	local.now = clock.now
+	return map[string]messageLimiter{"redis": redisLimiter, "local": local}
+}
+
+func TestRateLimiterChatWindow(t *testing.T) {
+	log.Out = ioutil.Discard
+	clock := newFakeClock()
+
+	for name, l := range rateLimiters(t, clock) {
+		t.Run(name, func(t *testing.T) {
+			// Commands do not take slots of the chat, replies do
+			for i := 0; i < 25; i++ {
+				if res := limit(l, 1, i+1); res != sent {
+					t.Fatalf("Command %d: got %v", i, res)
+				}
+			}
+
+			for i := 0; i < 20; i++ {
+				if wait := l.Reserve(1); wait != 0 {
+					t.Fatalf("Message %d waits %s", i, wait)
+				}
+				clock.add(time.Second)
+			}
+
+			if wait := l.Reserve(1); wait != 40*time.Second {
+				t.Fatalf("Message over chat limit waits %s, want 40s", wait)
+			}
+			if res := limit(l, 1, 0); res != warned {
+				t.Fatalf("First exceeding command: got %v, want warned", res)
+			}
+			if res := limit(l, 1, 0); res != dropped {
+				t.Fatalf("Second exceeding command: got %v, want dropped", res)
+			}
+			if res := limit(l, 2, 0); res != sent {
+				t.Fatalf("Other chat: got %v", res)
+			}
+			if wait := l.Reserve(2); wait != 0 {
+				t.Fatalf("Message to other chat waits %s", wait)
+			}
+
+			// The window slides, the limit is not reset at the minute boundary
+			clock.add(30 * time.Second)
+			if res := limit(l, 1, 0); res != dropped {
+				t.Fatalf("Command within the window: got %v, want dropped", res)
+			}
+			if wait := l.Reserve(1); wait != 10*time.Second {
+				t.Fatalf("Message within the window waits %s, want 10s", wait)
+			}
+			clock.add(11 * time.Second)
+			if res := limit(l, 1, 0); res != sent {
+				t.Fatalf("Command after the first message left the window: got %v", res)
+			}
+			for i := 0; i < 2; i++ {
+				if wait := l.Reserve(1); wait != 0 {
+					t.Fatalf("Message %d after two messages left the window waits %s", i, wait)
+				}
+			}
+			if wait := l.Reserve(1); wait != time.Second {
+				t.Fatalf("Third message waits %s, want 1s", wait)
+			}
+			clock.add(time.Minute)
+		})
+	}
+}
+
+func TestRateLimiterUser(t *testing.T) {
+	log.Out = ioutil.Discard
+	clock := newFakeClock()
+
+	for name, l := range rateLimiters(t, clock) {
+		t.Run(name, func(t *testing.T) {
+			if res := limit(l, 300, 7); res != sent {
+				t.Fatalf("Command: got %v", res)
+			}
+			if res := limit(l, 301, 7); res != dropped {
+				t.Fatalf("Second command within a second: got %v, want dropped", res)
+			}
+			if res := limit(l, 301, 8); res != sent {
+				t.Fatalf("Command of another user: got %v", res)
+			}
+			clock.add(time.Second)
+			if res := limit(l, 301, 7); res != sent {
+				t.Fatalf("Command a second later: got %v", res)
+			}
+			clock.add(time.Minute)
+		})
+	}
+}
+
+func TestRateLimiterReserve(t *testing.T) {
+	log.Out = ioutil.Discard
+	clock := newFakeClock()
+
+	for name, l := range rateLimiters(t, clock) {
+		t.Run(name, func(t *testing.T) {
+			for i := 0; i < 30; i++ {
+				if wait := l.Reserve(int64(100 + i)); wait != 0 {
+					t.Fatalf("Message %d waits %s", i, wait)
+				}
+				clock.add(10 * time.Millisecond)
+			}
+
+			// The message waits until the first one leaves the window
+			if wait := l.Reserve(200); wait != 700*time.Millisecond {
+				t.Fatalf("Message over global limit waits %s, want 700ms", wait)
+			}
+			clock.add(700 * time.Millisecond)
+			if wait := l.Reserve(200); wait != 0 {
+				t.Fatalf("Message after the first one left the window waits %s", wait)
+			}
+
+			// Commands are not counted in the global budget
+			if res := limit(l, 1, 1); res != sent {
+				t.Fatalf("Command: got %v", res)
+			}
+			clock.add(time.Minute)
+		})
+	}
+}
+
+func TestRateLimiterFallback(t *testing.T) {
+	log.Out = ioutil.Discard
+	clock := newFakeClock()
+	l, mr := newRedisRateLimiter(t, clock)
+
+	for i := 0; i < 10; i++ {
+		l.Reserve(1)
+		clock.add(time.Second)
+	}
+	if !mr.Exists("{rate}/chat/1") || !mr.Exists("{rate}/global") {
+		t.Fatal("Messages are not counted in Redis")
+	}
+
+	// Redis is gone, messages are counted from scratch in memory
+	mr.Close()
+	for i := 0; i < 20; i++ {
+		if wait := l.Reserve(1); wait != 0 {
+			t.Fatalf("Message %d waits %s", i, wait)
+		}
+	}
+	if wait := l.Reserve(1); wait == 0 {
+		t.Fatal("Message over chat limit does not wait")
+	}
+	if res := limit(l, 1, 0); res != warned {
+		t.Fatalf("Got %v, want warned", res)
+	}
+}
+
+func TestRateLimiterMigrateChat(t *testing.T) {
+	log.Out = ioutil.Discard
+	clock := newFakeClock()
+
+	for name, l := range rateLimiters(t, clock) {
+		t.Run(name, func(t *testing.T) {
+			for i := 0; i < 20; i++ {
+				l.Reserve(1)
+				clock.add(time.Second)
+			}
+
+			l.MigrateChat(1, 2)
+			if res := limit(l, 2, 0); res != warned {
+				t.Fatalf("New chat: got %v, want warned", res)
+			}
+			if res := limit(l, 1, 0); res != sent {
+				t.Fatalf("Old chat: got %v", res)
+			}
+			clock.add(time.Minute)
+		})
+	}
+}
@@ -0,0 +1,100 @@
+/*
+ * This file is part of Crocodile Game Bot.
+ * Copyright (C) 2019  Viktor
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package redisconn
+
+import (
+	"sync"
+	"time"
+)
+
+// BreakerState is state of the circuit breaker
+type BreakerState int
+
+const (
+	// BreakerClosed passes all calls
+	BreakerClosed BreakerState = iota
+	// BreakerOpen rejects all calls until the cooldown is over
+	BreakerOpen
+	// BreakerHalfOpen passes calls to check whether the service is back
+	BreakerHalfOpen
+)
+
+// Breaker is a circuit breaker which opens after threshold failures in a row
+type Breaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time
+	open     bool
+
+	// Allows to fake time in tests
+	now func() time.Time
+}
+
+// NewBreaker returns closed Breaker
+func NewBreaker(threshold int, cooldown time.Duration) *Breaker {
+	if threshold <= 0 {
+		threshold = 1
+	}
+	return &Breaker{threshold: threshold, cooldown: cooldown, now: time.Now}
+}
+
+// State returns current state of the breaker
+func (b *Breaker) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state()
+}
+
+func (b *Breaker) state() BreakerState {
+	switch {
+	case !b.open:
+		return BreakerClosed
+	case b.now().Sub(b.openedAt) < b.cooldown:
+		return BreakerOpen
+	}
+	return BreakerHalfOpen
+}
+
+// Allow returns false if the call should be rejected
+func (b *Breaker) Allow() bool {
+	return b.State() != BreakerOpen
+}
+
+// Success closes the breaker
+func (b *Breaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	b.open = false
+}
+
+// Failure counts the failure, the breaker opens again if the call was made in half-open state
+func (b *Breaker) Failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	if b.state() == BreakerHalfOpen || b.failures >= b.threshold {
+		b.open = true
+		b.openedAt = b.now()
+	}
+}
@@ -0,0 +1,292 @@
+/*
+ * This file is part of Crocodile Game Bot.
+ * Copyright (C) 2019  Viktor
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package redisconn connects to a single Redis, to Redis Sentinel or to Redis Cluster
+// and protects the bot from Redis failures with retries and a circuit breaker.
+package redisconn
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/mna/redisc"
+)
+
+// ErrUnavailable is returned by connections while the circuit breaker is open
+var ErrUnavailable = errors.New("redis is unavailable")
+
+// Config describes how to connect to Redis, only one of Addr, SentinelAddrs and ClusterAddrs is used
+type Config struct {
+	// Addr of a single Redis
+	Addr string
+
+	// SentinelAddrs are addresses of Sentinels monitoring MasterName
+	SentinelAddrs []string
+	MasterName    string
+
+	// ClusterAddrs are startup nodes of Redis Cluster
+	ClusterAddrs []string
+
+	Password string
+
+	// Timeouts of connecting, reading replies and writing commands, 0 means no timeout.
+	// Commands would hang forever without them if Redis stopped answering without closing connections.
+	ConnectTimeout time.Duration
+	ReadTimeout    time.Duration
+	WriteTimeout   time.Duration
+
+	// DialRetries is how many times dialing is retried before the failure is counted
+	DialRetries  int
+	RetryBackoff time.Duration
+
+	// The breaker opens after BreakerThreshold failures in a row and stays open for BreakerCooldown
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+}
+
+// DefaultConfig returns Config of local Redis with retries and the breaker set up
+func DefaultConfig() Config {
+	return Config{
+		Addr:             ":6379",
+		MasterName:       "mymaster",
+		ConnectTimeout:   2 * time.Second,
+		ReadTimeout:      2 * time.Second,
+		WriteTimeout:     2 * time.Second,
+		DialRetries:      2,
+		RetryBackoff:     50 * time.Millisecond,
+		BreakerThreshold: 5,
+		BreakerCooldown:  10 * time.Second,
+	}
+}
+
+type pool interface {
+	Get() redis.Conn
+	Close() error
+}
+
+// Client is a pool of Redis connections, it never panics and
+// returns connections failing with ErrUnavailable while Redis is down
+type Client struct {
+	pool    pool
+	breaker *Breaker
+	config  Config
+	cluster bool
+
+	// Observe is called with duration of every command if it is set
+	Observe func(cmd string, d time.Duration, err error)
+}
+
+// New returns Client, connections are dialed lazily so Redis may be down at the moment
+func New(c Config) (*Client, error) {
+	client := &Client{
+		breaker: NewBreaker(c.BreakerThreshold, c.BreakerCooldown),
+		config:  c,
+	}
+
+	timeouts := []redis.DialOption{
+		redis.DialConnectTimeout(c.ConnectTimeout),
+		redis.DialReadTimeout(c.ReadTimeout),
+		redis.DialWriteTimeout(c.WriteTimeout),
+	}
+	options := append([]redis.DialOption(nil), timeouts...)
+	if c.Password != "" {
+		options = append(options, redis.DialPassword(c.Password))
+	}
+
+	switch {
+	case len(c.ClusterAddrs) > 0:
+		cluster := &redisc.Cluster{
+			StartupNodes: c.ClusterAddrs,
+			DialOptions:  options,
+			CreatePool: func(addr string, options ...redis.DialOption) (*redis.Pool, error) {
+				return newPool(func() (redis.Conn, error) { return redis.Dial("tcp", addr, options...) }, nil), nil
+			},
+		}
+		if err := cluster.Refresh(); err != nil {
+			// The layout is refreshed again on the first command
+			client.breaker.Failure()
+		}
+		client.pool = cluster
+		client.cluster = true
+
+	case len(c.SentinelAddrs) > 0:
+		s := &sentinel{addrs: c.SentinelAddrs, master: c.MasterName, options: options, sentinelOptions: timeouts}
+		client.pool = newPool(s.dial, s.testRole)
+
+	case c.Addr != "":
+		client.pool = newPool(func() (redis.Conn, error) { return redis.Dial("tcp", c.Addr, options...) }, nil)
+
+	default:
+		return nil, fmt.Errorf("redis address is not set")
+	}
+
+	return client, nil
+}
+
+func newPool(dial func() (redis.Conn, error), test func(redis.Conn) error) *redis.Pool {
+	return &redis.Pool{
+		MaxIdle:     200,
+		MaxActive:   10000,
+		IdleTimeout: 240 * time.Second,
+		Dial:        dial,
+		TestOnBorrow: func(c redis.Conn, t time.Time) error {
+			// Connections used recently are fine
+			if time.Since(t) < time.Minute {
+				return nil
+			}
+			if test != nil {
+				return test(c)
+			}
+			_, err := c.Do("PING")
+			return err
+		},
+	}
+}
+
+// Get returns connection, dialing is retried with backoff.
+// The connection fails with ErrUnavailable if the breaker is open.
+func (c *Client) Get() redis.Conn {
+	conn, err := c.dial()
+	if err != nil {
+		return errorConn{err}
+	}
+
+	if c.cluster {
+		// Follows MOVED and ASK redirections
+		if rc, err := redisc.RetryConn(conn, 3, 100*time.Millisecond); err == nil {
+			conn = rc
+		}
+	}
+
+	return &breakerConn{Conn: conn, breaker: c.breaker, observe: c.Observe}
+}
+
+// PubSubConn returns connection for SUBSCRIBE and other commands using Send and Receive.
+// Connections of Redis Cluster following redirections support Do only, so this one
+// is bound to a random node, messages are published to every node of the cluster.
+func (c *Client) PubSubConn() redis.Conn {
+	conn, err := c.dial()
+	if err != nil {
+		return errorConn{err}
+	}
+
+	if c.cluster {
+		if err := redisc.BindConn(conn); err != nil {
+			c.breaker.Failure()
+			conn.Close()
+			return errorConn{err}
+		}
+	}
+
+	return &breakerConn{Conn: conn, breaker: c.breaker, observe: c.Observe}
+}
+
+func (c *Client) dial() (redis.Conn, error) {
+	if !c.breaker.Allow() {
+		return nil, ErrUnavailable
+	}
+
+	var conn redis.Conn
+	for attempt := 0; ; attempt++ {
+		conn = c.pool.Get()
+		if conn.Err() == nil || attempt >= c.config.DialRetries {
+			break
+		}
+		conn.Close()
+		time.Sleep(c.config.RetryBackoff << uint(attempt))
+	}
+
+	if err := conn.Err(); err != nil {
+		c.breaker.Failure()
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Available returns false while the breaker is open
+func (c *Client) Available() bool {
+	return c.breaker.State() != BreakerOpen
+}
+
+// Close closes all connections
+func (c *Client) Close() error {
+	return c.pool.Close()
+}
+
+// breakerConn reports results of commands to the breaker
+type breakerConn struct {
+	redis.Conn
+	breaker *Breaker
+	observe func(cmd string, d time.Duration, err error)
+}
+
+func (c *breakerConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	start := time.Now()
+	reply, err := c.Conn.Do(cmd, args...)
+	if c.observe != nil && cmd != "" {
+		c.observe(cmd, time.Since(start), err)
+	}
+	c.report(err)
+	return reply, err
+}
+
+// DoWithTimeout makes redis.DoWithTimeout work through the breaker
+func (c *breakerConn) DoWithTimeout(timeout time.Duration, cmd string, args ...interface{}) (interface{}, error) {
+	start := time.Now()
+	reply, err := redis.DoWithTimeout(c.Conn, timeout, cmd, args...)
+	if c.observe != nil && cmd != "" {
+		c.observe(cmd, time.Since(start), err)
+	}
+	c.report(err)
+	return reply, err
+}
+
+func (c *breakerConn) Receive() (interface{}, error) {
+	reply, err := c.Conn.Receive()
+	c.report(err)
+	return reply, err
+}
+
+// ReceiveWithTimeout makes redis.ReceiveWithTimeout work through the breaker
+func (c *breakerConn) ReceiveWithTimeout(timeout time.Duration) (interface{}, error) {
+	reply, err := redis.ReceiveWithTimeout(c.Conn, timeout)
+	c.report(err)
+	return reply, err
+}
+
+func (c *breakerConn) report(err error) {
+	// Error replies and nil replies mean Redis works
+	if _, ok := err.(redis.Error); err == nil || ok || err == redis.ErrNil {
+		c.breaker.Success()
+		return
+	}
+	c.breaker.Failure()
+}
+
+// errorConn fails every command with the error
+type errorConn struct{ err error }
+
+func (c errorConn) Close() error                                   { return nil }
+func (c errorConn) Err() error                                     { return c.err }
+func (c errorConn) Do(string, ...interface{}) (interface{}, error) { return nil, c.err }
+func (c errorConn) Send(string, ...interface{}) error              { return c.err }
+func (c errorConn) Flush() error                                   { return c.err }
+func (c errorConn) Receive() (interface{}, error)                  { return nil, c.err }
@@ -0,0 +1,237 @@
+/*
+ * This file is part of Crocodile Game Bot.
+ * Copyright (C) 2019  Viktor
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package redisconn
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/alicebob/miniredis/v2/server"
+	"github.com/gomodule/redigo/redis"
+)
+
+func TestBreaker(t *testing.T) {
+	now := time.Unix(0, 0)
+	b := NewBreaker(2, time.Minute)
+	b.now = func() time.Time { return now }
+
+	b.Failure()
+	if b.State() != BreakerClosed {
+		t.Fatalf("Breaker opened after the first failure")
+	}
+	b.Failure()
+	if b.Allow() {
+		t.Fatalf("Breaker is not open after threshold failures")
+	}
+
+	now = now.Add(time.Minute)
+	if b.State() != BreakerHalfOpen {
+		t.Fatalf("Breaker is %v after cooldown, want half-open", b.State())
+	}
+
+	// A single failure in half-open state opens the breaker again
+	b.Failure()
+	if b.Allow() {
+		t.Fatalf("Breaker is not open after failure in half-open state")
+	}
+
+	now = now.Add(time.Minute)
+	b.Success()
+	if b.State() != BreakerClosed {
+		t.Fatalf("Breaker is not closed after success")
+	}
+}
+
+func TestClientOpensBreaker(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := New(Config{Addr: mr.Addr(), BreakerThreshold: 3, BreakerCooldown: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	conn := c.Get()
+	if _, err := conn.Do("SET", "a", "b"); err != nil {
+		t.Fatal(err)
+	}
+	// Error replies do not mean Redis is down
+	if _, err := conn.Do("INCR", "a"); err == nil {
+		t.Fatal("INCR of a string succeeded")
+	}
+	conn.Close()
+
+	mr.Close()
+	for i := 0; i < 3; i++ {
+		conn := c.Get()
+		if _, err := conn.Do("GET", "a"); err == nil {
+			t.Fatal("GET succeeded without Redis")
+		}
+		conn.Close()
+	}
+
+	if c.Available() {
+		t.Fatal("Client is available after failures")
+	}
+	if _, err := c.Get().Do("GET", "a"); !errors.Is(err, ErrUnavailable) {
+		t.Fatalf("Got %v, want ErrUnavailable", err)
+	}
+}
+
+func TestClientClusterPubSub(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mr.Close()
+
+	c, err := New(Config{ClusterAddrs: []string{mr.Addr()}, BreakerThreshold: 3, BreakerCooldown: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// Connections following redirections cannot subscribe
+	conn := c.Get()
+	if err := conn.Send("SUBSCRIBE", "channel"); err == nil {
+		t.Fatal("SUBSCRIBE succeeded on connection following redirections")
+	}
+	conn.Close()
+
+	psc := redis.PubSubConn{Conn: c.PubSubConn()}
+	defer psc.Close()
+	if err := psc.Subscribe("channel"); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := psc.Receive().(redis.Subscription); !ok || v.Count != 1 {
+		t.Fatalf("Got %v, want subscription", v)
+	}
+
+	mr.Publish("channel", "message")
+	if v, ok := psc.Receive().(redis.Message); !ok || string(v.Data) != "message" {
+		t.Fatalf("Got %v, want message", v)
+	}
+
+	if !c.Available() {
+		t.Fatal("Client is not available after subscription")
+	}
+}
+
+func TestClientTimeouts(t *testing.T) {
+	// Connections are accepted by the kernel, but nothing is ever replied
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	c, err := New(Config{Addr: l.Addr().String(), ReadTimeout: 50 * time.Millisecond, BreakerThreshold: 1, BreakerCooldown: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	start := time.Now()
+	conn := c.Get()
+	if _, err := conn.Do("GET", "a"); err == nil {
+		t.Fatal("GET succeeded without replies")
+	}
+	conn.Close()
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("GET has taken %s", d)
+	}
+	// Timeouts are failures, so the breaker opens
+	if c.Available() {
+		t.Error("Client is available after timeout")
+	}
+
+	// Sentinels which do not reply are skipped
+	s := &sentinel{
+		addrs:           []string{l.Addr().String()},
+		master:          "mymaster",
+		sentinelOptions: []redis.DialOption{redis.DialReadTimeout(50 * time.Millisecond)},
+	}
+	start = time.Now()
+	if _, err := s.dial(); err == nil {
+		t.Fatal("Connected through the hung sentinel")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Asking the sentinel has taken %s", d)
+	}
+}
+
+func TestClientSentinel(t *testing.T) {
+	master, replica, sentinelRedis := runRedis(t, "master"), runRedis(t, "slave"), runRedis(t, "sentinel")
+
+	var mu sync.Mutex
+	current := master
+	sentinelRedis.Server().Register("SENTINEL", func(c *server.Peer, cmd string, args []string) {
+		mu.Lock()
+		host, port, _ := net.SplitHostPort(current.Addr())
+		mu.Unlock()
+		c.WriteStrings([]string{host, port})
+	})
+
+	c, err := New(Config{SentinelAddrs: []string{"127.0.0.1:1", sentinelRedis.Addr()}, MasterName: "mymaster", BreakerThreshold: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	conn := c.Get()
+	if _, err := conn.Do("SET", "a", "b"); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if v, _ := master.Get("a"); v != "b" {
+		t.Fatalf("The key is not written to the master")
+	}
+
+	// Sentinel points to the old master which has been demoted
+	mu.Lock()
+	current = replica
+	mu.Unlock()
+
+	s := &sentinel{addrs: []string{sentinelRedis.Addr()}, master: "mymaster"}
+	if _, err := s.dial(); err == nil {
+		t.Fatal("Connected to the replica")
+	}
+}
+
+// runRedis starts miniredis replying to ROLE with the role
+func runRedis(t *testing.T, role string) *miniredis.Miniredis {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(mr.Close)
+
+	mr.Server().Register("ROLE", func(c *server.Peer, cmd string, args []string) {
+		c.WriteLen(1)
+		c.WriteBulk(role)
+	})
+	return mr
+}
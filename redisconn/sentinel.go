@@ -0,0 +1,100 @@
+/*
+ * This file is part of Crocodile Game Bot.
+ * Copyright (C) 2019  Viktor
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package redisconn
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// sentinel dials the current master of Sentinel setup
+type sentinel struct {
+	addrs  []string
+	master string
+
+	// options of connections to the master, sentinelOptions of connections to Sentinels
+	options         []redis.DialOption
+	sentinelOptions []redis.DialOption
+}
+
+// dial asks Sentinels for the master address and connects to it
+func (s *sentinel) dial() (redis.Conn, error) {
+	addr, err := s.masterAddr()
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := redis.Dial("tcp", addr, s.options...)
+	if err != nil {
+		return nil, err
+	}
+
+	// Sentinels may not know about the failover yet
+	if err := s.testRole(c); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (s *sentinel) masterAddr() (string, error) {
+	var lastErr error
+	for _, addr := range s.addrs {
+		c, err := redis.Dial("tcp", addr, s.sentinelOptions...)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		res, err := redis.Strings(c.Do("SENTINEL", "get-master-addr-by-name", s.master))
+		c.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if len(res) != 2 {
+			lastErr = fmt.Errorf("sentinel %s does not know master %q", addr, s.master)
+			continue
+		}
+		return net.JoinHostPort(res[0], res[1]), nil
+	}
+
+	if lastErr == nil {
+		lastErr = errors.New("no sentinels are configured")
+	}
+	return "", lastErr
+}
+
+// testRole checks the connection still goes to the master, e.g. after failover
+func (s *sentinel) testRole(c redis.Conn) error {
+	role, err := redis.Values(c.Do("ROLE"))
+	if err != nil {
+		return err
+	}
+	if len(role) == 0 {
+		return errors.New("empty ROLE reply")
+	}
+	if r, _ := redis.String(role[0], nil); r != "master" {
+		return fmt.Errorf("redis has role %q instead of master", r)
+	}
+	return nil
+}
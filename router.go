@@ -0,0 +1,175 @@
+/*
+ * This file is part of Crocodile Game Bot.
+ * Copyright (C) 2019  Viktor
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"regexp"
+	"strings"
+
+	tb "gopkg.in/tucnak/telebot.v2"
+
+	"github.com/nuetoban/crocodile-game-bot/dispatcher"
+)
+
+var (
+	updatesDispatcher *dispatcher.Dispatcher
+	updatesRouter     = newUpdateRouter()
+
+	routerCmdRx   = regexp.MustCompile(`^(/\w+)(@(\w+))?(\s|$)(.+)?`)
+	routerCbackRx = regexp.MustCompile(`^\f(\w+)(\|(.+))?$`)
+)
+
+// updateRouter calls handlers the same way telebot does, but synchronously,
+// so updates of one chat are handled in order by the dispatcher worker
+type updateRouter struct {
+	messageHandlers  map[string]func(context.Context, *tb.Message)
+	callbackHandlers map[string]func(context.Context, *tb.Callback)
+
+	// Username of the bot, commands addressed to other bots are ignored
+	username string
+}
+
+func newUpdateRouter() *updateRouter {
+	return &updateRouter{
+		messageHandlers:  make(map[string]func(context.Context, *tb.Message)),
+		callbackHandlers: make(map[string]func(context.Context, *tb.Callback)),
+	}
+}
+
+// Handle binds message handler to command or telebot endpoint (e.g. tb.OnText)
+func (r *updateRouter) Handle(endpoint string, f func(context.Context, *tb.Message)) {
+	r.messageHandlers[endpoint] = f
+}
+
+// HandleButton binds callback handler to inline button
+func (r *updateRouter) HandleButton(btn *tb.InlineButton, f func(context.Context, *tb.Callback)) {
+	r.callbackHandlers[btn.Unique] = f
+}
+
+// Route calls handler of the update
+func (r *updateRouter) Route(ctx context.Context, upd *tb.Update) {
+	switch {
+	case upd.Message != nil:
+		r.routeMessage(ctx, upd.Message)
+	case upd.Callback != nil:
+		r.routeCallback(ctx, upd.Callback)
+	}
+}
+
+func (r *updateRouter) routeMessage(ctx context.Context, m *tb.Message) {
+	if m.MigrateTo != 0 || m.MigrateFrom != 0 {
+		if f, ok := r.messageHandlers[tb.OnMigration]; ok {
+			observeHandler(ctx, nil, "migration", func(ctx context.Context) { f(ctx, m) })
+		}
+		return
+	}
+
+	if m.Text == "" {
+		return
+	}
+
+	if match := routerCmdRx.FindAllStringSubmatch(m.Text, -1); match != nil {
+		command, botName := match[0][1], match[0][3]
+		if botName != "" && !strings.EqualFold(botName, r.username) {
+			return
+		}
+
+		m.Payload = match[0][5]
+		if f, ok := r.messageHandlers[command]; ok {
+			observeHandler(ctx, commandsTotal.WithLabelValues(command), command, func(ctx context.Context) { f(ctx, m) })
+			countLegacyCommand(command)
+			return
+		}
+	}
+
+	if f, ok := r.messageHandlers[tb.OnText]; ok {
+		observeHandler(ctx, textUpdatesTotal, "text", func(ctx context.Context) { f(ctx, m) })
+	}
+}
+
+func (r *updateRouter) routeCallback(ctx context.Context, c *tb.Callback) {
+	match := routerCbackRx.FindAllStringSubmatch(c.Data, -1)
+	if match == nil {
+		return
+	}
+
+	c.Data = match[0][3]
+	if f, ok := r.callbackHandlers[match[0][1]]; ok {
+		button := match[0][1]
+		observeHandler(ctx, callbacksTotal.WithLabelValues(button), button, func(ctx context.Context) { f(ctx, c) })
+	}
+}
+
+// Returns chat ID of the update, 0 if there is no chat
+func updateChatID(upd *tb.Update) int64 {
+	switch {
+	case upd.Message != nil && upd.Message.Chat != nil:
+		return upd.Message.Chat.ID
+	case upd.Callback != nil && upd.Callback.Message != nil && upd.Callback.Message.Chat != nil:
+		return upd.Callback.Message.Chat.ID
+	}
+	return 0
+}
+
+// Returns ID of the user who has sent the update, 0 if there is no user
+func updateUserID(upd *tb.Update) int {
+	switch {
+	case upd.Message != nil && upd.Message.Sender != nil:
+		return upd.Message.Sender.ID
+	case upd.Callback != nil && upd.Callback.Sender != nil:
+		return upd.Callback.Sender.ID
+	}
+	return 0
+}
+
+// Plain text messages (guesses) may be dropped when a chat is flooded,
+// commands, chat migrations and button presses are always handled
+func updateDroppable(upd *tb.Update) bool {
+	m := upd.Message
+	return m != nil && !strings.HasPrefix(m.Text, "/") && m.MigrateTo == 0 && m.MigrateFrom == 0
+}
+
+// Middleware passing updates to the dispatcher instead of telebot handlers
+func dispatchMiddlewarePoller(upd *tb.Update) bool {
+	chatID := updateChatID(upd)
+	l := updateLog(upd)
+	route := func() {
+		ctx, span := startSpan(withLog(context.Background(), l), "update",
+			updateAttributes(upd.ID, chatID, updateUserID(upd))...)
+		defer span.End()
+		updatesRouter.Route(ctx, upd)
+	}
+	if !updatesDispatcher.Dispatch(chatID, route, updateDroppable(upd)) {
+		l.Debugf("Chat %d is flooded, update has been dropped", chatID)
+	}
+	return false
+}
+
+// Combines several middlewares, the update is passed further while they return true
+func chainMiddlewares(ms ...func(*tb.Update) bool) func(*tb.Update) bool {
+	return func(upd *tb.Update) bool {
+		for _, m := range ms {
+			if !m(upd) {
+				return false
+			}
+		}
+		return true
+	}
+}
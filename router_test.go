@@ -0,0 +1,61 @@
+/*
+ * This file is part of Crocodile Game Bot.
+ * Copyright (C) 2019  Viktor
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+func TestUpdateRouter(t *testing.T) {
+	r := newUpdateRouter()
+	r.username = "Crocodile_Game_Bot"
+
+	var got []string
+	r.Handle("/start", func(_ context.Context, m *tb.Message) { got = append(got, "start:"+m.Payload) })
+	r.Handle(tb.OnText, func(_ context.Context, m *tb.Message) { got = append(got, "text:"+m.Text) })
+	r.Handle(tb.OnMigration, func(_ context.Context, m *tb.Message) { got = append(got, "migration") })
+	r.HandleButton(&tb.InlineButton{Unique: "see_word"}, func(_ context.Context, c *tb.Callback) { got = append(got, "see_word:"+c.Data) })
+
+	for _, upd := range []*tb.Update{
+		{Message: &tb.Message{Text: "/start"}},
+		{Message: &tb.Message{Text: "/start@crocodile_game_bot daily"}},
+		{Message: &tb.Message{Text: "/start@other_bot"}},
+		{Message: &tb.Message{Text: "/unknown"}},
+		{Message: &tb.Message{Text: "крокодил"}},
+		{Message: &tb.Message{MigrateTo: -1001}},
+		{Callback: &tb.Callback{Data: "\fsee_word|42"}},
+		{Callback: &tb.Callback{Data: "\fnext_word"}},
+	} {
+		r.Route(context.Background(), upd)
+	}
+
+	expected := []string{"start:", "start:daily", "text:/unknown", "text:крокодил", "migration", "see_word:42"}
+	if len(got) != len(expected) {
+		t.Fatalf("Got %v, expected %v", got, expected)
+	}
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Errorf("Got %v, expected %v", got, expected)
+			break
+		}
+	}
+}
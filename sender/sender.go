@@ -0,0 +1,285 @@
+/*
+ * This file is part of Crocodile Game Bot.
+ * Copyright (C) 2019  Viktor
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package sender delivers messages of the bot in order per chat,
+// waiting for Telegram when it asks to retry later.
+package sender
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrDropped is returned when the message is not queued
+var ErrDropped = errors.New("message has been dropped")
+
+var retryAfterRx = regexp.MustCompile(`retry after (\d+)`)
+
+// Errors of Telegram meaning the bot cannot write to the chat anymore
+var kickedErrors = []string{
+	"bot was kicked",
+	"bot was blocked by the user",
+	"bot is not a member",
+	"chat not found",
+	"user is deactivated",
+	"group chat was upgraded to a supergroup",
+}
+
+// Errors of Telegram which may go away by themselves: 429 and 5xx
+var transientErrors = []string{
+	"Too Many Requests",
+	"Internal Server Error",
+	"Bad Gateway",
+	"Service Unavailable",
+	"Gateway Timeout",
+}
+
+// RetryAfter returns how long Telegram asked to wait, telebot keeps it only in the description
+func RetryAfter(err error) (time.Duration, bool) {
+	match := retryAfterRx.FindStringSubmatch(err.Error())
+	if match == nil {
+		return 0, false
+	}
+	seconds, _ := strconv.Atoi(match[1])
+	return time.Duration(seconds) * time.Second, true
+}
+
+// IsKicked returns true if the bot has been removed from the chat or blocked by the user
+func IsKicked(err error) bool {
+	return containsAny(err.Error(), kickedErrors)
+}
+
+// IsTransient returns true for failed connections to Telegram, flood limits and errors of Telegram servers.
+// Other errors, e.g. invalid requests or responses, are not fixed by retries.
+func IsTransient(err error) bool {
+	s := err.Error()
+	if strings.HasPrefix(s, "api error") {
+		return containsAny(s, transientErrors)
+	}
+	return isConnectionError(err)
+}
+
+// isConnectionError returns true if connecting to Telegram or reading its response has failed,
+// telebot wraps such errors with github.com/pkg/errors
+func isConnectionError(err error) bool {
+	for err != nil {
+		switch e := err.(type) {
+		case *net.OpError:
+			return true
+		case *url.Error:
+			if e.Timeout() {
+				return true
+			}
+			err = e.Err
+		case interface{ Cause() error }:
+			err = e.Cause()
+		case interface{ Unwrap() error }:
+			err = e.Unwrap()
+		default:
+			return err == io.EOF || err == io.ErrUnexpectedEOF
+		}
+	}
+	return false
+}
+
+func containsAny(s string, list []string) bool {
+	for _, v := range list {
+		if strings.Contains(s, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// Stats are counters of the sender
+type Stats struct {
+	Sent    uint64
+	Retried uint64
+	Failed  uint64
+	Dropped uint64
+
+	// Messages waiting in queues of all chats
+	Queued int64
+}
+
+// Sender queues messages per chat, every chat has its own goroutine while it has messages
+type Sender struct {
+	// Counters are accessed atomically, they go first to be aligned on 32-bit platforms
+	sent, retried, failed, dropped uint64
+	queued                         int64
+
+	// How many messages may wait in the queue of one chat
+	QueueSize int
+
+	// How many times a message is sent before it is given up
+	MaxAttempts int
+
+	// Backoff is the delay before the first retry of a transient error, it is doubled up to MaxBackoff
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+
+	// Called when a message has not been delivered
+	OnError func(chatID int64, err error)
+
+	// Throttle is called with the chat before every attempt, the message waits as long as it returns,
+	// e.g. until budgets of the chat and of the bot have a slot
+	Throttle func(chatID int64) time.Duration
+
+	mu      sync.Mutex
+	queues  map[int64][]func() error
+	stopped bool
+	wg      sync.WaitGroup
+
+	// Allows to fake waiting in tests
+	sleep func(time.Duration)
+}
+
+// New returns Sender with Telegram friendly defaults
+func New() *Sender {
+	return &Sender{
+		QueueSize:   100,
+		MaxAttempts: 5,
+		Backoff:     500 * time.Millisecond,
+		MaxBackoff:  30 * time.Second,
+		queues:      make(map[int64][]func() error),
+		sleep:       time.Sleep,
+	}
+}
+
+// Enqueue adds the message to the queue of the chat. send is called for every attempt.
+// ErrDropped is returned if the queue is full or the sender has been stopped.
+func (s *Sender) Enqueue(chatID int64, send func() error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	queue, running := s.queues[chatID]
+	if s.stopped || len(queue) >= s.QueueSize {
+		atomic.AddUint64(&s.dropped, 1)
+		return ErrDropped
+	}
+
+	s.queues[chatID] = append(queue, send)
+	atomic.AddInt64(&s.queued, 1)
+
+	if !running {
+		s.wg.Add(1)
+		go s.run(chatID)
+	}
+	return nil
+}
+
+// run sends messages of the chat until the queue is empty
+func (s *Sender) run(chatID int64) {
+	defer s.wg.Done()
+
+	for {
+		s.mu.Lock()
+		queue := s.queues[chatID]
+		if len(queue) == 0 {
+			delete(s.queues, chatID)
+			s.mu.Unlock()
+			return
+		}
+		send := queue[0]
+		s.mu.Unlock()
+
+		err := s.deliver(chatID, send)
+
+		s.mu.Lock()
+		queue = s.queues[chatID]
+		n := 1
+		// Nobody will read the rest of messages either
+		if err != nil && IsKicked(err) {
+			n = len(queue)
+			atomic.AddUint64(&s.dropped, uint64(n-1))
+		}
+		s.queues[chatID] = queue[n:]
+		atomic.AddInt64(&s.queued, -int64(n))
+		s.mu.Unlock()
+
+		if err != nil {
+			atomic.AddUint64(&s.failed, 1)
+			if s.OnError != nil {
+				s.OnError(chatID, err)
+			}
+			continue
+		}
+		atomic.AddUint64(&s.sent, 1)
+	}
+}
+
+// deliver sends the message, retrying when it makes sense
+func (s *Sender) deliver(chatID int64, send func() error) error {
+	backoff := s.Backoff
+	for attempt := 1; ; attempt++ {
+		s.throttle(chatID)
+		err := send()
+		if err == nil || attempt >= s.MaxAttempts {
+			return err
+		}
+
+		if wait, ok := RetryAfter(err); ok {
+			s.sleep(wait)
+		} else if IsTransient(err) {
+			s.sleep(backoff)
+			if backoff *= 2; backoff > s.MaxBackoff {
+				backoff = s.MaxBackoff
+			}
+		} else {
+			return err
+		}
+		atomic.AddUint64(&s.retried, 1)
+	}
+}
+
+func (s *Sender) throttle(chatID int64) {
+	if s.Throttle == nil {
+		return
+	}
+	for wait := s.Throttle(chatID); wait > 0; wait = s.Throttle(chatID) {
+		s.sleep(wait)
+	}
+}
+
+// Stop drops new messages and waits until queued messages are delivered
+func (s *Sender) Stop() {
+	s.mu.Lock()
+	s.stopped = true
+	s.mu.Unlock()
+
+	s.wg.Wait()
+}
+
+// Stats returns counters of delivered and lost messages
+func (s *Sender) Stats() Stats {
+	return Stats{
+		Sent:    atomic.LoadUint64(&s.sent),
+		Retried: atomic.LoadUint64(&s.retried),
+		Failed:  atomic.LoadUint64(&s.failed),
+		Dropped: atomic.LoadUint64(&s.dropped),
+		Queued:  atomic.LoadInt64(&s.queued),
+	}
+}
@@ -0,0 +1,237 @@
+/*
+ * This file is part of Crocodile Game Bot.
+ * Copyright (C) 2019  Viktor
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package sender
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recorder is a fake Telegram, it fails every message with the errors in order
+type recorder struct {
+	mu     sync.Mutex
+	errs   []error
+	sent   []string
+	sleeps []time.Duration
+}
+
+func (r *recorder) send(text string) func() error {
+	return func() error {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if len(r.errs) > 0 {
+			err := r.errs[0]
+			r.errs = r.errs[1:]
+			if err != nil {
+				return err
+			}
+		}
+		r.sent = append(r.sent, text)
+		return nil
+	}
+}
+
+func (r *recorder) sleep(d time.Duration) {
+	r.mu.Lock()
+	r.sleeps = append(r.sleeps, d)
+	r.mu.Unlock()
+}
+
+func newTestSender(r *recorder) *Sender {
+	s := New()
+	s.sleep = r.sleep
+	return s
+}
+
+func TestSenderRetries(t *testing.T) {
+	r := &recorder{errs: []error{
+		errors.New("api error: Too Many Requests: retry after 7"),
+		postFailed(io.EOF),
+		errors.New("api error: Bad Gateway"),
+	}}
+	s := newTestSender(r)
+
+	for _, text := range []string{"отгадал(а) слово", "второе", "третье"} {
+		if err := s.Enqueue(1, r.send(text)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Stop()
+
+	if len(r.sent) != 3 || r.sent[0] != "отгадал(а) слово" || r.sent[2] != "третье" {
+		t.Errorf("Sent %v", r.sent)
+	}
+
+	expected := []time.Duration{7 * time.Second, s.Backoff, 2 * s.Backoff}
+	if len(r.sleeps) != len(expected) {
+		t.Fatalf("Slept %v, expected %v", r.sleeps, expected)
+	}
+	for i := range expected {
+		if r.sleeps[i] != expected[i] {
+			t.Errorf("Slept %v, expected %v", r.sleeps, expected)
+		}
+	}
+
+	if stats := s.Stats(); stats.Sent != 3 || stats.Retried != 3 || stats.Queued != 0 {
+		t.Errorf("Stats: %+v", stats)
+	}
+}
+
+// wrapped is an error wrapped by github.com/pkg/errors as telebot does
+type wrapped struct {
+	msg   string
+	cause error
+}
+
+func (w wrapped) Error() string { return w.msg + ": " + w.cause.Error() }
+func (w wrapped) Cause() error  { return w.cause }
+
+// postFailed returns the error of telebot when the request to Telegram has failed
+func postFailed(err error) error {
+	return wrapped{"http.Post failed", &url.Error{Op: "Post", URL: "https://api.telegram.org", Err: err}}
+}
+
+func TestIsTransient(t *testing.T) {
+	for _, tc := range []struct {
+		err       error
+		transient bool
+	}{
+		{postFailed(&net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}), true},
+		{postFailed(io.EOF), true},
+		{postFailed(errors.New("x509: certificate signed by unknown authority")), false},
+		{errors.New("api error: Too Many Requests: retry after 7"), true},
+		{errors.New("api error: Bad Gateway"), true},
+		{errors.New("api error: Bad Request: message text is empty"), false},
+		{wrapped{"bad response json", errors.New("invalid character '<'")}, false},
+	} {
+		if got := IsTransient(tc.err); got != tc.transient {
+			t.Errorf("IsTransient(%q): got %t, expected %t", tc.err, got, tc.transient)
+		}
+	}
+}
+
+func TestSenderGivesUp(t *testing.T) {
+	r := &recorder{errs: []error{
+		errors.New("api error: Bad Request: message text is empty"),
+		errors.New("api error: Bad Gateway"),
+		errors.New("api error: Bad Gateway"),
+	}}
+	s := newTestSender(r)
+	s.MaxAttempts = 2
+
+	var failed []error
+	s.OnError = func(chatID int64, err error) { failed = append(failed, err) }
+
+	s.Enqueue(1, r.send("пустое"))
+	s.Enqueue(1, r.send("недоставленное"))
+	s.Enqueue(1, r.send("доставленное"))
+	s.Stop()
+
+	if len(failed) != 2 || len(r.sent) != 1 || r.sent[0] != "доставленное" {
+		t.Errorf("Failed %v, sent %v", failed, r.sent)
+	}
+}
+
+func TestSenderDropsKickedChat(t *testing.T) {
+	r := &recorder{errs: []error{errors.New("api error: Forbidden: bot was kicked from the group chat")}}
+	s := newTestSender(r)
+
+	// The first message blocks the queue until the rest are queued
+	release := make(chan struct{})
+	s.Enqueue(1, func() error { <-release; return r.send("")() })
+	for i := 0; i < 3; i++ {
+		s.Enqueue(1, r.send("после удаления"))
+	}
+	close(release)
+	s.Stop()
+
+	stats := s.Stats()
+	if len(r.sent) != 0 || stats.Failed != 1 || stats.Dropped != 3 {
+		t.Errorf("Sent %v, stats %+v", r.sent, stats)
+	}
+}
+
+func TestSenderQueueSize(t *testing.T) {
+	s := newTestSender(&recorder{})
+	s.QueueSize = 2
+
+	release := make(chan struct{})
+	block := func() error { <-release; return nil }
+	for i := 0; i < 2; i++ {
+		if err := s.Enqueue(1, block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Enqueue(1, block); err != ErrDropped {
+		t.Errorf("Got %v, expected ErrDropped", err)
+	}
+	// Other chats have their own queues
+	if err := s.Enqueue(2, block); err != nil {
+		t.Errorf("Other chat: %v", err)
+	}
+
+	close(release)
+	s.Stop()
+	if err := s.Enqueue(1, block); err != ErrDropped {
+		t.Errorf("Stopped sender: got %v, expected ErrDropped", err)
+	}
+}
+
+func TestSenderThrottle(t *testing.T) {
+	r := &recorder{}
+	s := newTestSender(r)
+
+	// The budget has a slot after two waits
+	waits := []time.Duration{300 * time.Millisecond, 200 * time.Millisecond}
+	var chats []int64
+	s.Throttle = func(chatID int64) time.Duration {
+		chats = append(chats, chatID)
+		if len(waits) == 0 {
+			return 0
+		}
+		wait := waits[0]
+		waits = waits[1:]
+		return wait
+	}
+
+	if err := s.Enqueue(1, r.send("отгадал(а) слово")); err != nil {
+		t.Fatal(err)
+	}
+	s.Stop()
+
+	if len(r.sent) != 1 {
+		t.Errorf("Sent %v", r.sent)
+	}
+	if len(r.sleeps) != 2 || r.sleeps[0] != 300*time.Millisecond || r.sleeps[1] != 200*time.Millisecond {
+		t.Errorf("Slept %v, want [300ms 200ms]", r.sleeps)
+	}
+	if st := s.Stats(); st.Dropped != 0 || st.Sent != 1 {
+		t.Errorf("Stats: %+v", st)
+	}
+	for _, chatID := range chats {
+		if chatID != 1 {
+			t.Errorf("Throttled chat %d, want 1", chatID)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+/*
+ * This file is part of Crocodile Game Bot.
+ * Copyright (C) 2019  Viktor
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// waitContext calls f and waits until it returns or ctx is done
+func waitContext(ctx context.Context, f func()) error {
+	done := make(chan struct{})
+	go func() {
+		f()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// shutdown stops the bot when the root context is done. New updates are not taken,
+// in-flight updates and outgoing messages are given the timeout to finish,
+// connections are closed after that.
+func shutdown(timeout time.Duration, botDone <-chan struct{}, metricsServer *http.Server, pg botStorage, flushTraces func(context.Context) error) {
+	log.Info("Stopping the poller")
+	// Not ready anymore, webhook traffic goes to other replicas
+	botHealth.SetPolling(false)
+	bot.Stop()
+	<-botDone
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	log.Info("Waiting for in-flight updates")
+	if err := waitContext(ctx, updatesDispatcher.Stop); err != nil {
+		log.Errorf("Updates have not been handled in %s: %v", timeout, err)
+	}
+
+	log.Info("Waiting for outgoing messages")
+	if err := waitContext(ctx, messageSender.Stop); err != nil {
+		log.Errorf("%d messages have not been sent in %s: %v", messageSender.Stats().Queued, timeout, err)
+	}
+
+	log.Info("Flushing traces")
+	if err := flushTraces(ctx); err != nil {
+		log.Errorf("Cannot flush traces: %v", err)
+	}
+
+	// The last scrape may still be in progress
+	log.Info("Stopping metrics exporter server")
+	if err := metricsServer.Shutdown(ctx); err != nil {
+		log.Errorf("Cannot stop metrics exporter server: %v", err)
+	}
+
+	log.Info("Closing connections")
+	if err := redisPool.Close(); err != nil {
+		log.Errorf("Cannot close Redis connections: %v", err)
+	}
+	if err := pg.Close(); err != nil {
+		log.Errorf("Cannot close database connections: %v", err)
+	}
+}
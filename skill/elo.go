@@ -0,0 +1,77 @@
+/*
+ * This file is part of Crocodile Game Bot.
+ * Copyright (C) 2019  Viktor
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package skill
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	// DefaultRating is rating of a new player, it is also rating of the virtual opponent
+	DefaultRating = 1500.0
+
+	// K is the maximum rating change per round
+	K = 32.0
+
+	// ParTime is time of explanation which gives the host score 0.5
+	ParTime = 60 * time.Second
+)
+
+// Expected returns probability of a player with rating a to beat a player with rating b
+func Expected(a, b float64) float64 {
+	return 1 / (1 + math.Pow(10, (b-a)/400))
+}
+
+// GuesserDeltas treats the winner as beating every opponent,
+// K is split between the matches so the winner cannot get more than K per round.
+// Without opponents the winner plays against a virtual DefaultRating player
+func GuesserDeltas(winner float64, opponents []float64) (float64, []float64) {
+	if len(opponents) == 0 {
+		return K * (1 - Expected(winner, DefaultRating)), nil
+	}
+
+	k := K / float64(len(opponents))
+
+	var winnerDelta float64
+	deltas := make([]float64, len(opponents))
+	for i, o := range opponents {
+		d := k * (1 - Expected(winner, o))
+		winnerDelta += d
+		deltas[i] = -d
+	}
+
+	return winnerDelta, deltas
+}
+
+// HostScore returns 0 for a failed round and value in (0, 1] depending on how fast the word was guessed
+func HostScore(success bool, d time.Duration) float64 {
+	if !success {
+		return 0
+	}
+	if d < 0 {
+		d = 0
+	}
+	return float64(ParTime) / float64(ParTime+d)
+}
+
+// HostDelta returns rating change of the host judged against a virtual DefaultRating player
+func HostDelta(rating, score float64) float64 {
+	return K * (score - Expected(rating, DefaultRating))
+}
@@ -0,0 +1,69 @@
+/*
+ * This file is part of Crocodile Game Bot.
+ * Copyright (C) 2019  Viktor
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package skill
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestGuesserDeltas(t *testing.T) {
+	winner, deltas := GuesserDeltas(DefaultRating, []float64{DefaultRating, DefaultRating})
+
+	if math.Abs(winner-K/2) > 1e-9 {
+		t.Errorf("Winner delta: got %v, expected %v", winner, K/2)
+	}
+
+	var sum float64
+	for _, d := range deltas {
+		if d >= 0 {
+			t.Errorf("Opponent delta should be negative, got %v", d)
+		}
+		sum += d
+	}
+	if math.Abs(winner+sum) > 1e-9 {
+		t.Errorf("Ratings should be zero-sum, winner: %v, opponents: %v", winner, sum)
+	}
+
+	// Beating a stronger player gives more
+	weak, _ := GuesserDeltas(DefaultRating, []float64{DefaultRating - 200})
+	strong, _ := GuesserDeltas(DefaultRating, []float64{DefaultRating + 200})
+	if strong <= weak {
+		t.Errorf("Beating stronger player should give more: weak %v, strong %v", weak, strong)
+	}
+}
+
+func TestHostScore(t *testing.T) {
+	if s := HostScore(false, time.Second); s != 0 {
+		t.Errorf("Failed round score: got %v, expected 0", s)
+	}
+	if s := HostScore(true, 0); s != 1 {
+		t.Errorf("Instant round score: got %v, expected 1", s)
+	}
+	if s := HostScore(true, ParTime); s != 0.5 {
+		t.Errorf("Par time round score: got %v, expected 0.5", s)
+	}
+	if HostDelta(DefaultRating, HostScore(true, 10*time.Second)) <= 0 {
+		t.Errorf("Fast round should increase host rating")
+	}
+	if HostDelta(DefaultRating, HostScore(true, 5*time.Minute)) >= 0 {
+		t.Errorf("Slow round should decrease host rating")
+	}
+}
@@ -0,0 +1,148 @@
+/*
+ * This file is part of Crocodile Game Bot.
+ * Copyright (C) 2019  Viktor
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package skill
+
+import (
+	"github.com/nuetoban/crocodile-game-bot/model"
+)
+
+// Storage keeps ratings, ChatID == 0 is used for global ratings
+type Storage interface {
+	GetSkillRatings(chatID int64, role string, userIDs ...int) (map[int]model.SkillRating, error)
+	// AddSkillRatings adds Rating and Games of the changes to stored ratings atomically,
+	// users without rating start from initial. Global ratings are changed by rounds
+	// of every chat at once, so the stored ratings are never overwritten.
+	AddSkillRatings(initial float64, changes ...model.SkillRating) error
+}
+
+// Logger is used to report errors during updating
+type Logger interface {
+	Errorf(format string, args ...interface{})
+}
+
+// Updater recalculates ratings of round participants
+type Updater struct {
+	storage Storage
+	log     Logger
+}
+
+// NewUpdater returns new instance of Updater
+func NewUpdater(s Storage, log Logger) *Updater {
+	return &Updater{storage: s, log: log}
+}
+
+// RoundFinished implements crocodile.RoundObserver
+func (u *Updater) RoundFinished(r model.Round) []string {
+	if err := u.Update(r); err != nil {
+		u.log.Errorf("Skill: cannot update ratings in chat %d: %v", r.ChatID, err)
+	}
+	return nil
+}
+
+// Update recalculates chat and global ratings of the host and guessers of the round,
+// flagged rounds are ignored
+func (u *Updater) Update(r model.Round) error {
+	if r.Flagged() {
+		return nil
+	}
+
+	for _, chatID := range []int64{r.ChatID, 0} {
+		if err := u.updateHost(chatID, r); err != nil {
+			return err
+		}
+		if !r.Success() {
+			continue
+		}
+		if err := u.updateGuessers(chatID, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (u *Updater) updateHost(chatID int64, r model.Round) error {
+	ratings, err := u.load(chatID, model.RoleHost, []model.Player{{ID: r.HostID, Name: r.HostName}})
+	if err != nil {
+		return err
+	}
+
+	host := change(ratings[0], HostDelta(ratings[0].Rating, HostScore(r.Success(), r.Duration())))
+	return u.storage.AddSkillRatings(DefaultRating, host)
+}
+
+func (u *Updater) updateGuessers(chatID int64, r model.Round) error {
+	players := []model.Player{{ID: r.WinnerID, Name: r.WinnerName}}
+	for _, p := range r.Players {
+		if p.ID != r.WinnerID && p.ID != r.HostID {
+			players = append(players, p)
+		}
+	}
+
+	ratings, err := u.load(chatID, model.RoleGuesser, players)
+	if err != nil {
+		return err
+	}
+
+	opponents := make([]float64, len(ratings)-1)
+	for i, o := range ratings[1:] {
+		opponents[i] = o.Rating
+	}
+
+	winnerDelta, deltas := GuesserDeltas(ratings[0].Rating, opponents)
+	changes := []model.SkillRating{change(ratings[0], winnerDelta)}
+	for i, d := range deltas {
+		changes = append(changes, change(ratings[i+1], d))
+	}
+
+	return u.storage.AddSkillRatings(DefaultRating, changes...)
+}
+
+// change returns change of the rating by delta for one more game
+func change(r model.SkillRating, delta float64) model.SkillRating {
+	r.Rating = delta
+	r.Games = 1
+	return r
+}
+
+// load returns ratings in the same order as players, new players get DefaultRating
+func (u *Updater) load(chatID int64, role string, players []model.Player) ([]model.SkillRating, error) {
+	ids := make([]int, len(players))
+	for i, p := range players {
+		ids[i] = p.ID
+	}
+
+	stored, err := u.storage.GetSkillRatings(chatID, role, ids...)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]model.SkillRating, len(players))
+	for i, p := range players {
+		r, ok := stored[p.ID]
+		if !ok {
+			r = model.SkillRating{UserID: p.ID, ChatID: chatID, Role: role, Rating: DefaultRating}
+		}
+		if p.Name != "" {
+			r.Name = p.Name
+		}
+		out[i] = r
+	}
+
+	return out, nil
+}
@@ -0,0 +1,100 @@
+/*
+ * This file is part of Crocodile Game Bot.
+ * Copyright (C) 2019  Viktor
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/nuetoban/crocodile-game-bot/achievements"
+	"github.com/nuetoban/crocodile-game-bot/antiabuse"
+	"github.com/nuetoban/crocodile-game-bot/config"
+	"github.com/nuetoban/crocodile-game-bot/crocodile"
+	"github.com/nuetoban/crocodile-game-bot/migrations"
+	"github.com/nuetoban/crocodile-game-bot/redisconn"
+	"github.com/nuetoban/crocodile-game-bot/skill"
+	"github.com/nuetoban/crocodile-game-bot/storage"
+)
+
+// botStorage is everything the bot keeps in Postgres and Redis or in SQLite
+type botStorage interface {
+	crocodile.Storage
+	achievements.Storage
+	skill.Storage
+	antiabuse.Storage
+	RatingGetter
+	StatisticsGetter
+	PersonalStatsGetter
+	AbuseReporter
+	ChatMigrator
+	AdminStorage
+	Migrator() (*migrations.Migrator, error)
+	Ping(ctx context.Context) error
+	Close() error
+	loggingStorage
+}
+
+// loggingStorage returns storage of machines logging with the logger of the update
+type loggingStorage interface {
+	WithLogger(storage.Logger) crocodile.Storage
+}
+
+type machinesWatcher interface {
+	WatchMachines(ctx context.Context, cache storage.MachineForgetter, log storage.Logger)
+}
+
+// openStorage connects to Postgres and Redis, or opens SQLite file
+// when the database driver is "sqlite"
+func openStorage(cfg config.Config) (botStorage, error) {
+	if cfg.SQLite() {
+		log.Infof("Opening SQLite database %s", cfg.Database.SQLitePath)
+		return storage.NewSQLite(cfg.Database.SQLitePath, queryMetricsLogger{storage.WrapLogrus(log)})
+	}
+
+	db := cfg.Database
+	kw := make(storage.KW, len(db.Params))
+	for k, v := range db.Params {
+		kw[k] = v
+	}
+
+	log.Info("Connecting to the database")
+	s, err := storage.NewStorage(storage.NewConnString(
+		db.Host, db.User,
+		db.Password, db.Name,
+		db.Port, kw,
+	), redisPool, queryMetricsLogger{storage.WrapLogrus(log)})
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to database (%s, %s) on host %s: %v", db.User, db.Name, db.Host, err)
+	}
+	return s, nil
+}
+
+// redisConfig returns settings of Redis connections
+func redisConfig(r config.Redis) redisconn.Config {
+	c := redisconn.DefaultConfig()
+	c.Addr = r.Addr
+	c.SentinelAddrs = r.Sentinels
+	c.MasterName = r.SentinelMaster
+	c.ClusterAddrs = r.Cluster
+	c.Password = r.Password
+	c.ConnectTimeout = r.ConnectTimeout
+	c.ReadTimeout = r.ReadTimeout
+	c.WriteTimeout = r.WriteTimeout
+	return c
+}
@@ -0,0 +1,175 @@
+/*
+ * This file is part of Crocodile Game Bot.
+ * Copyright (C) 2019  Viktor
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/nuetoban/crocodile-game-bot/model"
+)
+
+// ErrNotFound is returned when the chat or stats of the user do not exist
+var ErrNotFound = errors.New("not found")
+
+// RoundFilter selects rounds of the history, zero fields match everything
+type RoundFilter struct {
+	ChatID int64
+
+	// UserID matches rounds hosted or won by the user
+	UserID int
+
+	// Before returns rounds finished before the time, it pages the history
+	Before time.Time
+	Limit  int
+}
+
+const chatSummaryQuery = `SELECT chats.id, chats.title,
+                              COUNT(user_in_chats.id) AS players,
+                              COALESCE(SUM(user_in_chats.was_host), 0) AS games
+                          FROM chats
+                          LEFT JOIN user_in_chats ON user_in_chats.chat_id = chats.id`
+
+// ListChats returns chats with titles containing the query, the most active first
+func (p *Postgres) ListChats(query string, limit, offset int) ([]model.ChatSummary, error) {
+	var chats []model.ChatSummary
+
+	rows, err := p.db.Raw(chatSummaryQuery+`
+                          WHERE LOWER(chats.title) LIKE LOWER(?)
+                          GROUP BY chats.id, chats.title
+                          ORDER BY games DESC, chats.id
+                          LIMIT ? OFFSET ?`,
+		"%"+query+"%", limit, offset,
+	).Rows()
+	if err != nil {
+		return chats, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var c model.ChatSummary
+		if err := rows.Scan(&c.ID, &c.Title, &c.Players, &c.Games); err != nil {
+			return chats, err
+		}
+		chats = append(chats, c)
+	}
+
+	return chats, rows.Err()
+}
+
+// GetChat returns ErrNotFound if nobody has played in the chat
+func (p *Postgres) GetChat(chatID int64) (model.ChatSummary, error) {
+	var c model.ChatSummary
+	err := p.db.Raw(chatSummaryQuery+`
+                          WHERE chats.id = ?
+                          GROUP BY chats.id, chats.title`,
+		chatID,
+	).Row().Scan(&c.ID, &c.Title, &c.Players, &c.Games)
+	if err == sql.ErrNoRows {
+		return c, ErrNotFound
+	}
+	return c, err
+}
+
+// GetUserStats returns stats of the user in every chat
+func (p *Postgres) GetUserStats(userID int) ([]model.UserInChat, error) {
+	var users []model.UserInChat
+	err := p.db.Where("id = ?", userID).Order("chat_id").Find(&users).Error
+	return users, err
+}
+
+// SetUserStats overwrites counters of the user in the chat, ErrNotFound is returned
+// if the user has not played there
+func (p *Postgres) SetUserStats(u model.UserInChat) error {
+	res := p.db.Exec(`UPDATE user_in_chats SET was_host = ?, success = ?, guessed = ?
+                      WHERE id = ? AND chat_id = ?`,
+		u.WasHost, u.Success, u.Guessed, u.ID, u.ChatID,
+	)
+	if res.Error == nil && res.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return res.Error
+}
+
+// ResetUserStats zeroes counters of the user in the chat, chatID == 0 means all chats.
+// Returns count of changed chats.
+func (p *Postgres) ResetUserStats(userID int, chatID int64) (int64, error) {
+	query := p.db.Model(&model.UserInChat{}).Where("id = ?", userID)
+	if chatID != 0 {
+		query = query.Where("chat_id = ?", chatID)
+	}
+
+	res := query.UpdateColumns(map[string]interface{}{"was_host": 0, "success": 0, "guessed": 0})
+	return res.RowsAffected, res.Error
+}
+
+// GetBans returns every ban, the most recent first
+func (p *Postgres) GetBans() ([]model.Ban, error) {
+	var bans []model.Ban
+	err := p.db.Order("created_at desc").Find(&bans).Error
+	return bans, err
+}
+
+// SaveBan bans the user or the chat, the reason of the existing ban is replaced
+func (p *Postgres) SaveBan(b model.Ban) error {
+	return p.db.Exec(`INSERT INTO bans (kind, id, reason, created_at) VALUES (?, ?, ?, ?)
+                      ON CONFLICT (kind, id) DO UPDATE SET reason = EXCLUDED.reason`,
+		b.Kind, b.ID, b.Reason, b.CreatedAt.UTC(),
+	).Error
+}
+
+// DeleteBan returns false if there was no such ban
+func (p *Postgres) DeleteBan(kind string, id int64) (bool, error) {
+	res := p.db.Exec("DELETE FROM bans WHERE kind = ? AND id = ?", kind, id)
+	return res.RowsAffected > 0, res.Error
+}
+
+// GetDictionaryWords returns changes of the dictionary made by admins
+func (p *Postgres) GetDictionaryWords() ([]model.DictionaryWord, error) {
+	var words []model.DictionaryWord
+	err := p.db.Order("word").Find(&words).Error
+	return words, err
+}
+
+// SaveDictionaryWord adds the word to the dictionary or removes it
+func (p *Postgres) SaveDictionaryWord(w model.DictionaryWord) error {
+	return p.db.Exec(`INSERT INTO dictionary_words (word, removed, updated_at) VALUES (?, ?, ?)
+                      ON CONFLICT (word) DO UPDATE SET removed = EXCLUDED.removed, updated_at = EXCLUDED.updated_at`,
+		w.Word, w.Removed, w.UpdatedAt.UTC(),
+	).Error
+}
+
+// GetRounds returns finished rounds matching the filter, the most recent first
+func (p *Postgres) GetRounds(f RoundFilter) ([]model.Round, error) {
+	query := p.db.Order("finished_at desc").Limit(f.Limit)
+	if f.ChatID != 0 {
+		query = query.Where("chat_id = ?", f.ChatID)
+	}
+	if f.UserID != 0 {
+		query = query.Where("host_id = ? OR winner_id = ?", f.UserID, f.UserID)
+	}
+	if !f.Before.IsZero() {
+		query = query.Where("finished_at < ?", f.Before)
+	}
+
+	var rounds []model.Round
+	err := query.Find(&rounds).Error
+	return rounds, err
+}
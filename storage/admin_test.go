@@ -0,0 +1,133 @@
+/*
+ * This file is part of Crocodile Game Bot.
+ * Copyright (C) 2019  Viktor
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nuetoban/crocodile-game-bot/model"
+)
+
+func TestAdminChatsAndStats(t *testing.T) {
+	chat := model.Chat{ID: -5001, Title: "Admin Chat"}
+	err := p.IncrementUserStats(chat,
+		model.UserInChat{ID: 5001, ChatID: chat.ID, Name: "host", WasHost: 3, Success: 2},
+		model.UserInChat{ID: 5002, ChatID: chat.ID, Name: "guesser", Guessed: 2},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chats, err := p.ListChats("admin", 10, 0)
+	if err != nil || len(chats) != 1 {
+		t.Fatalf("ListChats: got %+v, %v", chats, err)
+	}
+	if c := chats[0]; c.ID != chat.ID || c.Players != 2 || c.Games != 3 {
+		t.Errorf("ListChats: got %+v", c)
+	}
+
+	if _, err := p.GetChat(-5999); err != ErrNotFound {
+		t.Errorf("GetChat of unknown chat: got %v, want ErrNotFound", err)
+	}
+
+	if err := p.SetUserStats(model.UserInChat{ID: 5002, ChatID: chat.ID, Guessed: 10}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.SetUserStats(model.UserInChat{ID: 5002, ChatID: -5999}); err != ErrNotFound {
+		t.Errorf("SetUserStats in unknown chat: got %v, want ErrNotFound", err)
+	}
+	stats, err := p.GetUserStats(5002)
+	if err != nil || len(stats) != 1 || stats[0].Guessed != 10 {
+		t.Errorf("GetUserStats: got %+v, %v", stats, err)
+	}
+
+	n, err := p.ResetUserStats(5001, 0)
+	if err != nil || n != 1 {
+		t.Fatalf("ResetUserStats: got %d, %v", n, err)
+	}
+	if u, _ := p.GetUserInChat(chat.ID, 5001); u.WasHost != 0 || u.Success != 0 || u.Name != "host" {
+		t.Errorf("Stats are not zeroed: %+v", u)
+	}
+}
+
+func TestAdminBans(t *testing.T) {
+	now := time.Now()
+	if err := p.SaveBan(model.Ban{Kind: model.BanUser, ID: 5101, Reason: "spam", CreatedAt: now}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.SaveBan(model.Ban{Kind: model.BanUser, ID: 5101, Reason: "flood", CreatedAt: now}); err != nil {
+		t.Fatal(err)
+	}
+
+	bans, err := p.GetBans()
+	if err != nil || len(bans) != 1 || bans[0].Reason != "flood" {
+		t.Fatalf("GetBans: got %+v, %v", bans, err)
+	}
+
+	if ok, err := p.DeleteBan(model.BanUser, 5101); !ok || err != nil {
+		t.Errorf("DeleteBan: got %t, %v", ok, err)
+	}
+	if ok, err := p.DeleteBan(model.BanUser, 5101); ok || err != nil {
+		t.Errorf("DeleteBan of deleted ban: got %t, %v", ok, err)
+	}
+}
+
+func TestAdminDictionary(t *testing.T) {
+	now := time.Now()
+	for _, w := range []model.DictionaryWord{
+		{Word: "ёжик", UpdatedAt: now},
+		{Word: "слон", Removed: true, UpdatedAt: now},
+		{Word: "ёжик", Removed: true, UpdatedAt: now},
+	} {
+		if err := p.SaveDictionaryWord(w); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	words, err := p.GetDictionaryWords()
+	if err != nil || len(words) != 2 || !words[0].Removed || !words[1].Removed {
+		t.Errorf("GetDictionaryWords: got %+v, %v", words, err)
+	}
+}
+
+func TestAdminRounds(t *testing.T) {
+	start := time.Now().Add(-time.Hour)
+	for i, r := range []model.Round{
+		{ChatID: -5201, HostID: 5201, WinnerID: 5202},
+		{ChatID: -5201, HostID: 5202, WinnerID: 5201},
+		{ChatID: -5202, HostID: 5203},
+	} {
+		r.StartedAt = start
+		r.FinishedAt = start.Add(time.Duration(i+1) * time.Minute)
+		if err := p.SaveRound(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rounds, err := p.GetRounds(RoundFilter{UserID: 5201, Limit: 10})
+	if err != nil || len(rounds) != 2 || rounds[0].HostID != 5202 {
+		t.Fatalf("Rounds of the user: got %+v, %v", rounds, err)
+	}
+
+	rounds, err = p.GetRounds(RoundFilter{ChatID: -5201, Before: rounds[0].FinishedAt, Limit: 10})
+	if err != nil || len(rounds) != 1 || rounds[0].HostID != 5201 {
+		t.Errorf("Rounds before the last one: got %+v, %v", rounds, err)
+	}
+}
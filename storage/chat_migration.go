@@ -0,0 +1,183 @@
+/*
+ * This file is part of Crocodile Game Bot.
+ * Copyright (C) 2019  Viktor
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package storage
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/jinzhu/gorm"
+)
+
+// migrateChatRows moves everything of the chat to another one.
+// Rows already existing in the new chat win, counters of players are summed.
+func migrateChatRows(tx *gorm.DB, from, to int64) error {
+	statements := []struct {
+		query string
+		args  []interface{}
+	}{
+		{`INSERT INTO chats (id, title)
+          SELECT ?, title FROM chats WHERE id = ?
+          ON CONFLICT (id) DO NOTHING`,
+			[]interface{}{to, from}},
+
+		{`INSERT INTO user_in_chats (id, chat_id, name, was_host, success, guessed)
+          SELECT id, ?, name, COALESCE(was_host, 0), COALESCE(success, 0), COALESCE(guessed, 0)
+          FROM user_in_chats WHERE chat_id = ?
+          ON CONFLICT (id, chat_id) DO UPDATE SET
+              was_host = COALESCE(user_in_chats.was_host, 0) + EXCLUDED.was_host,
+              success = COALESCE(user_in_chats.success, 0) + EXCLUDED.success,
+              guessed = COALESCE(user_in_chats.guessed, 0) + EXCLUDED.guessed`,
+			[]interface{}{to, from}},
+
+		{`UPDATE daily_results SET chat_id = ?
+          WHERE chat_id = ? AND day NOT IN (SELECT d.day FROM daily_results d WHERE d.chat_id = ?)`,
+			[]interface{}{to, from, to}},
+
+		{`UPDATE skill_ratings SET chat_id = ?
+          WHERE chat_id = ? AND NOT EXISTS (
+              SELECT 1 FROM skill_ratings s
+              WHERE s.chat_id = ? AND s.user_id = skill_ratings.user_id AND s.role = skill_ratings.role
+          )`,
+			[]interface{}{to, from, to}},
+
+		{`UPDATE rounds SET chat_id = ? WHERE chat_id = ?`, []interface{}{to, from}},
+		{`UPDATE achievements SET chat_id = ? WHERE chat_id = ?`, []interface{}{to, from}},
+
+		// Rows which have not been moved because of conflicts
+		{`DELETE FROM user_in_chats WHERE chat_id = ?`, []interface{}{from}},
+		{`DELETE FROM daily_results WHERE chat_id = ?`, []interface{}{from}},
+		{`DELETE FROM skill_ratings WHERE chat_id = ?`, []interface{}{from}},
+		{`DELETE FROM chats WHERE id = ?`, []interface{}{from}},
+	}
+
+	for _, s := range statements {
+		if err := tx.Exec(s.query, s.args...).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MigrateChat moves rating, rounds and results of the group to the supergroup it has been upgraded to
+func (p *Postgres) MigrateChat(from, to int64) error {
+	tx := p.db.Begin()
+	if err := tx.Error; err != nil {
+		return err
+	}
+
+	if err := migrateChatRows(tx, from, to); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// MigrateChat moves the rows and the machine state in one transaction
+func (s *SQLite) MigrateChat(from, to int64) error {
+	tx := s.db.Begin()
+	if err := tx.Error; err != nil {
+		return err
+	}
+
+	err := migrateChatRows(tx, from, to)
+	if err == nil {
+		err = migrateMachineStateRow(tx, from, to)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+func migrateMachineStateRow(tx *gorm.DB, from, to int64) error {
+	var data string
+	err := tx.Table("machine_states").Select("state").Where("chat_id = ?", from).Row().Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	moved, err := moveMachineState([]byte(data), to)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Exec(`INSERT INTO machine_states (chat_id, state, updated_at) VALUES (?, ?, ?)
+                   ON CONFLICT (chat_id) DO NOTHING`,
+		to, string(moved), time.Now().UTC(),
+	).Error
+	if err != nil {
+		return err
+	}
+	return tx.Exec(`DELETE FROM machine_states WHERE chat_id = ?`, from).Error
+}
+
+// MigrateChat moves the machine state unless the new chat has its own.
+// Keys are copied and deleted instead of RENAME, the keys may be kept on different nodes of Redis Cluster.
+// Other replicas are told to forget both chats, even if there was no state to move.
+func (r *Redis) MigrateChat(from, to int64) error {
+	conn := r.Pool.Get()
+	defer conn.Close()
+
+	if err := r.moveMachine(conn, from, to); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	delete(r.local, from)
+	r.mu.Unlock()
+
+	r.announceMachine(conn, from)
+	r.announceMachine(conn, to)
+	return nil
+}
+
+func (r *Redis) moveMachine(conn redis.Conn, from, to int64) error {
+	data, err := redis.Bytes(conn.Do("GET", machineKey(from)))
+	if err == redis.ErrNil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	moved, err := moveMachineState(data, to)
+	if err != nil {
+		return err
+	}
+
+	if _, err := conn.Do("SET", machineKey(to), moved, "EX", machineTTL, "NX"); err != nil {
+		return err
+	}
+	_, err = conn.Do("DEL", machineKey(from))
+	return err
+}
+
+// MigrateChat moves rows in Postgres first, the machine in Redis is less valuable
+func (s *Storage) MigrateChat(from, to int64) error {
+	if err := s.Postgres.MigrateChat(from, to); err != nil {
+		return err
+	}
+	return s.Redis.MigrateChat(from, to)
+}
@@ -0,0 +1,183 @@
+/*
+ * This file is part of Crocodile Game Bot.
+ * Copyright (C) 2019  Viktor
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package storage
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gomodule/redigo/redis"
+
+	"github.com/nuetoban/crocodile-game-bot/crocodile"
+	"github.com/nuetoban/crocodile-game-bot/model"
+)
+
+func TestSQLiteMigrateChat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "crocodile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := NewSQLite(filepath.Join(dir, "crocodile.db"), log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.db.Close()
+
+	m, err := s.Migrator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+
+	day := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	must := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The supergroup has been used for a while before the migration was handled
+	must(s.IncrementUserStats(model.Chat{ID: 1, Title: "group"},
+		model.UserInChat{ID: 10, ChatID: 1, Name: "a", Guessed: 2},
+		model.UserInChat{ID: 11, ChatID: 1, Name: "b", WasHost: 1},
+	))
+	must(s.IncrementUserStats(model.Chat{ID: 2, Title: "supergroup"}, model.UserInChat{ID: 10, ChatID: 2, Name: "a", Guessed: 3}))
+	must(s.SaveDailyResult(model.DailyResult{Day: day, ChatID: 1, UserID: 10}))
+	must(s.SaveDailyResult(model.DailyResult{Day: day.AddDate(0, 0, 1), ChatID: 1, UserID: 10}))
+	must(s.SaveDailyResult(model.DailyResult{Day: day, ChatID: 2, UserID: 11}))
+	must(s.SaveSkillRatings(
+		model.SkillRating{UserID: 10, ChatID: 1, Role: "guesser", Rating: 1},
+		model.SkillRating{UserID: 10, ChatID: 2, Role: "guesser", Rating: 2},
+		model.SkillRating{UserID: 11, ChatID: 1, Role: "host", Rating: 3},
+	))
+	must(s.SaveRound(model.Round{ChatID: 1, HostID: 11, StartedAt: day, FinishedAt: day}))
+	must(s.SaveMachineState(crocodile.MachineState{ChatID: 1, Word: "кот"}))
+
+	must(s.MigrateChat(1, 2))
+
+	for _, want := range []model.UserInChat{
+		{ID: 10, ChatID: 2, Name: "a", Guessed: 5},
+		{ID: 11, ChatID: 2, Name: "b", WasHost: 1},
+	} {
+		u, err := s.GetUserInChat(2, want.ID)
+		if err != nil || u != want {
+			t.Errorf("User %d in the new chat: got %+v, %v", want.ID, u, err)
+		}
+	}
+
+	count := func(table, where string, args ...interface{}) int {
+		var n int
+		must(s.db.Table(table).Where(where, args...).Count(&n).Error)
+		return n
+	}
+	for _, table := range []string{"user_in_chats", "daily_results", "skill_ratings", "rounds", "machine_states"} {
+		if n := count(table, "chat_id = ?", 1); n != 0 {
+			t.Errorf("%d rows of the old chat are left in %s", n, table)
+		}
+	}
+	if n := count("chats", "id = ?", 1); n != 0 {
+		t.Errorf("The old chat is left")
+	}
+	if n := count("daily_results", "chat_id = ?", 2); n != 2 {
+		t.Errorf("Got %d daily results, want 2", n)
+	}
+	if n := count("skill_ratings", "chat_id = ? AND rating = ?", 2, 2); n != 1 {
+		t.Errorf("Skill rating of the new chat has been overwritten")
+	}
+	if n := count("rounds", "chat_id = ?", 2); n != 1 {
+		t.Errorf("Round has not been moved")
+	}
+
+	state, err := s.LookupForMachine(2)
+	if err != nil || state == nil || state.ChatID != 2 || state.Word != "кот" {
+		t.Errorf("Machine of the new chat: %+v, %v", state, err)
+	}
+}
+
+func TestRedisMigrateChat(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mr.Close()
+
+	r := NewRedis(&redis.Pool{Dial: func() (redis.Conn, error) { return redis.Dial("tcp", mr.Addr()) }})
+	if err := r.SaveMachineState(crocodile.MachineState{ChatID: 1, Word: "кот"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.MigrateChat(1, 2); err != nil {
+		t.Fatal(err)
+	}
+	if mr.Exists("machine/1") {
+		t.Errorf("The old machine is left")
+	}
+	state, err := r.LookupForMachine(2)
+	if err != nil || state == nil || state.ChatID != 2 || state.Word != "кот" {
+		t.Errorf("Machine of the new chat: %+v, %v", state, err)
+	}
+
+	// Nothing to move the second time
+	if err := r.MigrateChat(1, 2); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRedisMigrateChatAnnouncesMachines(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mr.Close()
+
+	pool := &redis.Pool{Dial: func() (redis.Conn, error) { return redis.Dial("tcp", mr.Addr()) }}
+	own, other := NewRedis(pool), NewRedis(pool)
+
+	cache := &fakeForgetter{}
+	go own.watchMachines(context.Background(), cache)
+
+	// Wait for subscription
+	for len(mr.PubSubChannels("")) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := other.MigrateChat(1, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for len(cache.get()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	if got := cache.get(); len(got) != 2 || got[0] != 1 || got[1] != 2 {
+		t.Errorf("Forgotten: got %v, expected [1 2]", got)
+	}
+}
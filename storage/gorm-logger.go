@@ -9,7 +9,7 @@ type Logger interface {
 }
 
 type logger struct {
-	log *logrus.Logger
+	log logrus.FieldLogger
 }
 
 func (l *logger) Print(v ...interface{}) {
@@ -26,6 +26,7 @@ func (l *logger) Print(v ...interface{}) {
 	}
 }
 
-func WrapLogrus(log *logrus.Logger) *logger {
+// WrapLogrus returns gorm logger writing to logrus.Logger or logrus.Entry
+func WrapLogrus(log logrus.FieldLogger) *logger {
 	return &logger{log: log}
 }
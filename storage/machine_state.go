@@ -0,0 +1,122 @@
+/*
+ * This file is part of Crocodile Game Bot.
+ * Copyright (C) 2019  Viktor
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/nuetoban/crocodile-game-bot/crocodile"
+)
+
+// machineStateUpgrades[v] converts machine state of version v to version v+1
+var machineStateUpgrades = map[int]func([]byte) ([]byte, error){
+	0: upgradeMachineStateV0,
+}
+
+// decodeMachineState upgrades the saved state to the current version and decodes it
+func decodeMachineState(data []byte) (crocodile.MachineState, error) {
+	var state crocodile.MachineState
+
+	var v struct {
+		Version int `json:"version"`
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return state, err
+	}
+
+	if v.Version > crocodile.MachineStateVersion {
+		return state, fmt.Errorf("machine state version %d is newer than supported %d", v.Version, crocodile.MachineStateVersion)
+	}
+
+	for version := v.Version; version < crocodile.MachineStateVersion; version++ {
+		upgrade, ok := machineStateUpgrades[version]
+		if !ok {
+			return state, fmt.Errorf("no upgrade for machine state version %d", version)
+		}
+
+		var err error
+		if data, err = upgrade(data); err != nil {
+			return state, fmt.Errorf("cannot upgrade machine state version %d: %v", version, err)
+		}
+	}
+
+	err := json.Unmarshal(data, &state)
+	return state, err
+}
+
+// Version 0 is crocodile.Machine marshaled as is
+func upgradeMachineStateV0(data []byte) ([]byte, error) {
+	var old struct {
+		MesID       int
+		ChatID      int64
+		ChatTitle   string
+		Word        string
+		Host        int
+		HostName    string
+		Winner      int
+		StartedTime time.Time
+		GuessedTime time.Time
+		Daily       bool
+		Players     []struct {
+			ID   int
+			Name string
+		}
+		SeenTime time.Time
+		State    string
+	}
+	if err := json.Unmarshal(data, &old); err != nil {
+		return nil, err
+	}
+
+	// Keys of version 1 are written explicitly, so the upgrade does not depend on the current format
+	var players []map[string]interface{}
+	for _, p := range old.Players {
+		players = append(players, map[string]interface{}{"id": p.ID, "name": p.Name})
+	}
+
+	return json.Marshal(map[string]interface{}{
+		"version":    1,
+		"chat_id":    old.ChatID,
+		"chat_title": old.ChatTitle,
+		"message_id": old.MesID,
+		"state":      old.State,
+		"word":       old.Word,
+		"daily":      old.Daily,
+		"host_id":    old.Host,
+		"host_name":  old.HostName,
+		"winner_id":  old.Winner,
+		"players":    players,
+		"started_at": old.StartedTime,
+		"seen_at":    old.SeenTime,
+		"guessed_at": old.GuessedTime,
+	})
+}
+
+// moveMachineState returns the saved state rewritten for another chat
+func moveMachineState(data []byte, chatID int64) ([]byte, error) {
+	state, err := decodeMachineState(data)
+	if err != nil {
+		return nil, err
+	}
+	state.ChatID = chatID
+	state.Version = crocodile.MachineStateVersion
+	return json.Marshal(state)
+}
@@ -0,0 +1,154 @@
+/*
+ * This file is part of Crocodile Game Bot.
+ * Copyright (C) 2019  Viktor
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package storage
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/nuetoban/crocodile-game-bot/crocodile"
+)
+
+func fixtureTime(s string) time.Time {
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// Every historical format of machine state should have a fixture here
+var machineStateFixtures = map[string]crocodile.MachineState{
+	"v0_initial.json": {
+		Version:   crocodile.MachineStateVersion,
+		ChatID:    -1001234567890,
+		ChatTitle: "Крокодилы",
+		MesID:     4021,
+		State:     "game_started",
+		Word:      "самолёт",
+		HostID:    111,
+		HostName:  "Иван Петров",
+		StartedAt: fixtureTime("2019-12-28T18:04:05.123456789+03:00"),
+		GuessedAt: fixtureTime("2019-12-28T18:00:00+03:00"),
+	},
+	"v0_daily.json": {
+		Version:   crocodile.MachineStateVersion,
+		ChatID:    -1001234567890,
+		ChatTitle: "Крокодилы",
+		MesID:     4021,
+		State:     "done",
+		Word:      "самолёт",
+		Daily:     true,
+		HostID:    111,
+		HostName:  "Иван Петров",
+		WinnerID:  222,
+		StartedAt: fixtureTime("2020-01-10T18:04:05+03:00"),
+		GuessedAt: fixtureTime("2020-01-10T18:06:00+03:00"),
+	},
+	"v0_players.json": {
+		Version:   crocodile.MachineStateVersion,
+		ChatID:    -1001234567890,
+		ChatTitle: "Крокодилы",
+		MesID:     4021,
+		State:     "game_started",
+		Word:      "самолёт",
+		HostID:    111,
+		HostName:  "Иван Петров",
+		Players:   []crocodile.StatePlayer{{ID: 222, Name: "Мария"}, {ID: 333, Name: "Олег"}},
+		StartedAt: fixtureTime("2020-02-01T18:04:05+03:00"),
+		SeenAt:    fixtureTime("2020-02-01T18:04:10+03:00"),
+		GuessedAt: fixtureTime("2020-02-01T18:00:00+03:00"),
+	},
+	"v1.json": {
+		Version:   crocodile.MachineStateVersion,
+		ChatID:    -1001234567890,
+		ChatTitle: "Крокодилы",
+		MesID:     4021,
+		State:     "game_started",
+		Word:      "самолёт",
+		HostID:    111,
+		HostName:  "Иван Петров",
+		Players:   []crocodile.StatePlayer{{ID: 222, Name: "Мария"}, {ID: 333, Name: "Олег"}},
+		StartedAt: fixtureTime("2020-02-01T18:04:05+03:00"),
+		SeenAt:    fixtureTime("2020-02-01T18:04:10+03:00"),
+		GuessedAt: fixtureTime("2020-02-01T18:00:00+03:00"),
+	},
+}
+
+func TestDecodeMachineStateFixtures(t *testing.T) {
+	files, err := filepath.Glob("testdata/machine_state/*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, file := range files {
+		expected, ok := machineStateFixtures[filepath.Base(file)]
+		if !ok {
+			t.Errorf("%s: no expected state", file)
+			continue
+		}
+
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := decodeMachineState(data)
+		if err != nil {
+			t.Errorf("%s: cannot decode: %v", file, err)
+			continue
+		}
+
+		// Times are compared by value, locations may differ
+		for _, p := range []*time.Time{&got.StartedAt, &got.SeenAt, &got.GuessedAt, &expected.StartedAt, &expected.SeenAt, &expected.GuessedAt} {
+			*p = p.UTC()
+		}
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("%s:\ngot      %+v\nexpected %+v", file, got, expected)
+		}
+	}
+
+	if len(files) != len(machineStateFixtures) {
+		t.Errorf("Found %d fixtures, expected %d", len(files), len(machineStateFixtures))
+	}
+}
+
+func TestDecodeMachineStateCurrentVersion(t *testing.T) {
+	m := crocodile.Machine{ChatID: 1, Word: "слово", State: "game_started", Host: 10}
+	data, err := json.Marshal(m.Snapshot())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := decodeMachineState(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Word != "слово" || got.HostID != 10 || got.Version != crocodile.MachineStateVersion {
+		t.Errorf("Got %+v", got)
+	}
+
+	if _, err := decodeMachineState([]byte(`{"version": 100}`)); err == nil {
+		t.Errorf("State of unknown version has been decoded")
+	}
+}
@@ -19,11 +19,15 @@
 package storage
 
 import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/postgres"
 
-	"fmt"
-
+	"github.com/nuetoban/crocodile-game-bot/migrations"
 	"github.com/nuetoban/crocodile-game-bot/model"
 )
 
@@ -62,62 +66,85 @@ func NewPostgres(conn string, logger Logger) (*Postgres, error) {
 	}, nil
 }
 
-func (p *Postgres) IncrementUserStats(chat model.Chat, givenUser ...model.UserInChat) error {
-	tx := p.db.Begin()
-	defer func() {
-		if r := recover(); r != nil {
-			tx.Rollback()
-		}
-	}()
+// withLogger returns Postgres sharing connections with p and logging queries with the logger
+func (p *Postgres) withLogger(logger Logger) *Postgres {
+	db := p.db.New()
+	db.SetLogger(logger)
+	return &Postgres{db: db, log: logger}
+}
 
-	if err := tx.Error; err != nil {
-		return err
+// Migrator returns migrator of the database schema
+func (p *Postgres) Migrator() (*migrations.Migrator, error) {
+	return migrations.NewMigrator(p.db.DB(), p.db.Dialect().GetName(), migrations.Postgres)
+}
+
+// Ping checks the database is reachable
+func (p *Postgres) Ping(ctx context.Context) error {
+	return p.db.DB().PingContext(ctx)
+}
+
+// Close closes connections to the database
+func (p *Postgres) Close() error {
+	return p.db.Close()
+}
+
+// IncrementUserStats adds counters of the users atomically, so concurrent increments are not lost
+func (p *Postgres) IncrementUserStats(chat model.Chat, givenUser ...model.UserInChat) error {
+	if len(givenUser) == 0 {
+		return nil
 	}
 
+	// One statement cannot update the same row twice
+	var users []model.UserInChat
 	for _, u := range givenUser {
-		var (
-			user model.UserInChat
-			err  error
-		)
-
-		err = tx.FirstOrCreate(&model.Chat{}, model.Chat{ID: chat.ID}).Error
-		if err != nil {
-			tx.Rollback()
-			return err
+		merged := false
+		for i := range users {
+			if users[i].ID == u.ID && users[i].ChatID == u.ChatID {
+				users[i].Name = u.Name
+				users[i].WasHost += u.WasHost
+				users[i].Success += u.Success
+				users[i].Guessed += u.Guessed
+				merged = true
+			}
 		}
-
-		err = tx.FirstOrCreate(&user, model.UserInChat{
-			ID:     u.ID,
-			ChatID: u.ChatID,
-		}).Error
-		if err != nil {
-			tx.Rollback()
-			return err
+		if !merged {
+			users = append(users, u)
 		}
+	}
 
-		err = tx.Table("chats").
-			Where("id = ?", chat.ID).
-			Updates(map[string]interface{}{
-				"title":     chat.Title,
-			}).Error
-		if err != nil {
-			tx.Rollback()
-			return err
-		}
+	values := make([]string, 0, len(users))
+	args := make([]interface{}, 0, len(users)*6)
+	for _, u := range users {
+		values = append(values, "(?, ?, ?, ?, ?, ?)")
+		args = append(args, u.ID, u.ChatID, u.Name, u.WasHost, u.Success, u.Guessed)
+	}
 
-		err = tx.Table("user_in_chats").
-			Where("id = ? AND chat_id = ?", u.ID, u.ChatID).
-			Updates(map[string]interface{}{
-				"name":     u.Name,
-				"was_host": user.WasHost + u.WasHost,
-				"success":  user.Success + u.Success,
-				"guessed":  user.Guessed + u.Guessed,
-			}).Error
-		if err != nil {
-			tx.Rollback()
-			return err
-		}
+	tx := p.db.Begin()
+	if err := tx.Error; err != nil {
+		return err
+	}
+
+	err := tx.Exec(`INSERT INTO chats (id, title) VALUES (?, ?)
+                    ON CONFLICT (id) DO UPDATE SET title = EXCLUDED.title`,
+		chat.ID, chat.Title,
+	).Error
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
 
+	err = tx.Exec(`INSERT INTO user_in_chats (id, chat_id, name, was_host, success, guessed)
+                   VALUES `+strings.Join(values, ", ")+`
+                   ON CONFLICT (id, chat_id) DO UPDATE SET
+                       name = EXCLUDED.name,
+                       was_host = user_in_chats.was_host + EXCLUDED.was_host,
+                       success = user_in_chats.success + EXCLUDED.success,
+                       guessed = user_in_chats.guessed + EXCLUDED.guessed`,
+		args...,
+	).Error
+	if err != nil {
+		tx.Rollback()
+		return err
 	}
 
 	return tx.Commit().Error
@@ -125,15 +152,15 @@ func (p *Postgres) IncrementUserStats(chat model.Chat, givenUser ...model.UserIn
 
 func (p *Postgres) GetRating(chatID int64) ([]model.UserInChat, error) {
 	var users []model.UserInChat
-	p.db.Where("guessed > 0 AND chat_id = ?", chatID).Limit(25).Order("guessed desc").Find(&users)
-	return users, nil
+	err := p.db.Where("guessed > 0 AND chat_id = ?", chatID).Limit(25).Order("guessed desc").Find(&users).Error
+	return users, err
 }
 
 func (p *Postgres) GetGlobalRating() ([]model.UserInChat, error) {
 	var users []model.UserInChat
 
 	rows, err := p.db.Table("user_in_chats").
-		Select("sum(\"guessed\") as guessed, (array_agg(\"name\"))[1] as name, \"id\"").
+		Select("sum(\"guessed\") as guessed, max(\"name\") as name, \"id\"").
 		Group("id").
 		Limit(25).
 		Order("guessed desc").
@@ -146,23 +173,25 @@ func (p *Postgres) GetGlobalRating() ([]model.UserInChat, error) {
 
 	for rows.Next() {
 		var user model.UserInChat
-		p.db.ScanRows(rows, &user)
+		if err := p.db.ScanRows(rows, &user); err != nil {
+			return users, err
+		}
 		users = append(users, user)
 	}
 
-	return users, nil
+	return users, rows.Err()
 }
 
 func (p *Postgres) GetStatistics() (model.Statistics, error) {
 	result := model.Statistics{}
 
-	p.db.Raw(`SELECT
+	err := p.db.Raw(`SELECT
                  (SELECT COUNT(DISTINCT("chat_id")) FROM user_in_chats WHERE "id" != "chat_id") AS chats,
                  (SELECT COUNT(DISTINCT("id")) FROM user_in_chats) AS users,
-                 (SELECT SUM("was_host") FROM user_in_chats) AS games_played;`).
-		Scan(&result)
+                 (SELECT COALESCE(SUM("was_host"), 0) FROM user_in_chats) AS games_played;`).
+		Scan(&result).Error
 
-	return result, nil
+	return result, err
 }
 
 func (p *Postgres) GetChatsRating() ([]model.ChatStatistics, error) {
@@ -184,9 +213,345 @@ func (p *Postgres) GetChatsRating() ([]model.ChatStatistics, error) {
 
 	for rows.Next() {
 		var chat model.ChatStatistics
-		p.db.ScanRows(rows, &chat)
+		if err := p.db.ScanRows(rows, &chat); err != nil {
+			return chats, err
+		}
 		chats = append(chats, chat)
 	}
 
-	return chats, nil
+	return chats, rows.Err()
+}
+
+// day truncates t to the beginning of its UTC day, daily results are keyed by it
+func day(t time.Time) time.Time {
+	y, m, d := t.UTC().Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
+
+// SaveDailyResult saves the result only if the chat has not guessed the daily word yet
+func (p *Postgres) SaveDailyResult(r model.DailyResult) error {
+	return p.db.Exec(`INSERT INTO daily_results
+                          (day, chat_id, chat_title, user_id, user_name, host_id, duration_ms)
+                      VALUES (?, ?, ?, ?, ?, ?, ?)
+                      ON CONFLICT (day, chat_id) DO NOTHING`,
+		day(r.Day), r.ChatID, r.ChatTitle, r.UserID, r.UserName, r.HostID, r.DurationMs,
+	).Error
+}
+
+func (p *Postgres) HasDailyResult(chatID int64, t time.Time) (bool, error) {
+	var count int
+	err := p.db.Model(&model.DailyResult{}).
+		Where("day = ? AND chat_id = ?", day(t), chatID).
+		Count(&count).Error
+	return count > 0, err
+}
+
+func (p *Postgres) GetDailyRating(t time.Time) ([]model.DailyResult, error) {
+	var results []model.DailyResult
+	err := p.db.Where("day = ?", day(t)).Limit(25).Order("duration_ms asc").Find(&results).Error
+	return results, err
+}
+
+func (p *Postgres) SaveRound(r model.Round) error {
+	return p.db.Create(&r).Error
+}
+
+// GetUserTotals returns stats of the user summed over all chats
+func (p *Postgres) GetUserTotals(userID int) (model.UserInChat, error) {
+	user := model.UserInChat{ID: userID}
+	err := p.db.Table("user_in_chats").
+		Select("coalesce(sum(was_host), 0) as was_host, coalesce(sum(success), 0) as success, coalesce(sum(guessed), 0) as guessed").
+		Where("id = ?", userID).
+		Row().
+		Scan(&user.WasHost, &user.Success, &user.Guessed)
+	return user, err
+}
+
+func (p *Postgres) CountUserChats(userID int) (int, error) {
+	var count int
+	err := p.db.Model(&model.UserInChat{}).Where("id = ?", userID).Count(&count).Error
+	return count, err
+}
+
+// GetLastHostedRounds returns rounds hosted by the user, the most recent first, flagged rounds are skipped
+func (p *Postgres) GetLastHostedRounds(userID int, limit int) ([]model.Round, error) {
+	var rounds []model.Round
+	err := p.db.Where("host_id = ? AND flags = ''", userID).Order("finished_at desc").Limit(limit).Find(&rounds).Error
+	return rounds, err
+}
+
+// AwardAchievement saves the achievement and returns false if user already has it
+func (p *Postgres) AwardAchievement(a model.Achievement) (bool, error) {
+	res := p.db.Exec(`INSERT INTO achievements (user_id, code, chat_id, awarded_at)
+                      VALUES (?, ?, ?, ?)
+                      ON CONFLICT (user_id, code) DO NOTHING`,
+		a.UserID, a.Code, a.ChatID, a.AwardedAt,
+	)
+	return res.RowsAffected > 0, res.Error
+}
+
+func (p *Postgres) GetAchievements(userID int) ([]model.Achievement, error) {
+	var list []model.Achievement
+	err := p.db.Where("user_id = ?", userID).Order("awarded_at asc").Find(&list).Error
+	return list, err
+}
+
+// GetUserInChat returns stats of the user in the chat, empty stats if user has not played there
+func (p *Postgres) GetUserInChat(chatID int64, userID int) (model.UserInChat, error) {
+	var user model.UserInChat
+	err := p.db.Where("id = ? AND chat_id = ?", userID, chatID).First(&user).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return model.UserInChat{ID: userID, ChatID: chatID}, nil
+	}
+	return user, err
+}
+
+// GetUserRank returns position of the user in the chat rating, 0 if user has not guessed anything
+func (p *Postgres) GetUserRank(chatID int64, userID int) (int, error) {
+	user, err := p.GetUserInChat(chatID, userID)
+	if err != nil || user.Guessed == 0 {
+		return 0, err
+	}
+
+	var count int
+	err = p.db.Model(&model.UserInChat{}).
+		Where("chat_id = ? AND guessed > ?", chatID, user.Guessed).
+		Count(&count).Error
+	return count + 1, err
+}
+
+// GetGlobalUserRank returns position of the user in the global rating, 0 if user has not guessed anything
+func (p *Postgres) GetGlobalUserRank(userID int) (int, error) {
+	user, err := p.GetUserTotals(userID)
+	if err != nil || user.Guessed == 0 {
+		return 0, err
+	}
+
+	var count int
+	err = p.db.Raw(`SELECT COUNT(*) FROM (
+                        SELECT id FROM user_in_chats GROUP BY id HAVING SUM(guessed) > ?
+                    ) AS better`, user.Guessed).
+		Row().
+		Scan(&count)
+	return count + 1, err
+}
+
+// GetAverageGuessTime returns average time the user needs to guess a word,
+// chatID == 0 means all chats. Flagged rounds are not counted, as in all stats of rounds.
+func (p *Postgres) GetAverageGuessTime(chatID int64, userID int) (time.Duration, error) {
+	var avg *float64
+
+	query := p.db.Model(&model.Round{}).Select("AVG(duration_ms)").Where("winner_id = ? AND flags = ''", userID)
+	if chatID != 0 {
+		query = query.Where("chat_id = ?", chatID)
+	}
+
+	err := query.Row().Scan(&avg)
+	if err != nil || avg == nil {
+		return 0, err
+	}
+	return time.Duration(*avg) * time.Millisecond, nil
+}
+
+// streakRounds limits how many of the latest rounds are scanned to count streaks
+const streakRounds = 1000
+
+// GetGuessStreaks returns current and the best count of successful rounds
+// in the chat won by the user in a row among the latest streakRounds rounds
+func (p *Postgres) GetGuessStreaks(chatID int64, userID int) (current, best int, err error) {
+	winners, err := latestWinners(p.db.Model(&model.Round{}).Where("chat_id = ? AND winner_id != 0 AND flags = ''", chatID))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	for _, winner := range winners {
+		current, best = streak(current, best, winner == userID)
+	}
+	return current, best, nil
+}
+
+// GetHostStreaks returns current and the best count of successful rounds hosted by the user in a row
+// among the latest streakRounds rounds of the user
+func (p *Postgres) GetHostStreaks(userID int) (current, best int, err error) {
+	winners, err := latestWinners(p.db.Model(&model.Round{}).Where("host_id = ? AND flags = ''", userID))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	for _, winner := range winners {
+		current, best = streak(current, best, winner != 0)
+	}
+	return current, best, nil
+}
+
+// latestWinners returns winners of the latest streakRounds rounds of the query, oldest first
+func latestWinners(query *gorm.DB) ([]int, error) {
+	var winners []int
+	err := query.Order("finished_at desc").Limit(streakRounds).Pluck("winner_id", &winners).Error
+	if err != nil {
+		return nil, err
+	}
+
+	for i, j := 0, len(winners)-1; i < j; i, j = i+1, j-1 {
+		winners[i], winners[j] = winners[j], winners[i]
+	}
+	return winners, nil
+}
+
+func streak(current, best int, ok bool) (int, int) {
+	if !ok {
+		return 0, best
+	}
+	current++
+	if current > best {
+		best = current
+	}
+	return current, best
+}
+
+// SaveUsername remembers username of the user to find the user by mention
+func (p *Postgres) SaveUsername(userID int, username string) error {
+	if username == "" {
+		return nil
+	}
+	username = strings.ToLower(username)
+
+	tx := p.db.Begin()
+	if err := tx.Error; err != nil {
+		return err
+	}
+
+	// Usernames can be given up and taken by another user, the latest owner keeps it
+	err := tx.Exec("DELETE FROM usernames WHERE username = ? AND id != ?", username, userID).Error
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	err = tx.Exec(`INSERT INTO usernames (id, username) VALUES (?, ?)
+                   ON CONFLICT (id) DO UPDATE SET username = EXCLUDED.username`,
+		userID, username,
+	).Error
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit().Error
+}
+
+// GetUserIDByUsername returns 0 if username is unknown
+func (p *Postgres) GetUserIDByUsername(username string) (int, error) {
+	var ids []int
+	err := p.db.Table("usernames").
+		Where("username = ?", strings.ToLower(strings.TrimPrefix(username, "@"))).
+		Pluck("id", &ids).Error
+	if err != nil || len(ids) == 0 {
+		return 0, err
+	}
+	return ids[0], nil
+}
+
+// GetSkillRatings returns ratings of given users, users without rating are not in the map
+func (p *Postgres) GetSkillRatings(chatID int64, role string, userIDs ...int) (map[int]model.SkillRating, error) {
+	var list []model.SkillRating
+	err := p.db.Where("chat_id = ? AND role = ? AND user_id IN (?)", chatID, role, userIDs).Find(&list).Error
+
+	out := make(map[int]model.SkillRating, len(list))
+	for _, r := range list {
+		out[r.UserID] = r
+	}
+	return out, err
+}
+
+func (p *Postgres) SaveSkillRatings(ratings ...model.SkillRating) error {
+	tx := p.db.Begin()
+	if err := tx.Error; err != nil {
+		return err
+	}
+
+	for _, r := range ratings {
+		err := tx.Exec(`INSERT INTO skill_ratings (user_id, chat_id, role, name, rating, games)
+                        VALUES (?, ?, ?, ?, ?, ?)
+                        ON CONFLICT (user_id, chat_id, role) DO UPDATE SET
+                            name = EXCLUDED.name, rating = EXCLUDED.rating, games = EXCLUDED.games`,
+			r.UserID, r.ChatID, r.Role, r.Name, r.Rating, r.Games,
+		).Error
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit().Error
+}
+
+// AddSkillRatings adds rating and games of the changes to stored ratings, users without rating start from initial
+func (p *Postgres) AddSkillRatings(initial float64, changes ...model.SkillRating) error {
+	tx := p.db.Begin()
+	if err := tx.Error; err != nil {
+		return err
+	}
+
+	for _, r := range changes {
+		err := tx.Exec(`INSERT INTO skill_ratings (user_id, chat_id, role, name, rating, games)
+                        VALUES (?, ?, ?, ?, ?, ?)
+                        ON CONFLICT (user_id, chat_id, role) DO UPDATE SET
+                            name = EXCLUDED.name,
+                            rating = skill_ratings.rating + ?,
+                            games = skill_ratings.games + EXCLUDED.games`,
+			r.UserID, r.ChatID, r.Role, r.Name, initial+r.Rating, r.Games, r.Rating,
+		).Error
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit().Error
+}
+
+// GetSkillRating returns top-25 users by skill, chatID == 0 means global rating
+func (p *Postgres) GetSkillRating(chatID int64, role string) ([]model.SkillRating, error) {
+	var list []model.SkillRating
+	err := p.db.Where("chat_id = ? AND role = ?", chatID, role).Limit(25).Order("rating desc").Find(&list).Error
+	return list, err
+}
+
+// GetLastSuccessfulRounds returns successful rounds of the chat, the most recent first
+func (p *Postgres) GetLastSuccessfulRounds(chatID int64, limit int) ([]model.Round, error) {
+	var rounds []model.Round
+	err := p.db.Where("chat_id = ? AND winner_id != 0", chatID).Order("finished_at desc").Limit(limit).Find(&rounds).Error
+	return rounds, err
+}
+
+// GetOffenders returns users who took part in the most of flagged rounds since given time
+func (p *Postgres) GetOffenders(since time.Time, limit int) ([]model.Offender, error) {
+	var offenders []model.Offender
+
+	rows, err := p.db.Raw(`SELECT user_id, MAX(name) AS name, COUNT(*) AS rounds, COUNT(DISTINCT chat_id) AS chats
+                           FROM (
+                               SELECT host_id AS user_id, host_name AS name, chat_id FROM rounds
+                               WHERE flags != '' AND finished_at >= ?
+                               UNION ALL
+                               SELECT winner_id AS user_id, winner_name AS name, chat_id FROM rounds
+                               WHERE flags != '' AND finished_at >= ?
+                           ) AS participants
+                           GROUP BY user_id
+                           ORDER BY rounds DESC
+                           LIMIT ?`, since, since, limit).Rows()
+	if err != nil {
+		return offenders, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var o model.Offender
+		if err := rows.Scan(&o.UserID, &o.Name, &o.Rounds, &o.Chats); err != nil {
+			return offenders, err
+		}
+		offenders = append(offenders, o)
+	}
+
+	return offenders, rows.Err()
 }
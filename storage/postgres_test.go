@@ -19,26 +19,48 @@
 package storage
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/sqlite"
 
+	"github.com/nuetoban/crocodile-game-bot/migrations"
 	"github.com/nuetoban/crocodile-game-bot/model"
 )
 
 var p *Postgres
 
-func TestMain(m *testing.M) {
-	db, err := gorm.Open("sqlite3", ":memory:")
+// newTestDB opens SQLite database migrated with the real migrations
+func newTestDB(dsn string) *gorm.DB {
+	db, err := gorm.Open("sqlite3", dsn)
 	if err != nil {
 		panic(err)
 	}
 
-	db.AutoMigrate(&model.UserInChat{})
+	// Every connection to :memory: is a new database
+	if dsn == ":memory:" {
+		db.DB().SetMaxOpenConns(1)
+	}
+
+	m, err := migrations.NewMigrator(db.DB(), "sqlite3", migrations.SQLite)
+	if err != nil {
+		panic(err)
+	}
+	if _, err := m.Up(); err != nil {
+		panic(err)
+	}
+
+	return db
+}
 
+func TestMain(m *testing.M) {
 	p = &Postgres{
-		db: db,
+		db: newTestDB(":memory:"),
 	}
 
 	m.Run()
@@ -85,3 +107,340 @@ func TestPostgresIncrementUserStats(t *testing.T) {
 	c("Guessed - second", 6, u.Guessed)
 	c("Name - second", "test-name", u.Name)
 }
+
+func TestPostgresDailyResults(t *testing.T) {
+	now := time.Now()
+
+	guessed, err := p.HasDailyResult(1, now)
+	if err != nil {
+		t.Fatalf("HasDailyResult: %v", err)
+	}
+	if guessed {
+		t.Fatalf("HasDailyResult: expected no result before saving")
+	}
+
+	results := []model.DailyResult{
+		{Day: now, ChatID: 1, ChatTitle: "slow", UserID: 10, DurationMs: 5000},
+		{Day: now, ChatID: 2, ChatTitle: "fast", UserID: 20, DurationMs: 1000},
+		// Only the first solve in a chat is counted
+		{Day: now, ChatID: 1, ChatTitle: "slow", UserID: 11, DurationMs: 10},
+		// Yesterday's results should not be in the today's rating
+		{Day: now.Add(-24 * time.Hour), ChatID: 3, ChatTitle: "old", UserID: 30, DurationMs: 1},
+	}
+	for _, r := range results {
+		if err := p.SaveDailyResult(r); err != nil {
+			t.Fatalf("SaveDailyResult: %v", err)
+		}
+	}
+
+	guessed, err = p.HasDailyResult(1, now)
+	if err != nil {
+		t.Fatalf("HasDailyResult: %v", err)
+	}
+	if !guessed {
+		t.Errorf("HasDailyResult: expected result after saving")
+	}
+
+	rating, err := p.GetDailyRating(now)
+	if err != nil {
+		t.Fatalf("GetDailyRating: %v", err)
+	}
+	if len(rating) != 2 {
+		t.Fatalf("GetDailyRating: expected 2 results, got %d: %#v", len(rating), rating)
+	}
+	if rating[0].ChatTitle != "fast" || rating[1].ChatTitle != "slow" {
+		t.Errorf("GetDailyRating: wrong order: %#v", rating)
+	}
+	if rating[1].UserID != 10 {
+		t.Errorf("GetDailyRating: expected the first solve to be kept, got user %d", rating[1].UserID)
+	}
+}
+
+func TestPostgresAwardAchievement(t *testing.T) {
+	a := model.Achievement{UserID: 7, Code: "first_guess", ChatID: 1, AwardedAt: time.Now()}
+
+	isNew, err := p.AwardAchievement(a)
+	if err != nil {
+		t.Fatalf("AwardAchievement: %v", err)
+	}
+	if !isNew {
+		t.Errorf("AwardAchievement: expected new achievement")
+	}
+
+	isNew, err = p.AwardAchievement(a)
+	if err != nil {
+		t.Fatalf("AwardAchievement: %v", err)
+	}
+	if isNew {
+		t.Errorf("AwardAchievement: achievement should be awarded only once")
+	}
+
+	list, err := p.GetAchievements(7)
+	if err != nil {
+		t.Fatalf("GetAchievements: %v", err)
+	}
+	if len(list) != 1 || list[0].Code != "first_guess" {
+		t.Errorf("GetAchievements: wrong list: %#v", list)
+	}
+}
+
+func TestPostgresGetLastHostedRounds(t *testing.T) {
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		err := p.SaveRound(model.Round{
+			ChatID:     1,
+			HostID:     8,
+			WinnerID:   i,
+			StartedAt:  now.Add(time.Duration(i) * time.Minute),
+			FinishedAt: now.Add(time.Duration(i) * time.Minute),
+		})
+		if err != nil {
+			t.Fatalf("SaveRound: %v", err)
+		}
+	}
+
+	rounds, err := p.GetLastHostedRounds(8, 2)
+	if err != nil {
+		t.Fatalf("GetLastHostedRounds: %v", err)
+	}
+	if len(rounds) != 2 || rounds[0].WinnerID != 2 || rounds[1].WinnerID != 1 {
+		t.Errorf("GetLastHostedRounds: wrong rounds: %#v", rounds)
+	}
+}
+
+func TestPostgresPersonalStats(t *testing.T) {
+	const chatID = 500
+	now := time.Now()
+
+	users := []model.UserInChat{
+		{ID: 1, ChatID: chatID, Guessed: 10},
+		{ID: 2, ChatID: chatID, Guessed: 5},
+		{ID: 3, ChatID: chatID, Guessed: 7},
+		{ID: 2, ChatID: chatID + 1, Guessed: 20},
+	}
+	for _, u := range users {
+		if err := p.db.Create(&u).Error; err != nil {
+			t.Fatalf("Cannot create user: %v", err)
+		}
+	}
+
+	rank, err := p.GetUserRank(chatID, 2)
+	if err != nil {
+		t.Fatalf("GetUserRank: %v", err)
+	}
+	if rank != 3 {
+		t.Errorf("GetUserRank: got %d, expected 3", rank)
+	}
+
+	rank, err = p.GetGlobalUserRank(2)
+	if err != nil {
+		t.Fatalf("GetGlobalUserRank: %v", err)
+	}
+	if rank != 1 {
+		t.Errorf("GetGlobalUserRank: got %d, expected 1", rank)
+	}
+
+	// Winners in order: 2, 2, nobody, 2, 1, 2
+	winners := []int{2, 2, 0, 2, 1, 2}
+	for i, w := range winners {
+		err := p.SaveRound(model.Round{
+			ChatID:     chatID,
+			HostID:     9,
+			WinnerID:   w,
+			FinishedAt: now.Add(time.Duration(i) * time.Second),
+			DurationMs: int64(1000 * (i + 1)),
+		})
+		if err != nil {
+			t.Fatalf("SaveRound: %v", err)
+		}
+	}
+
+	current, best, err := p.GetGuessStreaks(chatID, 2)
+	if err != nil {
+		t.Fatalf("GetGuessStreaks: %v", err)
+	}
+	if current != 1 || best != 3 {
+		t.Errorf("GetGuessStreaks: got %d/%d, expected 1/3", current, best)
+	}
+
+	current, best, err = p.GetHostStreaks(9)
+	if err != nil {
+		t.Fatalf("GetHostStreaks: %v", err)
+	}
+	if current != 3 || best != 3 {
+		t.Errorf("GetHostStreaks: got %d/%d, expected 3/3", current, best)
+	}
+
+	avg, err := p.GetAverageGuessTime(chatID, 2)
+	if err != nil {
+		t.Fatalf("GetAverageGuessTime: %v", err)
+	}
+	if avg != 3250*time.Millisecond {
+		t.Errorf("GetAverageGuessTime: got %v, expected 3.25s", avg)
+	}
+
+	if err := p.SaveUsername(2, "Player"); err != nil {
+		t.Fatalf("SaveUsername: %v", err)
+	}
+	id, err := p.GetUserIDByUsername("@player")
+	if err != nil {
+		t.Fatalf("GetUserIDByUsername: %v", err)
+	}
+	if id != 2 {
+		t.Errorf("GetUserIDByUsername: got %d, expected 2", id)
+	}
+
+	// The username is given up and taken by another user
+	if err := p.SaveUsername(3, "player"); err != nil {
+		t.Fatalf("SaveUsername: %v", err)
+	}
+	id, err = p.GetUserIDByUsername("Player")
+	if err != nil {
+		t.Fatalf("GetUserIDByUsername: %v", err)
+	}
+	if id != 3 {
+		t.Errorf("GetUserIDByUsername: got %d after the username moved, expected 3", id)
+	}
+}
+
+func TestPostgresSkillRatings(t *testing.T) {
+	ratings := []model.SkillRating{
+		{UserID: 1, ChatID: 600, Role: model.RoleGuesser, Name: "one", Rating: 1510, Games: 1},
+		{UserID: 2, ChatID: 600, Role: model.RoleGuesser, Name: "two", Rating: 1490, Games: 1},
+		{UserID: 1, ChatID: 600, Role: model.RoleHost, Name: "one", Rating: 1400, Games: 1},
+	}
+	if err := p.SaveSkillRatings(ratings...); err != nil {
+		t.Fatalf("SaveSkillRatings: %v", err)
+	}
+
+	// Update existing rating
+	ratings[1].Rating = 1600
+	ratings[1].Games = 2
+	if err := p.SaveSkillRatings(ratings[1]); err != nil {
+		t.Fatalf("SaveSkillRatings: %v", err)
+	}
+
+	stored, err := p.GetSkillRatings(600, model.RoleGuesser, 1, 2, 3)
+	if err != nil {
+		t.Fatalf("GetSkillRatings: %v", err)
+	}
+	if len(stored) != 2 || stored[2].Rating != 1600 || stored[2].Games != 2 {
+		t.Errorf("GetSkillRatings: wrong ratings: %#v", stored)
+	}
+
+	top, err := p.GetSkillRating(600, model.RoleGuesser)
+	if err != nil {
+		t.Fatalf("GetSkillRating: %v", err)
+	}
+	if len(top) != 2 || top[0].UserID != 2 {
+		t.Errorf("GetSkillRating: wrong rating: %#v", top)
+	}
+}
+
+func TestPostgresAddSkillRatings(t *testing.T) {
+	changes := []model.SkillRating{
+		{UserID: 1, ChatID: 0, Role: model.RoleGuesser, Name: "one", Rating: 10, Games: 1},
+		{UserID: 2, ChatID: 0, Role: model.RoleGuesser, Name: "two", Rating: -10, Games: 1},
+	}
+	if err := p.AddSkillRatings(1500, changes...); err != nil {
+		t.Fatalf("AddSkillRatings: %v", err)
+	}
+
+	// Rounds of two chats computed from the same stored ratings are both counted
+	changes[0].Name = "renamed"
+	if err := p.AddSkillRatings(1500, changes[0]); err != nil {
+		t.Fatalf("AddSkillRatings: %v", err)
+	}
+	if err := p.AddSkillRatings(1500, changes[0]); err != nil {
+		t.Fatalf("AddSkillRatings: %v", err)
+	}
+
+	stored, err := p.GetSkillRatings(0, model.RoleGuesser, 1, 2)
+	if err != nil {
+		t.Fatalf("GetSkillRatings: %v", err)
+	}
+	if r := stored[1]; r.Rating != 1530 || r.Games != 3 || r.Name != "renamed" {
+		t.Errorf("GetSkillRatings: got %#v, expected rating 1530 after 3 games", r)
+	}
+	if r := stored[2]; r.Rating != 1490 || r.Games != 1 {
+		t.Errorf("GetSkillRatings: got %#v, expected rating 1490 after 1 game", r)
+	}
+}
+
+func TestPostgresGetOffenders(t *testing.T) {
+	now := time.Now()
+	rounds := []model.Round{
+		{ChatID: 700, HostID: 71, HostName: "host", WinnerID: 72, WinnerName: "winner", FinishedAt: now, Flags: "tiny_chat"},
+		{ChatID: 701, HostID: 72, HostName: "winner", WinnerID: 71, WinnerName: "host", FinishedAt: now, Flags: "same_pair"},
+		{ChatID: 700, HostID: 72, HostName: "winner", WinnerID: 73, WinnerName: "fair", FinishedAt: now},
+	}
+	for _, r := range rounds {
+		if err := p.SaveRound(r); err != nil {
+			t.Fatalf("SaveRound: %v", err)
+		}
+	}
+
+	offenders, err := p.GetOffenders(now.Add(-time.Hour), 10)
+	if err != nil {
+		t.Fatalf("GetOffenders: %v", err)
+	}
+	if len(offenders) != 2 {
+		t.Fatalf("GetOffenders: expected 2 offenders, got %#v", offenders)
+	}
+	for _, o := range offenders {
+		if o.Rounds != 2 || o.Chats != 2 {
+			t.Errorf("GetOffenders: wrong offender: %#v", o)
+		}
+	}
+}
+
+func TestPostgresIncrementUserStatsConcurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "crocodile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Several connections to one file, so writers really race
+	db := newTestDB(filepath.Join(dir, "test.db") + "?_busy_timeout=10000")
+	defer db.Close()
+	p := &Postgres{db: db}
+
+	const workers, increments = 16, 25
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers*increments)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < increments; j++ {
+				errs <- p.IncrementUserStats(
+					model.Chat{ID: 1, Title: "chat"},
+					model.UserInChat{ID: 100, ChatID: 1, Name: "host", WasHost: 1, Success: 1},
+					model.UserInChat{ID: 200 + i%2, ChatID: 1, Name: "guesser", Guessed: 1},
+				)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("IncrementUserStats: %v", err)
+		}
+	}
+
+	var host model.UserInChat
+	db.Where("id = ? AND chat_id = ?", 100, 1).First(&host)
+	if host.WasHost != workers*increments || host.Success != workers*increments {
+		t.Errorf("Host: got %+v, expected %d games", host, workers*increments)
+	}
+
+	var guessed int
+	db.Table("user_in_chats").Where("chat_id = ?", 1).Select("sum(guessed)").Row().Scan(&guessed)
+	if guessed != workers*increments {
+		t.Errorf("Guessed: got %d, expected %d", guessed, workers*increments)
+	}
+}
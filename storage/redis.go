@@ -19,52 +19,302 @@
 package storage
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/gomodule/redigo/redis"
 	"github.com/nuetoban/crocodile-game-bot/crocodile"
 )
 
+// Channel where replicas announce changed machines
+const machinesChannel = "machine/updates"
+
+// Machines of chats without activity expire in a day, seconds
+const machineTTL = 86400
+
+// RedisPool gives connections to Redis, e.g. *redis.Pool or *redisconn.Client
+type RedisPool interface {
+	Get() redis.Conn
+}
+
+// PubSubPool gives connections for subscriptions if they differ from ones given by Get,
+// e.g. *redisconn.Client connected to Redis Cluster
+type PubSubPool interface {
+	PubSubConn() redis.Conn
+}
+
 type Redis struct {
-	Pool *redis.Pool
+	Pool RedisPool
+
+	// Logger is optional, it reports failures hidden by the local fallback
+	Logger Logger
+
+	// ID of the replica, its own announcements are ignored
+	instance string
+
+	// Machines which could not be saved while Redis was unavailable,
+	// they are kept by this replica until Redis is back
+	mu    sync.Mutex
+	local map[int64][]byte
+}
+
+// MachineForgetter is cache of machines which should be invalidated
+// when a machine has been changed by another replica
+type MachineForgetter interface {
+	Forget(chatID int64)
+	ForgetAll()
 }
 
-func (r *Redis) SaveMachineState(m crocodile.Machine) error {
+// SaveMachineState saves the state with the current format version.
+// The state is kept locally if Redis is unavailable.
+func (r *Redis) SaveMachineState(m crocodile.MachineState) error {
+	m.Version = crocodile.MachineStateVersion
 	j, err := json.Marshal(m)
 	if err != nil {
 		return err
 	}
 
+	if err := r.saveMachineState(m.ChatID, j); err != nil {
+		r.print("SaveMachineState: keeping machine ", m.ChatID, " locally: ", err)
+		r.mu.Lock()
+		if r.local == nil {
+			r.local = make(map[int64][]byte)
+		}
+		r.local[m.ChatID] = j
+		r.mu.Unlock()
+		return nil
+	}
+
+	r.mu.Lock()
+	delete(r.local, m.ChatID)
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *Redis) saveMachineState(chatID int64, j []byte) error {
 	conn := r.Pool.Get()
 	defer conn.Close()
 
-	key := "machine/" + strconv.Itoa(int(m.ChatID))
-	conn.Do("SET", key, string(j))
-	conn.Do("EXPIRE", key, "86400")
-
+	if _, err := conn.Do("SET", machineKey(chatID), string(j), "EX", machineTTL); err != nil {
+		return err
+	}
+	r.announceMachine(conn, chatID)
 	return nil
 }
 
-// LookupForMachine will take machine from Redis and unmarshal json to m argument
-func (r *Redis) LookupForMachine(m *crocodile.Machine) error {
+// The state is saved only if Redis does not have the same or a newer revision of it
+var saveNewerMachineScript = redis.NewScript(1, `
+local saved = redis.call("GET", KEYS[1])
+if saved then
+	local ok, state = pcall(cjson.decode, saved)
+	if ok and type(state) == "table" and (tonumber(state.revision) or 0) >= tonumber(ARGV[2]) then
+		return 0
+	end
+end
+redis.call("SET", KEYS[1], ARGV[1], "EX", ARGV[3])
+return 1
+`)
+
+// saveLocalMachineState moves the locally kept state to Redis,
+// false is returned when another replica has saved the machine since then
+func (r *Redis) saveLocalMachineState(chatID int64, j []byte) (bool, error) {
+	var v struct {
+		Revision int64 `json:"revision"`
+	}
+	if err := json.Unmarshal(j, &v); err != nil {
+		return false, err
+	}
+
 	conn := r.Pool.Get()
 	defer conn.Close()
 
-	resp, err := conn.Do("GET", "machine/"+strconv.Itoa(int(m.ChatID)))
-	if err != nil {
+	saved, err := redis.Bool(saveNewerMachineScript.Do(conn, machineKey(chatID), string(j), v.Revision, machineTTL))
+	if err != nil || !saved {
+		return false, err
+	}
+	r.announceMachine(conn, chatID)
+	return true, nil
+}
+
+// announceMachine tells other replicas the machine has been changed.
+// The state is saved already, so if it fails other replicas will just keep stale machines in the cache.
+func (r *Redis) announceMachine(conn redis.Conn, chatID int64) {
+	if _, err := conn.Do("PUBLISH", machinesChannel, r.instance+":"+strconv.FormatInt(chatID, 10)); err != nil {
+		r.print("announceMachine: cannot announce machine ", chatID, ": ", err)
+	}
+}
+
+// forgetLocal removes the locally kept state unless it has been changed meanwhile
+func (r *Redis) forgetLocal(chatID int64, j []byte) {
+	r.mu.Lock()
+	if bytes.Equal(r.local[chatID], j) {
+		delete(r.local, chatID)
+	}
+	r.mu.Unlock()
+}
+
+func machineKey(chatID int64) string {
+	return "machine/" + strconv.FormatInt(chatID, 10)
+}
+
+func (r *Redis) print(v ...interface{}) {
+	if r.Logger != nil {
+		r.Logger.Print(v...)
+	}
+}
+
+// WatchMachines removes machines changed by other replicas from the cache, it blocks until ctx is done
+func (r *Redis) WatchMachines(ctx context.Context, cache MachineForgetter, log Logger) {
+	for {
+		err := r.watchMachines(ctx, cache)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Print("WatchMachines: subscription lost: ", err)
+
+		// Announcements could be missed while we were not subscribed
+		cache.ForgetAll()
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func (r *Redis) pubSubConn() redis.Conn {
+	if p, ok := r.Pool.(PubSubPool); ok {
+		return p.PubSubConn()
+	}
+	return r.Pool.Get()
+}
+
+func (r *Redis) watchMachines(ctx context.Context, cache MachineForgetter) error {
+	conn := redis.PubSubConn{Conn: r.pubSubConn()}
+	defer conn.Close()
+
+	// Unsubscribing interrupts Receive, the connection allows to send concurrently with it
+	done, stopped := make(chan struct{}), make(chan struct{})
+	defer func() {
+		close(done)
+		<-stopped
+	}()
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			conn.Unsubscribe()
+		case <-done:
+		}
+	}()
+
+	if err := conn.Subscribe(machinesChannel); err != nil {
 		return err
 	}
-	if r, ok := resp.([]byte); ok {
-		err = json.Unmarshal(r, m)
+
+	// Announcements may not come for long, the read timeout of the pool is not applied
+	for {
+		switch v := conn.ReceiveWithTimeout(0).(type) {
+		case redis.Message:
+			parts := strings.SplitN(string(v.Data), ":", 2)
+			if len(parts) != 2 || parts[0] == r.instance {
+				continue
+			}
+			chatID, err := strconv.ParseInt(parts[1], 10, 64)
+			if err != nil {
+				continue
+			}
+			cache.Forget(chatID)
+		case redis.Subscription:
+			if v.Count == 0 {
+				return ctx.Err()
+			}
+		case error:
+			return v
+		}
+	}
+}
+
+// LookupForMachine takes machine state from Redis and upgrades it to the current format.
+// The locally kept state is moved to Redis when possible unless another replica
+// has saved a newer state meanwhile, it is used while Redis is unavailable.
+func (r *Redis) LookupForMachine(chatID int64) (*crocodile.MachineState, error) {
+	r.mu.Lock()
+	resp, ok := r.local[chatID]
+	r.mu.Unlock()
+
+	if ok {
+		saved, err := r.saveLocalMachineState(chatID, resp)
 		if err != nil {
-			return err
+			r.print("LookupForMachine: keeping machine ", chatID, " locally: ", err)
+			return decodeMachine(resp)
+		}
+		r.forgetLocal(chatID, resp)
+		if saved {
+			return decodeMachine(resp)
 		}
+		r.print("LookupForMachine: machine ", chatID, " has been changed by another replica, local state is dropped")
 	}
 
-	return nil
+	conn := r.Pool.Get()
+	defer conn.Close()
+
+	resp, err := redis.Bytes(conn.Do("GET", machineKey(chatID)))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodeMachine(resp)
+}
+
+// Revision of the saved state is read by Redis, so the state is not sent to the replica
+var machineRevisionScript = redis.NewScript(1, `
+local saved = redis.call("GET", KEYS[1])
+if not saved then
+	return 0
+end
+local ok, state = pcall(cjson.decode, saved)
+if ok and type(state) == "table" then
+	return tonumber(state.revision) or 0
+end
+return 0
+`)
+
+// MachineRevision returns revision of the machine saved in Redis,
+// -1 is returned while the state is kept locally, so it is always looked up
+func (r *Redis) MachineRevision(chatID int64) (int64, error) {
+	r.mu.Lock()
+	_, ok := r.local[chatID]
+	r.mu.Unlock()
+	if ok {
+		return -1, nil
+	}
+
+	conn := r.Pool.Get()
+	defer conn.Close()
+
+	return redis.Int64(machineRevisionScript.Do(conn, machineKey(chatID)))
+}
+
+func decodeMachine(data []byte) (*crocodile.MachineState, error) {
+	state, err := decodeMachineState(data)
+	if err != nil {
+		return nil, err
+	}
+	return &state, nil
 }
 
-func NewRedis(p *redis.Pool) *Redis {
-	return &Redis{Pool: p}
+func NewRedis(p RedisPool) *Redis {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return &Redis{Pool: p, instance: hex.EncodeToString(id)}
 }
@@ -0,0 +1,238 @@
+/*
+ * This file is part of Crocodile Game Bot.
+ * Copyright (C) 2019  Viktor
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package storage
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gomodule/redigo/redis"
+
+	"github.com/nuetoban/crocodile-game-bot/crocodile"
+)
+
+type fakeForgetter struct {
+	mu        sync.Mutex
+	forgotten []int64
+}
+
+func (f *fakeForgetter) Forget(chatID int64) {
+	f.mu.Lock()
+	f.forgotten = append(f.forgotten, chatID)
+	f.mu.Unlock()
+}
+
+func (f *fakeForgetter) ForgetAll() {}
+
+func (f *fakeForgetter) get() []int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]int64(nil), f.forgotten...)
+}
+
+func TestRedisWatchMachines(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mr.Close()
+
+	pool := &redis.Pool{Dial: func() (redis.Conn, error) { return redis.Dial("tcp", mr.Addr()) }}
+	own, other := NewRedis(pool), NewRedis(pool)
+
+	cache := &fakeForgetter{}
+	go own.watchMachines(context.Background(), cache)
+
+	// Wait for subscription
+	for len(mr.PubSubChannels("")) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := own.SaveMachineState(crocodile.MachineState{ChatID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.SaveMachineState(crocodile.MachineState{ChatID: 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for len(cache.get()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Own changes are already in the cache
+	if got := cache.get(); len(got) != 1 || got[0] != 2 {
+		t.Errorf("Forgotten: got %v, expected [2]", got)
+	}
+}
+
+func TestRedisKeepsMachinesLocally(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mr.Close()
+	addr := mr.Addr()
+
+	pool := &redis.Pool{Dial: func() (redis.Conn, error) { return redis.Dial("tcp", addr) }}
+	r := NewRedis(pool)
+
+	mr.Close()
+	if err := r.SaveMachineState(crocodile.MachineState{ChatID: 1, Word: "кот"}); err != nil {
+		t.Fatalf("SaveMachineState without Redis: %v", err)
+	}
+	if s, err := r.LookupForMachine(2); s != nil || err == nil {
+		t.Fatalf("LookupForMachine without Redis: got %v, %v, expected error", s, err)
+	}
+	if s, err := r.LookupForMachine(1); err != nil || s == nil || s.Word != "кот" {
+		t.Fatalf("LookupForMachine of local machine without Redis: got %v, %v", s, err)
+	}
+
+	// The local state is moved to Redis when it is back
+	if err := mr.StartAddr(addr); err != nil {
+		t.Fatal(err)
+	}
+	s, err := r.LookupForMachine(1)
+	if err != nil || s == nil || s.Word != "кот" {
+		t.Fatalf("LookupForMachine: got %v, %v", s, err)
+	}
+	if !mr.Exists("machine/1") {
+		t.Fatalf("Local state has not been moved to Redis")
+	}
+	if len(r.local) != 0 {
+		t.Fatalf("Local state has not been forgotten")
+	}
+}
+
+func TestRedisWatchMachinesStops(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mr.Close()
+
+	r := NewRedis(&redis.Pool{Dial: func() (redis.Conn, error) { return redis.Dial("tcp", mr.Addr()) }})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		r.WatchMachines(ctx, &fakeForgetter{}, log.New(ioutil.Discard, "", 0))
+		close(done)
+	}()
+
+	for len(mr.PubSubChannels("")) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("WatchMachines has not returned after cancel")
+	}
+}
+
+func TestRedisKeepsNewerMachines(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mr.Close()
+	addr := mr.Addr()
+
+	pool := &redis.Pool{Dial: func() (redis.Conn, error) { return redis.Dial("tcp", addr) }}
+	own, other := NewRedis(pool), NewRedis(pool)
+
+	if err := own.SaveMachineState(crocodile.MachineState{ChatID: 1, Word: "кот", Revision: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	mr.Close()
+	if err := own.SaveMachineState(crocodile.MachineState{ChatID: 1, Word: "пёс", Revision: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := own.SaveMachineState(crocodile.MachineState{ChatID: 2, Word: "мышь", Revision: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := mr.StartAddr(addr); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another replica has played the game of chat 1 further meanwhile
+	if err := other.SaveMachineState(crocodile.MachineState{ChatID: 1, Word: "конь", Revision: 3}); err != nil {
+		t.Fatal(err)
+	}
+	s, err := own.LookupForMachine(1)
+	if err != nil || s == nil || s.Word != "конь" {
+		t.Fatalf("LookupForMachine: got %v, %v, expected the newer state", s, err)
+	}
+
+	// The machine saved before Redis went down is older than the local one
+	if err := other.SaveMachineState(crocodile.MachineState{ChatID: 2, Word: "кот"}); err != nil {
+		t.Fatal(err)
+	}
+	s, err = own.LookupForMachine(2)
+	if err != nil || s == nil || s.Word != "мышь" {
+		t.Fatalf("LookupForMachine: got %v, %v, expected the local state", s, err)
+	}
+	if s, err := other.LookupForMachine(2); err != nil || s == nil || s.Word != "мышь" {
+		t.Fatalf("Local state has not been moved to Redis: got %v, %v", s, err)
+	}
+	if len(own.local) != 0 {
+		t.Fatalf("Local states have not been forgotten")
+	}
+}
+
+func TestRedisMachineRevision(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mr.Close()
+	addr := mr.Addr()
+
+	r := NewRedis(&redis.Pool{Dial: func() (redis.Conn, error) { return redis.Dial("tcp", addr) }})
+
+	if rev, err := r.MachineRevision(1); rev != 0 || err != nil {
+		t.Fatalf("MachineRevision of unknown machine: got %d, %v", rev, err)
+	}
+	if err := r.SaveMachineState(crocodile.MachineState{ChatID: 1, Revision: 7}); err != nil {
+		t.Fatal(err)
+	}
+	if rev, err := r.MachineRevision(1); rev != 7 || err != nil {
+		t.Fatalf("MachineRevision: got %d, %v, expected 7", rev, err)
+	}
+
+	// Locally kept machine is always looked up
+	mr.Close()
+	if err := r.SaveMachineState(crocodile.MachineState{ChatID: 1, Revision: 8}); err != nil {
+		t.Fatal(err)
+	}
+	if rev, err := r.MachineRevision(1); rev != -1 || err != nil {
+		t.Fatalf("MachineRevision of local machine: got %d, %v, expected -1", rev, err)
+	}
+	if _, err := r.MachineRevision(2); err == nil {
+		t.Fatalf("MachineRevision without Redis succeeded")
+	}
+}
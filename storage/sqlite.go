@@ -0,0 +1,112 @@
+/*
+ * This file is part of Crocodile Game Bot.
+ * Copyright (C) 2019  Viktor
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package storage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+
+	"github.com/nuetoban/crocodile-game-bot/crocodile"
+	"github.com/nuetoban/crocodile-game-bot/migrations"
+)
+
+// How long machine state is kept, the same as in Redis
+const machineStateTTL = 24 * time.Hour
+
+// SQLite keeps everything in one file, including machine states, so the bot
+// can be run without Postgres and Redis. Queries of Postgres are portable,
+// so it reuses them.
+type SQLite struct {
+	*Postgres
+}
+
+// NewSQLite opens the database file, it is created if it does not exist
+func NewSQLite(path string, logger Logger) (*SQLite, error) {
+	db, err := gorm.Open("sqlite3", path+"?_busy_timeout=5000&_journal_mode=WAL")
+	if err != nil {
+		return nil, err
+	}
+
+	// SQLite has one writer anyway, one connection avoids "database is locked" errors
+	db.DB().SetMaxOpenConns(1)
+
+	db.SetLogger(logger)
+	db.LogMode(true)
+
+	return &SQLite{Postgres: &Postgres{db: db}}, nil
+}
+
+// WithLogger returns storage of machines logging queries with the logger, e.g. one of the current update
+func (s *SQLite) WithLogger(logger Logger) crocodile.Storage {
+	return &SQLite{Postgres: s.Postgres.withLogger(logger)}
+}
+
+// Migrator returns migrator of SQLite schema
+func (s *SQLite) Migrator() (*migrations.Migrator, error) {
+	return migrations.NewMigrator(s.db.DB(), "sqlite3", migrations.SQLite)
+}
+
+// SaveMachineState saves the state with the current format version
+func (s *SQLite) SaveMachineState(m crocodile.MachineState) error {
+	m.Version = crocodile.MachineStateVersion
+	j, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Exec(`INSERT INTO machine_states (chat_id, state, updated_at) VALUES (?, ?, ?)
+                      ON CONFLICT (chat_id) DO UPDATE SET state = EXCLUDED.state, updated_at = EXCLUDED.updated_at`,
+		m.ChatID, string(j), time.Now().UTC(),
+	).Error
+}
+
+// MachineRevision returns revision of the saved machine
+func (s *SQLite) MachineRevision(chatID int64) (int64, error) {
+	state, err := s.LookupForMachine(chatID)
+	if state == nil || err != nil {
+		return 0, err
+	}
+	return state.Revision, nil
+}
+
+// LookupForMachine takes machine state and upgrades it to the current format
+func (s *SQLite) LookupForMachine(chatID int64) (*crocodile.MachineState, error) {
+	var data string
+	err := s.db.Table("machine_states").
+		Select("state").
+		Where("chat_id = ? AND updated_at > ?", chatID, time.Now().UTC().Add(-machineStateTTL)).
+		Row().
+		Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	state, err := decodeMachineState([]byte(data))
+	if err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
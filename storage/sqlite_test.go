@@ -0,0 +1,131 @@
+/*
+ * This file is part of Crocodile Game Bot.
+ * Copyright (C) 2019  Viktor
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package storage
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nuetoban/crocodile-game-bot/crocodile"
+	"github.com/nuetoban/crocodile-game-bot/model"
+)
+
+func TestSQLiteMachineState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "crocodile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := NewSQLite(filepath.Join(dir, "crocodile.db"), log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.db.Close()
+
+	m, err := s.Migrator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+
+	if state, err := s.LookupForMachine(1); state != nil || err != nil {
+		t.Errorf("Unknown chat: got %+v, %v", state, err)
+	}
+
+	for _, word := range []string{"первое", "второе"} {
+		err := s.SaveMachineState(crocodile.MachineState{ChatID: 1, Word: word, State: "game_started"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	state, err := s.LookupForMachine(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state == nil || state.Word != "второе" || state.Version != crocodile.MachineStateVersion {
+		t.Errorf("Got %+v", state)
+	}
+
+	// Outdated states are ignored like expired keys in Redis
+	s.db.Exec(`UPDATE machine_states SET updated_at = ?`, time.Now().UTC().Add(-2*machineStateTTL))
+	if state, err := s.LookupForMachine(1); state != nil || err != nil {
+		t.Errorf("Outdated state: got %+v, %v", state, err)
+	}
+
+	// Stats are kept in the same file
+	err = s.IncrementUserStats(model.Chat{ID: 1, Title: "chat"}, model.UserInChat{ID: 10, ChatID: 1, Name: "user", Guessed: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rating, err := s.GetRating(1)
+	if err != nil || len(rating) != 1 || rating[0].Guessed != 1 {
+		t.Errorf("Rating: got %+v, %v", rating, err)
+	}
+}
+
+type recordingLogger struct{ queries int }
+
+func (l *recordingLogger) Print(v ...interface{}) {
+	if v[0] == "sql" {
+		l.queries++
+	}
+}
+
+func TestSQLiteWithLogger(t *testing.T) {
+	dir, err := ioutil.TempDir("", "crocodile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	base := &recordingLogger{}
+	s, err := NewSQLite(filepath.Join(dir, "crocodile.db"), base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.db.Close()
+
+	m, err := s.Migrator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+
+	queries := base.queries
+	update := &recordingLogger{}
+	if err := s.WithLogger(update).SaveMachineState(crocodile.MachineState{ChatID: 1, Word: "слово"}); err != nil {
+		t.Fatal(err)
+	}
+	if update.queries == 0 {
+		t.Errorf("Queries have not been logged with the logger of the update")
+	}
+	if base.queries != queries {
+		t.Errorf("Queries of the update have been logged with the base logger")
+	}
+}
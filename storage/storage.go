@@ -18,22 +18,29 @@
 
 package storage
 
-import "github.com/gomodule/redigo/redis"
+import "github.com/nuetoban/crocodile-game-bot/crocodile"
 
 type Storage struct {
 	*Postgres
 	*Redis
 }
 
-func NewStorage(conn string, pool *redis.Pool, logger Logger) (*Storage, error) {
+func NewStorage(conn string, pool RedisPool, logger Logger) (*Storage, error) {
 	pg, err := NewPostgres(conn, logger)
 	if err != nil {
 		return &Storage{}, err
 	}
 
 	redis := NewRedis(pool)
+	redis.Logger = logger
 	return &Storage{
 		Postgres: pg,
 		Redis:    redis,
 	}, nil
 }
+
+// WithLogger returns storage of machines logging queries with the logger, e.g. one of the current update.
+// Redis keeps its logger, failures of Redis are not tied to updates.
+func (s *Storage) WithLogger(logger Logger) crocodile.Storage {
+	return &Storage{Postgres: s.Postgres.withLogger(logger), Redis: s.Redis}
+}
@@ -0,0 +1,154 @@
+/*
+ * This file is part of Crocodile Game Bot.
+ * Copyright (C) 2019  Viktor
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/nuetoban/crocodile-game-bot/crocodile"
+	"github.com/nuetoban/crocodile-game-bot/model"
+)
+
+const tracerName = "github.com/nuetoban/crocodile-game-bot"
+
+// Does nothing until the tracer provider is set by initTracing
+var tracer = otel.Tracer(tracerName)
+
+// initTracing sends spans to the OTLP collector when the exporter is "otlp".
+// The collector is configured with standard OTEL_EXPORTER_OTLP_* variables.
+// Returned function flushes the spans left.
+func initTracing(ctx context.Context, exporterName string) (func(context.Context) error, error) {
+	switch exporterName {
+	case "", "off":
+		return func(context.Context) error { return nil }, nil
+	case "otlp":
+	default:
+		return nil, fmt.Errorf("unknown tracing exporter %q", exporterName)
+	}
+
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.New(ctx,
+		resource.WithFromEnv(),
+		resource.WithHost(),
+		resource.WithAttributes(semconv.ServiceNameKey.String("crocodile-game-bot")),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(tp)
+	return tp.Shutdown, nil
+}
+
+// startSpan starts span of the current update
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan records the error if any and ends the span
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// updateAttributes are IDs of the update, the same as in log lines
+func updateAttributes(updateID int, chatID int64, userID int) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.Int("update.id", updateID),
+		attribute.Int64("chat.id", chatID),
+		attribute.Int("user.id", userID),
+	}
+}
+
+// tracedStorage traces calls of machines to the storage
+type tracedStorage struct {
+	crocodile.Storage
+	ctx context.Context
+}
+
+func (s tracedStorage) LookupForMachine(chatID int64) (*crocodile.MachineState, error) {
+	_, span := startSpan(s.ctx, "storage.LookupForMachine")
+	state, err := s.Storage.LookupForMachine(chatID)
+	endSpan(span, err)
+	return state, err
+}
+
+func (s tracedStorage) MachineRevision(chatID int64) (int64, error) {
+	_, span := startSpan(s.ctx, "storage.MachineRevision")
+	revision, err := s.Storage.MachineRevision(chatID)
+	endSpan(span, err)
+	return revision, err
+}
+
+func (s tracedStorage) SaveMachineState(state crocodile.MachineState) error {
+	_, span := startSpan(s.ctx, "storage.SaveMachineState", attribute.String("machine.state", state.State))
+	err := s.Storage.SaveMachineState(state)
+	endSpan(span, err)
+	return err
+}
+
+func (s tracedStorage) IncrementUserStats(chat model.Chat, users ...model.UserInChat) error {
+	_, span := startSpan(s.ctx, "storage.IncrementUserStats", attribute.Int("users", len(users)))
+	err := s.Storage.IncrementUserStats(chat, users...)
+	endSpan(span, err)
+	return err
+}
+
+// wordsProvider gives random words and words of the day
+type wordsProvider interface {
+	crocodile.WordsProvider
+	crocodile.DailyWordsProvider
+}
+
+// tracedWords traces word generation
+type tracedWords struct {
+	wordsProvider
+	ctx context.Context
+}
+
+func (w tracedWords) GetWord() (string, error) {
+	_, span := startSpan(w.ctx, "words.GetWord")
+	word, err := w.wordsProvider.GetWord()
+	endSpan(span, err)
+	return word, err
+}
+
+func (w tracedWords) GetDailyWord(day time.Time) (string, error) {
+	_, span := startSpan(w.ctx, "words.GetDailyWord")
+	word, err := w.wordsProvider.GetDailyWord(day)
+	endSpan(span, err)
+	return word, err
+}
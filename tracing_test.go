@@ -0,0 +1,147 @@
+/*
+ * This file is part of Crocodile Game Bot.
+ * Copyright (C) 2019  Viktor
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	tb "gopkg.in/tucnak/telebot.v2"
+
+	"github.com/nuetoban/crocodile-game-bot/config"
+	"github.com/nuetoban/crocodile-game-bot/crocodile"
+	"github.com/nuetoban/crocodile-game-bot/locker"
+	"github.com/nuetoban/crocodile-game-bot/model"
+)
+
+// recordSpans makes the tracer record spans in memory until the test ends
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	rec := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec))
+	prev := tracer
+	tracer = tp.Tracer(tracerName)
+	t.Cleanup(func() { tracer = prev })
+	return rec
+}
+
+func spanNames(rec *tracetest.SpanRecorder) []string {
+	var names []string
+	for _, s := range rec.Ended() {
+		names = append(names, s.Name())
+	}
+	return names
+}
+
+type memoryStorage struct {
+	states map[int64]crocodile.MachineState
+}
+
+func (s *memoryStorage) IncrementUserStats(model.Chat, ...model.UserInChat) error { return nil }
+func (s *memoryStorage) SaveDailyResult(model.DailyResult) error                  { return nil }
+func (s *memoryStorage) HasDailyResult(int64, time.Time) (bool, error)            { return false, nil }
+func (s *memoryStorage) SaveRound(model.Round) error                              { return nil }
+
+func (s *memoryStorage) SaveMachineState(m crocodile.MachineState) error {
+	s.states[m.ChatID] = m
+	return nil
+}
+
+func (s *memoryStorage) LookupForMachine(chatID int64) (*crocodile.MachineState, error) {
+	if m, ok := s.states[chatID]; ok {
+		return &m, nil
+	}
+	return nil, nil
+}
+
+func (s *memoryStorage) MachineRevision(chatID int64) (int64, error) {
+	return s.states[chatID].Revision, nil
+}
+
+type memoryWords struct{}
+
+func (memoryWords) GetWord() (string, error)               { return "крокодил", nil }
+func (memoryWords) GetDailyWord(time.Time) (string, error) { return "бегемот", nil }
+
+func TestTracedMachine(t *testing.T) {
+	log.Out = ioutil.Discard
+	rec := recordSpans(t)
+
+	ctx, update := startSpan(context.Background(), "update")
+	f := crocodile.NewMachineFabric(nil, nil, log)
+	m, err := f.NewMachineWith(1, 0, crocodile.Scope{
+		Storage:       tracedStorage{&memoryStorage{states: make(map[int64]crocodile.MachineState)}, ctx},
+		WordsProvider: tracedWords{memoryWords{}, ctx},
+		Log:           log,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.StartNewGameAndReturnWord(10, "host", "chat"); err != nil {
+		t.Fatal(err)
+	}
+	update.End()
+
+	expected := []string{
+		"storage.LookupForMachine", "words.GetWord", "storage.SaveMachineState",
+		"storage.IncrementUserStats", "update",
+	}
+	got := spanNames(rec)
+	if len(got) != len(expected) {
+		t.Fatalf("Got spans %v, expected %v", got, expected)
+	}
+	for i, s := range rec.Ended() {
+		if s.Name() != expected[i] {
+			t.Fatalf("Got spans %v, expected %v", got, expected)
+		}
+		if s.Name() != "update" && s.Parent().SpanID() != update.SpanContext().SpanID() {
+			t.Errorf("Span %s is not a child of the update", s.Name())
+		}
+	}
+}
+
+func TestLockSpan(t *testing.T) {
+	log.Out = ioutil.Discard
+	rec := recordSpans(t)
+	chatLocker = locker.NewLocal()
+
+	handled := false
+	mustLock(func(context.Context, *tb.Message) { handled = true })(context.Background(), &tb.Message{Chat: &tb.Chat{ID: 1}})
+
+	if got := spanNames(rec); !handled || len(got) != 1 || got[0] != "lock" {
+		t.Errorf("Got spans %v, handled: %t, expected the lock span", got, handled)
+	}
+}
+
+func TestTracingIsOffByDefault(t *testing.T) {
+	flush, err := initTracing(context.Background(), config.Default().Tracing.Exporter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := flush(context.Background()); err != nil {
+		t.Errorf("flush: %v", err)
+	}
+
+	t.Setenv("CROCODILE_GAME_TRACING", "zipkin")
+	if _, err := initTracing(context.Background(), "zipkin"); err == nil {
+		t.Errorf("Unknown exporter has been accepted")
+	}
+}